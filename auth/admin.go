@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"meshspy/storage"
+)
+
+// Mount registers the login, logout and account endpoints on mux:
+//
+//	POST   /api/login        {"name", "password"}, or a form
+//	POST   /api/logout
+//	GET    /api/me           the authenticated user and role
+//	POST   /api/password     {"old", "new"} changes the own password
+//	GET    /api/tokens       API tokens of the user, of everyone for admins
+//	POST   /api/tokens       {"name"} creates a token, answered once
+//	DELETE /api/tokens?id=   revokes a token
+//	*      /api/users        user management, admins only
+//	GET    /api/audit        audit trail, admins only, ?user= and paging
+func (a *Authenticator) Mount(mux *http.ServeMux) {
+	mux.HandleFunc("/api/login", a.Login)
+	mux.HandleFunc("/api/logout", a.Logout)
+	mux.Handle("/api/me", a.Require(Viewer, http.HandlerFunc(a.Me)))
+	mux.Handle("/api/password", a.Require(Viewer, http.HandlerFunc(a.password)))
+	mux.Handle("/api/tokens", a.Require(Viewer, http.HandlerFunc(a.tokens)))
+	mux.Handle("/api/users", a.Require(Admin, http.HandlerFunc(a.users)))
+	mux.Handle("/api/audit", a.Require(Admin, http.HandlerFunc(a.audit)))
+}
+
+// UserRequest is the body creating or updating a user. Empty fields are
+// left unchanged on updates.
+type UserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+func (a *Authenticator) users(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.store.Users()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+		role, err := ParseRole(req.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := HashPassword(req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if u, err := a.store.UserByName(strings.TrimSpace(req.Name)); err != nil || u != nil {
+			http.Error(w, "user exists", http.StatusConflict)
+			return
+		}
+		u := storage.User{Name: strings.TrimSpace(req.Name), PasswordHash: hash, Role: string(role)}
+		if err := a.store.AddUser(&u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.Audit(r, "user_add", fmt.Sprintf("%s (%s)", u.Name, u.Role))
+		writeJSON(w, http.StatusCreated, u)
+	case http.MethodPut:
+		u, ok := a.lookupUser(w, r)
+		if !ok {
+			return
+		}
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if req.Role != "" {
+			role, err := ParseRole(req.Role)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if role != Admin && !a.otherAdmin(w, u) {
+				return
+			}
+			u.Role = string(role)
+		}
+		if req.Password != "" {
+			hash, err := HashPassword(req.Password)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			u.PasswordHash = hash
+		}
+		if err := a.store.UpdateUser(u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.Audit(r, "user_update", fmt.Sprintf("%s (%s)", u.Name, u.Role))
+		writeJSON(w, http.StatusOK, u)
+	case http.MethodDelete:
+		u, ok := a.lookupUser(w, r)
+		if !ok || !a.otherAdmin(w, u) {
+			return
+		}
+		if err := a.store.DeleteUser(u.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.Audit(r, "user_delete", u.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// otherAdmin reports whether an admin other than u exists, answering 409
+// when u is the last one and would be demoted or deleted.
+func (a *Authenticator) otherAdmin(w http.ResponseWriter, u *storage.User) bool {
+	if Role(u.Role) != Admin {
+		return true
+	}
+	list, err := a.store.Users()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	for _, other := range list {
+		if other.ID != u.ID && Role(other.Role) == Admin {
+			return true
+		}
+	}
+	http.Error(w, "the last admin cannot be removed", http.StatusConflict)
+	return false
+}
+
+func (a *Authenticator) lookupUser(w http.ResponseWriter, r *http.Request) (*storage.User, bool) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return nil, false
+	}
+	u, err := a.store.User(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if u == nil {
+		http.Error(w, "unknown user", http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+func (a *Authenticator) password(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := FromContext(r.Context())
+	var req struct {
+		Old string `json:"old"`
+		New string `json:"new"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	u, err := a.store.User(p.UserID)
+	if err != nil || u == nil {
+		http.Error(w, "unknown user", http.StatusNotFound)
+		return
+	}
+	if !checkPassword(u.PasswordHash, req.Old) {
+		http.Error(w, "wrong password", http.StatusForbidden)
+		return
+	}
+	if u.PasswordHash, err = HashPassword(req.New); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.store.UpdateUser(u); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.Audit(r, "password", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NewTokenResponse is the answer to a token creation, the only time the
+// token is shown.
+type NewTokenResponse struct {
+	storage.APIToken
+	Token string `json:"token"`
+}
+
+func (a *Authenticator) tokens(w http.ResponseWriter, r *http.Request) {
+	p := FromContext(r.Context())
+	owner := p.UserID
+	if p.Role.Allows(Admin) {
+		owner = 0
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.store.APITokens(owner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+		token, err := NewToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t := storage.APIToken{Name: strings.TrimSpace(req.Name), UserID: p.UserID, User: p.User, TokenHash: HashToken(token)}
+		if err := a.store.AddAPIToken(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.Audit(r, "token_add", t.Name)
+		writeJSON(w, http.StatusCreated, NewTokenResponse{APIToken: t, Token: token})
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id required", http.StatusBadRequest)
+			return
+		}
+		list, err := a.store.APITokens(owner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, t := range list {
+			if t.ID != id {
+				continue
+			}
+			if err := a.store.DeleteAPIToken(id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			a.Audit(r, "token_delete", t.Name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "unknown token", http.StatusNotFound)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *Authenticator) audit(w http.ResponseWriter, r *http.Request) {
+	page, err := storage.PageFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := a.store.Audit(r.URL.Query().Get("user"), page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,355 @@
+// Package auth authenticates the users of the HTTP servers and gates the
+// endpoints by role. Browsers log in with a password and keep a session
+// cookie; scripts send a bearer API token created by a user and act with
+// the role of that user. Adopted gateways may authenticate with their own
+// credential on the endpoints wrapped by Gateway.
+//
+// Roles are ordered: viewers read, operators also send on the mesh and
+// admins also change the configuration and manage the users.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"meshspy/storage"
+)
+
+// Role is the access level of a user.
+type Role string
+
+// Roles, from the least to the most privileged.
+const (
+	Viewer   Role = "viewer"
+	Operator Role = "operator"
+	Admin    Role = "admin"
+)
+
+var rank = map[Role]int{Viewer: 1, Operator: 2, Admin: 3}
+
+// ParseRole validates a role name.
+func ParseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(strings.TrimSpace(s)))
+	if rank[r] == 0 {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return r, nil
+}
+
+// Allows reports whether r grants the access of min.
+func (r Role) Allows(min Role) bool {
+	return rank[r] > 0 && rank[r] >= rank[min]
+}
+
+// CookieName is the cookie holding the session token.
+const CookieName = "meshspy_session"
+
+// Principal is the authenticated originator of a request.
+type Principal struct {
+	UserID int64  `json:"-"`
+	User   string `json:"user,omitempty"`
+	Role   Role   `json:"role,omitempty"`
+	// Gateway is the ID of a gateway authenticated by its credential.
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Name identifies p in the audit trail.
+func (p *Principal) Name() string {
+	if p.Gateway != "" {
+		return "gateway:" + p.Gateway
+	}
+	return p.User
+}
+
+type ctxKey struct{}
+
+// FromContext returns the principal of a request wrapped by the
+// middlewares, or nil.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(ctxKey{}).(*Principal)
+	return p
+}
+
+// Options configures an Authenticator.
+type Options struct {
+	// SessionTTL is the lifetime of a login session, a week by default.
+	SessionTTL time.Duration
+	// Gateways accepts the credentials of the adopted gateways.
+	Gateways bool
+}
+
+// Authenticator checks the credentials of the requests against store.
+type Authenticator struct {
+	store storage.Backend
+	opts  Options
+	// dummy is compared when the user does not exist, so that unknown
+	// names take as long to reject as wrong passwords.
+	dummy []byte
+}
+
+// New returns an Authenticator backed by store.
+func New(store storage.Backend, opts Options) *Authenticator {
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = 7 * 24 * time.Hour
+	}
+	dummy, _ := bcrypt.GenerateFromPassword([]byte("meshspy"), bcrypt.DefaultCost)
+	return &Authenticator{store: store, opts: opts, dummy: dummy}
+}
+
+// Bootstrap creates the admin account name when there are no users yet.
+// Without a password a random one is generated and returned, so it can be
+// shown once.
+func (a *Authenticator) Bootstrap(name, password string) (string, error) {
+	users, err := a.store.Users()
+	if err != nil || len(users) > 0 {
+		return "", err
+	}
+	generated := ""
+	if password == "" {
+		if password, err = NewToken(); err != nil {
+			return "", err
+		}
+		password = password[:16]
+		generated = password
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	return generated, a.store.AddUser(&storage.User{Name: name, PasswordHash: hash, Role: string(Admin)})
+}
+
+// Authenticate returns the principal of r, or nil when it carries no valid
+// credential.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	now := time.Now()
+	if token, ok := bearer(r); ok {
+		u, err := a.store.TokenUser(HashToken(token), now)
+		if err != nil || u != nil {
+			return userPrincipal(u), err
+		}
+		if a.opts.Gateways {
+			g, err := a.store.GatewayByToken(HashToken(token))
+			if err != nil || g == nil {
+				return nil, err
+			}
+			return &Principal{Gateway: g.ID}, nil
+		}
+		return nil, nil
+	}
+	if c, err := r.Cookie(CookieName); err == nil && c.Value != "" {
+		u, err := a.store.SessionUser(HashToken(c.Value), now)
+		return userPrincipal(u), err
+	}
+	return nil, nil
+}
+
+func userPrincipal(u *storage.User) *Principal {
+	if u == nil {
+		return nil
+	}
+	return &Principal{UserID: u.ID, User: u.Name, Role: Role(u.Role)}
+}
+
+// Require serves next to users holding at least role min, answering 401
+// without credentials and 403 with a weaker role.
+func (a *Authenticator) Require(min Role, next http.Handler) http.Handler {
+	return a.check(func(p *Principal) bool { return p.Role.Allows(min) }, false, next)
+}
+
+// Gateway serves next to adopted gateways and to operators, e.g. for the
+// uploads of the gateways.
+func (a *Authenticator) Gateway(next http.Handler) http.Handler {
+	return a.check(func(p *Principal) bool { return p.Gateway != "" || p.Role.Allows(Operator) }, false, next)
+}
+
+// Page serves next to any user, redirecting browsers without a session to
+// the login page.
+func (a *Authenticator) Page(next http.Handler) http.Handler {
+	return a.check(func(p *Principal) bool { return p.Role.Allows(Viewer) }, true, next)
+}
+
+func (a *Authenticator) check(allowed func(*Principal) bool, redirect bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case p == nil && redirect:
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		case p == nil:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="meshspy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case !allowed(p):
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, p)))
+	})
+}
+
+// Audit records action taken by the principal of r.
+func (a *Authenticator) Audit(r *http.Request, action, detail string) {
+	e := storage.AuditEntry{Action: action, Detail: detail, Remote: remoteHost(r)}
+	if p := FromContext(r.Context()); p != nil {
+		e.User = p.Name()
+	}
+	if err := a.store.AddAudit(&e); err != nil {
+		log.Printf("audit %s: %v", action, err)
+	}
+}
+
+// Credentials is the body of a login.
+type Credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// Login checks the credentials posted as JSON or as a form and starts a
+// session. Forms are redirected to their next field.
+func (a *Authenticator) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var c Credentials
+	form := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if form {
+		c.Name, c.Password = r.PostFormValue("name"), r.PostFormValue("password")
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&c); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	u, err := a.store.UserByName(strings.TrimSpace(c.Name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash := a.dummy
+	if u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(c.Password)) != nil || u == nil {
+		a.store.AddAudit(&storage.AuditEntry{User: c.Name, Action: "login_failed", Remote: remoteHost(r)})
+		if form {
+			http.Redirect(w, r, "/login?failed=1&next="+url.QueryEscape(r.PostFormValue("next")), http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	token, err := NewToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	expires := time.Now().Add(a.opts.SessionTTL)
+	if err := a.store.AddSession(HashToken(token), u.ID, expires); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: CookieName, Value: token, Path: "/", Expires: expires,
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+	a.store.AddAudit(&storage.AuditEntry{User: u.Name, Action: "login", Remote: remoteHost(r)})
+	if form {
+		http.Redirect(w, r, localPath(r.PostFormValue("next")), http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, userPrincipal(u))
+}
+
+// Logout ends the session of the request.
+func (a *Authenticator) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(CookieName); err == nil {
+		if err := a.store.DeleteSession(HashToken(c.Value)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: CookieName, Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me answers the principal of the request.
+func (a *Authenticator) Me(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, FromContext(r.Context()))
+}
+
+// HashPassword returns the bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", fmt.Errorf("password must have at least 8 characters")
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// HashToken returns the stored form of a session, API or gateway token.
+// Tokens are random, so a fast hash is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken returns a random token.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func bearer(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+// localPath returns next when it is a path on this server, to avoid open
+// redirects after the login.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"meshspy/storage"
+)
+
+func newTestAuth(t *testing.T) (*Authenticator, storage.Backend, *httptest.Server) {
+	t.Helper()
+	store, err := storage.Open(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	a := New(store, Options{})
+	mux := http.NewServeMux()
+	a.Mount(mux)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	mux.Handle("/read", a.Require(Viewer, ok))
+	mux.Handle("/send", a.Require(Operator, ok))
+	mux.Handle("/page", a.Page(ok))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return a, store, ts
+}
+
+func do(t *testing.T, method, url string, body any, prepare func(*http.Request)) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s returned error: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func withBearer(token string) func(*http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func TestParseRole(t *testing.T) {
+	if r, err := ParseRole(" Operator "); err != nil || r != Operator {
+		t.Fatalf("ParseRole returned %q, %v", r, err)
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Fatalf("expected error for unknown role")
+	}
+	if !Admin.Allows(Operator) || !Operator.Allows(Viewer) || Viewer.Allows(Operator) {
+		t.Fatalf("unexpected role ordering")
+	}
+	if Role("").Allows(Viewer) {
+		t.Fatalf("empty role must not be allowed")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	a, store, _ := newTestAuth(t)
+	pw, err := a.Bootstrap("admin", "")
+	if err != nil || len(pw) != 16 {
+		t.Fatalf("Bootstrap returned %q, %v", pw, err)
+	}
+	if pw, err := a.Bootstrap("other", "secret-password"); err != nil || pw != "" {
+		t.Fatalf("second Bootstrap returned %q, %v", pw, err)
+	}
+	users, err := store.Users()
+	if err != nil || len(users) != 1 || users[0].Name != "admin" || users[0].Role != string(Admin) {
+		t.Fatalf("unexpected users %+v, %v", users, err)
+	}
+}
+
+func TestLoginSession(t *testing.T) {
+	a, store, ts := newTestAuth(t)
+	if _, err := a.Bootstrap("admin", "secret-password"); err != nil {
+		t.Fatalf("Bootstrap returned error: %v", err)
+	}
+
+	if resp := do(t, "GET", ts.URL+"/read", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+	if resp := do(t, "GET", ts.URL+"/page", nil, nil); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login?next=%2Fpage" {
+		t.Fatalf("expected redirect to login, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := do(t, "POST", ts.URL+"/api/login", Credentials{Name: "admin", Password: "wrong"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong password, got %d", resp.StatusCode)
+	}
+
+	resp := do(t, "POST", ts.URL+"/api/login", Credentials{Name: "admin", Password: "secret-password"}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login returned %d", resp.StatusCode)
+	}
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == CookieName {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("expected an HttpOnly session cookie, got %+v", resp.Cookies())
+	}
+	withCookie := func(r *http.Request) { r.AddCookie(session) }
+	if resp := do(t, "GET", ts.URL+"/send", nil, withCookie); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected session to authenticate, got %d", resp.StatusCode)
+	}
+	var me Principal
+	if err := json.NewDecoder(do(t, "GET", ts.URL+"/api/me", nil, withCookie).Body).Decode(&me); err != nil || me.User != "admin" || me.Role != Admin {
+		t.Fatalf("unexpected principal %+v, %v", me, err)
+	}
+
+	if resp := do(t, "POST", ts.URL+"/api/logout", nil, withCookie); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "GET", ts.URL+"/read", nil, withCookie); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after logout, got %d", resp.StatusCode)
+	}
+
+	audit, err := store.Audit("admin", storage.Page{})
+	if err != nil {
+		t.Fatalf("Audit returned error: %v", err)
+	}
+	actions := map[string]bool{}
+	for _, e := range audit {
+		actions[e.Action] = true
+	}
+	if !actions["login"] || !actions["login_failed"] {
+		t.Fatalf("unexpected audit trail %+v", audit)
+	}
+}
+
+func TestTokensAndRoles(t *testing.T) {
+	a, store, ts := newTestAuth(t)
+	if _, err := a.Bootstrap("admin", "secret-password"); err != nil {
+		t.Fatalf("Bootstrap returned error: %v", err)
+	}
+	admin, _ := store.UserByName("admin")
+	adminToken, _ := NewToken()
+	if err := store.AddAPIToken(&storage.APIToken{Name: "ci", UserID: admin.ID, TokenHash: HashToken(adminToken)}); err != nil {
+		t.Fatalf("AddAPIToken returned error: %v", err)
+	}
+
+	resp := do(t, "POST", ts.URL+"/api/users", UserRequest{Name: "bob", Password: "bob-password", Role: "viewer"}, withBearer(adminToken))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("user creation returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "POST", ts.URL+"/api/users", UserRequest{Name: "bob", Password: "bob-password", Role: "viewer"}, withBearer(adminToken)); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for duplicate user, got %d", resp.StatusCode)
+	}
+
+	// bob logs in and creates a token for his scripts
+	resp = do(t, "POST", ts.URL+"/api/login", Credentials{Name: "bob", Password: "bob-password"}, nil)
+	session := resp.Cookies()[0]
+	resp = do(t, "POST", ts.URL+"/api/tokens", map[string]string{"name": "script"}, func(r *http.Request) { r.AddCookie(session) })
+	var created NewTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated || created.Token == "" {
+		t.Fatalf("token creation returned %d %+v, %v", resp.StatusCode, created, err)
+	}
+	if resp := do(t, "GET", ts.URL+"/read", nil, withBearer(created.Token)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected viewer token to read, got %d", resp.StatusCode)
+	}
+	if resp := do(t, "GET", ts.URL+"/send", nil, withBearer(created.Token)); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for viewer sending, got %d", resp.StatusCode)
+	}
+	if resp := do(t, "GET", ts.URL+"/api/users", nil, withBearer(created.Token)); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for viewer on users, got %d", resp.StatusCode)
+	}
+
+	if resp := do(t, "DELETE", ts.URL+"/api/users?id=1", nil, withBearer(adminToken)); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 deleting the last admin, got %d", resp.StatusCode)
+	}
+
+	audit, err := store.Audit("admin", storage.Page{})
+	if err != nil || len(audit) == 0 || audit[0].Action != "user_add" || audit[0].Detail != "bob (viewer)" {
+		t.Fatalf("unexpected audit trail %+v, %v", audit, err)
+	}
+}
@@ -27,6 +27,7 @@ type NodeInfo struct {
 	MacAddr               string
 	HwModel               string
 	Role                  string
+	PublicKey             string
 	Latitude              float64
 	Longitude             float64
 	Altitude              int
@@ -249,9 +250,7 @@ func GetLocalNodeInfoCached(port, path string) (*NodeInfo, error) {
 
 // PublishAlive sends a simple \"MeshSpy Alive\" message to the given topic.
 func PublishAlive(client mqtt.Client, topic string) error {
-	token := client.Publish(topic, 0, false, []byte("MeshSpy Alive"))
-	token.Wait()
-	return token.Error()
+	return Publish(client, topic, 0, false, []byte("MeshSpy Alive"))
 }
 
 // SendAliveIfNeeded publishes an Alive message when cfg.SendAlive is true.
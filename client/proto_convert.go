@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"encoding/base64"
 	"fmt"
 
 	latestpb "meshspy/proto/latest/meshtastic"
@@ -21,6 +22,9 @@ func NodeInfoFromProto(ni *latestpb.NodeInfo) *NodeInfo {
 		HwModel:   u.GetHwModel().String(),
 		Role:      u.GetRole().String(),
 	}
+	if len(u.GetPublicKey()) > 0 {
+		info.PublicKey = base64.StdEncoding.EncodeToString(u.GetPublicKey())
+	}
 	if pos := ni.GetPosition(); pos != nil {
 		info.Latitude = float64(pos.GetLatitudeI()) / 1e7
 		info.Longitude = float64(pos.GetLongitudeI()) / 1e7
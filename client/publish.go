@@ -0,0 +1,35 @@
+package mqtt
+
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	publishTotal = promauto.NewCounterVec(prometheus.CounterOpts{Name: "meshspy_mqtt_publish_total",
+		Help: "MQTT publishes by result (success or failure)."}, []string{"result"})
+	publishLatency = promauto.NewHistogram(prometheus.HistogramOpts{Name: "meshspy_mqtt_publish_latency_seconds",
+		Help: "Time until the broker acknowledged an MQTT publish."})
+	publishesInFlight = promauto.NewGauge(prometheus.GaugeOpts{Name: "meshspy_mqtt_publishes_in_flight",
+		Help: "MQTT publishes waiting for the broker acknowledgement."})
+)
+
+// Publish sends payload on topic, waits for the broker acknowledgement and
+// records the outcome and latency in the MQTT metrics.
+func Publish(client mqtt.Client, topic string, qos byte, retained bool, payload interface{}) error {
+	publishesInFlight.Inc()
+	defer publishesInFlight.Dec()
+	start := time.Now()
+	token := client.Publish(topic, qos, retained, payload)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		publishTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+	publishLatency.Observe(time.Since(start).Seconds())
+	publishTotal.WithLabelValues("success").Inc()
+	return nil
+}
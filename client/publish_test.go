@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// latencyCount returns the number of publish latency observations.
+func latencyCount(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := publishLatency.Write(&m); err != nil {
+		t.Fatalf("write histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPublishRecordsMetrics(t *testing.T) {
+	success, failure := publishTotal.WithLabelValues("success"), publishTotal.WithLabelValues("failure")
+	ok, failed := testutil.ToFloat64(success), testutil.ToFloat64(failure)
+	observed := latencyCount(t)
+
+	if err := Publish(&mockClient{}, "t", 0, false, "x"); err != nil {
+		t.Fatalf("Publish returned error: %v", err)
+	}
+	if err := Publish(&mockClient{err: errors.New("fail")}, "t", 0, false, "x"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if testutil.ToFloat64(success) != ok+1 || testutil.ToFloat64(failure) != failed+1 {
+		t.Fatalf("unexpected publish counters")
+	}
+	if latencyCount(t) != observed+1 {
+		t.Fatalf("expected one latency observation")
+	}
+	if n := testutil.ToFloat64(publishesInFlight); n != 0 {
+		t.Fatalf("in-flight publishes not released: %v", n)
+	}
+}
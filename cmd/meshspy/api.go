@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	mqttpkg "meshspy/client"
+	"meshspy/gatewayapi"
+	"meshspy/serial"
+	"meshspy/state"
+	"meshspy/storage"
+	"meshspy/webui"
+)
+
+// deviceSnapshot is the state of the local radio served by the gateway API.
+type deviceSnapshot struct {
+	Node         *mqttpkg.NodeInfo `json:"node,omitempty"`
+	State        *state.NodeState  `json:"state,omitempty"`
+	SerialPort   string            `json:"serial_port"`
+	ProtoVersion string            `json:"proto_version,omitempty"`
+	Connected    bool              `json:"connected"`
+}
+
+// snapshot returns the stored info and the merged state of the local node.
+func snapshot(store storage.Backend, tracker *state.Tracker, port *serial.Manager, portName, protoVer string, num uint32) (any, error) {
+	if num == 0 {
+		return nil, fmt.Errorf("local node not known yet")
+	}
+	id := fmt.Sprintf("0x%x", num)
+	snap := deviceSnapshot{SerialPort: portName, ProtoVersion: protoVer, Connected: port.Connected()}
+	node, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	snap.Node = node
+	if st, ok := tracker.Get(id); ok {
+		snap.State = &st
+	}
+	return snap, nil
+}
+
+// serveAPI runs the gateway API on addr.
+func serveAPI(addr string, api *gatewayapi.Server) {
+	log.Printf("🌐 API del gateway su %s/api", addr)
+	if err := http.ListenAndServe(addr, api); err != nil {
+		log.Printf("❌ server API: %v", err)
+	}
+}
+
+// serveWeb runs the web interface on addr.
+func serveWeb(addr string, web *webui.Server) {
+	log.Printf("🌐 interfaccia web su %s", addr)
+	if err := http.ListenAndServe(addr, web); err != nil {
+		log.Printf("❌ server web: %v", err)
+	}
+}
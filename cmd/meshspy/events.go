@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"meshspy/events"
+	"meshspy/influx"
+	"meshspy/nodemap"
+	latestpb "meshspy/proto/latest/meshtastic"
+	"meshspy/storage"
+	"meshspy/webhook"
+)
+
+// packetEvent returns the alert, text_message, position or telemetry event
+// of a received packet, if any.
+func packetEvent(pkt *latestpb.MeshPacket) (events.Event, bool) {
+	dec := pkt.GetDecoded()
+	if dec == nil {
+		return events.Event{}, false
+	}
+	from := nodemap.FormatID(pkt.GetFrom())
+	switch dec.GetPortnum() {
+	case latestpb.PortNum_ALERT_APP, latestpb.PortNum_TEXT_MESSAGE_APP:
+		typ := events.TextMessage
+		if dec.GetPortnum() == latestpb.PortNum_ALERT_APP {
+			typ = events.Alert
+		}
+		return events.New(typ, from, map[string]any{
+			"text":    string(dec.GetPayload()),
+			"to":      nodemap.FormatID(pkt.GetTo()),
+			"channel": pkt.GetChannel(),
+		}), true
+	case latestpb.PortNum_POSITION_APP:
+		var pos latestpb.Position
+		if err := proto.Unmarshal(dec.GetPayload(), &pos); err != nil || (pos.GetLatitudeI() == 0 && pos.GetLongitudeI() == 0) {
+			return events.Event{}, false
+		}
+		return events.New(events.Position, from, map[string]any{
+			"latitude":  float64(pos.GetLatitudeI()) * 1e-7,
+			"longitude": float64(pos.GetLongitudeI()) * 1e-7,
+			"altitude":  pos.GetAltitude(),
+			"time":      pos.GetTime(),
+		}), true
+	case latestpb.PortNum_TELEMETRY_APP:
+		var tm latestpb.Telemetry
+		if err := proto.Unmarshal(dec.GetPayload(), &tm); err != nil {
+			return events.Event{}, false
+		}
+		p, ok := influx.TelemetryPoint(from, "", &tm, time.Now())
+		if !ok {
+			return events.Event{}, false
+		}
+		p.Fields["variant"] = p.Measurement
+		return events.New(events.Telemetry, from, p.Fields), true
+	}
+	return events.Event{}, false
+}
+
+// loadWebhooks returns the webhook sinks in path, plus a sink named
+// "default" receiving every event when url is set.
+func loadWebhooks(path, url string) []*webhook.Sink {
+	sinks, err := webhook.LoadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		log.Printf("❌ webhook %s: %v", path, err)
+	default:
+		log.Printf("🪝 %d webhook caricati da %s", len(sinks), path)
+	}
+	if url != "" {
+		s := &webhook.Sink{Name: "default", URL: url}
+		if err := s.Init(); err != nil {
+			log.Printf("❌ webhook %s: %v", url, err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	return sinks
+}
+
+// storeDeadLetter returns a dead letter handler saving abandoned webhook
+// deliveries in store.
+func storeDeadLetter(store storage.Backend) func(webhook.DeadLetter) {
+	return func(dl webhook.DeadLetter) {
+		log.Printf("⚠️ webhook %s: evento %d non consegnato dopo %d tentativi: %v", dl.Sink, dl.Event.ID, dl.Attempts, dl.Err)
+		payload := dl.Payload
+		if payload == nil {
+			payload, _ = json.Marshal(dl.Event)
+		}
+		if err := store.AddDeadLetter(&storage.DeadLetter{
+			Sink:      dl.Sink,
+			EventID:   dl.Event.ID,
+			EventType: dl.Event.Type,
+			Payload:   string(payload),
+			Error:     dl.Err.Error(),
+			Attempts:  dl.Attempts,
+		}); err != nil {
+			log.Printf("⚠️ salvataggio dead letter: %v", err)
+		}
+	}
+}
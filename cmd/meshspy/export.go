@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"meshspy/export"
+	"meshspy/storage"
+)
+
+// runExport implements the export subcommand, which writes the stored tracks
+// as GPX, KML or GeoJSON without starting the listener:
+//
+//	meshspy export -format kml -node 0x1,0x2 -since 2025-05-01T00:00:00Z -o tracks.kml
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", export.FormatGPX, "Formato di esportazione: gpx, kml o geojson")
+	nodes := fs.String("node", "", "Nodi da esportare separati da virgola (tutti se vuoto)")
+	since := fs.String("since", "", "Inizio della finestra temporale (RFC 3339 o secondi Unix)")
+	until := fs.String("until", "", "Fine della finestra temporale (RFC 3339 o secondi Unix)")
+	out := fs.String("o", "", "File di destinazione (stdout se vuoto)")
+	fs.Parse(args)
+
+	if !export.ValidFormat(*format) {
+		return fmt.Errorf("formato %q non supportato", *format)
+	}
+
+	godotenv.Load(".env.runtime")
+	dbPath := os.Getenv("NODE_DB_PATH")
+	if dbPath == "" {
+		dbPath = "nodes.db"
+	}
+
+	filter, err := export.FilterFromQuery(url.Values{"node": {*nodes}, "since": {*since}, "until": {*until}})
+	if err != nil {
+		return err
+	}
+	store, err := storage.Open(dbPath)
+	if err != nil {
+		return fmt.Errorf("apertura db nodi: %w", err)
+	}
+	defer store.Close()
+	data, err := export.Collect(store, filter)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return export.Write(w, *format, data)
+}
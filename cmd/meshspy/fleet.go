@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqttpkg "meshspy/client"
+	"meshspy/config"
+	"meshspy/mgmtapi"
+	"meshspy/storage"
+)
+
+// fleet keeps the gateway registered with the management server: it
+// announces the gateway until an operator adopts it, stores the credential
+// then issued, and sends the heartbeats.
+type fleet struct {
+	client    *mgmtapi.Client
+	tokenFile string
+	started   time.Time
+
+	mu    sync.Mutex
+	ann   mgmtapi.Announcement
+	token string
+	send  storage.SendPermissions
+}
+
+// newFleet returns the registration of the gateway with the server of
+// client, reading the credential saved by a previous adoption. It returns
+// nil when client is nil.
+func newFleet(client *mgmtapi.Client, cfg config.Config, version string) *fleet {
+	if client == nil {
+		return nil
+	}
+	f := &fleet{
+		client:    client,
+		tokenFile: cfg.MgmtTokenFile,
+		started:   time.Now(),
+		ann:       mgmtapi.Announcement{ID: cfg.GatewayID, Name: cfg.GatewayID, Version: version, Key: newKey()},
+	}
+	if b, err := os.ReadFile(cfg.MgmtTokenFile); err == nil {
+		f.token = strings.TrimSpace(string(b))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("⚠️ lettura credenziale del gateway: %v", err)
+	}
+	return f
+}
+
+// pullSettings returns the settings pushed by the server, or nil when the
+// gateway is not adopted yet or the server cannot be reached.
+func (f *fleet) pullSettings() *storage.GatewaySettings {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	token := f.token
+	f.mu.Unlock()
+	if token == "" {
+		return nil
+	}
+	set, err := f.client.WithToken(token).PullSettings()
+	if err != nil {
+		log.Printf("⚠️ lettura impostazioni dal server: %v", err)
+		return nil
+	}
+	f.mu.Lock()
+	f.send = set.Send
+	f.mu.Unlock()
+	return set
+}
+
+// uploads returns the client sending node data with the credential of the
+// gateway, or nil until the gateway is adopted.
+func (f *fleet) uploads() *mgmtapi.Client {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.token == "" {
+		return nil
+	}
+	return f.client.WithToken(f.token)
+}
+
+// canSend returns an error when the settings forbid sending on channel.
+func (f *fleet) canSend(channel uint32) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.send.Allows(channel) {
+		return fmt.Errorf("sending on channel %d not permitted by the management server", channel)
+	}
+	return nil
+}
+
+// setRadio completes the announcement with the local node and the hash of
+// its exported configuration.
+func (f *fleet) setRadio(info *mqttpkg.NodeInfo, configFile string) {
+	if f == nil || info == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ann.Radio, f.ann.Firmware = info.HwModel, info.FirmwareVersion
+	if info.LongName != "" {
+		f.ann.Name = info.LongName
+	}
+	if b, err := os.ReadFile(configFile); err == nil {
+		sum := sha256.Sum256(b)
+		f.ann.ConfigHash = hex.EncodeToString(sum[:])
+	}
+}
+
+// run registers the gateway and sends heartbeats until ctx is cancelled.
+// status returns the last error of the gateway, empty when healthy, and
+// nodes the number of known nodes.
+func (f *fleet) run(ctx context.Context, status func() string, nodes func() int) {
+	if f == nil {
+		return
+	}
+	interval := 30 * time.Second
+	registered := false
+	for {
+		f.mu.Lock()
+		ann, token := f.ann, f.token
+		f.mu.Unlock()
+		client := f.client.WithToken(token)
+
+		var err error
+		if !registered || token == "" {
+			var reg *mgmtapi.Registration
+			if reg, err = client.Register(ann); err == nil {
+				registered = true
+				if reg.Heartbeat > 0 {
+					interval = time.Duration(reg.Heartbeat) * time.Second
+				}
+				if reg.Token != "" {
+					f.adopted(reg.Token)
+				} else if reg.Status == mgmtapi.StatusPending {
+					log.Printf("⏳ gateway %s in attesa di adozione sul server", ann.ID)
+				}
+			}
+		} else {
+			err = client.Heartbeat(mgmtapi.Heartbeat{
+				Error:      status(),
+				ConfigHash: ann.ConfigHash,
+				Nodes:      nodes(),
+				Uptime:     time.Since(f.started).Seconds(),
+			})
+		}
+		var se *mgmtapi.StatusError
+		if errors.As(err, &se) && se.Code == http.StatusUnauthorized && token != "" {
+			f.revoked()
+			registered = false
+		} else if err != nil {
+			log.Printf("⚠️ server di gestione: %v", err)
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// adopted saves the credential issued by the server and applies the send
+// permissions; topics and rules take effect at the next start.
+func (f *fleet) adopted(token string) {
+	log.Printf("✅ gateway adottato dal server di gestione")
+	if err := os.WriteFile(f.tokenFile, []byte(token+"\n"), 0600); err != nil {
+		log.Printf("⚠️ salvataggio credenziale del gateway: %v", err)
+	}
+	f.mu.Lock()
+	f.token = token
+	f.mu.Unlock()
+	if set := f.pullSettings(); set != nil && (set.MQTTTopic != "" || set.CommandTopic != "" || set.StatePrefix != "" || set.Rules != "") {
+		log.Printf("ℹ️ topic e regole del server applicati al prossimo avvio")
+	}
+}
+
+// revoked drops a credential the server no longer accepts, e.g. after the
+// gateway was forgotten, and registers again from scratch.
+func (f *fleet) revoked() {
+	log.Printf("⚠️ credenziale del gateway revocata, nuova registrazione")
+	if err := os.Remove(f.tokenFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("⚠️ rimozione credenziale del gateway: %v", err)
+	}
+	f.mu.Lock()
+	f.token, f.ann.Key, f.send = "", newKey(), storage.SendPermissions{}
+	f.mu.Unlock()
+}
+
+// applySettings overrides the topics of cfg with those pushed by the server
+// and returns the alert rules, if any.
+func applySettings(cfg *config.Config, set *storage.GatewaySettings) string {
+	if set == nil {
+		return ""
+	}
+	if set.MQTTTopic != "" {
+		cfg.MQTTTopic = set.MQTTTopic
+	}
+	if set.CommandTopic != "" {
+		cfg.CommandTopic = set.CommandTopic
+	}
+	if set.StatePrefix != "" {
+		cfg.StatePrefix = set.StatePrefix
+	}
+	log.Printf("✅ impostazioni ricevute dal server di gestione")
+	return set.Rules
+}
+
+// newKey returns the secret proving that the adopted gateway is the one
+// that registered.
+func newKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("⚠️ generazione chiave del gateway: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,29 +1,46 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/joho/godotenv" // ← used to read .env files
 
+	"meshspy/auth"
 	mqttpkg "meshspy/client"
 	"meshspy/config"
+	"meshspy/events"
+	"meshspy/gatewayapi"
+	"meshspy/influx"
 	"meshspy/mgmtapi"
 	"meshspy/nodemap"
+	"meshspy/presence"
 	latestpb "meshspy/proto/latest/meshtastic"
+	"meshspy/rules"
 	"meshspy/serial"
+	"meshspy/state"
 	"meshspy/storage"
+	"meshspy/webhook"
+	"meshspy/webui"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -49,6 +66,15 @@ func init() {
 }
 
 func main() {
+	// Subcommands run before logging is set up so their output stays clean
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ esportazione: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Open or create the log file and direct all log output to it
 	f, err := os.OpenFile(logFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
@@ -77,6 +103,11 @@ func main() {
 	nodes := nodemap.New()
 	mgmt := mgmtapi.New(cfg.MgmtURL)
 
+	// Adopted gateways take their topics, alert rules and send permissions
+	// from the management server
+	gateway := newFleet(mgmt, cfg, Version)
+	serverRules := applySettings(&cfg, gateway.pullSettings())
+
 	// Print MQTT credentials so they can be verified before connecting
 	log.Printf("ℹ️  MQTT user: %s", cfg.User)
 	log.Printf("ℹ️  MQTT password: %s", cfg.Password)
@@ -85,14 +116,58 @@ func main() {
 	if nodeDB == "" {
 		nodeDB = "nodes.db"
 	}
-	nodeStore, err := storage.NewNodeStore(nodeDB)
+	nodeStore, err := storage.Open(nodeDB)
 	if err != nil {
 		log.Fatalf("❌ apertura db nodi: %v", err)
 	}
 	defer nodeStore.Close()
 
+	// Names resolve from the database right away instead of waiting for
+	// NodeInfo packets to be heard again
+	if err := nodes.Load(nodeStore); err != nil {
+		log.Printf("⚠️ caricamento mappa nodi: %v", err)
+	} else {
+		log.Printf("✅ %d nodi caricati dal db", len(nodes.List()))
+	}
+
+	// Downsample and trim old positions and telemetry, and drop expired
+	// events, dead letters and audit rows in the background
+	retentionCtx, stopRetention := context.WithCancel(context.Background())
+	defer stopRetention()
+	go nodeStore.RunRetention(retentionCtx, storage.Retention{
+		Positions:   storage.RetentionPolicy{Raw: cfg.PositionsRaw, Hourly: cfg.PositionsHourly, Daily: cfg.PositionsDaily},
+		Telemetry:   storage.RetentionPolicy{Raw: cfg.TelemetryRaw, Hourly: cfg.TelemetryHourly, Daily: cfg.TelemetryDaily},
+		Events:      cfg.EventsRetention,
+		DeadLetters: cfg.DeadLettersRetention,
+		Audit:       cfg.AuditRetention,
+		Interval:    cfg.CompactInterval,
+		VacuumEvery: cfg.VacuumInterval,
+	})
+
+	// Optional InfluxDB line protocol sink for telemetry and link quality
+	var influxSink *influx.Sink
+	if cfg.InfluxURL != "" {
+		w, err := influx.Open(cfg.InfluxURL, cfg.InfluxOrg, cfg.InfluxBucket, cfg.InfluxToken)
+		if err != nil {
+			log.Fatalf("❌ configurazione InfluxDB: %v", err)
+		}
+		influxSink = influx.NewSink(w, influx.Options{BatchSize: cfg.InfluxBatchSize, FlushInterval: cfg.InfluxFlushInterval})
+		influxCtx, stopInflux := context.WithCancel(context.Background())
+		defer stopInflux()
+		go influxSink.Run(influxCtx)
+		log.Printf("📈 invio telemetria a InfluxDB: %s", cfg.InfluxURL)
+	}
+
 	if *msg != "" {
-		if err := serial.SendText(cfg.SerialPort, *msg); err != nil {
+		to := ""
+		if *dest != "" {
+			n, ok := nodes.Lookup(*dest)
+			if !ok {
+				log.Fatalf("❌ Nodo destinatario sconosciuto: %s", *dest)
+			}
+			to = fmt.Sprintf("!%08x", n.Num())
+		}
+		if err := serial.SendTextMessageTo(cfg.SerialPort, to, *msg); err != nil {
 			log.Fatalf("❌ Errore invio messaggio: %v", err)
 		}
 		if *dest != "" {
@@ -103,56 +178,348 @@ func main() {
 		return
 	}
 
-	// Connect to the MQTT broker
-	client, err := mqttpkg.ConnectMQTT(cfg)
-	if err != nil {
-		log.Fatalf("❌ Errore connessione MQTT: %v", err)
+	// Connect to the MQTT broker, unless disabled with an empty MQTT_BROKER
+	// on sites without one
+	var client paho.Client
+	if cfg.MQTTBroker != "" {
+		client, err = mqttpkg.ConnectMQTT(cfg)
+		if err != nil {
+			log.Fatalf("❌ Errore connessione MQTT: %v", err)
+		}
+		defer client.Disconnect(250)
+
+		if err := mqttpkg.SendAliveIfNeeded(client, cfg); err != nil {
+			log.Printf("⚠️  Errore invio messaggio Alive: %v", err)
+		} else if cfg.SendAlive {
+			log.Printf("✅ Messaggio Alive inviato su '%s'", cfg.MQTTTopic)
+		}
+	} else {
+		log.Printf("ℹ️ MQTT disattivato")
+	}
+	// publish sends payload on topic, doing nothing without a broker.
+	publish := func(topic string, qos byte, retained bool, payload interface{}) error {
+		if client == nil {
+			return nil
+		}
+		return mqttpkg.Publish(client, topic, qos, retained, payload)
+	}
+
+	// Merged per-node state published as retained messages for late subscribers
+	tracker := state.New(cfg.StatePrefix, func(topic string, payload []byte) error {
+		err := publish(topic, 1, true, payload)
+		if err != nil {
+			log.Printf("❌ Errore pubblicazione stato %s: %v", topic, err)
+		}
+		return err
+	})
+
+	if cfg.MetricsAddr != "" {
+		prometheus.MustRegister(newNodeCollector(tracker))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Printf("📈 metriche Prometheus su %s/metrics", cfg.MetricsAddr)
+			if err := http.ListenAndServe(cfg.MetricsAddr, mux); err != nil {
+				log.Printf("❌ server metriche: %v", err)
+			}
+		}()
+	}
+
+	// Events are stored in the database, published on MQTT under
+	// <prefix>/events/<type> and routed to the webhook sinks
+	bus := events.NewBus(nodeStore.AddEvent)
+	defer bus.Handle(func(e events.Event) {
+		b, _ := json.Marshal(e)
+		topic := fmt.Sprintf("%s/events/%s", cfg.StatePrefix, e.Type)
+		if err := publish(topic, 1, false, b); err != nil {
+			log.Printf("❌ Errore pubblicazione evento %s: %v", topic, err)
+		}
+	})()
+	// Once adopted, the gateway also forwards its events to the management
+	// server, which streams them to its clients
+	if gateway != nil {
+		defer bus.Handle(func(e events.Event) {
+			if err := gateway.uploads().SendEvent(e); err != nil {
+				log.Printf("⚠️ invio evento al server di gestione: %v", err)
+			}
+		})()
+	}
+	var dispatcher *webhook.Dispatcher
+	if sinks := loadWebhooks(cfg.WebhooksFile, cfg.EventsWebhookURL); len(sinks) > 0 {
+		dispatcher = webhook.NewDispatcher(sinks, webhook.Options{
+			Resolve:    nodes.ResolveLong,
+			DeadLetter: storeDeadLetter(nodeStore),
+		})
+		go dispatcher.Run(context.Background())
+		// At shutdown the queued deliveries get a few seconds, then are
+		// dead-lettered while the store is still open
+		defer func() {
+			closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dispatcher.Close(closeCtx)
+		}()
+		defer bus.Handle(dispatcher.Handle)()
 	}
-	defer client.Disconnect(250)
 
-	if err := mqttpkg.SendAliveIfNeeded(client, cfg); err != nil {
-		log.Printf("⚠️  Errore invio messaggio Alive: %v", err)
-	} else if cfg.SendAlive {
-		log.Printf("✅ Messaggio Alive inviato su '%s'", cfg.MQTTTopic)
+	// Presence of the nodes, fed by every received packet
+	timeouts := presence.Timeouts{Default: cfg.PresenceTimeout, Roles: cfg.PresenceRoleTimeouts}
+	presenceTracker := presence.New(timeouts, func(e events.Event) {
+		switch e.Type {
+		case events.NodeNew:
+			log.Printf("🆕 nuovo nodo %s", e.NodeID)
+		case events.NodeOnline:
+			log.Printf("🟢 nodo %s online", e.NodeID)
+		case events.NodeOffline:
+			log.Printf("🔴 nodo %s offline", e.NodeID)
+		}
+		if _, err := bus.Publish(e); err != nil {
+			log.Printf("⚠️ salvataggio evento: %v", err)
+		}
+	})
+	restorePresence(presenceTracker, nodeStore, timeouts)
+	prometheus.MustRegister(presenceCollector{presenceTracker})
+	presenceCtx, stopPresence := context.WithCancel(context.Background())
+	defer stopPresence()
+	go presenceTracker.Run(presenceCtx, 30*time.Second)
+
+	// Subscribe to the command topic and forward messages over serial. The
+	// port is opened later; the MQTT, web and rule goroutines started
+	// before read it through portMgr.
+	var portMgr atomic.Pointer[serial.Manager]
+	// Node number of the local radio, used as sender of outgoing messages
+	var localNum atomic.Uint32
+
+	// sendTextTo sends text to dest on channel and archives it so its
+	// delivery status can be followed.
+	sendTextTo := func(dest, channel uint32, text string) (uint32, error) {
+		if err := gateway.canSend(channel); err != nil {
+			return 0, err
+		}
+		pm := portMgr.Load()
+		if pm == nil {
+			return 0, fmt.Errorf("serial port not open")
+		}
+		id, err := pm.SendText(dest, channel, text)
+		if err != nil {
+			return 0, err
+		}
+		m := &storage.Message{
+			PacketID:  id,
+			From:      nodemap.FormatID(localNum.Load()),
+			To:        nodemap.FormatID(dest),
+			Channel:   channel,
+			Direction: storage.DirectionOut,
+			Text:      text,
+			Status:    storage.StatusPending,
+		}
+		if _, err := nodeStore.AddMessage(m); err != nil {
+			log.Printf("⚠️ salvataggio messaggio inviato: %v", err)
+		}
+		if _, err := bus.Publish(events.New(events.MessageSent, m.To, m)); err != nil {
+			log.Printf("⚠️ salvataggio evento: %v", err)
+		}
+		return id, nil
+	}
+	// sendText broadcasts text on the primary channel.
+	sendText := func(text string) error {
+		_, err := sendTextTo(serial.BroadcastAddr, 0, text)
+		return err
 	}
 
-	// Subscribe to the command topic and forward messages over serial
-	var portMgr *serial.Manager
+	// sendWaypoint broadcasts wp and stores it; our own packets are not
+	// echoed back by the radio. Waypoints are refused until the local node
+	// number is known, as it names their author and owner.
+	sendWaypoint := func(wp *latestpb.Waypoint) error {
+		from := localNum.Load()
+		if from == 0 {
+			return fmt.Errorf("local node number not known yet")
+		}
+		if err := gateway.canSend(0); err != nil {
+			return err
+		}
+		pm := portMgr.Load()
+		if pm == nil {
+			return fmt.Errorf("serial port not open")
+		}
+		if _, err := pm.SendWaypoint(serial.BroadcastAddr, 0, wp); err != nil {
+			return err
+		}
+		return nodeStore.SaveWaypoint(storage.WaypointFromProto(from, wp))
+	}
 
-	token := client.Subscribe(cfg.CommandTopic, 0, func(c paho.Client, m paho.Message) {
-		msg := string(m.Payload())
-		log.Printf("📥 comando ricevuto (%s): %s", m.Topic(), msg)
-		if portMgr == nil {
+	// deleteWaypoint resends a stored waypoint with an expiry in the past,
+	// which removes it from every node.
+	deleteWaypoint := func(id uint32) error {
+		wp := &latestpb.Waypoint{Id: id}
+		stored, err := nodeStore.Waypoint(id)
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			wp = stored.Proto()
+		}
+		wp.Expire = 1
+		return sendWaypoint(wp)
+	}
+
+	// Alert rules evaluated against the events and the received metrics,
+	// notifying on MQTT, webhooks or back on the mesh
+	ruleSender := &rules.Sender{
+		MQTT: func(topic string, payload []byte) error {
+			return publish(topic, 1, false, payload)
+		},
+		Webhook: func(sink string, n rules.Notification) error {
+			if dispatcher == nil {
+				return fmt.Errorf("no webhook sinks configured")
+			}
+			return dispatcher.Send(sink, events.New(events.Alert, n.NodeID, n))
+		},
+		Mesh: func(to string, channel uint32, text string) error {
+			if portMgr.Load() == nil {
+				return fmt.Errorf("serial port not open")
+			}
+			dest := uint32(serial.BroadcastAddr)
+			if to != "" {
+				n, ok := nodes.Lookup(to)
+				if !ok {
+					return fmt.Errorf("unknown node %s", to)
+				}
+				dest = n.Num()
+			}
+			_, err := sendTextTo(dest, channel, text)
+			return err
+		},
+	}
+	ruleEngine := newRuleEngine(cfg.RulesFile, serverRules, nodes, ruleSender)
+	if ruleEngine != nil {
+		defer bus.Handle(ruleEngine.HandleEvent)()
+		rulesCtx, stopRules := context.WithCancel(context.Background())
+		defer stopRules()
+		// The notifications are delivered apart from the serial read
+		// loop, which feeds the engine
+		go ruleSender.Run(rulesCtx)
+		go ruleEngine.Run(rulesCtx, 30*time.Second)
+	}
+
+	// runCommand runs a command received on the command topic or from the
+	// web interface.
+	runCommand := func(msg string) {
+		if portMgr.Load() == nil {
 			log.Printf("❌ Porta seriale non inizializzata")
 			return
 		}
 		switch {
 		case msg == "sendhello":
-			if err := portMgr.SendTextMessage(welcomeMessage); err != nil {
+			if err := sendText(welcomeMessage); err != nil {
 				log.Printf("❌ Errore invio messaggio standard: %v", err)
 			} else {
 				log.Printf("✅ Messaggio standard inviato")
 			}
 		case strings.HasPrefix(msg, "send:"):
 			text := strings.TrimPrefix(msg, "send:")
-			if err := portMgr.SendTextMessage(text); err != nil {
+			if err := sendText(text); err != nil {
 				log.Printf("❌ Errore invio messaggio personalizzato: %v", err)
 			} else {
 				log.Printf("✅ Messaggio personalizzato inviato: %s", text)
 			}
+		case strings.HasPrefix(msg, "chan:"):
+			// chan:<index>:<text> broadcasts on a secondary channel
+			idx, text, _ := strings.Cut(strings.TrimPrefix(msg, "chan:"), ":")
+			channel, err := strconv.ParseUint(idx, 10, 8)
+			if err != nil {
+				log.Printf("❌ Canale non valido: %s", idx)
+				return
+			}
+			if _, err := sendTextTo(serial.BroadcastAddr, uint32(channel), text); err != nil {
+				log.Printf("❌ Errore invio messaggio sul canale %d: %v", channel, err)
+			} else {
+				log.Printf("✅ Messaggio inviato sul canale %d: %s", channel, text)
+			}
+		case strings.HasPrefix(msg, "dm:"):
+			// dm:<node>:<text>, the node given by name, short name or ID
+			target, text, _ := strings.Cut(strings.TrimPrefix(msg, "dm:"), ":")
+			n, ok := nodes.Lookup(target)
+			if !ok {
+				log.Printf("❌ Nodo destinatario sconosciuto: %s", target)
+				return
+			}
+			if _, err := sendTextTo(n.Num(), 0, text); err != nil {
+				log.Printf("❌ Errore invio messaggio diretto: %v", err)
+			} else {
+				log.Printf("✅ Messaggio diretto inviato a %s (%s)", nodes.ResolveLong(n.ID), n.ID)
+			}
+		case strings.HasPrefix(msg, "waypoint:"):
+			wp, err := parseWaypointCommand(strings.TrimPrefix(msg, "waypoint:"), localNum.Load())
+			if err == nil {
+				err = sendWaypoint(wp)
+			}
+			if err != nil {
+				log.Printf("❌ Errore invio waypoint: %v", err)
+			} else {
+				log.Printf("✅ Waypoint %d inviato: %s", wp.GetId(), wp.GetName())
+			}
+		case strings.HasPrefix(msg, "delwaypoint:"):
+			id, err := parseWaypointID(strings.TrimPrefix(msg, "delwaypoint:"))
+			if err == nil {
+				err = deleteWaypoint(id)
+			}
+			if err != nil {
+				log.Printf("❌ Errore cancellazione waypoint: %v", err)
+			} else {
+				log.Printf("✅ Waypoint %d cancellato", id)
+			}
 		default:
-			if err := portMgr.SendTextMessage(msg); err != nil {
+			if err := sendText(msg); err != nil {
 				log.Printf("❌ Errore invio messaggio: %v", err)
 			} else {
 				log.Printf("✅ Messaggio inviato: %s", msg)
 			}
 		}
-	})
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("⚠️  Errore sottoscrizione comandi: %v", token.Error())
 	}
-	log.Printf("✅ in ascolto su topic comandi %s", cfg.CommandTopic)
+	handleCommand := func(c paho.Client, m paho.Message) {
+		msg := string(m.Payload())
+		log.Printf("📥 comando ricevuto (%s): %s", m.Topic(), msg)
+		runCommand(msg)
+	}
+	if client != nil {
+		token := client.Subscribe(cfg.CommandTopic, 0, handleCommand)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("⚠️  Errore sottoscrizione comandi: %v", token.Error())
+		}
+		log.Printf("✅ in ascolto su topic comandi %s", cfg.CommandTopic)
+	}
+
+	// Optional web interface fed by the event bus instead of MQTT, sharing
+	// the database of the gateway
+	var web *webui.Server
+	if cfg.WebAddr != "" {
+		a := auth.New(nodeStore, auth.Options{SessionTTL: cfg.SessionTTL})
+		if generated, err := a.Bootstrap(cfg.AdminUser, cfg.AdminPassword); err != nil {
+			log.Fatalf("❌ creazione utente admin: %v", err)
+		} else if generated != "" {
+			log.Printf("🔑 creato l'utente %s con password %s", cfg.AdminUser, generated)
+		}
+		web = webui.New(webui.Options{
+			Store:  nodeStore,
+			Auth:   a,
+			Config: cfg,
+			Send: func(cmd string) error {
+				if portMgr.Load() == nil {
+					return fmt.Errorf("serial port not open")
+				}
+				log.Printf("📥 comando dall'interfaccia web: %s", cmd)
+				runCommand(cmd)
+				return nil
+			},
+			EventsTopic: cfg.StatePrefix + "/events/#",
+		})
+		defer bus.Handle(func(e events.Event) {
+			b, _ := json.Marshal(e)
+			web.Publish(fmt.Sprintf("%s/events/%s", cfg.StatePrefix, e.Type), b)
+		})()
+		go serveWeb(cfg.WebAddr, web)
+	}
 
 	// Initialize the exit channel to handle termination signals
 	sigs := make(chan os.Signal, 1)
@@ -195,23 +562,26 @@ func main() {
 		log.Printf("⚠️ Lettura info nodo fallita: %v", err)
 	} else {
 		protoVer = mqttpkg.ProtoVersionForFirmware(info.FirmwareVersion)
+		localNum.Store(info.Num)
 		if err := mqttpkg.SaveNodeInfo(info, "nodes.json"); err != nil {
 			log.Printf("⚠️ Salvataggio info nodo fallito: %v", err)
 		}
-		nodes.Update(info.Num, info.LongName, info.ShortName)
+		nodes.UpdateInfo(info)
+		presenceTracker.Update(info.ID, info.LongName, info.Role)
 		if err := nodeStore.Upsert(info); err != nil {
 			log.Printf("⚠️ aggiornamento db nodi: %v", err)
 		}
-		if err := mgmt.SendNode(info); err != nil {
+		if err := gateway.uploads().SendNode(info); err != nil {
 			log.Printf("⚠️ invio info nodo al server: %v", err)
 		}
 		if nodesList, err := mqttpkg.GetMeshNodes(cfg.SerialPort); err == nil {
 			for _, n := range nodesList {
-				nodes.Update(n.Num, n.LongName, n.ShortName)
+				nodes.UpdateInfo(n)
+				seenNode(presenceTracker, n)
 				if err := nodeStore.Upsert(n); err != nil {
 					log.Printf("⚠️ aggiornamento db nodi: %v", err)
 				}
-				if err := mgmt.SendNode(n); err != nil {
+				if err := gateway.uploads().SendNode(n); err != nil {
 					log.Printf("⚠️ invio info nodo al server: %v", err)
 				}
 			}
@@ -224,6 +594,7 @@ func main() {
 		} else {
 			log.Printf("✅ Configurazione salvata in %s", cfgFile)
 		}
+		gateway.setRadio(info, cfgFile)
 	}
 	if err := serial.SendTextMessage(cfg.SerialPort, welcomeMessage); err != nil {
 		log.Printf("⚠️ Errore invio messaggio di benvenuto: %v", err)
@@ -231,62 +602,192 @@ func main() {
 		log.Printf("✅ Messaggio di benvenuto inviato")
 	}
 
-	portMgr, err = serial.OpenManager(cfg.SerialPort, cfg.BaudRate, protoVer)
+	pm, err := serial.OpenManager(cfg.SerialPort, cfg.BaudRate, protoVer)
 	if err != nil {
 		log.Fatalf("❌ apertura porta seriale: %v", err)
 	}
-	defer portMgr.Close()
+	defer pm.Close()
+	portMgr.Store(pm)
+
+	// checks reports the status of the gateway components.
+	checks := func() map[string]bool {
+		checks := map[string]bool{"serial": pm.Connected()}
+		if client != nil {
+			checks["mqtt"] = client.IsConnectionOpen()
+		}
+		return checks
+	}
+
+	// Registration and heartbeats with the management server
+	fleetCtx, stopFleet := context.WithCancel(context.Background())
+	defer stopFleet()
+	go gateway.run(fleetCtx, func() string {
+		var down []string
+		for name, ok := range checks() {
+			if !ok {
+				down = append(down, name+" disconnected")
+			}
+		}
+		sort.Strings(down)
+		return strings.Join(down, ", ")
+	}, func() int { return len(nodes.List()) })
+
+	// Optional local HTTP API to script the gateway without a broker,
+	// never exposed without a token
+	var api *gatewayapi.Server
+	if cfg.APIAddr != "" && cfg.APIToken == "" {
+		log.Printf("❌ API del gateway non avviata: API_ADDR richiede API_TOKEN")
+	} else if cfg.APIAddr != "" {
+		api = gatewayapi.New(gatewayapi.Options{
+			Token:      cfg.APIToken,
+			Nodes:      nodes,
+			SendText:   sendTextTo,
+			Traceroute: pm.SendTraceroute,
+			Snapshot: func() (any, error) {
+				return snapshot(nodeStore, tracker, pm, cfg.SerialPort, protoVer, localNum.Load())
+			},
+			Checks: checks,
+		})
+		go serveAPI(cfg.APIAddr, api)
+	}
 
 	// Start reading from the serial port in a goroutine
 	go func() {
-		portMgr.ReadLoop(cfg.Debug, protoVer, nodes, func(ni *latestpb.NodeInfo) {
+		pm.ReadLoop(cfg.Debug, protoVer, nodes, func(ni *latestpb.NodeInfo) {
+			tracker.UpdateNodeInfo(ni)
 			info := mqttpkg.NodeInfoFromProto(ni)
+			seenNode(presenceTracker, info)
 			if info != nil {
 				if err := nodeStore.Upsert(info); err != nil {
 					log.Printf("⚠️ aggiornamento db nodi: %v", err)
 				}
-				if err := mgmt.SendNode(info); err != nil {
+				if err := gateway.uploads().SendNode(info); err != nil {
 					log.Printf("⚠️ invio info nodo al server: %v", err)
 				}
 			}
 		}, func(mi *latestpb.MyNodeInfo) {
+			localNum.Store(mi.GetMyNodeNum())
 			info := mqttpkg.NodeInfoFromMyInfo(mi)
+			nodes.UpdateInfo(info)
 			if info != nil {
 				if err := nodeStore.Upsert(info); err != nil {
 					log.Printf("⚠️ aggiornamento db nodi: %v", err)
 				}
-				if err := mgmt.SendNode(info); err != nil {
+				if err := gateway.uploads().SendNode(info); err != nil {
 					log.Printf("⚠️ invio info nodo al server: %v", err)
 				}
 			}
+		}, func(ch *latestpb.Channel) {
+			c := storage.ChannelFromProto(ch)
+			log.Printf("📻 canale %d %s (%s)", c.Index, c.Name, c.Role)
+			if err := nodeStore.SaveChannel(c); err != nil {
+				log.Printf("⚠️ salvataggio canale: %v", err)
+			}
 		}, func(tm *latestpb.Telemetry) {
 			b, _ := json.Marshal(tm)
 			log.Printf("📊 Telemetry: %s", string(b))
 		}, func(wp *latestpb.Waypoint) {
-			if err := nodeStore.AddWaypoint(wp); err != nil {
-				log.Printf("⚠️ salvataggio waypoint: %v", err)
-			}
+			log.Printf("📍 Waypoint: %d %s", wp.GetId(), wp.GetName())
 		}, func(adm []byte) {
 			log.Printf("⚙️ Admin: %x", adm)
 		}, func(alert string) {
 			log.Printf("🚨 Alert: %s", alert)
 		}, func(txt string) {
 			log.Printf("💬 Text: %s", txt)
+		}, func(pkt *latestpb.MeshPacket) {
+			tracker.UpdatePacket(pkt)
+			nodes.Seen(pkt.GetFrom(), time.Now().Unix())
+			if pkt.GetFrom() != 0 {
+				presenceTracker.Seen(fmt.Sprintf("0x%x", pkt.GetFrom()), time.Now())
+			}
+			if m := storage.MessageFromPacket(pkt); m != nil {
+				if _, err := nodeStore.AddMessage(m); err != nil {
+					log.Printf("⚠️ salvataggio messaggio: %v", err)
+				}
+			}
+			if wp := storage.WaypointFromPacket(pkt); wp != nil {
+				if err := nodeStore.SaveWaypoint(wp); err != nil {
+					log.Printf("⚠️ salvataggio waypoint: %v", err)
+				}
+			}
+			if dec := pkt.GetDecoded(); dec != nil && dec.GetPortnum() == latestpb.PortNum_TELEMETRY_APP {
+				var tm latestpb.Telemetry
+				if err := proto.Unmarshal(dec.GetPayload(), &tm); err == nil {
+					if err := nodeStore.AddNodeTelemetry(fmt.Sprintf("0x%x", pkt.GetFrom()), &tm); err != nil {
+						log.Printf("⚠️ salvataggio telemetria: %v", err)
+					}
+				}
+			}
+			if values := storage.PacketMetrics(pkt); len(values) > 0 {
+				if err := nodeStore.AddNodeMetrics(fmt.Sprintf("0x%x", pkt.GetFrom()), time.Now(), values); err != nil {
+					log.Printf("⚠️ salvataggio metriche: %v", err)
+				}
+			}
+			// The gateway tag is left out until the local node number is known
+			var gatewayID string
+			if num := localNum.Load(); num != 0 {
+				gatewayID = nodemap.FormatID(num)
+			}
+			points := influx.PacketPoints(gatewayID, pkt)
+			if influxSink != nil {
+				influxSink.Add(points...)
+			}
+			if ruleEngine != nil {
+				observePoints(ruleEngine, points)
+			}
+			if e, ok := packetEvent(pkt); ok {
+				if _, err := bus.Publish(e); err != nil {
+					log.Printf("⚠️ salvataggio evento: %v", err)
+				}
+			}
+			if api != nil {
+				api.HandlePacket(pkt)
+			}
+			if id, status, reason, err := storage.RoutingStatus(pkt); err != nil {
+				log.Printf("⚠️ aggiornamento stato consegna: %v", err)
+			} else if id != 0 {
+				if err := nodeStore.UpdateMessageStatus(id, status, reason); err != nil {
+					log.Printf("⚠️ aggiornamento stato consegna: %v", err)
+				}
+				e := events.New(events.MessageStatus, nodemap.FormatID(pkt.GetFrom()), map[string]any{
+					"packet_id": id, "status": status, "error": reason,
+				})
+				if _, err := bus.Publish(e); err != nil {
+					log.Printf("⚠️ salvataggio evento: %v", err)
+				}
+			}
 		}, func(data string) {
+			if web != nil {
+				web.Publish(cfg.MQTTTopic, []byte(data))
+			}
 
 			// Publish every received message on the MQTT topic
-			token := client.Publish(cfg.MQTTTopic, 0, false, data)
-			token.Wait()
-			if token.Error() != nil {
-				log.Printf("❌ Errore pubblicazione MQTT: %v", token.Error())
+			if client == nil {
+				return
+			}
+			if err := publish(cfg.MQTTTopic, 0, false, data); err != nil {
+				log.Printf("❌ Errore pubblicazione MQTT: %v", err)
 			} else {
 				log.Printf("📡 Dato pubblicato su '%s': %s", cfg.MQTTTopic, data)
 			}
 		})
 	}()
 
+	// The configuration download sends the channels and refreshes the node
+	// database
+	if err := pm.RequestConfig(); err != nil {
+		log.Printf("⚠️ richiesta configurazione al nodo: %v", err)
+	}
+
 	// Keep the program running until an exit signal is received
 	<-sigs
 	log.Println("👋 Uscita in corso...")
+	if influxSink != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := influxSink.Flush(flushCtx); err != nil {
+			log.Printf("⚠️ invio finale a InfluxDB: %v", err)
+		}
+		cancel()
+	}
 	time.Sleep(time.Second)
 }
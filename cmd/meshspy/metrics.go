@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"meshspy/state"
+)
+
+// deviceMetrics holds the fields of the last device_metrics telemetry of a
+// node used by the gauges; nil fields were not reported.
+type deviceMetrics struct {
+	BatteryLevel       *float64 `json:"battery_level"`
+	Voltage            *float64 `json:"voltage"`
+	ChannelUtilization *float64 `json:"channel_utilization"`
+	AirUtilTx          *float64 `json:"air_util_tx"`
+}
+
+// nodeGauges describes the per-node gauges exported from the state tracker.
+var nodeGauges = []struct {
+	name  string
+	help  string
+	value func(n *state.NodeState, dm *deviceMetrics, now time.Time) (float64, bool)
+}{
+	{"meshspy_node_battery_level", "Battery level in percent reported by the node.",
+		func(_ *state.NodeState, dm *deviceMetrics, _ time.Time) (float64, bool) {
+			return reported(dm.BatteryLevel)
+		}},
+	{"meshspy_node_voltage", "Battery voltage reported by the node.",
+		func(_ *state.NodeState, dm *deviceMetrics, _ time.Time) (float64, bool) { return reported(dm.Voltage) }},
+	{"meshspy_node_channel_utilization", "Channel utilization in percent seen by the node.",
+		func(_ *state.NodeState, dm *deviceMetrics, _ time.Time) (float64, bool) {
+			return reported(dm.ChannelUtilization)
+		}},
+	{"meshspy_node_air_util_tx", "Airtime used for transmission in percent by the node.",
+		func(_ *state.NodeState, dm *deviceMetrics, _ time.Time) (float64, bool) {
+			return reported(dm.AirUtilTx)
+		}},
+	{"meshspy_node_snr", "SNR of the last packet received from the node.",
+		func(n *state.NodeState, _ *deviceMetrics, _ time.Time) (float64, bool) { return n.Snr, true }},
+	{"meshspy_node_hops_away", "Hops between the gateway and the node.",
+		func(n *state.NodeState, _ *deviceMetrics, _ time.Time) (float64, bool) {
+			return float64(n.HopsAway), true
+		}},
+	{"meshspy_node_last_heard_seconds", "Seconds since the node was last heard.",
+		func(n *state.NodeState, _ *deviceMetrics, now time.Time) (float64, bool) {
+			return now.Sub(time.Unix(n.LastHeard, 0)).Seconds(), n.LastHeard > 0
+		}},
+}
+
+func reported(v *float64) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return *v, true
+}
+
+// nodeCollector reads the per-node gauges from the state tracker at every
+// scrape, so they follow the packets as they are received rather than the
+// periodic saves to the database.
+type nodeCollector struct {
+	tracker *state.Tracker
+	descs   []*prometheus.Desc
+}
+
+func newNodeCollector(tracker *state.Tracker) *nodeCollector {
+	c := &nodeCollector{tracker: tracker}
+	for _, g := range nodeGauges {
+		c.descs = append(c.descs, prometheus.NewDesc(g.name, g.help, []string{"node_id", "name"}, nil))
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, n := range c.tracker.List() {
+		var dm deviceMetrics
+		if t, ok := n.Telemetry["device_metrics"]; ok {
+			// Left empty when undecodable, which only drops its gauges
+			_ = json.Unmarshal(t.Metrics, &dm)
+		}
+		for i, g := range nodeGauges {
+			if v, ok := g.value(&n, &dm, now); ok {
+				ch <- prometheus.MustNewConstMetric(c.descs[i], prometheus.GaugeValue, v, n.ID, labelValue(n.LongName))
+			}
+		}
+	}
+}
+
+// labelValue replaces the invalid UTF-8 of s, which Prometheus refuses in
+// label values.
+func labelValue(s string) string {
+	return strings.ToValidUTF8(s, "\uFFFD")
+}
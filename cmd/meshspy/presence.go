@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	mqttpkg "meshspy/client"
+	"meshspy/presence"
+	"meshspy/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// restorePresence seeds the tracker with the nodes in the database, taking
+// their online state from the stored presence events when available and
+// from LastHeard otherwise, so a restart does not announce them again.
+func restorePresence(tr *presence.Tracker, store storage.Backend, timeouts presence.Timeouts) {
+	nodes, err := store.List()
+	if err != nil {
+		log.Printf("⚠️ lettura nodi per presenza: %v", err)
+		return
+	}
+	now := time.Now()
+	states := map[string]storage.PresenceState{}
+	if list, err := store.Presence(now, now); err == nil {
+		for _, s := range list {
+			states[s.NodeID] = s
+		}
+	} else {
+		log.Printf("⚠️ lettura stato presenza: %v", err)
+	}
+	for _, n := range nodes {
+		p := presence.Node{ID: n.ID, Name: n.LongName, Role: n.Role}
+		if n.LastHeard > 0 {
+			p.LastSeen = time.Unix(n.LastHeard, 0)
+		}
+		if s, ok := states[n.ID]; ok {
+			p.Online, p.Since, p.FirstSeen = s.Online, s.Since, s.FirstSeen
+		} else {
+			p.Online = !p.LastSeen.IsZero() && now.Sub(p.LastSeen) < timeouts.For(n.Role)
+		}
+		tr.Restore(p)
+	}
+}
+
+// seenNode feeds the presence tracker with a NodeInfo: its name and role
+// and, when reported, the time the radio last heard it.
+func seenNode(tr *presence.Tracker, info *mqttpkg.NodeInfo) {
+	if info == nil || info.ID == "" {
+		return
+	}
+	tr.Update(info.ID, info.LongName, info.Role)
+	if info.LastHeard > 0 {
+		tr.Seen(info.ID, time.Unix(info.LastHeard, 0))
+	}
+}
+
+// presenceCollector exports the online state of every tracked node.
+type presenceCollector struct {
+	tracker *presence.Tracker
+}
+
+var nodeOnlineDesc = prometheus.NewDesc("meshspy_node_online",
+	"Whether the node has been heard within its presence timeout.", []string{"node_id", "name"}, nil)
+
+// Describe implements prometheus.Collector.
+func (c presenceCollector) Describe(ch chan<- *prometheus.Desc) { ch <- nodeOnlineDesc }
+
+// Collect implements prometheus.Collector.
+func (c presenceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, n := range c.tracker.Nodes() {
+		v := 0.0
+		if n.Online {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(nodeOnlineDesc, prometheus.GaugeValue, v, n.ID, labelValue(n.Name))
+	}
+}
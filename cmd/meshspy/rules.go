@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"time"
+
+	"meshspy/influx"
+	"meshspy/nodemap"
+	"meshspy/rules"
+)
+
+// newRuleEngine loads the alert rules from path, or from the YAML in inline
+// when pushed by the management server, and queues their notifications
+// on sender, which the caller runs. It returns nil when the file does not exist or the rules
+// are invalid.
+func newRuleEngine(path, inline string, nodes *nodemap.Map, sender *rules.Sender) *rules.Engine {
+	var (
+		list []*rules.Rule
+		err  error
+	)
+	if inline != "" {
+		path = "server di gestione"
+		list, err = rules.Parse([]byte(inline))
+	} else {
+		list, err = rules.LoadFile(path)
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("ℹ️ nessun file di regole %s, avvisi disattivati", path)
+		} else {
+			log.Printf("❌ regole di avviso %s: %v", path, err)
+		}
+		return nil
+	}
+	log.Printf("🚨 %d regole di avviso caricate da %s", len(list), path)
+	sender.Failed = func(a rules.Action, n rules.Notification, err error) {
+		log.Printf("❌ invio avviso %s: %v", n.Rule, err)
+	}
+	return rules.New(list, rules.Options{
+		Node: func(id string) (string, string) {
+			e, _ := nodes.Get(id)
+			return nodes.ResolveLong(id), e.Role
+		},
+		Notify: func(a rules.Action, n rules.Notification) {
+			if n.Resolved {
+				log.Printf("✅ avviso %s risolto: %s", n.Rule, n.Text)
+			} else {
+				log.Printf("🚨 avviso %s: %s", n.Rule, n.Text)
+			}
+			sender.Queue(a, n)
+		},
+	})
+}
+
+// observePoints feeds the numeric fields of the points recorded for a
+// packet, e.g. battery_level or channel_utilization, to the rule engine.
+func observePoints(engine *rules.Engine, points []influx.Point) {
+	now := time.Now()
+	for _, p := range points {
+		for k, v := range p.Fields {
+			if f, ok := toFloat(v); ok {
+				engine.Observe(p.Tags["node"], k, f, now)
+			}
+		}
+	}
+}
+
+func toFloat(v any) (float64, bool) {
+	switch x := v.(type) {
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	}
+	return 0, false
+}
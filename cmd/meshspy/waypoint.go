@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// waypointCommand is the JSON body of the "waypoint:" command, e.g.
+//
+//	waypoint:{"name":"Campo base","lat":43.71,"lon":10.40,"icon":"⛺"}
+//
+// A zero ID creates a new waypoint; Expire is a Unix time (0 = never).
+type waypointCommand struct {
+	ID          uint32  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Icon        string  `json:"icon"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Expire      uint32  `json:"expire"`
+	Locked      bool    `json:"locked"`
+}
+
+// parseWaypointCommand builds the Waypoint to send from a "waypoint:"
+// command. Locked waypoints can only be changed by the local node.
+func parseWaypointCommand(arg string, localNum uint32) (*latestpb.Waypoint, error) {
+	var c waypointCommand
+	if err := json.Unmarshal([]byte(arg), &c); err != nil {
+		return nil, fmt.Errorf("invalid waypoint json: %v", err)
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return nil, fmt.Errorf("waypoint name required")
+	}
+	if math.Abs(c.Lat) > 90 || math.Abs(c.Lon) > 180 {
+		return nil, fmt.Errorf("invalid coordinates %f,%f", c.Lat, c.Lon)
+	}
+	wp := &latestpb.Waypoint{
+		Id:          c.ID,
+		Name:        c.Name,
+		Description: c.Description,
+		LatitudeI:   proto.Int32(int32(math.Round(c.Lat * 1e7))),
+		LongitudeI:  proto.Int32(int32(math.Round(c.Lon * 1e7))),
+		Expire:      c.Expire,
+	}
+	if r, _ := utf8.DecodeRuneInString(c.Icon); r != utf8.RuneError {
+		wp.Icon = uint32(r)
+	}
+	if c.Locked {
+		wp.LockedTo = localNum
+	}
+	return wp, nil
+}
+
+// parseWaypointID parses the argument of the "delwaypoint:" command, given
+// in decimal or as 0x-prefixed hexadecimal.
+func parseWaypointID(arg string) (uint32, error) {
+	arg = strings.TrimSpace(arg)
+	base := 10
+	if strings.HasPrefix(arg, "0x") {
+		arg, base = arg[2:], 16
+	}
+	id, err := strconv.ParseUint(arg, base, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid waypoint id %q", arg)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"meshspy/auth"
+	"meshspy/events"
+	"meshspy/nodemap"
+	"meshspy/storage"
+)
+
+// maxPostText is the longest post accepted, in bytes, so that it fits in a
+// single text packet.
+const maxPostText = 200
+
+// board is a bulletin board bound to a mesh channel: posts are broadcast on
+// the channel and the texts received on it are posted.
+type board struct {
+	Name    string
+	Channel uint32
+}
+
+// newBoards returns the boards of the name to channel mapping, by channel.
+func newBoards(m map[string]uint32) []board {
+	out := make([]board, 0, len(m))
+	for name, ch := range m {
+		out = append(out, board{Name: name, Channel: ch})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Channel != out[j].Channel {
+			return out[i].Channel < out[j].Channel
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+type server struct {
+	store  storage.Backend
+	auth   *auth.Authenticator
+	nodes  *nodemap.Map
+	boards []board
+	// send runs a gateway command.
+	send  func(cmd string) error
+	tmpl  *template.Template
+	login *template.Template
+}
+
+func newServer(store storage.Backend, a *auth.Authenticator, nodes *nodemap.Map, boards []board, send func(string) error) *server {
+	return &server{
+		store:  store,
+		auth:   a,
+		nodes:  nodes,
+		boards: boards,
+		send:   send,
+		tmpl:   template.Must(template.New("index").Parse(indexHTML)),
+		login:  template.Must(template.New("login").Parse(loginHTML)),
+	}
+}
+
+// routes returns the handler of the board. Reading needs a viewer, posting
+// an operator and moderating an admin.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	s.auth.Mount(mux)
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.Handle("/", s.auth.Page(http.HandlerFunc(s.handleIndex)))
+	mux.Handle("/post", s.auth.Require(auth.Operator, http.HandlerFunc(s.handlePost)))
+	mux.Handle("/moderate", s.auth.Require(auth.Admin, http.HandlerFunc(s.handleModerate)))
+	return mux
+}
+
+// board returns the board named name, the first one when name is empty.
+func (s *server) board(name string) (board, bool) {
+	if name == "" && len(s.boards) > 0 {
+		return s.boards[0], true
+	}
+	for _, b := range s.boards {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return board{}, false
+}
+
+// boardOf returns the board of channel.
+func (s *server) boardOf(channel uint32) (board, bool) {
+	for _, b := range s.boards {
+		if b.Channel == channel {
+			return b, true
+		}
+	}
+	return board{}, false
+}
+
+// receive posts a text broadcast on the channel of a board. Direct
+// messages and texts on other channels are left to the chat.
+func (s *server) receive(e events.Event) {
+	if e.Type != events.TextMessage {
+		return
+	}
+	var data struct {
+		Text    string `json:"text"`
+		To      string `json:"to"`
+		Channel uint32 `json:"channel"`
+	}
+	if err := json.Unmarshal(e.Data, &data); err != nil || data.To != storage.BroadcastID || data.Text == "" {
+		return
+	}
+	b, ok := s.boardOf(data.Channel)
+	if !ok {
+		return
+	}
+	p := &storage.BoardPost{Channel: b.Channel, From: e.NodeID, Text: data.Text}
+	if _, err := s.store.AddBoardPost(p); err != nil {
+		log.Printf("store post: %v", err)
+		return
+	}
+	log.Printf("📌 %s on %s: %s", s.nodes.ResolveLong(e.NodeID), b.Name, data.Text)
+}
+
+// postView is a post as shown on the page.
+type postView struct {
+	storage.BoardPost
+	Sender string
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	b, ok := s.board(r.URL.Query().Get("board"))
+	if !ok {
+		http.Error(w, "unknown board", http.StatusNotFound)
+		return
+	}
+	p := auth.FromContext(r.Context())
+	admin := p.Role.Allows(auth.Admin)
+	page, err := storage.PageFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	posts, err := s.store.BoardPosts(b.Channel, admin, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views := make([]postView, len(posts))
+	for i, bp := range posts {
+		views[i] = postView{BoardPost: bp, Sender: bp.Author}
+		if bp.From != "" {
+			views[i].Sender = fmt.Sprintf("%s (%s)", s.nodes.ResolveLong(bp.From), bp.From)
+		}
+	}
+	data := struct {
+		Boards  []board
+		Board   board
+		Posts   []postView
+		User    string
+		CanPost bool
+		Admin   bool
+		Error   string
+		Max     int
+	}{
+		Boards:  s.boards,
+		Board:   b,
+		Posts:   views,
+		User:    p.Name(),
+		CanPost: p.Role.Allows(auth.Operator),
+		Admin:   admin,
+		Error:   r.URL.Query().Get("error"),
+		Max:     maxPostText,
+	}
+	if err := s.tmpl.Execute(w, data); err != nil {
+		log.Printf("template execute: %v", err)
+	}
+}
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := struct{ Next, Failed string }{r.URL.Query().Get("next"), r.URL.Query().Get("failed")}
+	if err := s.login.Execute(w, data); err != nil {
+		log.Printf("template execute: %v", err)
+	}
+}
+
+// handlePost broadcasts the posted message on the channel of the board
+// and adds it to the board once the link accepted it. Delivery is not
+// confirmed: the command is published on MQTT, directly or by the
+// management server, so a post refused by the gateway, e.g. by its send
+// permissions, still appears on the board.
+func (s *server) handlePost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, ok := s.board(r.PostFormValue("board"))
+	if !ok {
+		http.Error(w, "unknown board", http.StatusNotFound)
+		return
+	}
+	back := "/?board=" + url.QueryEscape(b.Name)
+	text := strings.TrimSpace(r.PostFormValue("msg"))
+	switch {
+	case text == "":
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	case len(text) > maxPostText:
+		http.Redirect(w, r, back+"&error=message+too+long", http.StatusSeeOther)
+		return
+	}
+	if err := s.send(fmt.Sprintf("chan:%d:%s", b.Channel, text)); err != nil {
+		log.Printf("send post: %v", err)
+		http.Redirect(w, r, back+"&error=gateway+unavailable", http.StatusSeeOther)
+		return
+	}
+	p := &storage.BoardPost{Channel: b.Channel, Author: auth.FromContext(r.Context()).Name(), Text: text}
+	if _, err := s.store.AddBoardPost(p); err != nil {
+		log.Printf("store post: %v", err)
+	}
+	s.auth.Audit(r, "board_post", fmt.Sprintf("%s: %s", b.Name, text))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// handleModerate hides, shows or deletes a post.
+func (s *server) handleModerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	action := r.PostFormValue("action")
+	switch action {
+	case "hide", "show":
+		err = s.store.SetBoardPostHidden(id, action == "hide")
+	case "delete":
+		err = s.store.DeleteBoardPost(id)
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.auth.Audit(r, "board_"+action, strconv.FormatInt(id, 10))
+	http.Redirect(w, r, "/?board="+url.QueryEscape(r.PostFormValue("board")), http.StatusSeeOther)
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>{{.Board.Name}} - Message Board</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; }
+nav a { margin-right: 1em; }
+nav a.current { font-weight: bold; }
+li { margin: .5em 0; }
+li.hidden { opacity: .5; }
+.meta { color: #666; font-size: .85em; }
+.error { color: #b00; }
+li form { display: inline; }
+</style>
+</head>
+<body>
+<h1>Message Board</h1>
+<p class="meta">Signed in as {{.User}}</p>
+<nav>{{range .Boards}}<a href="/?board={{.Name}}"{{if eq .Name $.Board.Name}} class="current"{{end}}>{{.Name}} (ch {{.Channel}})</a>{{end}}</nav>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .CanPost}}
+<form method="POST" action="/post">
+<input type="hidden" name="board" value="{{.Board.Name}}">
+<input type="text" name="msg" maxlength="{{.Max}}" placeholder="Type a message">
+<button type="submit">Send</button>
+</form>
+{{end}}
+<ul>
+{{range .Posts}}<li{{if .Hidden}} class="hidden"{{end}}>
+<span class="meta">{{.CreatedAt.Format "2006-01-02 15:04"}} · {{.Sender}}</span><br>{{.Text}}
+{{if $.Admin}}
+<form method="POST" action="/moderate">
+<input type="hidden" name="board" value="{{$.Board.Name}}">
+<input type="hidden" name="id" value="{{.ID}}">
+{{if .Hidden}}<button name="action" value="show">Show</button>{{else}}<button name="action" value="hide">Hide</button>{{end}}
+<button name="action" value="delete">Delete</button>
+</form>
+{{end}}
+</li>{{end}}
+</ul>
+</body>
+</html>`
+
+const loginHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Sign in - Message Board</title>
+</head>
+<body>
+<h1>Message Board</h1>
+{{if .Failed}}<p>Invalid name or password.</p>{{end}}
+<form method="POST" action="/api/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="text" name="name" placeholder="Name">
+<input type="password" name="password" placeholder="Password">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>`
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"meshspy/auth"
+	"meshspy/events"
+	"meshspy/nodemap"
+	"meshspy/storage"
+)
+
+func TestNewBoards(t *testing.T) {
+	got := newBoards(map[string]uint32{"emergency": 1, "general": 0, "alpha": 1})
+	want := []board{{"general", 0}, {"alpha", 1}, {"emergency", 1}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("newBoards returned %v, want %v", got, want)
+	}
+}
+
+func TestBoard(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer store.Close()
+	tokens := make(map[auth.Role]string)
+	for _, role := range []auth.Role{auth.Viewer, auth.Operator, auth.Admin} {
+		u := &storage.User{Name: string(role), Role: string(role)}
+		if err := store.AddUser(u); err != nil {
+			t.Fatalf("AddUser returned error: %v", err)
+		}
+		token, err := auth.NewToken()
+		if err != nil {
+			t.Fatalf("NewToken returned error: %v", err)
+		}
+		if err := store.AddAPIToken(&storage.APIToken{Name: "test", UserID: u.ID, TokenHash: auth.HashToken(token)}); err != nil {
+			t.Fatalf("AddAPIToken returned error: %v", err)
+		}
+		tokens[role] = token
+	}
+	nodes := nodemap.New()
+	nodes.Update(0xa, "Monte Serra", "MS")
+	var sent []string
+	s := newServer(store, auth.New(store, auth.Options{}), nodes, []board{{"general", 0}, {"team", 1}}, func(cmd string) error {
+		sent = append(sent, cmd)
+		return nil
+	})
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	// Broadcasts on the channel of a board are posted, direct messages
+	// and other channels are not
+	s.receive(events.New(events.TextMessage, "0xa", map[string]any{"text": "ciao team", "to": storage.BroadcastID, "channel": 1}))
+	s.receive(events.New(events.TextMessage, "0xa", map[string]any{"text": "private", "to": "0x1", "channel": 1}))
+	s.receive(events.New(events.TextMessage, "0xa", map[string]any{"text": "elsewhere", "to": storage.BroadcastID, "channel": 3}))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(role auth.Role, method, path string, form url.Values) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest returned error: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+tokens[role])
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s returned error: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := do(auth.Viewer, http.MethodGet, "/?board=team", nil)
+	if code != http.StatusOK || !strings.Contains(body, "Monte Serra (0xa)") || !strings.Contains(body, "ciao team") ||
+		strings.Contains(body, "private") || strings.Contains(body, "elsewhere") || strings.Contains(body, `action="/post"`) {
+		t.Fatalf("viewer page returned %d %s", code, body)
+	}
+
+	// Posting needs an operator and goes to the channel of the board
+	post := url.Values{"board": {"team"}, "msg": {" all good "}}
+	if code, _ := do(auth.Viewer, http.MethodPost, "/post", post); code != http.StatusForbidden {
+		t.Fatalf("viewer post returned %d", code)
+	}
+	if code, _ := do(auth.Operator, http.MethodPost, "/post", post); code != http.StatusSeeOther || len(sent) != 1 || sent[0] != "chan:1:all good" {
+		t.Fatalf("operator post returned %d, sent %q", code, sent)
+	}
+	long := url.Values{"board": {"team"}, "msg": {strings.Repeat("x", maxPostText+1)}}
+	if code, _ := do(auth.Operator, http.MethodPost, "/post", long); code != http.StatusSeeOther || len(sent) != 1 {
+		t.Fatalf("long post returned %d, sent %q", code, sent)
+	}
+	posts, err := store.BoardPosts(1, false, storage.Page{})
+	if err != nil || len(posts) != 2 || posts[0].Author != string(auth.Operator) || posts[0].Text != "all good" {
+		t.Fatalf("BoardPosts returned %+v, %v", posts, err)
+	}
+
+	// Moderation is reserved to admins; hidden posts are only shown to them
+	hide := url.Values{"board": {"team"}, "id": {fmt.Sprint(posts[1].ID)}, "action": {"hide"}}
+	if code, _ := do(auth.Operator, http.MethodPost, "/moderate", hide); code != http.StatusForbidden {
+		t.Fatalf("operator moderation returned %d", code)
+	}
+	if code, _ := do(auth.Admin, http.MethodPost, "/moderate", hide); code != http.StatusSeeOther {
+		t.Fatalf("admin moderation returned %d", code)
+	}
+	if _, body := do(auth.Viewer, http.MethodGet, "/?board=team", nil); strings.Contains(body, "ciao team") {
+		t.Fatalf("hidden post shown to a viewer")
+	}
+	if _, body := do(auth.Admin, http.MethodGet, "/?board=team", nil); !strings.Contains(body, "ciao team") || !strings.Contains(body, `value="show"`) {
+		t.Fatalf("hidden post not shown to the admin: %s", body)
+	}
+	del := url.Values{"board": {"team"}, "id": {fmt.Sprint(posts[1].ID)}, "action": {"delete"}}
+	if code, _ := do(auth.Admin, http.MethodPost, "/moderate", del); code != http.StatusSeeOther {
+		t.Fatalf("admin delete returned %d", code)
+	}
+	if posts, _ := store.BoardPosts(1, true, storage.Page{}); len(posts) != 1 {
+		t.Fatalf("post not deleted: %+v", posts)
+	}
+}
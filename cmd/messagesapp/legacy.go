@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+
+	"meshspy/storage"
+)
+
+// importLegacy moves the messages of the standalone board, kept in the
+// messages table of the SQLite database at path, to the board of channel.
+// The database is renamed with an .imported suffix afterwards so that the
+// messages are imported once. It returns the number of messages imported,
+// 0 when path does not exist.
+func importLegacy(store storage.Backend, path string, channel uint32) (int, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT text, created_at FROM messages ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	var posts []storage.BoardPost
+	for rows.Next() {
+		var (
+			text sql.NullString
+			at   sql.NullTime
+		)
+		if err := rows.Scan(&text, &at); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if text.String != "" {
+			posts = append(posts, storage.BoardPost{Channel: channel, Text: text.String, CreatedAt: at.Time})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for i := range posts {
+		if _, err := store.AddBoardPost(&posts[i]); err != nil {
+			return i, err
+		}
+	}
+	db.Close()
+	return len(posts), os.Rename(path, path+".imported")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"meshspy/storage"
+)
+
+func TestImportLegacy(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.Open(filepath.Join(dir, "nodes.db"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer store.Close()
+	path := filepath.Join(dir, "messages.db")
+	if n, err := importLegacy(store, path, 2); n != 0 || err != nil {
+		t.Fatalf("importLegacy without file returned %d, %v", n, err)
+	}
+
+	// The schema of the standalone board
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open legacy db: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE messages (id INTEGER PRIMARY KEY AUTOINCREMENT, text TEXT, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO messages(text, created_at) VALUES('first', '2024-03-01 10:00:00')`,
+		`INSERT INTO messages(text) VALUES('second')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("legacy %q: %v", stmt, err)
+		}
+	}
+	db.Close()
+
+	if n, err := importLegacy(store, path, 2); n != 2 || err != nil {
+		t.Fatalf("importLegacy returned %d, %v", n, err)
+	}
+	posts, err := store.BoardPosts(2, false, storage.Page{})
+	if err != nil || len(posts) != 2 || posts[1].Text != "first" || posts[1].CreatedAt.Year() != 2024 || posts[0].Text != "second" {
+		t.Fatalf("BoardPosts returned %+v, %v", posts, err)
+	}
+	if _, err := os.Stat(path + ".imported"); err != nil {
+		t.Fatalf("legacy db not renamed: %v", err)
+	}
+	if n, err := importLegacy(store, path, 2); n != 0 || err != nil {
+		t.Fatalf("second importLegacy returned %d, %v", n, err)
+	}
+}
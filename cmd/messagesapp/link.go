@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"meshspy/config"
+	"meshspy/events"
+	"meshspy/mgmtapi"
+	"meshspy/nodemap"
+	"meshspy/state"
+)
+
+// link carries the board to the mesh through a gateway.
+type link interface {
+	// send runs a gateway command, e.g. "chan:1:ciao".
+	send(cmd string) error
+	// run passes the text messages received by the gateway to handle and
+	// keeps nodes up to date until ctx is done.
+	run(ctx context.Context, nodes *nodemap.Map, handle func(events.Event))
+}
+
+// mqttLink talks to the gateway over its MQTT topics: commands are
+// published on the command topic and the events are read under the state
+// prefix together with the retained index of the node names.
+type mqttLink struct {
+	client mqtt.Client
+	cfg    config.Config
+}
+
+// send publishes cmd; the gateway does not acknowledge it, so a nil error
+// only means the broker took it.
+func (l *mqttLink) send(cmd string) error {
+	t := l.client.Publish(l.cfg.CommandTopic, 1, false, cmd)
+	if !t.WaitTimeout(3 * time.Second) {
+		return fmt.Errorf("mqtt publish timeout")
+	}
+	return t.Error()
+}
+
+func (l *mqttLink) run(ctx context.Context, nodes *nodemap.Map, handle func(events.Event)) {
+	subs := map[string]mqtt.MessageHandler{
+		l.cfg.StatePrefix + "/events/" + events.TextMessage: func(_ mqtt.Client, m mqtt.Message) {
+			var e events.Event
+			if err := json.Unmarshal(m.Payload(), &e); err != nil {
+				log.Printf("invalid event on %s: %v", m.Topic(), err)
+				return
+			}
+			handle(e)
+		},
+		l.cfg.StatePrefix + "/nodes/index": func(_ mqtt.Client, m mqtt.Message) {
+			var index []state.IndexEntry
+			if err := json.Unmarshal(m.Payload(), &index); err != nil {
+				log.Printf("invalid node index: %v", err)
+				return
+			}
+			for _, e := range index {
+				if num, ok := nodemap.ParseID(e.ID); ok {
+					nodes.Update(num, e.LongName, e.ShortName)
+				}
+			}
+		},
+	}
+	for topic, h := range subs {
+		token := l.client.Subscribe(topic, 1, h)
+		token.Wait()
+		if token.Error() != nil {
+			log.Fatalf("MQTT subscribe error: %v", token.Error())
+		}
+		log.Printf("✅ subscribed to %s", topic)
+	}
+	<-ctx.Done()
+}
+
+// mgmtLink goes through the management server: commands are sent with its
+// API, which publishes them to the gateways, and the events are followed on
+// its stream, resuming after the last one received.
+type mgmtLink struct {
+	client *mgmtapi.Client
+}
+
+// mgmtRetry is the pause before reconnecting to the event stream; the node
+// names are refreshed at every reconnection and every mgmtRefresh.
+const (
+	mgmtRetry   = 5 * time.Second
+	mgmtRefresh = 10 * time.Minute
+)
+
+func (l *mgmtLink) send(cmd string) error {
+	return l.client.SendCommand(cmd)
+}
+
+func (l *mgmtLink) run(ctx context.Context, nodes *nodemap.Map, handle func(events.Event)) {
+	refresh := func() {
+		list, err := l.client.ListNodes()
+		if err != nil {
+			log.Printf("list nodes: %v", err)
+			return
+		}
+		for _, n := range list {
+			nodes.UpdateInfo(n)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(mgmtRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+
+	var last int64
+	for {
+		refresh()
+		err := l.client.StreamEvents(ctx, []string{events.TextMessage}, last, func(e events.Event) {
+			last = e.ID
+			handle(e)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("event stream: %v, retrying in %v", err, mgmtRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mgmtRetry):
+		}
+	}
+}
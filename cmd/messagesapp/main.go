@@ -1,82 +1,106 @@
 package main
 
 import (
-	"html/template"
+	"context"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 
+	"meshspy/auth"
+	mqttpkg "meshspy/client"
+	"meshspy/config"
+	"meshspy/mgmtapi"
+	"meshspy/nodemap"
 	"meshspy/storage"
-)
-
-type server struct {
-	mu    sync.Mutex
-	store *storage.Store
-	tmpl  *template.Template
-}
 
-func newServer(store *storage.Store) *server {
-	tmpl := template.Must(template.New("index").Parse(indexHTML))
-	return &server{tmpl: tmpl, store: store}
-}
+	"github.com/joho/godotenv"
+)
 
-func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		if err := r.ParseForm(); err == nil {
-			msg := r.Form.Get("msg")
-			if msg != "" {
-				if err := s.store.Add(msg); err != nil {
-					log.Printf("store add: %v", err)
-				}
-			}
-		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+func main() {
+	// Load environment variables from .env.runtime if present
+	if err := godotenv.Load(".env.runtime"); err != nil {
+		log.Printf("⚠️  Nessun file .env.runtime trovato o errore di caricamento: %v", err)
 	}
 
-	msgs, err := s.store.List()
-	if err != nil {
-		log.Printf("store list: %v", err)
-	}
-	data := struct{ Messages []string }{Messages: msgs}
-	if err := s.tmpl.Execute(w, data); err != nil {
-		log.Printf("template execute: %v", err)
+	cfg := config.Load()
+	boards := newBoards(cfg.Boards)
+	if len(boards) == 0 {
+		log.Fatalf("no boards configured in MESSAGE_BOARDS")
 	}
-}
-
-const indexHTML = `<!DOCTYPE html>
-<html lang="en">
-<head>
-<meta charset="UTF-8">
-<title>Message Board</title>
-</head>
-<body>
-<h1>Message Board</h1>
-<form method="POST" action="/">
-<input type="text" name="msg" placeholder="Type a message">
-<button type="submit">Send</button>
-</form>
-<ul>
-{{range .Messages}}<li>{{.}}</li>{{end}}
-</ul>
-</body>
-</html>`
 
-func main() {
-	dbPath := os.Getenv("MSG_DB_PATH")
+	// The posts and the accounts live in the node database, which also
+	// names the nodes when shared with the gateway
+	dbPath := os.Getenv("NODE_DB_PATH")
 	if dbPath == "" {
-		dbPath = "messages.db"
+		dbPath = "nodes.db"
 	}
-	store, err := storage.New(dbPath)
+	store, err := storage.Open(dbPath)
 	if err != nil {
 		log.Fatalf("open db: %v", err)
 	}
 	defer store.Close()
+	// Expire old audit rows in the background
+	go store.RunRetention(context.Background(), storage.Retention{
+		Audit:    cfg.AuditRetention,
+		Interval: cfg.CompactInterval,
+	})
+	// The messages of the former standalone board go to the first board
+	legacyPath := os.Getenv("MSG_DB_PATH")
+	if legacyPath == "" {
+		legacyPath = "messages.db"
+	}
+	if n, err := importLegacy(store, legacyPath, boards[0].Channel); err != nil {
+		log.Printf("import %s: %v", legacyPath, err)
+	} else if n > 0 {
+		log.Printf("📥 %d messaggi importati da %s sulla board %s", n, legacyPath, boards[0].Name)
+	}
+	nodes := nodemap.New()
+	if err := nodes.Load(store); err != nil {
+		log.Printf("load node names: %v", err)
+	}
 
-	srv := newServer(store)
-	http.HandleFunc("/", srv.handleIndex)
-	log.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	a := auth.New(store, auth.Options{SessionTTL: cfg.SessionTTL})
+	if generated, err := a.Bootstrap(cfg.AdminUser, cfg.AdminPassword); err != nil {
+		log.Fatalf("admin bootstrap error: %v", err)
+	} else if generated != "" {
+		log.Printf("🔑 creato l'utente %s con password %s", cfg.AdminUser, generated)
+	}
+
+	// The gateway is reached through the management server when a token
+	// is given, directly over MQTT otherwise
+	var l link
+	if cfg.MgmtURL != "" && cfg.MgmtAPIToken != "" {
+		l = &mgmtLink{client: mgmtapi.New(cfg.MgmtURL).WithToken(cfg.MgmtAPIToken)}
+		log.Printf("✅ gateway reached through %s", cfg.MgmtURL)
+	} else {
+		// A client ID of its own keeps the board from taking over the
+		// session of the gateway
+		cfg.ClientID += "-board"
+		client, err := mqttpkg.ConnectMQTT(cfg)
+		if err != nil {
+			log.Fatalf("MQTT connect error: %v", err)
+		}
+		defer client.Disconnect(250)
+		l = &mqttLink{client: client, cfg: cfg}
+	}
+
+	srv := newServer(store, a, nodes, boards, l.send)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go l.run(ctx, nodes, srv.receive)
+
+	for _, b := range boards {
+		log.Printf("📋 board %s on channel %d", b.Name, b.Channel)
+	}
+	httpSrv := &http.Server{Addr: cfg.BoardAddr, Handler: srv.routes()}
+	go func() {
+		<-ctx.Done()
+		httpSrv.Close()
+	}()
+	log.Printf("Server running on %s", cfg.BoardAddr)
+	if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
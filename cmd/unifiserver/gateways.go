@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"meshspy/auth"
+	"meshspy/mgmtapi"
+	"meshspy/rules"
+	"meshspy/storage"
+)
+
+// heartbeatInterval is the period asked to the gateways; a gateway missing
+// three heartbeats in a row is reported offline.
+const heartbeatInterval = 30 * time.Second
+
+// gatewayView is a gateway as listed to operators.
+type gatewayView struct {
+	storage.Gateway
+	Online bool `json:"online"`
+}
+
+// gateways lists the gateways, or forgets the one named by the id
+// parameter on DELETE.
+func (s *apiServer) gateways(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.store.Gateways()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out := make([]gatewayView, 0, len(list))
+		for _, g := range list {
+			out = append(out, gatewayView{Gateway: g, Online: online(&g, time.Now())})
+		}
+		writeJSON(w, out)
+	case http.MethodDelete:
+		g, ok := s.lookupGateway(w, r)
+		if !ok {
+			return
+		}
+		if err := s.store.DeleteGateway(g.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.gwMu.Lock()
+		delete(s.gwOnline, g.ID)
+		s.gwMu.Unlock()
+		s.auth.Audit(r, "gateway_forget", g.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// register records the announcement of a gateway. Unknown gateways are kept
+// pending with the key of their first announcement, which later ones must
+// carry; once adopted, the first announcement carrying the key collects the
+// credential, which later announcements must present.
+func (s *apiServer) register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var a mgmtapi.Announcement
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpload)).Decode(&a); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	a.ID = strings.TrimSpace(a.ID)
+	if a.ID == "" {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return
+	}
+
+	reg := mgmtapi.Registration{Status: mgmtapi.StatusPending, Heartbeat: int(heartbeatInterval.Seconds())}
+	var g *storage.Gateway
+	if token, ok := bearer(r); ok {
+		found, err := s.store.GatewayByToken(auth.HashToken(token))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if found == nil || found.ID != a.ID {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		g, reg.Status = found, mgmtapi.StatusAdopted
+	} else {
+		if a.Key == "" {
+			http.Error(w, "key required", http.StatusBadRequest)
+			return
+		}
+		found, err := s.store.Gateway(a.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case found == nil:
+			g = &storage.Gateway{ID: a.ID, KeyHash: auth.HashToken(a.Key)}
+		case !found.Adopted:
+			// The key of the first announcement holds until adoption: a
+			// gateway announcing another key must be deleted first
+			if subtle.ConstantTimeCompare([]byte(found.KeyHash), []byte(auth.HashToken(a.Key))) != 1 {
+				http.Error(w, "gateway pending with another key", http.StatusConflict)
+				return
+			}
+			g = found
+		case found.TokenHash != "":
+			http.Error(w, "credential required", http.StatusUnauthorized)
+			return
+		case subtle.ConstantTimeCompare([]byte(found.KeyHash), []byte(auth.HashToken(a.Key))) != 1:
+			http.Error(w, "key mismatch", http.StatusForbidden)
+			return
+		default:
+			token, err := auth.NewToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			g = found
+			g.TokenHash = auth.HashToken(token)
+			reg.Status, reg.Token = mgmtapi.StatusAdopted, token
+		}
+	}
+
+	g.Name, g.Version, g.Radio, g.Firmware, g.ConfigHash = a.Name, a.Version, a.Radio, a.Firmware, a.ConfigHash
+	g.Addr, g.LastSeen = remoteHost(r), time.Now()
+	if err := s.store.SaveGateway(g); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reg.Status == mgmtapi.StatusAdopted {
+		s.gatewaySeen(g)
+	}
+	writeJSON(w, reg)
+}
+
+// heartbeat records that the authenticated gateway is alive.
+func (s *apiServer) heartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	g, ok := s.authGateway(w, r)
+	if !ok {
+		return
+	}
+	var h mgmtapi.Heartbeat
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpload)).Decode(&h); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	var err error
+	if h.ConfigHash != "" && h.ConfigHash != g.ConfigHash {
+		g.ConfigHash, g.LastSeen, g.LastError = h.ConfigHash, now, h.Error
+		err = s.store.SaveGateway(g)
+	} else {
+		err = s.store.GatewayHeartbeat(g.ID, now, h.Error)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	g.LastSeen, g.LastError = now, h.Error
+	s.gatewaySeen(g)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// settings serves the settings of the authenticated gateway on GET, and
+// replaces those of the gateway named by the id parameter on PUT.
+func (s *apiServer) settings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		g, ok := s.authGateway(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, g.Settings)
+	case http.MethodPut:
+		g, ok := s.lookupGateway(w, r)
+		if !ok {
+			return
+		}
+		var set storage.GatewaySettings
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpload)).Decode(&set); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if set.Rules != "" {
+			if _, err := rules.Parse([]byte(set.Rules)); err != nil {
+				http.Error(w, "invalid rules: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		g.Settings = set
+		if err := s.store.SaveGateway(g); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.auth.Audit(r, "gateway_settings", g.ID)
+		writeJSON(w, g.Settings)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adopt accepts the pending gateway named by the id parameter. The gateway
+// collects its credential with its next announcement.
+func (s *apiServer) adopt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	g, ok := s.lookupGateway(w, r)
+	if !ok {
+		return
+	}
+	if !g.Adopted {
+		now := time.Now()
+		g.Adopted, g.AdoptedAt = true, &now
+		if err := s.store.SaveGateway(g); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.auth.Audit(r, "gateway_adopt", g.ID)
+	}
+	writeJSON(w, gatewayView{Gateway: *g, Online: online(g, time.Now())})
+}
+
+// lookupGateway returns the gateway named by the id parameter, answering
+// 404 when unknown.
+func (s *apiServer) lookupGateway(w http.ResponseWriter, r *http.Request) (*storage.Gateway, bool) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return nil, false
+	}
+	g, err := s.store.Gateway(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if g == nil {
+		http.Error(w, "unknown gateway "+id, http.StatusNotFound)
+		return nil, false
+	}
+	return g, true
+}
+
+// authGateway returns the gateway owning the bearer token of r, answering
+// 401 when there is none.
+func (s *apiServer) authGateway(w http.ResponseWriter, r *http.Request) (*storage.Gateway, bool) {
+	token, ok := bearer(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	g, err := s.store.GatewayByToken(auth.HashToken(token))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if g == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return g, true
+}
+
+// online reports whether g sent a heartbeat recently.
+func online(g *storage.Gateway, now time.Time) bool {
+	return g.Adopted && now.Sub(g.LastSeen) < 3*heartbeatInterval
+}
+
+func bearer(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"meshspy/events"
+	"meshspy/influx"
+	"meshspy/nodemap"
+	latestpb "meshspy/proto/latest/meshtastic"
+	"meshspy/storage"
+)
+
+// maxUpload caps the size of the bodies uploaded by the gateways.
+const maxUpload = 1 << 20
+
+// maxAlertLength is the longest alert text accepted, the size of a mesh
+// packet payload.
+const maxAlertLength = 233
+
+// uploadNode returns the node an upload is about, from the node query
+// parameter. It is optional unless required is set.
+func uploadNode(r *http.Request, required bool) (string, error) {
+	v := r.URL.Query().Get("node")
+	if v == "" {
+		if required {
+			return "", fmt.Errorf("node required")
+		}
+		return "", nil
+	}
+	num, ok := nodemap.ParseID(v)
+	if !ok {
+		return "", fmt.Errorf("invalid node %q", v)
+	}
+	return nodemap.FormatID(num), nil
+}
+
+// readProto decodes the protojson body of r into m.
+func readProto(w http.ResponseWriter, r *http.Request, m proto.Message) error {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpload))
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(b, m)
+}
+
+// telemetry stores a Telemetry message uploaded for the node given by the
+// node query parameter, or lists the stored telemetry of that node.
+func (s *apiServer) telemetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.listTelemetry(w, r)
+		return
+	}
+	node, err := uploadNode(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var tm latestpb.Telemetry
+	if err := readProto(w, r, &tm); err != nil {
+		http.Error(w, "invalid telemetry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tm.GetVariant() == nil {
+		http.Error(w, "telemetry without metrics", http.StatusBadRequest)
+		return
+	}
+	if err := s.store.AddNodeTelemetry(node, &tm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p, ok := influx.TelemetryPoint(node, "", &tm, time.Now()); ok {
+		p.Fields["variant"] = p.Measurement
+		if err := s.publish(r, events.New(events.Telemetry, node, p.Fields)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) listTelemetry(w http.ResponseWriter, r *http.Request) {
+	node, err := uploadNode(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := storage.PageFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := s.store.Telemetry(node, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// waypoints stores an uploaded Waypoint, created by the node given by the
+// node query parameter if any, or lists the active waypoints. With
+// expired=1 the expired and deleted ones are listed instead.
+func (s *apiServer) waypoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		list, err := s.store.ActiveWaypoints(time.Now())
+		if r.URL.Query().Get("expired") == "1" {
+			list, err = s.store.ExpiredWaypoints(time.Now())
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+		return
+	}
+	node, err := uploadNode(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var wp latestpb.Waypoint
+	if err := readProto(w, r, &wp); err != nil {
+		http.Error(w, "invalid waypoint: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validWaypoint(&wp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, _ := nodemap.ParseID(node)
+	if err := s.store.SaveWaypoint(storage.WaypointFromProto(from, &wp)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validWaypoint(wp *latestpb.Waypoint) error {
+	if wp.GetId() == 0 {
+		return fmt.Errorf("waypoint id required")
+	}
+	lat, lon := float64(wp.GetLatitudeI())/1e7, float64(wp.GetLongitudeI())/1e7
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return fmt.Errorf("invalid coordinates %f,%f", lat, lon)
+	}
+	return nil
+}
+
+// admin stores an uploaded admin payload as an admin event, or lists them.
+func (s *apiServer) admin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.listEvents(w, r, events.Admin)
+		return
+	}
+	var req struct {
+		Payload string `json:"payload"`
+	}
+	node, err := s.decodeUpload(w, r, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(req.Payload)
+	if err != nil || len(b) == 0 {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	// The AdminMessage schema is not compiled in; check the wire format.
+	if err := proto.Unmarshal(b, &emptypb.Empty{}); err != nil {
+		http.Error(w, "invalid admin message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.addEvent(w, r, events.New(events.Admin, node, req))
+}
+
+// alerts stores an uploaded alert as an alert event, or lists them.
+func (s *apiServer) alerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.listEvents(w, r, events.Alert)
+		return
+	}
+	var req struct {
+		Text string `json:"text"`
+	}
+	node, err := s.decodeUpload(w, r, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || len(req.Text) > maxAlertLength {
+		http.Error(w, fmt.Sprintf("text must be 1 to %d bytes", maxAlertLength), http.StatusBadRequest)
+		return
+	}
+	s.addEvent(w, r, events.New(events.Alert, node, req))
+}
+
+// decodeUpload decodes the JSON body of r into v and returns the optional
+// node of the upload.
+func (s *apiServer) decodeUpload(w http.ResponseWriter, r *http.Request, v any) (string, error) {
+	node, err := uploadNode(r, false)
+	if err != nil {
+		return "", err
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpload)).Decode(v); err != nil {
+		return "", fmt.Errorf("invalid json")
+	}
+	return node, nil
+}
+
+func (s *apiServer) addEvent(w http.ResponseWriter, r *http.Request, e events.Event) {
+	if err := s.publish(r, e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listEvents returns the stored events of type typ, optionally about the
+// node query parameter, newest first.
+func (s *apiServer) listEvents(w http.ResponseWriter, r *http.Request, typ string) {
+	node, err := uploadNode(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := storage.PageFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := s.store.Events(storage.EventFilter{Types: []string{typ}, NodeID: node}, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
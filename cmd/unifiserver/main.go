@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"sync"
 
+	"meshspy/auth"
 	mqttpkg "meshspy/client"
 	"meshspy/config"
+	"meshspy/events"
+	"meshspy/export"
 	"meshspy/storage"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -18,17 +23,36 @@ import (
 type apiServer struct {
 	mqtt  mqtt.Client
 	cfg   config.Config
-	store *storage.NodeStore
+	store storage.Backend
+	auth  *auth.Authenticator
+	// bus stores the ingested events and fans them out to /api/events.
+	bus *events.Bus
+
+	gwMu     sync.Mutex
+	gwOnline map[string]bool
 }
 
-func newServer(m mqtt.Client, cfg config.Config, store *storage.NodeStore) *apiServer {
-	return &apiServer{mqtt: m, cfg: cfg, store: store}
+func newServer(m mqtt.Client, cfg config.Config, store storage.Backend) *apiServer {
+	return &apiServer{
+		mqtt:     m,
+		cfg:      cfg,
+		store:    store,
+		auth:     auth.New(store, auth.Options{SessionTTL: cfg.SessionTTL, Gateways: true}),
+		bus:      events.NewBus(store.AddEvent),
+		gwOnline: make(map[string]bool),
+	}
 }
 
-// listPositions returns stored node positions as JSON.
+// listPositions returns stored node positions as JSON, newest first. The
+// before, limit, since and until query parameters select the page.
 func (s *apiServer) listPositions(w http.ResponseWriter, r *http.Request) {
 	nodeID := r.URL.Query().Get("node")
-	pos, err := s.store.Positions(nodeID)
+	page, err := storage.PageFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pos, err := s.store.Positions(nodeID, page)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -63,6 +87,10 @@ func (s *apiServer) upsertNode(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := s.publish(r, events.New(events.NodeInfo, info.ID, &info)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -79,15 +107,65 @@ func (s *apiServer) sendCommand(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
+	if s.mqtt == nil {
+		http.Error(w, "mqtt not connected", http.StatusServiceUnavailable)
+		return
+	}
 	token := s.mqtt.Publish(s.cfg.CommandTopic, 0, false, req.Cmd)
 	token.Wait()
 	if token.Error() != nil {
 		http.Error(w, token.Error().Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auth.Audit(r, "send", req.Cmd)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// routes returns the handler serving the API. Reads require a viewer,
+// uploads a gateway or an operator, sending an operator and the gateway
+// administration an admin; gateways authenticate the registration
+// endpoints themselves.
+func (s *apiServer) routes() http.Handler {
+	a := s.auth
+	mux := http.NewServeMux()
+	a.Mount(mux)
+	mux.Handle("/api/nodes", readWrite(a.Require(auth.Viewer, http.HandlerFunc(s.listNodes)),
+		a.Gateway(http.HandlerFunc(s.upsertNode))))
+	mux.Handle("/api/positions", a.Require(auth.Viewer, http.HandlerFunc(s.listPositions)))
+	for path, h := range map[string]http.HandlerFunc{
+		"/api/telemetry": s.telemetry,
+		"/api/waypoints": s.waypoints,
+		"/api/admin":     s.admin,
+		"/api/alerts":    s.alerts,
+	} {
+		mux.Handle(path, readWrite(a.Require(auth.Viewer, h), a.Gateway(h)))
+	}
+	mux.Handle("/api/events", readWrite(a.Require(auth.Viewer, http.HandlerFunc(s.streamEvents)),
+		a.Gateway(http.HandlerFunc(s.uploadEvent))))
+	mux.Handle("/api/send", a.Require(auth.Operator, http.HandlerFunc(s.sendCommand)))
+	mux.Handle("/api/gateways", readWrite(a.Require(auth.Viewer, http.HandlerFunc(s.gateways)),
+		a.Require(auth.Admin, http.HandlerFunc(s.gateways))))
+	mux.HandleFunc("/api/gateways/register", s.register)
+	mux.Handle("/api/gateways/adopt", a.Require(auth.Admin, http.HandlerFunc(s.adopt)))
+	mux.HandleFunc("/api/gateways/heartbeat", s.heartbeat)
+	mux.Handle("/api/gateways/settings", readWrite(http.HandlerFunc(s.settings),
+		a.Require(auth.Admin, http.HandlerFunc(s.settings))))
+	mux.Handle("/api/export", a.Require(auth.Viewer, export.Handler(s.store)))
+	return mux
+}
+
+// readWrite serves GET and HEAD requests with read and the others with
+// write.
+func readWrite(read, write http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read.ServeHTTP(w, r)
+			return
+		}
+		write.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 	if err := godotenv.Load(".env.runtime"); err != nil {
 		log.Printf("⚠️  .env.runtime not loaded: %v", err)
@@ -104,28 +182,35 @@ func main() {
 	if dbPath == "" {
 		dbPath = "nodes.db"
 	}
-	store, err := storage.NewNodeStore(dbPath)
+	store, err := storage.Open(dbPath)
 	if err != nil {
 		log.Fatalf("node store open error: %v", err)
 	}
 	defer store.Close()
+	// The data ingested from the gateways is compacted and expires like
+	// on the gateways, and so does the audit trail
+	go store.RunRetention(context.Background(), storage.Retention{
+		Positions:   storage.RetentionPolicy{Raw: cfg.PositionsRaw, Hourly: cfg.PositionsHourly, Daily: cfg.PositionsDaily},
+		Telemetry:   storage.RetentionPolicy{Raw: cfg.TelemetryRaw, Hourly: cfg.TelemetryHourly, Daily: cfg.TelemetryDaily},
+		Events:      cfg.EventsRetention,
+		Audit:       cfg.AuditRetention,
+		Interval:    cfg.CompactInterval,
+		VacuumEvery: cfg.VacuumInterval,
+	})
 
 	srv := newServer(client, cfg, store)
+	if pw, err := srv.auth.Bootstrap(cfg.AdminUser, cfg.AdminPassword); err != nil {
+		log.Fatalf("admin account: %v", err)
+	} else if pw != "" {
+		log.Printf("🔑 created admin account %q with password %s", cfg.AdminUser, pw)
+	}
 
-	http.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			srv.upsertNode(w, r)
-			return
-		}
-		srv.listNodes(w, r)
-	})
-	http.HandleFunc("/api/positions", srv.listPositions)
-	http.HandleFunc("/api/send", srv.sendCommand)
+	go srv.watchGateways(context.Background())
 
 	port := os.Getenv("SERVER_PORT")
 	if port == "" {
 		port = "8081"
 	}
 	log.Printf("🌐 Management server listening on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, srv.routes()))
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"meshspy/auth"
+	mqttpkg "meshspy/client"
+	"meshspy/config"
+	"meshspy/events"
+	"meshspy/mgmtapi"
+	latestpb "meshspy/proto/latest/meshtastic"
+	"meshspy/storage"
+)
+
+// newTestServer returns a server backed by a temporary SQLite store, with
+// an API token for a user of each role.
+func newTestServer(t *testing.T) (*httptest.Server, map[auth.Role]string) {
+	t.Helper()
+	store, err := storage.NewNodeStore(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tokens := make(map[auth.Role]string)
+	for _, role := range []auth.Role{auth.Viewer, auth.Operator, auth.Admin} {
+		u := storage.User{Name: string(role), PasswordHash: "-", Role: string(role)}
+		if err := store.AddUser(&u); err != nil {
+			t.Fatalf("add user: %v", err)
+		}
+		tokens[role] = string(role) + "-token"
+		if err := store.AddAPIToken(&storage.APIToken{UserID: u.ID, TokenHash: auth.HashToken(tokens[role])}); err != nil {
+			t.Fatalf("add token: %v", err)
+		}
+	}
+	ts := httptest.NewServer(newServer(nil, config.Config{}, store).routes())
+	t.Cleanup(ts.Close)
+	return ts, tokens
+}
+
+// TestClientAgainstServer runs mgmtapi.Client against the server handlers
+// backed by a temporary SQLite store.
+func TestClientAgainstServer(t *testing.T) {
+	ts, tokens := newTestServer(t)
+	c := mgmtapi.New(ts.URL).WithToken(tokens[auth.Operator])
+	node := c.WithNode("!00001a2b")
+
+	if _, err := mgmtapi.New(ts.URL).ListNodes(); !isStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("nodes listed without credential: %v", err)
+	}
+	if err := mgmtapi.New(ts.URL).WithToken(tokens[auth.Viewer]).SendAlert("x"); !isStatus(err, http.StatusForbidden) {
+		t.Fatalf("viewer uploaded an alert: %v", err)
+	}
+
+	if err := c.SendNode(&mqttpkg.NodeInfo{ID: "0x1a2b", Num: 0x1a2b, LongName: "Base"}); err != nil {
+		t.Fatalf("SendNode: %v", err)
+	}
+	if nodes, err := c.ListNodes(); err != nil || len(nodes) != 1 || nodes[0].LongName != "Base" {
+		t.Fatalf("ListNodes returned %+v, %v", nodes, err)
+	}
+
+	tel := &latestpb.Telemetry{Time: 1700000000, Variant: &latestpb.Telemetry_DeviceMetrics{
+		DeviceMetrics: &latestpb.DeviceMetrics{BatteryLevel: proto.Uint32(87)},
+	}}
+	if err := node.SendTelemetry(tel); err != nil {
+		t.Fatalf("SendTelemetry: %v", err)
+	}
+	if err := c.SendTelemetry(tel); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("telemetry without node accepted: %v", err)
+	}
+	if err := node.SendTelemetry(&latestpb.Telemetry{Time: 1}); err == nil {
+		t.Fatal("telemetry without metrics accepted")
+	}
+	if list, err := c.ListTelemetry("0x1a2b"); err != nil || len(list) != 1 || list[0].BatteryLevel != 87 {
+		t.Fatalf("ListTelemetry returned %+v, %v", list, err)
+	}
+
+	wp := &latestpb.Waypoint{Id: 9, Name: "Rifugio", LatitudeI: proto.Int32(436000000), LongitudeI: proto.Int32(104000000)}
+	if err := node.SendWaypoint(wp); err != nil {
+		t.Fatalf("SendWaypoint: %v", err)
+	}
+	if err := node.SendWaypoint(&latestpb.Waypoint{Name: "no id"}); err == nil {
+		t.Fatal("waypoint without id accepted")
+	}
+	if list, err := c.ListWaypoints(); err != nil || len(list) != 1 || list[0].Name != "Rifugio" || list[0].CreatedBy != "0x1a2b" {
+		t.Fatalf("ListWaypoints returned %+v, %v", list, err)
+	}
+
+	// field 1, varint 1: a well-formed protobuf message
+	if err := node.SendAdmin([]byte{0x08, 0x01}); err != nil {
+		t.Fatalf("SendAdmin: %v", err)
+	}
+	if err := node.SendAdmin([]byte{0x01, 0x02}); err == nil {
+		t.Fatal("malformed admin payload accepted")
+	}
+	if list, err := c.ListAdmin(""); err != nil || len(list) != 1 || list[0].NodeID != "0x1a2b" {
+		t.Fatalf("ListAdmin returned %+v, %v", list, err)
+	}
+
+	if err := node.SendAlert("batteria scarica"); err != nil {
+		t.Fatalf("SendAlert: %v", err)
+	}
+	if err := c.SendAlert(strings.Repeat("x", 300)); err == nil {
+		t.Fatal("oversized alert accepted")
+	}
+	list, err := c.ListAlerts("0x1a2b")
+	if err != nil || len(list) != 1 || !strings.Contains(string(list[0].Data), "batteria scarica") {
+		t.Fatalf("ListAlerts returned %+v, %v", list, err)
+	}
+}
+
+// TestGatewayAdoption walks a gateway through registration, adoption,
+// heartbeats and settings.
+func TestGatewayAdoption(t *testing.T) {
+	ts, tokens := newTestServer(t)
+	c := mgmtapi.New(ts.URL)
+	ann := mgmtapi.Announcement{ID: "gw-1", Version: "1.2.0", Radio: "TBEAM", Firmware: "2.5.6", Key: "secret"}
+
+	reg, err := c.Register(ann)
+	if err != nil || reg.Status != mgmtapi.StatusPending || reg.Token != "" || reg.Heartbeat != 30 {
+		t.Fatalf("Register returned %+v, %v", reg, err)
+	}
+	if _, err := c.PullSettings(); !isStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("settings served without credential: %v", err)
+	}
+	impostor := ann
+	impostor.Key = "other"
+	if _, err := c.Register(impostor); !isStatus(err, http.StatusConflict) {
+		t.Fatalf("pending gateway registered with another key: %v", err)
+	}
+
+	operator := func(method, path string, body string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+tokens[auth.Admin])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/gateways/adopt?id=gw-1", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens[auth.Operator])
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("operator adopted a gateway: %v %v", resp.Status, err)
+	}
+	if code := operator(http.MethodPost, "/api/gateways/adopt?id=gw-9", ""); code != http.StatusNotFound {
+		t.Fatalf("adopting unknown gateway answered %d", code)
+	}
+	if code := operator(http.MethodPost, "/api/gateways/adopt?id=gw-1", ""); code != http.StatusOK {
+		t.Fatalf("adopt answered %d", code)
+	}
+	if code := operator(http.MethodPut, "/api/gateways/settings?id=gw-1", `{"rules": "rules: ["}`); code != http.StatusBadRequest {
+		t.Fatalf("invalid rules answered %d", code)
+	}
+	if code := operator(http.MethodPut, "/api/gateways/settings?id=gw-1",
+		`{"mqtt_topic": "site/a", "send": {"channels": [1]}}`); code != http.StatusOK {
+		t.Fatalf("settings answered %d", code)
+	}
+
+	wrong := ann
+	wrong.Key = "guess"
+	if _, err := c.Register(wrong); !isStatus(err, http.StatusForbidden) {
+		t.Fatalf("credential collected with wrong key: %v", err)
+	}
+	reg, err = c.Register(ann)
+	if err != nil || reg.Status != mgmtapi.StatusAdopted || reg.Token == "" {
+		t.Fatalf("Register after adoption returned %+v, %v", reg, err)
+	}
+	if _, err := c.Register(ann); !isStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("credential issued twice: %v", err)
+	}
+
+	gw := c.WithToken(reg.Token)
+	if reg, err := gw.Register(ann); err != nil || reg.Status != mgmtapi.StatusAdopted || reg.Token != "" {
+		t.Fatalf("authenticated Register returned %+v, %v", reg, err)
+	}
+	set, err := gw.PullSettings()
+	if err != nil || set.MQTTTopic != "site/a" || set.Send.Allows(0) || !set.Send.Allows(1) {
+		t.Fatalf("PullSettings returned %+v, %v", set, err)
+	}
+	if err := gw.Heartbeat(mgmtapi.Heartbeat{Error: "serial disconnected", Nodes: 3}); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if err := gw.SendNode(&mqttpkg.NodeInfo{ID: "0x1", Num: 1}); err != nil {
+		t.Fatalf("gateway upload: %v", err)
+	}
+	if _, err := gw.ListNodes(); !isStatus(err, http.StatusForbidden) {
+		t.Fatalf("gateway read the node list: %v", err)
+	}
+	if err := gw.SendEvent(events.New(events.Alert, "!00000001", map[string]string{"text": "sos"})); err != nil {
+		t.Fatalf("SendEvent: %v", err)
+	}
+	if err := gw.SendEvent(events.New(events.GatewayOffline, "", nil)); !isStatus(err, http.StatusBadRequest) {
+		t.Fatalf("gateway forged a gateway event: %v", err)
+	}
+	alerts, err := mgmtapi.New(ts.URL).WithToken(tokens[auth.Viewer]).ListAlerts("0x1")
+	if err != nil || len(alerts) != 1 || alerts[0].Gateway != "gw-1" {
+		t.Fatalf("ListAlerts returned %+v, %v", alerts, err)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/api/gateways", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens[auth.Viewer])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("list gateways: %v", err)
+	}
+	defer resp.Body.Close()
+	var list []gatewayView
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode gateways: %v", err)
+	}
+	if len(list) != 1 || !list[0].Online || list[0].LastError != "serial disconnected" || list[0].Radio != "TBEAM" {
+		t.Fatalf("unexpected gateways %+v", list)
+	}
+
+	if code := operator(http.MethodDelete, "/api/gateways?id=gw-1", ""); code != http.StatusNoContent {
+		t.Fatalf("forget answered %d", code)
+	}
+	if err := gw.Heartbeat(mgmtapi.Heartbeat{}); !isStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("heartbeat accepted after forget: %v", err)
+	}
+}
+
+// TestEventStream follows /api/events as Server-Sent Events and over a
+// WebSocket, resuming after the last event received.
+func TestEventStream(t *testing.T) {
+	ts, tokens := newTestServer(t)
+	c := mgmtapi.New(ts.URL).WithToken(tokens[auth.Operator])
+	node := c.WithNode("0x1a2b")
+	if err := node.SendAlert("first"); err != nil {
+		t.Fatalf("SendAlert: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/events?type=alert&node=0x1a2b", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens[auth.Viewer])
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("event stream: %v %v", resp, err)
+	}
+	defer resp.Body.Close()
+	sse := bufio.NewReader(resp.Body)
+	next := func() events.Event {
+		t.Helper()
+		var e events.Event
+		for {
+			line, err := sse.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read stream: %v", err)
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatalf("decode event %q: %v", data, err)
+				}
+				return e
+			}
+		}
+	}
+	first := next()
+	if first.Type != events.Alert || !strings.Contains(string(first.Data), "first") {
+		t.Fatalf("unexpected replayed event %+v", first)
+	}
+
+	// Neither the alert of another node nor the text message pass the filter
+	if err := c.WithNode("0x1").SendAlert("other"); err != nil {
+		t.Fatalf("SendAlert: %v", err)
+	}
+	if err := c.SendEvent(events.New(events.TextMessage, "0x1a2b", map[string]string{"text": "ciao"})); err != nil {
+		t.Fatalf("SendEvent: %v", err)
+	}
+	if err := node.SendAlert("second"); err != nil {
+		t.Fatalf("SendAlert: %v", err)
+	}
+	if e := next(); !strings.Contains(string(e.Data), "second") || e.NodeID != "0x1a2b" {
+		t.Fatalf("unexpected live event %+v", e)
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/events?type=alert,text_message&last_event_id=" + strconv.FormatInt(first.ID, 10)
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + tokens[auth.Viewer]}})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var got []string
+	for i := 0; i < 3; i++ {
+		var e events.Event
+		if err := ws.ReadJSON(&e); err != nil {
+			t.Fatalf("read websocket: %v", err)
+		}
+		got = append(got, e.Type+" "+e.NodeID)
+	}
+	if want := "alert 0x1,text_message 0x1a2b,alert 0x1a2b"; strings.Join(got, ",") != want {
+		t.Fatalf("replayed %v, want %s", got, want)
+	}
+	if err := c.SendEvent(events.New(events.TextMessage, "0x1", nil)); err != nil {
+		t.Fatalf("SendEvent: %v", err)
+	}
+	var e events.Event
+	if err := ws.ReadJSON(&e); err != nil || e.Type != events.TextMessage || e.NodeID != "0x1" {
+		t.Fatalf("unexpected live event %+v, %v", e, err)
+	}
+}
+
+func isStatus(err error, code int) bool {
+	var se *mgmtapi.StatusError
+	return errors.As(err, &se) && se.Code == code
+}
+
+// TestPumpOutOfOrder checks that live events are only skipped when the
+// backlog already sent them, not when their ID is lower than the last one.
+func TestPumpOutOfOrder(t *testing.T) {
+	bus := events.NewBus(func(*events.Event) error { return nil })
+	sub := bus.Subscribe(10)
+	defer sub.Close()
+	backlog := []events.Event{{ID: 5, Type: events.Alert}}
+	for _, id := range []int64{5, 7, 6, 4} {
+		if _, err := bus.Publish(events.Event{ID: id, Type: events.Alert}); err != nil {
+			t.Fatalf("Publish returned error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []int64
+	send := func(e events.Event) error {
+		if got = append(got, e.ID); len(got) == 4 {
+			cancel()
+		}
+		return nil
+	}
+	err := pump(ctx, sub, storage.EventFilter{After: 4}, backlog, send, func() error { return nil })
+	if !errors.Is(err, context.Canceled) || len(got) != 4 || got[0] != 5 || got[1] != 7 || got[2] != 6 || got[3] != 4 {
+		t.Fatalf("pump sent %v, %v", got, err)
+	}
+}
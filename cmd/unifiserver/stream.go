@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"meshspy/auth"
+	"meshspy/events"
+	"meshspy/nodemap"
+	"meshspy/storage"
+)
+
+const (
+	// streamBuffer is the number of live events queued for a client; a
+	// client falling further behind is disconnected and resumes from the
+	// store.
+	streamBuffer = 256
+	// streamPing is the period of the keep-alives sent to idle clients.
+	streamPing = 15 * time.Second
+	// maxReplay caps the stored events sent to a resuming client, the
+	// newest being kept.
+	maxReplay  = 10000
+	replayPage = 1000
+)
+
+var errSlowClient = errors.New("client too slow, events dropped")
+
+var upgrader = websocket.Upgrader{}
+
+// publish stores e, attributed to the gateway authenticated on r if any,
+// and fans it out to the streaming clients.
+func (s *apiServer) publish(r *http.Request, e events.Event) error {
+	if p := auth.FromContext(r.Context()); p != nil {
+		e.Gateway = p.Gateway
+	}
+	_, err := s.bus.Publish(e)
+	return err
+}
+
+// uploadEvent publishes an event forwarded by a gateway from its own bus,
+// e.g. a received text message or a node going offline.
+func (s *apiServer) uploadEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var e events.Event
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpload)).Decode(&e); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	switch e.Type {
+	case "":
+		http.Error(w, "type required", http.StatusBadRequest)
+		return
+	case events.GatewayOnline, events.GatewayOffline:
+		http.Error(w, "reserved event type "+e.Type, http.StatusBadRequest)
+		return
+	}
+	if e.NodeID != "" {
+		num, ok := nodemap.ParseID(e.NodeID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid node %q", e.NodeID), http.StatusBadRequest)
+			return
+		}
+		e.NodeID = nodemap.FormatID(num)
+	}
+	e.ID = 0
+	if err := s.publish(r, e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamEvents sends the events matching the node, type (comma separated)
+// and gateway parameters as they are published, over a WebSocket when the
+// request asks for an upgrade and as Server-Sent Events otherwise. A
+// client passing the ID of the last event it received, in the
+// Last-Event-ID header or the last_event_id parameter, first receives the
+// stored events it missed.
+func (s *apiServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	node, err := uploadNode(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := storage.EventFilter{NodeID: node, Gateway: q.Get("gateway")}
+	for _, t := range strings.Split(q.Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.Types = append(f.Types, t)
+		}
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = q.Get("last_event_id")
+	}
+	resume := last != ""
+	if resume {
+		if f.After, err = strconv.ParseInt(last, 10, 64); err != nil || f.After < 0 {
+			http.Error(w, "invalid last event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before reading the store so that no event falls between
+	// the replay and the live events.
+	sub := s.bus.Subscribe(streamBuffer)
+	defer sub.Close()
+	var backlog []events.Event
+	if resume {
+		if backlog, err = s.replay(f); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		err = s.streamWebSocket(w, r, sub, f, backlog)
+	} else {
+		err = s.streamSSE(w, r, sub, f, backlog)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("event stream %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// streamSSE writes the events as Server-Sent Events.
+func (s *apiServer) streamSSE(w http.ResponseWriter, r *http.Request, sub *events.Subscription, f storage.EventFilter, backlog []events.Event) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(e events.Event) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	return pump(r.Context(), sub, f, backlog, send, ping)
+}
+
+// streamWebSocket writes the events as JSON text messages.
+func (s *apiServer) streamWebSocket(w http.ResponseWriter, r *http.Request, sub *events.Subscription, f storage.EventFilter, backlog []events.Event) error {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The reader only handles the control frames and notices the client
+	// going away.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e events.Event) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(e)
+	}
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+	}
+	err = pump(ctx, sub, f, backlog, send, ping)
+	if errors.Is(err, errSlowClient) {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(time.Second))
+	}
+	return err
+}
+
+// pump sends the backlog, then the live events of sub matching f, until
+// ctx is done or a send fails. Live events already sent with the backlog
+// are skipped by ID: concurrent publishers may deliver events out of order,
+// so a live event can have a lower ID than one already sent. It gives up
+// on clients losing events so they reconnect and resume from the store.
+func pump(ctx context.Context, sub *events.Subscription, f storage.EventFilter, backlog []events.Event, send func(events.Event) error, ping func() error) error {
+	sent := make(map[int64]bool, len(backlog))
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return err
+		}
+		sent[e.ID] = true
+	}
+	// The client cannot have received the live events yet, whatever their ID
+	live := f
+	live.After = 0
+	ticker := time.NewTicker(streamPing)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-sub.C():
+			if !ok {
+				return nil
+			}
+			if sub.Dropped() > 0 {
+				return errSlowClient
+			}
+			if sent[e.ID] {
+				delete(sent, e.ID)
+				continue
+			}
+			if !live.Match(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replay returns the stored events matching f, oldest first, at most
+// maxReplay of them.
+func (s *apiServer) replay(f storage.EventFilter) ([]events.Event, error) {
+	var out []events.Event
+	page := storage.Page{Limit: replayPage}
+	for len(out) < maxReplay {
+		list, err := s.store.Events(f, page)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, list...)
+		if len(list) < replayPage {
+			break
+		}
+		page.Before = list[len(list)-1].ID
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// gatewaySeen records that gateway g is alive, publishing gateway_online
+// when it was not.
+func (s *apiServer) gatewaySeen(g *storage.Gateway) {
+	s.gwMu.Lock()
+	was := s.gwOnline[g.ID]
+	s.gwOnline[g.ID] = true
+	s.gwMu.Unlock()
+	if !was {
+		s.gatewayEvent(events.GatewayOnline, g)
+	}
+}
+
+// watchGateways publishes gateway_offline for the gateways missing their
+// heartbeats until ctx is cancelled.
+func (s *apiServer) watchGateways(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		list, err := s.store.Gateways()
+		if err != nil {
+			log.Printf("gateway watch: %v", err)
+			continue
+		}
+		alive := make(map[string]bool, len(list))
+		now := time.Now()
+		for _, g := range list {
+			alive[g.ID] = online(&g, now)
+		}
+		s.gwMu.Lock()
+		var gone []string
+		for id, on := range s.gwOnline {
+			if on && !alive[id] {
+				s.gwOnline[id] = false
+				gone = append(gone, id)
+			}
+		}
+		s.gwMu.Unlock()
+		for _, id := range gone {
+			g := storage.Gateway{ID: id}
+			for _, found := range list {
+				if found.ID == id {
+					g = found
+				}
+			}
+			s.gatewayEvent(events.GatewayOffline, &g)
+		}
+	}
+}
+
+func (s *apiServer) gatewayEvent(typ string, g *storage.Gateway) {
+	e := events.New(typ, "", map[string]any{
+		"name":       g.Name,
+		"last_seen":  g.LastSeen,
+		"last_error": g.LastError,
+	})
+	e.Gateway = g.ID
+	if _, err := s.bus.Publish(e); err != nil {
+		log.Printf("gateway event %s: %v", g.ID, err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"go.bug.st/serial/enumerator"
 )
@@ -18,12 +20,95 @@ type Config struct {
 	MQTTBroker   string
 	MQTTTopic    string
 	CommandTopic string
+	StatePrefix  string
 	ClientID     string
 	User         string
 	Password     string
 	Debug        bool
 	SendAlive    bool
 	MgmtURL      string
+	// GatewayID names the gateway to the management server, the host
+	// name by default. MgmtTokenFile keeps the credential issued when the
+	// gateway is adopted.
+	GatewayID     string
+	MgmtTokenFile string
+	// AdminUser and AdminPassword name the admin account created when the
+	// web servers start without users; a random password is logged when
+	// AdminPassword is empty. SessionTTL is the lifetime of a login.
+	AdminUser     string
+	AdminPassword string
+	SessionTTL    time.Duration
+	// MetricsAddr is the listen address of the Prometheus /metrics
+	// endpoint; empty disables it.
+	MetricsAddr string
+	// APIAddr is the listen address of the local gateway HTTP API; empty
+	// disables it. APIToken is the bearer token it requires, without which
+	// the API is not started.
+	APIAddr  string
+	APIToken string
+
+	// MapTileURL is the tile template of the web map and MapAttribution
+	// its credit. When MapTileDir is set the tiles are served from that
+	// {z}/{x}/{y}.png directory instead, for deployments without internet.
+	// MapLeafletURL is the base URL of leaflet.js and leaflet.css, served
+	// from MapLeafletDir when that holds a local copy.
+	MapTileURL     string
+	MapAttribution string
+	MapTileDir     string
+	MapLeafletURL  string
+	MapLeafletDir  string
+	// WebAddr is the listen address of the web interface run inside
+	// meshspy; empty leaves it to the standalone webapp.
+	WebAddr string
+
+	// Boards maps the bulletin boards of the messagesapp to the channel
+	// they post to and collect, e.g. "general=0,emergency=1". BoardAddr
+	// is its listen address. With MgmtURL and MgmtAPIToken, an API token
+	// of an operator of the management server, the board goes through the
+	// server instead of MQTT.
+	Boards       map[string]uint32
+	BoardAddr    string
+	MgmtAPIToken string
+
+	// InfluxURL enables the line protocol sink: an InfluxDB v2 base URL,
+	// udp://host:port or file:///path.
+	InfluxURL           string
+	InfluxOrg           string
+	InfluxBucket        string
+	InfluxToken         string
+	InfluxBatchSize     int
+	InfluxFlushInterval time.Duration
+
+	// PresenceTimeout is the silence after which a node is reported
+	// offline; PresenceRoleTimeouts overrides it per device role.
+	PresenceTimeout      time.Duration
+	PresenceRoleTimeouts map[string]time.Duration
+	// EventsWebhookURL receives every event as a JSON POST when set.
+	EventsWebhookURL string
+	// WebhooksFile is the YAML file describing the webhook sinks.
+	WebhooksFile string
+	// RulesFile is the YAML file with the alert rules; alerting is
+	// disabled when it does not exist.
+	RulesFile string
+
+	// Retention of the time series stored in nodes.db. Raw rows older than
+	// the *Raw duration are downsampled to hourly aggregates, which become
+	// daily after *Hourly; daily aggregates are deleted after *Daily. Zero
+	// disables a step.
+	PositionsRaw    time.Duration
+	PositionsHourly time.Duration
+	PositionsDaily  time.Duration
+	TelemetryRaw    time.Duration
+	TelemetryHourly time.Duration
+	TelemetryDaily  time.Duration
+	// EventsRetention, DeadLettersRetention and AuditRetention are how long
+	// events, webhook dead letters and audit rows are kept; zero keeps
+	// them forever.
+	EventsRetention      time.Duration
+	DeadLettersRetention time.Duration
+	AuditRetention       time.Duration
+	CompactInterval      time.Duration
+	VacuumInterval       time.Duration
 }
 
 // Load reads configuration values from the environment and returns a Config.
@@ -60,18 +145,72 @@ func Load() Config {
 	}
 
 	return Config{
-		SerialPort:   serialPort,
-		BaudRate:     baud,
-		MQTTBroker:   getEnv("MQTT_BROKER", "tcp://mqtt-broker:1883"),
-		MQTTTopic:    getEnv("MQTT_TOPIC", "meshspy/nodo/connesso"),
-		CommandTopic: getEnv("MQTT_COMMAND_TOPIC", "meshspy/commands"),
-		ClientID:     getEnv("MQTT_CLIENT_ID", "meshspy-client"),
-		User:         os.Getenv("MQTT_USER"),
-		Password:     os.Getenv("MQTT_PASS"),
-		Debug:        debug,
-		SendAlive:    sendAlive,
-		MgmtURL:      os.Getenv("MGMT_SERVER_URL"),
+		SerialPort:    serialPort,
+		BaudRate:      baud,
+		MQTTBroker:    getEnv("MQTT_BROKER", "tcp://mqtt-broker:1883"),
+		MQTTTopic:     getEnv("MQTT_TOPIC", "meshspy/nodo/connesso"),
+		CommandTopic:  getEnv("MQTT_COMMAND_TOPIC", "meshspy/commands"),
+		StatePrefix:   getEnv("MQTT_STATE_PREFIX", "meshspy"),
+		ClientID:      getEnv("MQTT_CLIENT_ID", "meshspy-client"),
+		User:          os.Getenv("MQTT_USER"),
+		Password:      os.Getenv("MQTT_PASS"),
+		Debug:         debug,
+		SendAlive:     sendAlive,
+		MgmtURL:       os.Getenv("MGMT_SERVER_URL"),
+		GatewayID:     getEnv("GATEWAY_ID", hostname()),
+		MgmtTokenFile: getEnv("MGMT_TOKEN_FILE", "mgmt.token"),
+		AdminUser:     getEnv("ADMIN_USER", "admin"),
+		AdminPassword: os.Getenv("ADMIN_PASSWORD"),
+		SessionTTL:    getDuration("SESSION_TTL", 7*24*time.Hour),
+		MetricsAddr:   os.Getenv("METRICS_ADDR"),
+		APIAddr:       os.Getenv("API_ADDR"),
+		APIToken:      os.Getenv("API_TOKEN"),
+
+		MapTileURL:     getEnv("MAP_TILE_URL", "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png"),
+		MapAttribution: getEnv("MAP_ATTRIBUTION", "© OpenStreetMap contributors"),
+		MapTileDir:     os.Getenv("MAP_TILE_DIR"),
+		MapLeafletURL:  os.Getenv("MAP_LEAFLET_URL"),
+		MapLeafletDir:  getEnv("MAP_LEAFLET_DIR", "web/leaflet"),
+		WebAddr:        os.Getenv("WEB_ADDR"),
+
+		Boards:       getChannelMap("MESSAGE_BOARDS", "general=0"),
+		BoardAddr:    getEnv("BOARD_ADDR", ":8080"),
+		MgmtAPIToken: os.Getenv("MGMT_API_TOKEN"),
+
+		InfluxURL:           os.Getenv("INFLUX_URL"),
+		InfluxOrg:           os.Getenv("INFLUX_ORG"),
+		InfluxBucket:        getEnv("INFLUX_BUCKET", "meshspy"),
+		InfluxToken:         os.Getenv("INFLUX_TOKEN"),
+		InfluxBatchSize:     getInt("INFLUX_BATCH_SIZE", 500),
+		InfluxFlushInterval: getDuration("INFLUX_FLUSH_INTERVAL", 10*time.Second),
+
+		PresenceTimeout:      getDuration("PRESENCE_TIMEOUT", 2*time.Hour),
+		PresenceRoleTimeouts: getDurationMap("PRESENCE_ROLE_TIMEOUTS", "ROUTER=45m,ROUTER_LATE=45m,REPEATER=45m"),
+		EventsWebhookURL:     os.Getenv("EVENTS_WEBHOOK_URL"),
+		WebhooksFile:         getEnv("WEBHOOKS_FILE", "webhooks.yaml"),
+		RulesFile:            getEnv("RULES_FILE", "rules.yaml"),
+
+		PositionsRaw:    getDuration("RETENTION_POSITIONS_RAW", 30*24*time.Hour),
+		PositionsHourly: getDuration("RETENTION_POSITIONS_HOURLY", 180*24*time.Hour),
+		PositionsDaily:  getDuration("RETENTION_POSITIONS_DAILY", 0),
+		TelemetryRaw:    getDuration("RETENTION_TELEMETRY_RAW", 7*24*time.Hour),
+		TelemetryHourly: getDuration("RETENTION_TELEMETRY_HOURLY", 90*24*time.Hour),
+		TelemetryDaily:  getDuration("RETENTION_TELEMETRY_DAILY", 0),
+
+		EventsRetention:      getDuration("RETENTION_EVENTS", 30*24*time.Hour),
+		DeadLettersRetention: getDuration("RETENTION_DEAD_LETTERS", 30*24*time.Hour),
+		AuditRetention:       getDuration("RETENTION_AUDIT", 365*24*time.Hour),
+		CompactInterval:      getDuration("RETENTION_INTERVAL", time.Hour),
+		VacuumInterval:       getDuration("VACUUM_INTERVAL", 7*24*time.Hour),
+	}
+}
+
+// hostname returns the name of the host, or "meshspy" when unknown.
+func hostname() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
 	}
+	return "meshspy"
 }
 
 func getEnv(key, def string) string {
@@ -81,6 +220,76 @@ func getEnv(key, def string) string {
 	return def
 }
 
+// getDuration parses a Go duration (e.g. "720h") from the environment,
+// returning def when the variable is unset or invalid.
+func getDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s value %q, defaulting to %v", key, v, def)
+		return def
+	}
+	return d
+}
+
+// getDurationMap parses a comma separated list of KEY=duration pairs, such
+// as "ROUTER=30m,REPEATER=1h". Invalid entries are logged and skipped.
+func getDurationMap(key, def string) map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for _, kv := range strings.Split(getEnv(key, def), ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if !ok || err != nil {
+			log.Printf("invalid %s entry %q, skipping", key, kv)
+			continue
+		}
+		out[strings.ToUpper(strings.TrimSpace(k))] = d
+	}
+	return out
+}
+
+// getChannelMap parses a comma separated list of name=channel pairs, such
+// as "general=0,emergency=1". Invalid entries are logged and skipped.
+func getChannelMap(key, def string) map[string]uint32 {
+	out := make(map[string]uint32)
+	for _, kv := range strings.Split(getEnv(key, def), ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		ch, err := strconv.ParseUint(strings.TrimSpace(v), 10, 8)
+		if !ok || err != nil || ch > 7 || strings.TrimSpace(k) == "" {
+			log.Printf("invalid %s entry %q, skipping", key, kv)
+			continue
+		}
+		out[strings.TrimSpace(k)] = uint32(ch)
+	}
+	return out
+}
+
+// getInt parses an integer from the environment, returning def when the
+// variable is unset or invalid.
+func getInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s value %q, defaulting to %d", key, v, def)
+		return def
+	}
+	return n
+}
+
 func portExists(path string) bool {
 	if path == "" {
 		return false
@@ -0,0 +1,29 @@
+package decoder
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// DecodeChannel extracts the Channel carried by a FromRadio message, sent
+// by the radio for each of its channels while downloading its
+// configuration.
+func DecodeChannel(data []byte, version string) (*latestpb.Channel, error) {
+	var err error
+	data, err = stripFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case "", "latest", "2.1":
+		var fr latestpb.FromRadio
+		if err := proto.Unmarshal(data, &fr); err == nil && fr.GetChannel() != nil {
+			return fr.GetChannel(), nil
+		}
+		return nil, fmt.Errorf("not a Channel message")
+	default:
+		return nil, fmt.Errorf("unsupported proto version: %s", version)
+	}
+}
@@ -0,0 +1,29 @@
+package decoder
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	pb "meshspy/proto/latest/meshtastic"
+)
+
+func TestDecodeChannelFramed(t *testing.T) {
+	ch := &pb.Channel{Index: 1, Role: pb.Channel_SECONDARY, Settings: &pb.ChannelSettings{Name: "Soccorso"}}
+	payload, err := proto.Marshal(&pb.FromRadio{PayloadVariant: &pb.FromRadio_Channel{Channel: ch}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	header := []byte{0x94, 0xC3, byte(len(payload) >> 8), byte(len(payload))}
+	got, err := DecodeChannel(append(header, payload...), "latest")
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got.GetIndex() != 1 || got.GetRole() != pb.Channel_SECONDARY || got.GetSettings().GetName() != "Soccorso" {
+		t.Fatalf("unexpected channel %+v", got)
+	}
+
+	payload, _ = proto.Marshal(&pb.FromRadio{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 7}}})
+	if _, err := DecodeChannel(payload, "latest"); err == nil {
+		t.Fatal("expected error for a non channel message")
+	}
+}
@@ -180,3 +180,24 @@ func DecodeAlert(data []byte, version string) (string, error) {
 		return "", fmt.Errorf("unsupported proto version: %s", version)
 	}
 }
+
+// DecodePacket extracts the MeshPacket carried by a FromRadio message. The
+// returned packet keeps the routing metadata (sender, channel, RX SNR/RSSI,
+// hop counters) that the payload specific decoders discard.
+func DecodePacket(data []byte, version string) (*latestpb.MeshPacket, error) {
+	var err error
+	data, err = stripFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case "", "latest", "2.1":
+		var fr latestpb.FromRadio
+		if err := proto.Unmarshal(data, &fr); err == nil && fr.GetPacket() != nil {
+			return fr.GetPacket(), nil
+		}
+		return nil, fmt.Errorf("not a MeshPacket message")
+	default:
+		return nil, fmt.Errorf("unsupported proto version: %s", version)
+	}
+}
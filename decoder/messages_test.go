@@ -161,3 +161,31 @@ func TestDecodeAlert(t *testing.T) {
 		t.Fatalf("unexpected text %q", txt)
 	}
 }
+
+func TestDecodePacketKeepsMetadata(t *testing.T) {
+	d := &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hi")}
+	mp := &pb.MeshPacket{
+		From:           0x1234,
+		To:             0xffffffff,
+		Channel:        1,
+		RxSnr:          5.5,
+		HopStart:       3,
+		HopLimit:       1,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: d},
+	}
+	fr := &pb.FromRadio{PayloadVariant: &pb.FromRadio_Packet{Packet: mp}}
+	data, err := proto.Marshal(fr)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	pkt, err := DecodePacket(data, "latest")
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if pkt.GetFrom() != 0x1234 || pkt.GetChannel() != 1 || pkt.GetRxSnr() != 5.5 || pkt.GetHopStart() != 3 {
+		t.Fatalf("unexpected packet %+v", pkt)
+	}
+	if _, err := DecodePacket([]byte{0x01}, "latest"); err == nil {
+		t.Fatalf("expected error for garbage input")
+	}
+}
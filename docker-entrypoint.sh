@@ -1,4 +1,9 @@
 #!/bin/sh
+# With WEB_ADDR set meshspy serves the web interface itself; otherwise the
+# standalone webapp follows it over MQTT
+if [ -n "$WEB_ADDR" ]; then
+    exec /app/meshspy
+fi
 /app/meshspy &
 /usr/local/bin/webapp &
 wait -n
@@ -0,0 +1,154 @@
+// Package events carries notable mesh events, such as nodes going online or
+// offline, from the components detecting them to the sinks delivering them
+// (MQTT, storage, webhooks).
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types emitted by the presence tracker.
+const (
+	NodeNew     = "node_new"
+	NodeOnline  = "node_online"
+	NodeOffline = "node_offline"
+)
+
+// Event types emitted for received packets. The data of alerts and text
+// messages carries the received "text", that of admin messages the
+// base64 "payload".
+const (
+	Alert       = "alert"
+	TextMessage = "text_message"
+	Position    = "position"
+	Telemetry   = "telemetry"
+	Admin       = "admin"
+)
+
+// Event types emitted for the text messages sent by the gateway: the data
+// of message_sent is the stored message, that of message_status carries the
+// "packet_id" with its new delivery "status" and the failure "error".
+const (
+	MessageSent   = "message_sent"
+	MessageStatus = "message_status"
+)
+
+// Event types emitted by the management server: node infos uploaded by
+// the gateways and the gateways appearing or missing their heartbeats.
+const (
+	NodeInfo       = "node_info"
+	GatewayOnline  = "gateway_online"
+	GatewayOffline = "gateway_offline"
+)
+
+// Event is a single occurrence. ID is assigned when the event is published
+// and increases monotonically. Gateway is set by the management server to
+// the gateway that reported the event.
+type Event struct {
+	ID      int64           `json:"id"`
+	Type    string          `json:"type"`
+	NodeID  string          `json:"node_id,omitempty"`
+	Gateway string          `json:"gateway,omitempty"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// New returns an event of type typ about nodeID with data encoded as JSON.
+func New(typ, nodeID string, data any) Event {
+	e := Event{Type: typ, NodeID: nodeID, Time: time.Now().UTC()}
+	if data != nil {
+		if b, err := json.Marshal(data); err == nil {
+			e.Data = b
+		}
+	}
+	return e
+}
+
+// Bus fans published events out to its subscribers. Slow subscribers do not
+// block publishers: events that do not fit in their buffer are dropped.
+type Bus struct {
+	persist func(*Event) error
+	seq     atomic.Int64
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// NewBus returns a bus. When persist is not nil it is called for every event
+// before delivery and is expected to assign its ID, e.g. from a database
+// sequence; otherwise IDs come from an in-memory counter.
+func NewBus(persist func(*Event) error) *Bus {
+	return &Bus{persist: persist, subs: make(map[*Subscription]struct{})}
+}
+
+// Publish assigns an ID and time to e and delivers it to every subscriber.
+func (b *Bus) Publish(e Event) (Event, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if b.persist != nil {
+		if err := b.persist(&e); err != nil {
+			return e, err
+		}
+	} else {
+		e.ID = b.seq.Add(1)
+	}
+	b.mu.Lock()
+	for s := range b.subs {
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	b.mu.Unlock()
+	return e, nil
+}
+
+// Subscription receives the events published after it was created.
+type Subscription struct {
+	bus     *Bus
+	ch      chan Event
+	once    sync.Once
+	dropped atomic.Int64
+}
+
+// Subscribe returns a subscription buffering up to buffer events.
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	s := &Subscription{bus: b, ch: make(chan Event, buffer)}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// C returns the channel delivering events. It is closed by Close.
+func (s *Subscription) C() <-chan Event { return s.ch }
+
+// Dropped returns the number of events lost because the buffer was full.
+func (s *Subscription) Dropped() int64 { return s.dropped.Load() }
+
+// Close stops the delivery of events and closes the channel.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		close(s.ch)
+		s.bus.mu.Unlock()
+	})
+}
+
+// Handle calls fn for every event in its own goroutine until the returned
+// function is called.
+func (b *Bus) Handle(fn func(Event)) (stop func()) {
+	s := b.Subscribe(256)
+	go func() {
+		for e := range s.ch {
+			fn(e)
+		}
+	}()
+	return s.Close
+}
@@ -0,0 +1,54 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBusFanOut(t *testing.T) {
+	b := NewBus(nil)
+	s1, s2 := b.Subscribe(2), b.Subscribe(1)
+
+	e1, _ := b.Publish(New(NodeOnline, "0xa", map[string]int{"n": 1}))
+	e2, _ := b.Publish(New(NodeOffline, "0xa", nil))
+	if e1.ID != 1 || e2.ID != 2 || e1.Time.IsZero() {
+		t.Fatalf("unexpected ids %d %d", e1.ID, e2.ID)
+	}
+	if got := <-s1.C(); got.ID != 1 || string(got.Data) != `{"n":1}` {
+		t.Fatalf("unexpected event %+v", got)
+	}
+	if got := <-s1.C(); got.Type != NodeOffline {
+		t.Fatalf("unexpected event %+v", got)
+	}
+	// The second subscriber only had room for one event.
+	if got := <-s2.C(); got.ID != 1 || s2.Dropped() != 1 {
+		t.Fatalf("unexpected event %+v, dropped %d", got, s2.Dropped())
+	}
+
+	s1.Close()
+	s1.Close()
+	if _, ok := <-s1.C(); ok {
+		t.Fatalf("channel not closed")
+	}
+	b.Publish(New(NodeNew, "0xb", nil))
+}
+
+func TestBusPersist(t *testing.T) {
+	b := NewBus(func(e *Event) error {
+		if e.NodeID == "" {
+			return errors.New("no node")
+		}
+		e.ID = 42
+		return nil
+	})
+	s := b.Subscribe(1)
+	if e, err := b.Publish(New(NodeNew, "0xa", nil)); err != nil || e.ID != 42 {
+		t.Fatalf("unexpected %+v, %v", e, err)
+	}
+	if _, err := b.Publish(New(NodeNew, "", nil)); err == nil {
+		t.Fatalf("expected persist error")
+	}
+	if len(s.C()) != 1 {
+		t.Fatalf("failed events must not be delivered")
+	}
+}
@@ -0,0 +1,242 @@
+// Package export converts stored node tracks and waypoints into formats
+// understood by mapping tools: GPX, KML and GeoJSON.
+package export
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"meshspy/storage"
+)
+
+// Supported export formats.
+const (
+	FormatGPX     = "gpx"
+	FormatKML     = "kml"
+	FormatGeoJSON = "geojson"
+)
+
+// Point is a single position of a track.
+type Point struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  int
+	Time      time.Time
+}
+
+// Track is the ordered list of positions reported by a node.
+type Track struct {
+	NodeID string
+	Name   string
+	Points []Point
+}
+
+// Waypoint is a named point of interest shared on the mesh.
+type Waypoint struct {
+	ID          string
+	Name        string
+	Description string
+	Icon        string
+	Latitude    float64
+	Longitude   float64
+	Time        time.Time
+}
+
+// Data is the content of an export.
+type Data struct {
+	Tracks    []Track
+	Waypoints []Waypoint
+}
+
+// Filter restricts an export to a set of nodes and a time window. Empty
+// fields select everything.
+type Filter struct {
+	Nodes []string
+	Since time.Time
+	Until time.Time
+}
+
+// FilterFromQuery builds a Filter from the node, since and until URL query
+// parameters. node may be repeated or hold a comma separated list.
+func FilterFromQuery(q url.Values) (Filter, error) {
+	page, err := storage.PageFromQuery(url.Values{"since": q["since"], "until": q["until"]})
+	if err != nil {
+		return Filter{}, err
+	}
+	f := Filter{Since: page.Since, Until: page.Until}
+	for _, v := range q["node"] {
+		f.Nodes = append(f.Nodes, splitList(v)...)
+	}
+	return f, nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Collect loads the tracks selected by f from b, oldest point first, and
+// the active waypoints created by the selected nodes and updated within the
+// window. Nodes without positions in the window are left out.
+func Collect(b storage.Backend, f Filter) (*Data, error) {
+	nodes, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, n := range nodes {
+		names[n.ID] = n.LongName
+	}
+	ids := f.Nodes
+	if len(ids) == 0 {
+		for _, n := range nodes {
+			ids = append(ids, n.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	d := &Data{}
+	for _, id := range ids {
+		points, err := collectPoints(b, id, f)
+		if err != nil {
+			return nil, err
+		}
+		if len(points) == 0 {
+			continue
+		}
+		name := names[id]
+		if name == "" {
+			name = id
+		}
+		d.Tracks = append(d.Tracks, Track{NodeID: id, Name: name, Points: points})
+	}
+
+	wps, err := b.ActiveWaypoints(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, id := range f.Nodes {
+		selected[id] = true
+	}
+	for _, w := range wps {
+		if len(selected) > 0 && !selected[w.CreatedBy] {
+			continue
+		}
+		if (!f.Since.IsZero() && w.UpdatedAt.Before(f.Since)) || (!f.Until.IsZero() && !w.UpdatedAt.Before(f.Until)) {
+			continue
+		}
+		wp := Waypoint{ID: fmt.Sprintf("0x%x", w.ID), Name: w.Name, Description: w.Description,
+			Latitude: w.Latitude, Longitude: w.Longitude, Time: w.UpdatedAt.UTC()}
+		if w.Icon != 0 {
+			wp.Icon = string(rune(w.Icon))
+		}
+		d.Waypoints = append(d.Waypoints, wp)
+	}
+	return d, nil
+}
+
+// collectPoints pages through the positions of a node and returns them
+// oldest first.
+func collectPoints(b storage.Backend, nodeID string, f Filter) ([]Point, error) {
+	var points []Point
+	page := storage.Page{Limit: 5000, Since: f.Since, Until: f.Until}
+	for {
+		pos, err := b.Positions(nodeID, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pos {
+			t := p.ReceivedAt
+			if p.Time > 0 {
+				t = time.Unix(p.Time, 0)
+			}
+			points = append(points, Point{Latitude: p.Latitude, Longitude: p.Longitude,
+				Altitude: p.Altitude, Time: t.UTC()})
+		}
+		if len(pos) < page.Limit {
+			break
+		}
+		page.Before = pos[len(pos)-1].ID
+	}
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points, nil
+}
+
+// ValidFormat reports whether format is a supported export format.
+func ValidFormat(format string) bool {
+	return format == FormatGPX || format == FormatKML || format == FormatGeoJSON
+}
+
+// Write encodes d in the given format.
+func Write(w io.Writer, format string, d *Data) error {
+	switch format {
+	case FormatGPX:
+		return WriteGPX(w, d)
+	case FormatKML:
+		return WriteKML(w, d)
+	case FormatGeoJSON:
+		return WriteGeoJSON(w, d)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) string {
+	switch format {
+	case FormatGPX:
+		return "application/gpx+xml"
+	case FormatKML:
+		return "application/vnd.google-earth.kml+xml"
+	case FormatGeoJSON:
+		return "application/geo+json"
+	}
+	return "application/octet-stream"
+}
+
+// Handler serves exports of b. The format query parameter selects gpx, kml
+// or geojson (the default); node, since and until filter the data as in
+// FilterFromQuery.
+func Handler(b storage.Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		format := q.Get("format")
+		if format == "" {
+			format = FormatGeoJSON
+		}
+		if !ValidFormat(format) {
+			http.Error(w, "unknown format", http.StatusBadRequest)
+			return
+		}
+		f, err := FilterFromQuery(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d, err := Collect(b, f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType(format))
+		w.Header().Set("Content-Disposition", `attachment; filename="meshspy.`+format+`"`)
+		// The headers are sent by now, so the client only sees a truncated
+		// file
+		if err := Write(w, format, d); err != nil {
+			log.Printf("export %s write error: %v", format, err)
+		}
+	})
+}
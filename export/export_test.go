@@ -0,0 +1,183 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqttpkg "meshspy/client"
+	"meshspy/storage"
+)
+
+func sampleData() *Data {
+	t0 := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	return &Data{
+		Tracks: []Track{
+			{NodeID: "0x1", Name: "Alpha", Points: []Point{
+				{Latitude: 43.7, Longitude: 10.4, Altitude: 5, Time: t0},
+				{Latitude: 43.71, Longitude: 10.41, Altitude: 6, Time: t0.Add(time.Minute)},
+			}},
+			{NodeID: "0x2", Name: "Bravo", Points: []Point{{Latitude: 44, Longitude: 11, Time: t0}}},
+		},
+		Waypoints: []Waypoint{{ID: "0x99", Name: "Camp", Description: "base", Latitude: 43.8, Longitude: 10.5, Time: t0}},
+	}
+}
+
+func TestWriteGPX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteGPX(&buf, sampleData()); err != nil {
+		t.Fatalf("WriteGPX returned error: %v", err)
+	}
+	var doc gpxFile
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid GPX: %v", err)
+	}
+	if len(doc.Tracks) != 2 || len(doc.Tracks[0].Segments[0].Points) != 2 {
+		t.Fatalf("unexpected tracks %+v", doc.Tracks)
+	}
+	if doc.Tracks[0].Segments[0].Points[1].Time != "2025-05-01T10:01:00Z" {
+		t.Fatalf("unexpected point time %+v", doc.Tracks[0].Segments[0].Points[1])
+	}
+	if len(doc.Waypoints) != 1 || doc.Waypoints[0].Name != "Camp" {
+		t.Fatalf("unexpected waypoints %+v", doc.Waypoints)
+	}
+}
+
+func TestWriteKML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteKML(&buf, sampleData()); err != nil {
+		t.Fatalf("WriteKML returned error: %v", err)
+	}
+	var doc kmlFile
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid KML: %v", err)
+	}
+	folders := doc.Document.Folders
+	if len(folders) != 3 || folders[0].Name != "Alpha" || folders[2].Name != "Waypoints" {
+		t.Fatalf("unexpected folders %+v", folders)
+	}
+	// A track with several points has a line and a last position marker.
+	if len(folders[0].Placemarks) != 2 || folders[0].Placemarks[0].LineString == nil {
+		t.Fatalf("unexpected placemarks %+v", folders[0].Placemarks)
+	}
+	if folders[0].Placemarks[1].Point.Coordinates != "10.41,43.71,6" {
+		t.Fatalf("unexpected last position %+v", folders[0].Placemarks[1].Point)
+	}
+	if len(folders[1].Placemarks) != 1 || folders[1].Placemarks[0].StyleURL != "#node-0x2" {
+		t.Fatalf("unexpected single point folder %+v", folders[1])
+	}
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteGeoJSON(&buf, sampleData()); err != nil {
+		t.Fatalf("WriteGeoJSON returned error: %v", err)
+	}
+	var fc struct {
+		Type     string
+		Features []struct {
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties map[string]any
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &fc); err != nil {
+		t.Fatalf("invalid GeoJSON: %v", err)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 3 {
+		t.Fatalf("unexpected collection %+v", fc)
+	}
+	kinds := []string{"LineString", "Point", "Point"}
+	for i, f := range fc.Features {
+		if f.Geometry.Type != kinds[i] {
+			t.Fatalf("feature %d: expected %s, got %s", i, kinds[i], f.Geometry.Type)
+		}
+	}
+	if fc.Features[2].Properties["kind"] != "waypoint" || string(fc.Features[2].Geometry.Coordinates) != "[10.5,43.8]" {
+		t.Fatalf("unexpected waypoint feature %+v", fc.Features[2])
+	}
+}
+
+func TestCollectFiltersNodesAndTime(t *testing.T) {
+	ns, err := storage.NewNodeStore(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("NewNodeStore returned error: %v", err)
+	}
+	defer ns.Close()
+	for i, n := range []*mqttpkg.NodeInfo{
+		{ID: "0x1", LongName: "Alpha", Latitude: 1, Longitude: 1, LocationTime: 1000},
+		{ID: "0x1", Latitude: 2, Longitude: 2, LocationTime: 2000},
+		{ID: "0x2", LongName: "Bravo", Latitude: 3, Longitude: 3, LocationTime: 1500},
+	} {
+		if err := ns.Upsert(n); err != nil {
+			t.Fatalf("Upsert %d returned error: %v", i, err)
+		}
+	}
+
+	for _, w := range []*storage.Waypoint{
+		{ID: 5, Name: "Camp", Icon: 0x26FA, Latitude: 1.5, Longitude: 1.5, CreatedBy: "0x1"},
+		{ID: 6, Name: "Other", Latitude: 3.5, Longitude: 3.5, CreatedBy: "0x2"},
+		{ID: 7, Name: "Gone", Latitude: 1, Longitude: 1, Expire: 1, CreatedBy: "0x1"},
+	} {
+		if err := ns.SaveWaypoint(w); err != nil {
+			t.Fatalf("SaveWaypoint returned error: %v", err)
+		}
+	}
+
+	d, err := Collect(ns, Filter{Nodes: []string{"0x1"}})
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(d.Tracks) != 1 || d.Tracks[0].Name != "Alpha" || len(d.Tracks[0].Points) != 2 {
+		t.Fatalf("unexpected tracks %+v", d.Tracks)
+	}
+	if d.Tracks[0].Points[0].Latitude != 1 || !d.Tracks[0].Points[1].Time.Equal(time.Unix(2000, 0)) {
+		t.Fatalf("points not oldest first %+v", d.Tracks[0].Points)
+	}
+	if len(d.Waypoints) != 1 || d.Waypoints[0].Name != "Camp" || d.Waypoints[0].Icon != "⛺" {
+		t.Fatalf("unexpected waypoints %+v", d.Waypoints)
+	}
+
+	d, err = Collect(ns, Filter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(d.Tracks) != 0 || len(d.Waypoints) != 0 {
+		t.Fatalf("expected nothing after the window, got %+v", d)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(ns).ServeHTTP(rec, httptest.NewRequest("GET", "/export?format=gpx&node=0x1,0x2", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/gpx+xml" {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+	if !strings.Contains(rec.Body.String(), "<name>Bravo</name>") {
+		t.Fatalf("export misses Bravo: %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	Handler(ns).ServeHTTP(rec, httptest.NewRequest("GET", "/export?format=shp", nil))
+	if rec.Code != 400 {
+		t.Fatalf("expected 400 for unknown format, got %d", rec.Code)
+	}
+}
+
+func TestFilterFromQuery(t *testing.T) {
+	f, err := FilterFromQuery(url.Values{"node": {"0x1, 0x2", "0x3"}, "since": {"1700000000"}})
+	if err != nil {
+		t.Fatalf("FilterFromQuery returned error: %v", err)
+	}
+	if len(f.Nodes) != 3 || f.Since.Unix() != 1700000000 || !f.Until.IsZero() {
+		t.Fatalf("unexpected filter %+v", f)
+	}
+	if _, err := FilterFromQuery(url.Values{"until": {"yesterday"}}); err == nil {
+		t.Fatalf("expected error for invalid until")
+	}
+}
@@ -0,0 +1,66 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+type geoFeature struct {
+	Type       string         `json:"type"`
+	Geometry   geoGeometry    `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geoGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// WriteGeoJSON encodes d as a GeoJSON FeatureCollection. Tracks become
+// LineString features (a Point for a single position) carrying the node ID,
+// name and point times; waypoints become Point features.
+func WriteGeoJSON(w io.Writer, d *Data) error {
+	fc := geoFeatureCollection{Type: "FeatureCollection", Features: []geoFeature{}}
+	for _, t := range d.Tracks {
+		coords := make([][]float64, 0, len(t.Points))
+		times := make([]string, 0, len(t.Points))
+		for _, p := range t.Points {
+			coords = append(coords, []float64{p.Longitude, p.Latitude, float64(p.Altitude)})
+			times = append(times, gpxTime(p.Time))
+		}
+		geom := geoGeometry{Type: "LineString", Coordinates: coords}
+		if len(coords) == 1 {
+			geom = geoGeometry{Type: "Point", Coordinates: coords[0]}
+		}
+		fc.Features = append(fc.Features, geoFeature{
+			Type:     "Feature",
+			Geometry: geom,
+			Properties: map[string]any{
+				"kind":    "track",
+				"node_id": t.NodeID,
+				"name":    t.Name,
+				"times":   times,
+			},
+		})
+	}
+	for _, wp := range d.Waypoints {
+		fc.Features = append(fc.Features, geoFeature{
+			Type:     "Feature",
+			Geometry: geoGeometry{Type: "Point", Coordinates: []float64{wp.Longitude, wp.Latitude}},
+			Properties: map[string]any{
+				"kind":        "waypoint",
+				"id":          wp.ID,
+				"name":        wp.Name,
+				"description": wp.Description,
+				"icon":        wp.Icon,
+				"time":        gpxTime(wp.Time),
+			},
+		})
+	}
+	return json.NewEncoder(w).Encode(fc)
+}
@@ -0,0 +1,68 @@
+package export
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+type gpxFile struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Xmlns     string     `xml:"xmlns,attr"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Desc     string       `xml:"desc,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Ele  *int    `xml:"ele,omitempty"`
+	Time string  `xml:"time,omitempty"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+	Sym  string  `xml:"sym,omitempty"`
+}
+
+// WriteGPX encodes d as a GPX 1.1 document with one track per node and the
+// waypoints as wpt elements.
+func WriteGPX(w io.Writer, d *Data) error {
+	doc := gpxFile{Xmlns: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "MeshSpy"}
+	for _, wp := range d.Waypoints {
+		doc.Waypoints = append(doc.Waypoints, gpxPoint{Lat: wp.Latitude, Lon: wp.Longitude,
+			Time: gpxTime(wp.Time), Name: wp.Name, Desc: wp.Description, Sym: wp.Icon})
+	}
+	for _, t := range d.Tracks {
+		seg := gpxSegment{}
+		for _, p := range t.Points {
+			alt := p.Altitude
+			seg.Points = append(seg.Points, gpxPoint{Lat: p.Latitude, Lon: p.Longitude,
+				Ele: &alt, Time: gpxTime(p.Time)})
+		}
+		doc.Tracks = append(doc.Tracks, gpxTrack{Name: t.Name, Desc: t.NodeID, Segments: []gpxSegment{seg}})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+func gpxTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
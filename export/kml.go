@@ -0,0 +1,152 @@
+package export
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"time"
+)
+
+// kmlPalette holds the track colors assigned to nodes, in KML aabbggrr form.
+var kmlPalette = []string{
+	"ff3c14dc", // crimson
+	"ffe16941", // royal blue
+	"ff32cd32", // lime green
+	"ff00a5ff", // orange
+	"ffd30094", // dark violet
+	"ffd1ce00", // dark turquoise
+	"ff8b3d48", // dark slate blue
+	"ff1e69d2", // chocolate
+}
+
+type kmlFile struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name    string      `xml:"name"`
+	Styles  []kmlStyle  `xml:"Style"`
+	Folders []kmlFolder `xml:"Folder"`
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	IconStyle *kmlIconStyle `xml:"IconStyle,omitempty"`
+	LineStyle *kmlLineStyle `xml:"LineStyle,omitempty"`
+}
+
+type kmlIconStyle struct {
+	Color string `xml:"color,omitempty"`
+	Href  string `xml:"Icon>href"`
+}
+
+type kmlLineStyle struct {
+	Color string `xml:"color"`
+	Width int    `xml:"width"`
+}
+
+type kmlFolder struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	Placemarks  []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	StyleURL    string         `xml:"styleUrl,omitempty"`
+	TimeStamp   string         `xml:"TimeStamp>when,omitempty"`
+	TimeSpan    *kmlTimeSpan   `xml:"TimeSpan,omitempty"`
+	Point       *kmlPoint      `xml:"Point,omitempty"`
+	LineString  *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlTimeSpan struct {
+	Begin string `xml:"begin"`
+	End   string `xml:"end"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Tessellate  int    `xml:"tessellate"`
+	Coordinates string `xml:"coordinates"`
+}
+
+// WriteKML encodes d as a KML document with a folder per node holding its
+// track and last position, styled with a color derived from the node ID, and
+// a folder with the waypoints.
+func WriteKML(w io.Writer, d *Data) error {
+	doc := kmlFile{Xmlns: "http://www.opengis.net/kml/2.2", Document: kmlDocument{Name: "MeshSpy"}}
+	doc.Document.Styles = append(doc.Document.Styles, kmlStyle{ID: "waypoint",
+		IconStyle: &kmlIconStyle{Href: "http://maps.google.com/mapfiles/kml/pushpin/ylw-pushpin.png"}})
+
+	for _, t := range d.Tracks {
+		style := "node-" + t.NodeID
+		color := nodeColor(t.NodeID)
+		doc.Document.Styles = append(doc.Document.Styles, kmlStyle{ID: style,
+			IconStyle: &kmlIconStyle{Color: color, Href: "http://maps.google.com/mapfiles/kml/shapes/placemark_circle.png"},
+			LineStyle: &kmlLineStyle{Color: color, Width: 3}})
+
+		folder := kmlFolder{Name: t.Name, Description: t.NodeID}
+		coords := make([]string, 0, len(t.Points))
+		for _, p := range t.Points {
+			coords = append(coords, kmlCoord(p.Longitude, p.Latitude, p.Altitude))
+		}
+		first, last := t.Points[0], t.Points[len(t.Points)-1]
+		if len(t.Points) > 1 {
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:       t.Name + " track",
+				StyleURL:   "#" + style,
+				TimeSpan:   &kmlTimeSpan{Begin: gpxTime(first.Time), End: gpxTime(last.Time)},
+				LineString: &kmlLineString{Tessellate: 1, Coordinates: strings.Join(coords, " ")},
+			})
+		}
+		folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+			Name:        t.Name,
+			Description: fmt.Sprintf("%s, last seen %s", t.NodeID, last.Time.UTC().Format(time.RFC1123)),
+			StyleURL:    "#" + style,
+			TimeStamp:   gpxTime(last.Time),
+			Point:       &kmlPoint{Coordinates: coords[len(coords)-1]},
+		})
+		doc.Document.Folders = append(doc.Document.Folders, folder)
+	}
+
+	if len(d.Waypoints) > 0 {
+		folder := kmlFolder{Name: "Waypoints"}
+		for _, wp := range d.Waypoints {
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:        wp.Name,
+				Description: wp.Description,
+				StyleURL:    "#waypoint",
+				TimeStamp:   gpxTime(wp.Time),
+				Point:       &kmlPoint{Coordinates: kmlCoord(wp.Longitude, wp.Latitude, 0)},
+			})
+		}
+		doc.Document.Folders = append(doc.Document.Folders, folder)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+func kmlCoord(lon, lat float64, alt int) string {
+	return fmt.Sprintf("%g,%g,%d", lon, lat, alt)
+}
+
+// nodeColor picks a stable palette color for a node.
+func nodeColor(nodeID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(nodeID))
+	return kmlPalette[h.Sum32()%uint32(len(kmlPalette))]
+}
@@ -0,0 +1,211 @@
+// Package gatewayapi serves the local HTTP API of a gateway, used to script
+// it on sites without an MQTT broker: sending messages, running traceroutes
+// and reading the device snapshot, the live node list and the health.
+package gatewayapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"meshspy/nodemap"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// BroadcastAddr is the destination of messages sent to every node.
+const BroadcastAddr = 0xffffffff
+
+// Options configures a Server. Functions left nil disable their endpoint.
+type Options struct {
+	// Token must be sent as "Authorization: Bearer <token>" on every
+	// endpoint except the health check, which are all refused when it is
+	// empty.
+	Token string
+	// Nodes resolves destinations and lists the nodes.
+	Nodes *nodemap.Map
+	// SendText sends text to dest on a channel index and returns the
+	// packet ID, e.g. serial.Manager.SendText.
+	SendText func(dest, channel uint32, text string) (uint32, error)
+	// Traceroute sends a traceroute request and returns the packet ID,
+	// e.g. serial.Manager.SendTraceroute.
+	Traceroute func(dest, channel, hopLimit uint32) (uint32, error)
+	// TracerouteTimeout is the longest wait for a traceroute reply, 60
+	// seconds by default.
+	TracerouteTimeout time.Duration
+	// Snapshot returns the current state of the local device.
+	Snapshot func() (any, error)
+	// Checks returns the status of the gateway components, e.g. serial
+	// and mqtt; the gateway is healthy when all of them are true.
+	Checks func() map[string]bool
+}
+
+// Server is the HTTP handler of the API. Traceroute replies must be fed to
+// HandlePacket.
+type Server struct {
+	opts    Options
+	mux     *http.ServeMux
+	started time.Time
+
+	mu      sync.Mutex
+	waiters map[uint32]chan *latestpb.MeshPacket
+}
+
+// New returns a Server with opts.
+func New(opts Options) *Server {
+	if opts.TracerouteTimeout <= 0 {
+		opts.TracerouteTimeout = 60 * time.Second
+	}
+	if opts.Nodes == nil {
+		opts.Nodes = nodemap.New()
+	}
+	s := &Server{
+		opts:    opts,
+		mux:     http.NewServeMux(),
+		started: time.Now(),
+		waiters: make(map[uint32]chan *latestpb.MeshPacket),
+	}
+	s.mux.HandleFunc("/api/health", s.health)
+	s.mux.Handle("/api/nodes", s.auth(http.HandlerFunc(s.nodes)))
+	s.mux.Handle("/api/device", s.auth(http.HandlerFunc(s.device)))
+	s.mux.Handle("/api/messages", s.auth(http.HandlerFunc(s.sendMessage)))
+	s.mux.Handle("/api/traceroute", s.auth(http.HandlerFunc(s.traceroute)))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// auth rejects requests without the configured token.
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.opts.Token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(s.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="meshspy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Health is the answer of the health check.
+type Health struct {
+	Status string          `json:"status"`
+	Checks map[string]bool `json:"checks,omitempty"`
+	// Uptime is the number of seconds the API has been running.
+	Uptime float64 `json:"uptime"`
+	Nodes  int     `json:"nodes"`
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	h := Health{Status: "ok", Uptime: time.Since(s.started).Seconds(), Nodes: len(s.opts.Nodes.List())}
+	if s.opts.Checks != nil {
+		h.Checks = s.opts.Checks()
+	}
+	code := http.StatusOK
+	for _, ok := range h.Checks {
+		if !ok {
+			h.Status, code = "degraded", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, h)
+}
+
+// Node is a node of the live node map.
+type Node struct {
+	ID        string `json:"id"`
+	Num       uint32 `json:"num"`
+	LongName  string `json:"long_name,omitempty"`
+	ShortName string `json:"short_name,omitempty"`
+	HwModel   string `json:"hw_model,omitempty"`
+	Role      string `json:"role,omitempty"`
+	LastHeard int64  `json:"last_heard,omitempty"`
+}
+
+func (s *Server) nodes(w http.ResponseWriter, r *http.Request) {
+	list := s.opts.Nodes.List()
+	out := make([]Node, 0, len(list))
+	for _, n := range list {
+		out = append(out, Node{
+			ID: n.ID, Num: n.Num(), LongName: n.Long, ShortName: n.Short,
+			HwModel: n.HwModel, Role: n.Role, LastHeard: n.LastHeard,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) device(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Snapshot == nil {
+		http.Error(w, "not available", http.StatusNotImplemented)
+		return
+	}
+	snap, err := s.opts.Snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// MessageRequest is the body of POST /api/messages. To is a node ID or
+// name; without it the text is broadcast on the channel.
+type MessageRequest struct {
+	Text    string `json:"text"`
+	To      string `json:"to,omitempty"`
+	Channel uint32 `json:"channel"`
+}
+
+// MessageResponse is the answer to a message sent.
+type MessageResponse struct {
+	ID uint32 `json:"id"`
+	To string `json:"to"`
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.opts.SendText == nil {
+		http.Error(w, "not available", http.StatusNotImplemented)
+		return
+	}
+	var req MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "text required", http.StatusBadRequest)
+		return
+	}
+	dest, ok := s.destination(req.To)
+	if !ok {
+		http.Error(w, "unknown node "+req.To, http.StatusNotFound)
+		return
+	}
+	id, err := s.opts.SendText(dest, req.Channel, req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, MessageResponse{ID: id, To: nodemap.FormatID(dest)})
+}
+
+// destination resolves to, broadcasting when empty.
+func (s *Server) destination(to string) (uint32, bool) {
+	if to == "" {
+		return BroadcastAddr, true
+	}
+	n, ok := s.opts.Nodes.Lookup(to)
+	if !ok {
+		return 0, false
+	}
+	return n.Num(), true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,119 @@
+package gatewayapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"meshspy/nodemap"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+func do(t *testing.T, h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMessagesAndAuth(t *testing.T) {
+	nodes := nodemap.New()
+	nodes.Update(0x1a2b, "Base Camp", "BASE")
+	type sent struct {
+		dest, channel uint32
+		text          string
+	}
+	var got []sent
+	s := New(Options{
+		Token: "secret",
+		Nodes: nodes,
+		SendText: func(dest, channel uint32, text string) (uint32, error) {
+			got = append(got, sent{dest, channel, text})
+			return 42, nil
+		},
+		Checks: func() map[string]bool { return map[string]bool{"serial": true, "mqtt": false} },
+	})
+
+	if rec := do(t, s, "POST", "/api/messages", "wrong", `{"text":"hi"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	rec := do(t, s, "POST", "/api/messages", "secret", `{"text":"hi","to":"base camp","channel":1}`)
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"to":"0x1a2b"`) {
+		t.Fatalf("unexpected answer %d %s", rec.Code, rec.Body)
+	}
+	do(t, s, "POST", "/api/messages", "secret", `{"text":"all"}`)
+	if len(got) != 2 || got[0] != (sent{0x1a2b, 1, "hi"}) || got[1].dest != BroadcastAddr {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+	if rec := do(t, s, "POST", "/api/messages", "secret", `{"text":"hi","to":"nobody"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+
+	rec = do(t, s, "GET", "/api/nodes", "secret", "")
+	var list []Node
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].ShortName != "BASE" {
+		t.Fatalf("unexpected nodes %s", rec.Body)
+	}
+
+	// The health check needs no token and reports failed checks.
+	rec = do(t, s, "GET", "/api/health", "", "")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"status":"degraded"`) {
+		t.Fatalf("unexpected health %d %s", rec.Code, rec.Body)
+	}
+
+	// Without a token every other endpoint is refused.
+	if rec := do(t, New(Options{Nodes: nodes}), "GET", "/api/nodes", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("tokenless server answered %d", rec.Code)
+	}
+}
+
+func TestTraceroute(t *testing.T) {
+	nodes := nodemap.New()
+	nodes.Update(0xb, "Relay", "RL")
+	var s *Server
+	s = New(Options{
+		Token: "secret",
+		Nodes: nodes,
+		Traceroute: func(dest, channel, hopLimit uint32) (uint32, error) {
+			payload, _ := proto.Marshal(&latestpb.RouteDiscovery{
+				Route: []uint32{0xb}, SnrTowards: []int32{24, unknownSNR},
+				SnrBack: []int32{-8, 10},
+			})
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				s.HandlePacket(&latestpb.MeshPacket{From: dest, To: 0xa, PayloadVariant: &latestpb.MeshPacket_Decoded{
+					Decoded: &latestpb.Data{Portnum: latestpb.PortNum_TRACEROUTE_APP, Payload: payload, RequestId: 7},
+				}})
+			}()
+			return 7, nil
+		},
+	})
+	rec := do(t, s, "POST", "/api/traceroute", "secret", `{"to":"0xc"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected answer %d %s", rec.Code, rec.Body)
+	}
+	var res TracerouteResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Towards) != 2 || res.Towards[0].Name != "Relay" || *res.Towards[0].SNR != 6 || res.Towards[1].SNR != nil || res.Towards[1].ID != "0xc" {
+		t.Fatalf("unexpected route towards %+v", res.Towards)
+	}
+	if len(res.Back) != 1 || res.Back[0].ID != "0xa" || *res.Back[0].SNR != -2 {
+		t.Fatalf("unexpected route back %+v", res.Back)
+	}
+
+	s.opts.Traceroute = func(dest, channel, hopLimit uint32) (uint32, error) { return 8, nil }
+	if rec := do(t, s, "POST", "/api/traceroute?wait=20ms", "secret", `{"to":"0xc"}`); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rec.Code)
+	}
+}
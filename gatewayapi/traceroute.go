@@ -0,0 +1,150 @@
+package gatewayapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"meshspy/nodemap"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// TracerouteRequest is the body of POST /api/traceroute.
+type TracerouteRequest struct {
+	To       string `json:"to"`
+	Channel  uint32 `json:"channel"`
+	HopLimit uint32 `json:"hop_limit,omitempty"`
+}
+
+// Hop is a node crossed by a traceroute with the SNR it was received with,
+// when reported.
+type Hop struct {
+	ID   string   `json:"id"`
+	Name string   `json:"name"`
+	SNR  *float64 `json:"snr,omitempty"`
+}
+
+// TracerouteResult is the route to a node and back.
+type TracerouteResult struct {
+	ID      uint32 `json:"id"`
+	To      string `json:"to"`
+	Towards []Hop  `json:"towards"`
+	Back    []Hop  `json:"back,omitempty"`
+	// Duration is the number of seconds until the reply.
+	Duration float64 `json:"duration"`
+}
+
+// unknownSNR marks hops whose SNR was not recorded.
+const unknownSNR = -128
+
+func (s *Server) traceroute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.opts.Traceroute == nil {
+		http.Error(w, "not available", http.StatusNotImplemented)
+		return
+	}
+	var req TracerouteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.To == "" {
+		http.Error(w, "to required", http.StatusBadRequest)
+		return
+	}
+	n, ok := s.opts.Nodes.Lookup(req.To)
+	if !ok {
+		http.Error(w, "unknown node "+req.To, http.StatusNotFound)
+		return
+	}
+	timeout := s.opts.TracerouteTimeout
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+
+	start := time.Now()
+	id, err := s.opts.Traceroute(n.Num(), req.Channel, req.HopLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ch := make(chan *latestpb.MeshPacket, 1)
+	s.mu.Lock()
+	s.waiters[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiters, id)
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pkt := <-ch:
+		var rd latestpb.RouteDiscovery
+		if err := proto.Unmarshal(pkt.GetDecoded().GetPayload(), &rd); err != nil {
+			http.Error(w, "invalid reply: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		res := s.result(&rd, n.Num(), pkt.GetTo())
+		res.ID, res.Duration = id, time.Since(start).Seconds()
+		writeJSON(w, http.StatusOK, res)
+	case <-timer.C:
+		http.Error(w, "no reply from "+n.ID, http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+	}
+}
+
+// HandlePacket completes the pending traceroute answered by pkt, if any.
+func (s *Server) HandlePacket(pkt *latestpb.MeshPacket) {
+	dec := pkt.GetDecoded()
+	if dec == nil || dec.GetPortnum() != latestpb.PortNum_TRACEROUTE_APP || dec.GetRequestId() == 0 {
+		return
+	}
+	s.mu.Lock()
+	ch, ok := s.waiters[dec.GetRequestId()]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- pkt:
+	default:
+	}
+}
+
+// result converts a route discovery to the hops towards dest, ending with
+// dest, and back to origin, ending with origin.
+func (s *Server) result(rd *latestpb.RouteDiscovery, dest, origin uint32) TracerouteResult {
+	res := TracerouteResult{
+		To:      nodemap.FormatID(dest),
+		Towards: s.hops(append(append([]uint32{}, rd.GetRoute()...), dest), rd.GetSnrTowards()),
+	}
+	if len(rd.GetSnrBack()) > 0 || len(rd.GetRouteBack()) > 0 {
+		res.Back = s.hops(append(append([]uint32{}, rd.GetRouteBack()...), origin), rd.GetSnrBack())
+	}
+	return res
+}
+
+func (s *Server) hops(nums []uint32, snrs []int32) []Hop {
+	out := make([]Hop, 0, len(nums))
+	for i, num := range nums {
+		id := nodemap.FormatID(num)
+		h := Hop{ID: id, Name: s.opts.Nodes.ResolveLong(id)}
+		if i < len(snrs) && snrs[i] != unknownSNR {
+			snr := float64(snrs[i]) / 4
+			h.SNR = &snr
+		}
+		out = append(out, h)
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+// Package influx writes telemetry and link quality samples as InfluxDB line
+// protocol to an HTTP v2 write endpoint, a UDP listener or a file.
+package influx
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Point is a single line protocol sample.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	// Fields holds bool, string, integer and float values.
+	Fields map[string]any
+	Time   time.Time
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Line encodes p as a line of the line protocol with nanosecond timestamp,
+// tags and fields sorted by key. It returns "" when p has no valid field.
+func (p Point) Line() string {
+	var fields []string
+	for k, v := range p.Fields {
+		if s, ok := formatField(v); ok {
+			fields = append(fields, keyEscaper.Replace(k)+"="+s)
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	sort.Strings(fields)
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+	keys := make([]string, 0, len(p.Tags))
+	for k, v := range p.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(keyEscaper.Replace(p.Tags[k]))
+	}
+	b.WriteByte(' ')
+	b.WriteString(strings.Join(fields, ","))
+	if !p.Time.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+	}
+	return b.String()
+}
+
+func formatField(v any) (string, bool) {
+	switch x := v.(type) {
+	case bool:
+		return strconv.FormatBool(x), true
+	case string:
+		return `"` + stringEscaper.Replace(x) + `"`, true
+	case int:
+		return strconv.FormatInt(int64(x), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(x), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(x, 10) + "i", true
+	case uint32:
+		return strconv.FormatUint(uint64(x), 10) + "i", true
+	case uint64:
+		if x > math.MaxInt64 {
+			return "", false
+		}
+		return strconv.FormatUint(x, 10) + "i", true
+	case float32:
+		if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(float64(x), 'f', -1, 32), true
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(x, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// rxTime returns the packet RX time, or now when the radio did not set it.
+func rxTime(pkt *latestpb.MeshPacket) time.Time {
+	if pkt.GetRxTime() != 0 {
+		return time.Unix(int64(pkt.GetRxTime()), 0)
+	}
+	return time.Now()
+}
+
+// TelemetryPoint converts every metric set in the telemetry variant (device,
+// environment, air quality, power, local stats, health or host metrics) to
+// fields of a measurement named after the variant, e.g. "device_metrics".
+func TelemetryPoint(node, gateway string, tm *latestpb.Telemetry, ts time.Time) (Point, bool) {
+	m := tm.ProtoReflect()
+	fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("variant"))
+	if fd == nil || fd.Kind() != protoreflect.MessageKind {
+		return Point{}, false
+	}
+	p := Point{
+		Measurement: string(fd.Name()),
+		Tags:        map[string]string{"node": node, "gateway": gateway},
+		Fields:      map[string]any{},
+		Time:        ts,
+	}
+	m.Get(fd).Message().Range(func(f protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if f.IsList() || f.IsMap() {
+			return true
+		}
+		switch f.Kind() {
+		case protoreflect.BoolKind:
+			p.Fields[string(f.Name())] = v.Bool()
+		case protoreflect.StringKind:
+			p.Fields[string(f.Name())] = v.String()
+		case protoreflect.EnumKind:
+			if ev := f.Enum().Values().ByNumber(v.Enum()); ev != nil {
+				p.Fields[string(f.Name())] = string(ev.Name())
+			}
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+			protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			p.Fields[string(f.Name())] = v.Int()
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+			protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+			p.Fields[string(f.Name())] = v.Uint()
+		case protoreflect.FloatKind:
+			p.Fields[string(f.Name())] = float32(v.Float())
+		case protoreflect.DoubleKind:
+			p.Fields[string(f.Name())] = v.Float()
+		}
+		return true
+	})
+	return p, len(p.Fields) > 0
+}
+
+// LinkPoint returns the link quality of a packet heard directly or relayed
+// to the gateway: RX SNR and RSSI and the hop counters.
+func LinkPoint(gateway string, pkt *latestpb.MeshPacket) (Point, bool) {
+	if pkt.GetRxSnr() == 0 && pkt.GetRxRssi() == 0 {
+		return Point{}, false
+	}
+	p := Point{
+		Measurement: "link_quality",
+		Tags:        map[string]string{"node": fmt.Sprintf("0x%x", pkt.GetFrom()), "gateway": gateway},
+		Fields: map[string]any{
+			"rx_snr":    pkt.GetRxSnr(),
+			"rx_rssi":   pkt.GetRxRssi(),
+			"hop_limit": pkt.GetHopLimit(),
+			"via_mqtt":  pkt.GetViaMqtt(),
+		},
+		Time: rxTime(pkt),
+	}
+	if pkt.GetHopStart() != 0 && pkt.GetHopStart() >= pkt.GetHopLimit() {
+		p.Fields["hop_start"] = pkt.GetHopStart()
+		p.Fields["hops_away"] = pkt.GetHopStart() - pkt.GetHopLimit()
+	}
+	return p, true
+}
+
+// PacketPoints returns the points recorded for a received packet: its link
+// quality and, for TELEMETRY_APP packets, the reported metrics. An empty
+// gateway leaves out the gateway tag.
+func PacketPoints(gateway string, pkt *latestpb.MeshPacket) []Point {
+	var out []Point
+	if p, ok := LinkPoint(gateway, pkt); ok {
+		out = append(out, p)
+	}
+	if dec := pkt.GetDecoded(); dec != nil && dec.GetPortnum() == latestpb.PortNum_TELEMETRY_APP {
+		var tm latestpb.Telemetry
+		if err := proto.Unmarshal(dec.GetPayload(), &tm); err == nil {
+			if p, ok := TelemetryPoint(fmt.Sprintf("0x%x", pkt.GetFrom()), gateway, &tm, rxTime(pkt)); ok {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
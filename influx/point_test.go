@@ -0,0 +1,79 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+func TestPointLine(t *testing.T) {
+	p := Point{
+		Measurement: "link quality",
+		Tags:        map[string]string{"node": "0x1", "gateway": "gw,1", "empty": ""},
+		Fields:      map[string]any{"snr": float32(-7.25), "rssi": int32(-100), "ok": true, "note": `say "hi"`, "nan": float32(0) / zero},
+		Time:        time.Unix(1700000000, 0),
+	}
+	want := `link\ quality,gateway=gw\,1,node=0x1 note="say \"hi\"",ok=true,rssi=-100i,snr=-7.25 1700000000000000000`
+	if got := p.Line(); got != want {
+		t.Fatalf("unexpected line:\n%s\nwant\n%s", got, want)
+	}
+	if (Point{Measurement: "m"}).Line() != "" {
+		t.Fatalf("point without fields must be skipped")
+	}
+}
+
+var zero float32
+
+func telemetryPacket(tm *latestpb.Telemetry) *latestpb.MeshPacket {
+	payload, _ := proto.Marshal(tm)
+	return &latestpb.MeshPacket{
+		From: 0xa, RxTime: 1700000000, RxSnr: 6.5, RxRssi: -90, HopStart: 3, HopLimit: 1,
+		PayloadVariant: &latestpb.MeshPacket_Decoded{Decoded: &latestpb.Data{
+			Portnum: latestpb.PortNum_TELEMETRY_APP, Payload: payload,
+		}},
+	}
+}
+
+func TestPacketPoints(t *testing.T) {
+	pts := PacketPoints("0x1", telemetryPacket(&latestpb.Telemetry{
+		Time: 1600000000,
+		Variant: &latestpb.Telemetry_EnvironmentMetrics{EnvironmentMetrics: &latestpb.EnvironmentMetrics{
+			Temperature: proto.Float32(21.5), RelativeHumidity: proto.Float32(40), Lux: proto.Float32(0),
+		}},
+	}))
+	if len(pts) != 2 {
+		t.Fatalf("expected link and telemetry points, got %+v", pts)
+	}
+	link := pts[0].Line()
+	if link != "link_quality,gateway=0x1,node=0xa hop_limit=1i,hop_start=3i,hops_away=2i,rx_rssi=-90i,rx_snr=6.5,via_mqtt=false 1700000000000000000" {
+		t.Fatalf("unexpected link line %s", link)
+	}
+	env := pts[1].Line()
+	if !strings.HasPrefix(env, "environment_metrics,gateway=0x1,node=0xa ") || !strings.HasSuffix(env, " 1700000000000000000") {
+		t.Fatalf("unexpected telemetry line %s", env)
+	}
+	for _, f := range []string{"temperature=21.5", "relative_humidity=40", "lux=0"} {
+		if !strings.Contains(env, f) {
+			t.Fatalf("telemetry line %s misses %s", env, f)
+		}
+	}
+
+	pts = PacketPoints("0x1", telemetryPacket(&latestpb.Telemetry{
+		Variant: &latestpb.Telemetry_DeviceMetrics{DeviceMetrics: &latestpb.DeviceMetrics{
+			BatteryLevel: proto.Uint32(87), Voltage: proto.Float32(4.1),
+		}},
+	}))
+	if len(pts) != 2 || pts[1].Measurement != "device_metrics" || pts[1].Fields["battery_level"] != uint64(87) {
+		t.Fatalf("unexpected device metrics %+v", pts)
+	}
+
+	// Before the local node number is known there is no gateway tag.
+	pts = PacketPoints("", telemetryPacket(&latestpb.Telemetry{}))
+	if len(pts) != 1 || !strings.HasPrefix(pts[0].Line(), "link_quality,node=0xa ") {
+		t.Fatalf("unexpected points without gateway %+v", pts)
+	}
+}
@@ -0,0 +1,187 @@
+package influx
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pointsWritten = promauto.NewCounter(prometheus.CounterOpts{Name: "meshspy_influx_points_written_total",
+		Help: "Line protocol points delivered to the InfluxDB sink."})
+	pointsDropped = promauto.NewCounter(prometheus.CounterOpts{Name: "meshspy_influx_points_dropped_total",
+		Help: "Line protocol points dropped after failed writes or buffer overflow."})
+)
+
+// Options tune batching and retries of a Sink. Zero values select the
+// defaults.
+type Options struct {
+	// BatchSize is the number of points written at once (default 500).
+	BatchSize int
+	// FlushInterval bounds how long points wait in the buffer (default 10s).
+	FlushInterval time.Duration
+	// MaxRetries is the number of retries of a failed batch (default 3,
+	// negative disables retries).
+	MaxRetries int
+	// RetryBackoff is the first retry delay, doubled at each retry
+	// (default 1s).
+	RetryBackoff time.Duration
+	// MaxBuffered caps the points kept while the target is unreachable;
+	// the oldest are dropped first (default 10000).
+	MaxBuffered int
+}
+
+func (o Options) withDefaults() Options {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 10 * time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = time.Second
+	}
+	if o.MaxBuffered <= 0 {
+		o.MaxBuffered = 10000
+	}
+	if o.MaxBuffered < o.BatchSize {
+		o.MaxBuffered = o.BatchSize
+	}
+	return o
+}
+
+// Sink buffers points and writes them in batches, retrying failed writes
+// with exponential backoff.
+type Sink struct {
+	w    Writer
+	opts Options
+
+	mu      sync.Mutex
+	lines   []string
+	flushCh chan struct{}
+	writeMu sync.Mutex
+}
+
+// NewSink returns a sink writing to w. Call Run to start flushing.
+func NewSink(w Writer, opts Options) *Sink {
+	return &Sink{w: w, opts: opts.withDefaults(), flushCh: make(chan struct{}, 1)}
+}
+
+// Add queues points for writing. A full batch triggers a flush.
+func (s *Sink) Add(points ...Point) {
+	s.mu.Lock()
+	for _, p := range points {
+		if l := p.Line(); l != "" {
+			s.lines = append(s.lines, l)
+		}
+	}
+	if over := len(s.lines) - s.opts.MaxBuffered; over > 0 {
+		s.lines = s.lines[over:]
+		pointsDropped.Add(float64(over))
+	}
+	full := len(s.lines) >= s.opts.BatchSize
+	s.mu.Unlock()
+	if full {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Buffered returns the number of points waiting to be written.
+func (s *Sink) Buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lines)
+}
+
+// Run flushes the buffer every FlushInterval or when a batch is full until
+// ctx is cancelled, then writes what is left and closes the writer.
+func (s *Sink) Run(ctx context.Context) {
+	t := time.NewTicker(s.opts.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := s.Flush(final); err != nil {
+				log.Printf("influx: final flush: %v", err)
+			}
+			cancel()
+			s.w.Close()
+			return
+		case <-t.C:
+		case <-s.flushCh:
+		}
+		if err := s.Flush(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("influx: %v", err)
+		}
+	}
+}
+
+// Flush writes the buffered points batch by batch. A batch that still fails
+// after the retries is put back in the buffer when the error is temporary
+// and dropped otherwise.
+func (s *Sink) Flush(ctx context.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	for {
+		s.mu.Lock()
+		n := len(s.lines)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		batch := append([]string(nil), s.lines[:n]...)
+		s.lines = s.lines[n:]
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.write(ctx, batch); err != nil {
+			if retryable(err) {
+				s.requeue(batch)
+			} else {
+				pointsDropped.Add(float64(len(batch)))
+			}
+			return err
+		}
+		pointsWritten.Add(float64(len(batch)))
+	}
+}
+
+func (s *Sink) write(ctx context.Context, batch []string) error {
+	backoff := s.opts.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = s.w.Write(ctx, batch); err == nil || !retryable(err) || attempt >= s.opts.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// requeue puts a failed batch back in front of the points added meanwhile.
+func (s *Sink) requeue(batch []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(batch, s.lines...)
+	if over := len(s.lines) - s.opts.MaxBuffered; over > 0 {
+		s.lines = s.lines[over:]
+		pointsDropped.Add(float64(over))
+	}
+}
@@ -0,0 +1,127 @@
+package influx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeWriter struct {
+	fail    []error
+	batches [][]string
+}
+
+func (w *fakeWriter) Write(_ context.Context, lines []string) error {
+	if len(w.fail) > 0 {
+		err := w.fail[0]
+		w.fail = w.fail[1:]
+		return err
+	}
+	w.batches = append(w.batches, append([]string(nil), lines...))
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+func point(v int) Point {
+	return Point{Measurement: "m", Fields: map[string]any{"v": v}}
+}
+
+func TestSinkBatchesAndRetries(t *testing.T) {
+	w := &fakeWriter{fail: []error{errors.New("timeout")}}
+	s := NewSink(w, Options{BatchSize: 2, RetryBackoff: time.Millisecond})
+	s.Add(point(1), point(2), point(3))
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+	if len(w.batches) != 2 || len(w.batches[0]) != 2 || w.batches[1][0] != "m v=3i" {
+		t.Fatalf("unexpected batches %v", w.batches)
+	}
+	if s.Buffered() != 0 {
+		t.Fatalf("buffer not drained")
+	}
+}
+
+func TestSinkRequeuesAndDrops(t *testing.T) {
+	w := &fakeWriter{fail: []error{errors.New("down"), errors.New("down")}}
+	s := NewSink(w, Options{BatchSize: 2, MaxRetries: 1, RetryBackoff: time.Millisecond})
+	s.Add(point(1))
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if s.Buffered() != 1 {
+		t.Fatalf("failed batch not kept, buffered %d", s.Buffered())
+	}
+
+	// Rejected batches are not retried nor kept.
+	w.fail = []error{&StatusError{Code: http.StatusBadRequest}}
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if s.Buffered() != 0 || len(w.batches) != 0 {
+		t.Fatalf("rejected batch kept: %d %v", s.Buffered(), w.batches)
+	}
+}
+
+func TestSinkBufferLimit(t *testing.T) {
+	s := NewSink(&fakeWriter{}, Options{BatchSize: 2, MaxBuffered: 3})
+	s.Add(point(1), point(2), point(3), point(4))
+	if s.Buffered() != 3 {
+		t.Fatalf("expected 3 buffered points, got %d", s.Buffered())
+	}
+}
+
+func TestHTTPWriter(t *testing.T) {
+	var gotQuery, gotAuth, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery, gotAuth = r.URL.RawQuery, r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		if strings.Contains(gotBody, "bad") {
+			http.Error(w, "unable to parse", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := Open(srv.URL, "org", "mesh", "secret")
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if err := w.Write(context.Background(), []string{"m v=1i", "m v=2i"}); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if gotQuery != "bucket=mesh&org=org&precision=ns" || gotAuth != "Token secret" || gotBody != "m v=1i\nm v=2i\n" {
+		t.Fatalf("unexpected request %q %q %q", gotQuery, gotAuth, gotBody)
+	}
+	err = w.Write(context.Background(), []string{"bad"})
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusBadRequest || retryable(err) {
+		t.Fatalf("expected non retryable status error, got %v", err)
+	}
+}
+
+func TestFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.lp")
+	w, err := Open("file://"+path, "", "", "")
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	w.Write(context.Background(), []string{"m v=1i"})
+	w.Write(context.Background(), []string{"m v=2i"})
+	w.Close()
+	b, _ := os.ReadFile(path)
+	if string(b) != "m v=1i\nm v=2i\n" {
+		t.Fatalf("unexpected file %q", b)
+	}
+	if _, err := Open("ftp://x", "", "", ""); err == nil {
+		t.Fatalf("expected error for unsupported target")
+	}
+}
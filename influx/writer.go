@@ -0,0 +1,178 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writer delivers a batch of line protocol lines.
+type Writer interface {
+	Write(ctx context.Context, lines []string) error
+	Close() error
+}
+
+// StatusError is returned by HTTPWriter when the server rejects a batch.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("influx write failed: %d %s", e.Code, e.Body)
+}
+
+// retryable reports whether a failed write may succeed when repeated.
+// Batches rejected as malformed or unauthorized are not retried.
+func retryable(err error) bool {
+	if se, ok := err.(*StatusError); ok {
+		return se.Code == http.StatusTooManyRequests || se.Code >= 500
+	}
+	return true
+}
+
+// HTTPWriter posts batches to the InfluxDB v2 /api/v2/write endpoint.
+type HTTPWriter struct {
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	Client *http.Client
+}
+
+// Write implements Writer.
+func (w *HTTPWriter) Write(ctx context.Context, lines []string) error {
+	q := url.Values{"org": {w.Org}, "bucket": {w.Bucket}, "precision": {"ns"}}
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(w.URL, "/")+"/api/v2/write?"+q.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.Token)
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// Close implements Writer.
+func (w *HTTPWriter) Close() error { return nil }
+
+// maxDatagram keeps UDP packets below the usual Ethernet MTU.
+const maxDatagram = 1400
+
+// UDPWriter sends batches to an InfluxDB UDP listener, packing as many
+// lines as fit in each datagram.
+type UDPWriter struct {
+	conn net.Conn
+}
+
+// NewUDPWriter returns a writer sending to addr (host:port).
+func NewUDPWriter(addr string) (*UDPWriter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPWriter{conn: conn}, nil
+}
+
+// Write implements Writer.
+func (w *UDPWriter) Write(_ context.Context, lines []string) error {
+	var buf bytes.Buffer
+	send := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := w.conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+len(l)+1 > maxDatagram {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(l)
+		buf.WriteByte('\n')
+	}
+	return send()
+}
+
+// Close implements Writer.
+func (w *UDPWriter) Close() error { return w.conn.Close() }
+
+// FileWriter appends batches to a file, for example to be tailed by
+// Telegraf.
+type FileWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileWriter opens path for appending, creating it when missing.
+func NewFileWriter(path string) (*FileWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{f: f}, nil
+}
+
+// Write implements Writer.
+func (w *FileWriter) Write(_ context.Context, lines []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := io.WriteString(w.f, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// Close implements Writer.
+func (w *FileWriter) Close() error { return w.f.Close() }
+
+// Open returns the writer for target: an http(s):// InfluxDB v2 base URL,
+// udp://host:port or file:///path.
+func Open(target, org, bucket, token string) (Writer, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx target %q: %v", target, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if bucket == "" {
+			return nil, fmt.Errorf("influx bucket required")
+		}
+		return &HTTPWriter{URL: target, Org: org, Bucket: bucket, Token: token,
+			Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "udp":
+		return NewUDPWriter(u.Host)
+	case "file":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		return NewFileWriter(path)
+	}
+	return nil, fmt.Errorf("unsupported influx target %q", target)
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	mqttpkg "meshspy/client"
+	"meshspy/events"
 	"meshspy/storage"
 
 	"google.golang.org/protobuf/encoding/protojson"
@@ -20,6 +22,11 @@ import (
 type Client struct {
 	baseURL string
 	http    *http.Client
+	// node is the node the uploads are about, sent as the node query
+	// parameter.
+	node string
+	// token is the credential issued to the gateway at adoption.
+	token string
 }
 
 // New returns a new API client for the given base URL. If url is empty,
@@ -34,6 +41,28 @@ func New(url string) *Client {
 	}
 }
 
+// WithNode returns a copy of c whose telemetry, waypoint, admin and alert
+// uploads are attributed to node nodeID, e.g. the sender of the packet.
+func (c *Client) WithNode(nodeID string) *Client {
+	if c == nil {
+		return nil
+	}
+	cc := *c
+	cc.node = nodeID
+	return &cc
+}
+
+// WithToken returns a copy of c authenticating its requests with the
+// credential issued to the gateway.
+func (c *Client) WithToken(token string) *Client {
+	if c == nil {
+		return nil
+	}
+	cc := *c
+	cc.token = token
+	return &cc
+}
+
 // SendNode uploads a NodeInfo to the management server.
 func (c *Client) SendNode(info *mqttpkg.NodeInfo) error {
 	if c == nil {
@@ -43,20 +72,7 @@ func (c *Client) SendNode(info *mqttpkg.NodeInfo) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/nodes", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %s", resp.Status)
-	}
-	return nil
+	return c.post("/api/nodes", b)
 }
 
 // SendCommand sends a command string to the server which will publish it on MQTT.
@@ -71,20 +87,7 @@ func (c *Client) SendCommand(cmd string) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/send", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %s", resp.Status)
-	}
-	return nil
+	return c.post("/api/send", b)
 }
 
 // ListNodes retrieves the known nodes from the server.
@@ -92,19 +95,9 @@ func (c *Client) ListNodes() ([]*mqttpkg.NodeInfo, error) {
 	if c == nil {
 		return nil, nil
 	}
-	resp, err := c.http.Get(c.baseURL + "/api/nodes")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("server returned %s", resp.Status)
-	}
 	var nodes []*mqttpkg.NodeInfo
-	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
-		return nil, err
-	}
-	return nodes, nil
+	err := c.get("/api/nodes", nil, &nodes)
+	return nodes, err
 }
 
 // ListPositions retrieves node positions from the server.
@@ -112,23 +105,9 @@ func (c *Client) ListPositions(nodeID string) ([]storage.NodePosition, error) {
 	if c == nil {
 		return nil, nil
 	}
-	url := c.baseURL + "/api/positions"
-	if nodeID != "" {
-		url += "?node=" + nodeID
-	}
-	resp, err := c.http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("server returned %s", resp.Status)
-	}
 	var pos []storage.NodePosition
-	if err := json.NewDecoder(resp.Body).Decode(&pos); err != nil {
-		return nil, err
-	}
-	return pos, nil
+	err := c.get("/api/positions", nodeQuery(nodeID), &pos)
+	return pos, err
 }
 
 // SendTelemetry uploads a Telemetry message to the management server.
@@ -140,20 +119,7 @@ func (c *Client) SendTelemetry(t *latestpb.Telemetry) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/telemetry", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %s", resp.Status)
-	}
-	return nil
+	return c.post("/api/telemetry", b)
 }
 
 // SendWaypoint uploads a Waypoint message to the management server.
@@ -165,20 +131,7 @@ func (c *Client) SendWaypoint(wp *latestpb.Waypoint) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/waypoints", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %s", resp.Status)
-	}
-	return nil
+	return c.post("/api/waypoints", b)
 }
 
 // SendAdmin uploads raw admin payload to the management server encoded as base64.
@@ -193,20 +146,7 @@ func (c *Client) SendAdmin(payload []byte) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/admin", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %s", resp.Status)
-	}
-	return nil
+	return c.post("/api/admin", b)
 }
 
 // SendAlert uploads an alert text message to the management server.
@@ -221,18 +161,124 @@ func (c *Client) SendAlert(text string) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/alerts", bytes.NewReader(b))
+	return c.post("/api/alerts", b)
+}
+
+// SendEvent forwards an event of the gateway, e.g. a received text
+// message, to the management server, which streams it to its clients.
+func (c *Client) SendEvent(e events.Event) error {
+	if c == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return c.post("/api/events", b)
+}
+
+// ListTelemetry retrieves the telemetry stored for a node, newest first.
+func (c *Client) ListTelemetry(nodeID string) ([]storage.TelemetryRecord, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var out []storage.TelemetryRecord
+	err := c.get("/api/telemetry", nodeQuery(nodeID), &out)
+	return out, err
+}
+
+// ListWaypoints retrieves the active waypoints.
+func (c *Client) ListWaypoints() ([]storage.Waypoint, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var out []storage.Waypoint
+	err := c.get("/api/waypoints", nil, &out)
+	return out, err
+}
+
+// ListAlerts retrieves the alerts uploaded about a node, or about every node
+// when nodeID is empty, newest first.
+func (c *Client) ListAlerts(nodeID string) ([]events.Event, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var out []events.Event
+	err := c.get("/api/alerts", nodeQuery(nodeID), &out)
+	return out, err
+}
+
+// ListAdmin retrieves the admin payloads uploaded about a node, or about
+// every node when nodeID is empty, newest first.
+func (c *Client) ListAdmin(nodeID string) ([]events.Event, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var out []events.Event
+	err := c.get("/api/admin", nodeQuery(nodeID), &out)
+	return out, err
+}
+
+func nodeQuery(nodeID string) url.Values {
+	if nodeID == "" {
+		return nil
+	}
+	return url.Values{"node": {nodeID}}
+}
+
+// StatusError is returned for requests answered with a non-2xx status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string { return "server returned " + e.Status }
+
+// post sends body as JSON to path.
+func (c *Client) post(path string, body []byte) error {
+	var q url.Values
+	if c.node != "" {
+		q = nodeQuery(c.node)
+	}
+	return c.do(http.MethodPost, path, q, body, nil)
+}
+
+// get decodes the JSON answer of path into v.
+func (c *Client) get(path string, q url.Values, v any) error {
+	return c.do(http.MethodGet, path, q, nil, v)
+}
+
+// do sends a request with the JSON body, if any, and decodes the answer
+// into v unless nil.
+func (c *Client) do(method, path string, q url.Values, body []byte, v any) error {
+	u := c.baseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 	resp, err := c.http.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %s", resp.Status)
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	if v == nil {
+		return nil
 	}
-	return nil
+	return json.NewDecoder(resp.Body).Decode(v)
 }
@@ -79,3 +79,23 @@ func TestSendAlert(t *testing.T) {
 		t.Fatalf("bad body %s", got)
 	}
 }
+
+func TestRegisterSendsToken(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/gateways/register" {
+			t.Fatalf("path %s", r.URL.Path)
+		}
+		auth = r.Header.Get("Authorization")
+		io.WriteString(w, `{"status":"adopted","heartbeat":30}`)
+	}))
+	defer srv.Close()
+
+	reg, err := New(srv.URL).WithToken("abc").Register(Announcement{ID: "gw-1"})
+	if err != nil || reg.Status != StatusAdopted || reg.Heartbeat != 30 {
+		t.Fatalf("register returned %+v, %v", reg, err)
+	}
+	if auth != "Bearer abc" {
+		t.Fatalf("unexpected authorization %q", auth)
+	}
+}
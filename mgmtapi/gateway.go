@@ -0,0 +1,87 @@
+package mgmtapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"meshspy/storage"
+)
+
+// Registration states of a gateway.
+const (
+	StatusPending = "pending"
+	StatusAdopted = "adopted"
+)
+
+// Announcement is sent by a gateway to register with the server.
+type Announcement struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Radio      string `json:"radio,omitempty"`
+	Firmware   string `json:"firmware,omitempty"`
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Key is a secret chosen by the gateway; only announcements carrying
+	// the same key collect the credential once the gateway is adopted.
+	Key string `json:"key,omitempty"`
+}
+
+// Registration is the answer to an announcement.
+type Registration struct {
+	Status string `json:"status"`
+	// Token is the credential of the gateway, sent once after adoption.
+	Token string `json:"token,omitempty"`
+	// Heartbeat is the number of seconds between heartbeats.
+	Heartbeat int `json:"heartbeat"`
+}
+
+// Heartbeat reports that a gateway is alive.
+type Heartbeat struct {
+	// Error is the last error of the gateway, empty when healthy.
+	Error      string `json:"error,omitempty"`
+	ConfigHash string `json:"config_hash,omitempty"`
+	Nodes      int    `json:"nodes"`
+	// Uptime is the number of seconds the gateway has been running.
+	Uptime float64 `json:"uptime"`
+}
+
+// Register announces the gateway. Adopted gateways must send their token,
+// see WithToken.
+func (c *Client) Register(a Announcement) (*Registration, error) {
+	if c == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	var reg Registration
+	if err := c.do(http.MethodPost, "/api/gateways/register", nil, b, &reg); err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+// Heartbeat reports that the gateway is alive.
+func (c *Client) Heartbeat(h Heartbeat) error {
+	if c == nil {
+		return nil
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/api/gateways/heartbeat", nil, b, nil)
+}
+
+// PullSettings retrieves the settings pushed to the gateway.
+func (c *Client) PullSettings() (*storage.GatewaySettings, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var s storage.GatewaySettings
+	if err := c.get("/api/gateways/settings", nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
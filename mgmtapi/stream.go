@@ -0,0 +1,70 @@
+package mgmtapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"meshspy/events"
+)
+
+// StreamEvents follows the Server-Sent Events stream of the server, passing
+// the events of the given types, all when empty, to handle. The stream
+// resumes after the event ID after when not 0. It returns when ctx is done
+// or the connection ends; callers reconnect with the ID of the last event
+// handled.
+func (c *Client) StreamEvents(ctx context.Context, types []string, after int64, handle func(events.Event)) error {
+	q := url.Values{}
+	if len(types) > 0 {
+		q.Set("type", strings.Join(types, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/events?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if after > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(after, 10))
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	// The stream outlives the timeout of the other requests.
+	stream := *c.http
+	stream.Timeout = 0
+	resp, err := stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	// Each event is a data line followed by a blank line; comments carry
+	// the keep-alives.
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	var data strings.Builder
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case line == "" && data.Len() > 0:
+			var e events.Event
+			if err := json.Unmarshal([]byte(data.String()), &e); err == nil {
+				handle(e)
+			}
+			data.Reset()
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return sc.Err()
+}
@@ -0,0 +1,41 @@
+package mgmtapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"meshspy/events"
+)
+
+func TestStreamEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/events" || r.URL.Query().Get("type") != "text_message" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if got := r.Header.Get("Last-Event-ID"); got != "41" {
+			t.Errorf("Last-Event-ID %q", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer tok" {
+			t.Errorf("Authorization %q", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": ping\n\n")
+		fmt.Fprint(w, "id: 42\ndata: {\"id\":42,\"type\":\"text_message\",\"node_id\":\"0x1\",\"data\":{\"text\":\"ciao\"}}\n\n")
+		fmt.Fprint(w, "id: 43\ndata: {\"id\":43,\"type\":\"text_message\"}\n\n")
+	}))
+	defer srv.Close()
+
+	var got []events.Event
+	c := New(srv.URL).WithToken("tok")
+	if err := c.StreamEvents(context.Background(), []string{events.TextMessage}, 41, func(e events.Event) {
+		got = append(got, e)
+	}); err != nil {
+		t.Fatalf("StreamEvents returned error: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != 42 || got[0].NodeID != "0x1" || string(got[0].Data) != `{"text":"ciao"}` || got[1].ID != 43 {
+		t.Fatalf("unexpected events %+v", got)
+	}
+}
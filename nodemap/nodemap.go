@@ -1,16 +1,26 @@
+// Package nodemap keeps an in-memory index of the nodes known on the mesh,
+// resolving node IDs to names and names back to IDs.
 package nodemap
 
 import (
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
+	mqttpkg "meshspy/client"
 	latestpb "meshspy/proto/latest/meshtastic"
 )
 
 type Entry struct {
-	Long  string
-	Short string
+	Long      string
+	Short     string
+	HwModel   string
+	Role      string
+	PublicKey string
+	// LastHeard is the Unix time the node was last heard, 0 if unknown.
+	LastHeard int64
 }
 
 type Map struct {
@@ -24,24 +34,89 @@ type Node struct {
 	Entry
 }
 
+// Num returns the node number encoded in the ID.
+func (n Node) Num() uint32 {
+	num, _ := ParseID(n.ID)
+	return num
+}
+
+// Source lists the nodes used to seed a Map, e.g. a storage.Backend.
+type Source interface {
+	List() ([]*mqttpkg.NodeInfo, error)
+}
+
 func New() *Map {
 	return &Map{nodes: make(map[string]Entry)}
 }
 
+// Load adds every node listed by src, so names resolve right after a
+// restart instead of once NodeInfo packets are heard again.
+func (m *Map) Load(src Source) error {
+	nodes, err := src.List()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		m.UpdateInfo(n)
+	}
+	return nil
+}
+
 func (m *Map) Update(num uint32, long, short string) {
-	id := fmt.Sprintf("0x%x", num)
+	m.UpdateEntry(num, Entry{Long: long, Short: short})
+}
+
+// UpdateEntry merges the non-empty fields of e into the entry of num. The
+// last heard time only moves forward.
+func (m *Map) UpdateEntry(num uint32, e Entry) {
+	id := FormatID(num)
 	m.mu.Lock()
-	e := m.nodes[id]
-	if long != "" {
-		e.Long = long
+	cur := m.nodes[id]
+	setIfNotEmpty(&cur.Long, e.Long)
+	setIfNotEmpty(&cur.Short, e.Short)
+	setIfNotEmpty(&cur.HwModel, e.HwModel)
+	setIfNotEmpty(&cur.Role, e.Role)
+	setIfNotEmpty(&cur.PublicKey, e.PublicKey)
+	if e.LastHeard > cur.LastHeard {
+		cur.LastHeard = e.LastHeard
 	}
-	if short != "" {
-		e.Short = short
-	}
-	m.nodes[id] = e
+	m.nodes[id] = cur
 	m.mu.Unlock()
 }
 
+func setIfNotEmpty(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+// UpdateInfo merges a stored or decoded NodeInfo. Nodes without a number
+// are identified by their ID.
+func (m *Map) UpdateInfo(info *mqttpkg.NodeInfo) {
+	if info == nil {
+		return
+	}
+	num := info.Num
+	if num == 0 {
+		num, _ = ParseID(info.ID)
+	}
+	if num == 0 {
+		return
+	}
+	hw := info.HwModel
+	if hw == latestpb.HardwareModel_UNSET.String() {
+		hw = ""
+	}
+	m.UpdateEntry(num, Entry{
+		Long:      info.LongName,
+		Short:     info.ShortName,
+		HwModel:   hw,
+		Role:      info.Role,
+		PublicKey: info.PublicKey,
+		LastHeard: info.LastHeard,
+	})
+}
+
 func (m *Map) UpdateFromProto(ni *latestpb.NodeInfo) {
 	if ni == nil || ni.User == nil {
 		return
@@ -49,7 +124,23 @@ func (m *Map) UpdateFromProto(ni *latestpb.NodeInfo) {
 	if ni.GetNum() == 0 && ni.User.GetLongName() == "" && ni.User.GetShortName() == "" {
 		return
 	}
-	m.Update(ni.GetNum(), ni.User.GetLongName(), ni.User.GetShortName())
+	m.UpdateInfo(mqttpkg.NodeInfoFromProto(ni))
+}
+
+// Seen records that a packet from num was heard at the given Unix time.
+func (m *Map) Seen(num uint32, at int64) {
+	if num == 0 {
+		return
+	}
+	m.UpdateEntry(num, Entry{LastHeard: at})
+}
+
+// Get returns the entry of node id.
+func (m *Map) Get(id string) (Entry, bool) {
+	m.mu.RLock()
+	e, ok := m.nodes[id]
+	m.mu.RUnlock()
+	return e, ok
 }
 
 func (m *Map) Resolve(id string) string {
@@ -86,6 +177,44 @@ func (m *Map) ResolveLong(id string) string {
 	return id
 }
 
+// Lookup finds a node by ID (0x1a2b or !00001a2b), long name or short name,
+// ignoring case. When several nodes share the name the most recently heard
+// wins. A bare decimal node number is accepted as a last resort. Nodes
+// given by ID are returned even when not in the map.
+func (m *Map) Lookup(s string) (Node, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Node{}, false
+	}
+	if num, ok := ParseID(s); ok {
+		id := FormatID(num)
+		e, _ := m.Get(id)
+		return Node{ID: id, Entry: e}, true
+	}
+
+	var best Node
+	found := false
+	m.mu.RLock()
+	for id, e := range m.nodes {
+		if !strings.EqualFold(e.Long, s) && !strings.EqualFold(e.Short, s) {
+			continue
+		}
+		if !found || e.LastHeard > best.LastHeard || (e.LastHeard == best.LastHeard && id < best.ID) {
+			best, found = Node{ID: id, Entry: e}, true
+		}
+	}
+	m.mu.RUnlock()
+	if found {
+		return best, true
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil && n != 0 {
+		id := FormatID(uint32(n))
+		e, _ := m.Get(id)
+		return Node{ID: id, Entry: e}, true
+	}
+	return Node{}, false
+}
+
 // List returns a snapshot of all known nodes sorted by id.
 func (m *Map) List() []Node {
 	m.mu.RLock()
@@ -97,3 +226,26 @@ func (m *Map) List() []Node {
 	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
 	return nodes
 }
+
+// FormatID returns the 0x-prefixed hexadecimal ID used for node num.
+func FormatID(num uint32) string {
+	return fmt.Sprintf("0x%x", num)
+}
+
+// ParseID parses a node ID written as 0x1a2b or !00001a2b.
+func ParseID(s string) (uint32, bool) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "!"):
+		s = s[1:]
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		s = s[2:]
+	default:
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
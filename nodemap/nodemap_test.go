@@ -2,7 +2,9 @@ package nodemap
 
 import (
 	"fmt"
+	"testing"
 
+	mqttpkg "meshspy/client"
 	latestpb "meshspy/proto/latest/meshtastic"
 )
 
@@ -41,3 +43,61 @@ func ExampleMap_ResolveLong_fallbackShort() {
 	fmt.Println(nm.ResolveLong("0x1"))
 	// Output: A
 }
+
+type listSource []*mqttpkg.NodeInfo
+
+func (s listSource) List() ([]*mqttpkg.NodeInfo, error) { return s, nil }
+
+func TestLoadAndLookup(t *testing.T) {
+	nm := New()
+	err := nm.Load(listSource{
+		{ID: "0xa", Num: 0xa, LongName: "Monte Serra", ShortName: "MS", HwModel: "RAK4631", Role: "ROUTER", PublicKey: "a2V5", LastHeard: 100},
+		{ID: "0xb", Num: 0xb, LongName: "Base", ShortName: "B1", LastHeard: 200},
+		{ID: "0xc", Num: 0xc, LongName: "base", ShortName: "B2", LastHeard: 300},
+		{ID: "!0000000d", LongName: "Dash"},
+	})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if got := nm.ResolveLong("0xa"); got != "Monte Serra" {
+		t.Fatalf("ResolveLong = %q", got)
+	}
+	e, ok := nm.Get("0xa")
+	if !ok || e.HwModel != "RAK4631" || e.Role != "ROUTER" || e.PublicKey != "a2V5" || e.LastHeard != 100 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"monte serra", "0xa"},
+		{"ms", "0xa"},
+		{"!0000000a", "0xa"},
+		{"0xA", "0xa"},
+		{"Base", "0xc"}, // most recently heard wins
+		{"B1", "0xb"},
+		{"Dash", "0xd"},
+		{"!12345678", "0x12345678"},
+		{"11", "0xb"},
+	}
+	for _, tt := range tests {
+		n, ok := nm.Lookup(tt.query)
+		if !ok || n.ID != tt.want {
+			t.Errorf("Lookup(%q) = %q, %v; want %q", tt.query, n.ID, ok, tt.want)
+		}
+	}
+	if _, ok := nm.Lookup("nobody"); ok {
+		t.Fatalf("expected unknown name to fail")
+	}
+
+	// Updates keep known fields and only move LastHeard forward.
+	nm.UpdateFromProto(&latestpb.NodeInfo{Num: 0xa, User: &latestpb.User{LongName: "Serra"}, LastHeard: 50})
+	nm.Seen(0xa, 400)
+	if e, _ := nm.Get("0xa"); e.Long != "Serra" || e.HwModel != "RAK4631" || e.LastHeard != 400 {
+		t.Fatalf("unexpected merged entry %+v", e)
+	}
+	if n, _ := nm.Lookup("Serra"); n.Num() != 0xa {
+		t.Fatalf("unexpected node number %d", n.Num())
+	}
+}
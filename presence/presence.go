@@ -0,0 +1,205 @@
+// Package presence tracks whether nodes are still heard on the mesh and
+// emits node_new, node_online and node_offline events on transitions.
+package presence
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"meshspy/events"
+)
+
+// Timeouts holds how long a node may stay silent before it is considered
+// offline. Roles maps device roles (e.g. ROUTER, REPEATER) to their own
+// timeout; other roles use Default.
+type Timeouts struct {
+	Default time.Duration
+	Roles   map[string]time.Duration
+}
+
+// For returns the timeout of role.
+func (t Timeouts) For(role string) time.Duration {
+	if d, ok := t.Roles[role]; ok && d > 0 {
+		return d
+	}
+	return t.Default
+}
+
+// Node is the presence of a single node.
+type Node struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Online    bool      `json:"online"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Since is the time of the last online/offline transition.
+	Since time.Time `json:"since"`
+
+	// known is set once the node has been heard or restored.
+	known bool
+}
+
+// eventData is the payload of the presence events.
+type eventData struct {
+	Name     string    `json:"name,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	// Timeout is the silence in seconds after which the node goes offline.
+	Timeout float64 `json:"timeout"`
+}
+
+// Tracker keeps the presence of every node heard and reports transitions
+// to emit.
+type Tracker struct {
+	mu       sync.Mutex
+	timeouts Timeouts
+	nodes    map[string]*Node
+	emit     func(events.Event)
+	now      func() time.Time
+}
+
+// New returns a Tracker applying timeouts. emit may be nil.
+func New(timeouts Timeouts, emit func(events.Event)) *Tracker {
+	return &Tracker{timeouts: timeouts, nodes: make(map[string]*Node), emit: emit, now: time.Now}
+}
+
+// Restore registers a node known from a previous run without emitting
+// events, so that restarts do not report every node as new.
+func (t *Tracker) Restore(n Node) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n.FirstSeen.IsZero() {
+		n.FirstSeen = n.LastSeen
+	}
+	if n.Since.IsZero() {
+		n.Since = n.LastSeen
+	}
+	n.known = true
+	t.nodes[n.ID] = &n
+}
+
+// Update records the name and role of node id, as learned from NodeInfo.
+// It does not mark the node as heard.
+func (t *Tracker) Update(id, name, role string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n, ok := t.nodes[id]; ok {
+		if name != "" {
+			n.Name = name
+		}
+		if role != "" {
+			n.Role = role
+		}
+		return
+	}
+	t.nodes[id] = &Node{ID: id, Name: name, Role: role}
+}
+
+// Seen records that a packet from node id was received at at. A node heard
+// for the first time emits node_new; a node that was offline emits
+// node_online.
+func (t *Tracker) Seen(id string, at time.Time) {
+	var out []events.Event
+	t.mu.Lock()
+	n, ok := t.nodes[id]
+	if !ok {
+		n = &Node{ID: id}
+		t.nodes[id] = n
+	}
+	if !n.known {
+		n.known, n.FirstSeen = true, at
+		out = append(out, t.event(events.NodeNew, n, at))
+	}
+	if at.After(n.LastSeen) {
+		n.LastSeen = at
+	}
+	// Stale reports, e.g. an old LastHeard, do not bring a node back.
+	if !n.Online && at.Add(t.timeouts.For(n.Role)).After(t.now()) {
+		n.Online, n.Since = true, at
+		out = append(out, t.event(events.NodeOnline, n, at))
+	}
+	t.mu.Unlock()
+	t.send(out)
+}
+
+// Check marks as offline the nodes silent for longer than the timeout of
+// their role.
+func (t *Tracker) Check(now time.Time) {
+	var out []events.Event
+	t.mu.Lock()
+	for _, n := range t.nodes {
+		if !n.Online {
+			continue
+		}
+		if now.Sub(n.LastSeen) > t.timeouts.For(n.Role) {
+			n.Online, n.Since = false, now
+			out = append(out, t.event(events.NodeOffline, n, now))
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	t.send(out)
+}
+
+// Run calls Check every interval until ctx is cancelled.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.Check(now)
+		}
+	}
+}
+
+// Get returns the presence of node id.
+func (t *Tracker) Get(id string) (Node, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return *n, true
+}
+
+// Nodes returns the presence of every node heard or restored, sorted by ID.
+func (t *Tracker) Nodes() []Node {
+	t.mu.Lock()
+	out := make([]Node, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		if n.known {
+			out = append(out, *n)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// event builds a presence event for n. The caller must hold t.mu.
+func (t *Tracker) event(typ string, n *Node, at time.Time) events.Event {
+	e := events.New(typ, n.ID, eventData{
+		Name:     n.Name,
+		Role:     n.Role,
+		LastSeen: n.LastSeen,
+		Timeout:  t.timeouts.For(n.Role).Seconds(),
+	})
+	e.Time = at.UTC()
+	return e
+}
+
+func (t *Tracker) send(evs []events.Event) {
+	if t.emit == nil {
+		return
+	}
+	for _, e := range evs {
+		t.emit(e)
+	}
+}
@@ -0,0 +1,78 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"meshspy/events"
+)
+
+func newTestTracker(now *time.Time) (*Tracker, *[]events.Event) {
+	var got []events.Event
+	tr := New(Timeouts{Default: 2 * time.Hour, Roles: map[string]time.Duration{"ROUTER": 30 * time.Minute}},
+		func(e events.Event) { got = append(got, e) })
+	tr.now = func() time.Time { return *now }
+	return tr, &got
+}
+
+func types(evs []events.Event) []string {
+	var out []string
+	for _, e := range evs {
+		out = append(out, e.Type+" "+e.NodeID)
+	}
+	return out
+}
+
+func TestTrackerTransitions(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	tr, got := newTestTracker(&now)
+
+	tr.Update("0xa", "Hilltop", "ROUTER")
+	tr.Seen("0xa", now)
+	tr.Seen("0xb", now)
+	tr.Seen("0xa", now.Add(time.Minute))
+	if ts := types(*got); len(ts) != 4 || ts[0] != "node_new 0xa" || ts[1] != "node_online 0xa" || ts[3] != "node_online 0xb" {
+		t.Fatalf("unexpected events %v", ts)
+	}
+
+	// The router times out after 30 minutes, the client after 2 hours.
+	*got = nil
+	tr.Check(now.Add(40 * time.Minute))
+	if ts := types(*got); len(ts) != 1 || ts[0] != "node_offline 0xa" {
+		t.Fatalf("unexpected events %v", ts)
+	}
+	tr.Check(now.Add(50 * time.Minute))
+	if len(*got) != 1 {
+		t.Fatalf("offline reported twice: %v", types(*got))
+	}
+	n, _ := tr.Get("0xa")
+	if n.Online || n.Name != "Hilltop" || !n.LastSeen.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected node %+v", n)
+	}
+
+	*got = nil
+	now = now.Add(time.Hour)
+	tr.Seen("0xa", now)
+	if ts := types(*got); len(ts) != 1 || ts[0] != "node_online 0xa" {
+		t.Fatalf("unexpected events %v", ts)
+	}
+}
+
+func TestTrackerRestoreAndStaleReports(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	tr, got := newTestTracker(&now)
+
+	tr.Restore(Node{ID: "0xa", Role: "ROUTER", LastSeen: now.Add(-time.Hour)})
+	// An old LastHeard neither announces a new node nor brings it online.
+	tr.Seen("0xa", now.Add(-50*time.Minute))
+	if len(*got) != 0 {
+		t.Fatalf("unexpected events %v", types(*got))
+	}
+	tr.Seen("0xa", now)
+	if ts := types(*got); len(ts) != 1 || ts[0] != "node_online 0xa" {
+		t.Fatalf("unexpected events %v", ts)
+	}
+	if nodes := tr.Nodes(); len(nodes) != 1 || !nodes[0].Online {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+}
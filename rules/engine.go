@@ -0,0 +1,259 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"meshspy/events"
+)
+
+// Notification describes a rule firing or resolving.
+type Notification struct {
+	Rule   string `json:"rule"`
+	NodeID string `json:"node_id,omitempty"`
+	// Name is the name of the node when known, its ID otherwise.
+	Name string `json:"name,omitempty"`
+
+	Metric string  `json:"metric,omitempty"`
+	Value  float64 `json:"value,omitempty"`
+
+	Event     string `json:"event,omitempty"`
+	EventText string `json:"event_text,omitempty"`
+
+	// Text is the rendered message of the rule.
+	Text     string    `json:"text"`
+	Resolved bool      `json:"resolved"`
+	Time     time.Time `json:"time"`
+}
+
+// Options configures an Engine.
+type Options struct {
+	// Node returns the name and role of a node, used by the node filters
+	// and the messages. It may be nil.
+	Node func(id string) (name, role string)
+	// Notify is called for every action of a rule firing or resolving,
+	// from the goroutine feeding the engine: it must not block, e.g. it
+	// queues the notification on a Sender.
+	Notify func(Action, Notification)
+}
+
+// Engine evaluates rules against metrics and events. Each rule keeps a
+// separate state per node.
+type Engine struct {
+	rules  []*Rule
+	byName map[string]*Rule
+	opts   Options
+
+	mu     sync.Mutex
+	states map[stateKey]*state
+}
+
+type stateKey struct {
+	rule, node string
+}
+
+type state struct {
+	// pending is when the condition of a metric rule started to hold.
+	pending time.Time
+	firing  bool
+	value   float64
+	// last is when an event rule last fired for the node.
+	last time.Time
+}
+
+// New returns an engine evaluating rules.
+func New(rules []*Rule, opts Options) *Engine {
+	e := &Engine{rules: rules, byName: make(map[string]*Rule), opts: opts, states: make(map[stateKey]*state)}
+	for _, r := range rules {
+		e.byName[r.Name] = r
+	}
+	return e
+}
+
+// Rules returns the rules evaluated by the engine.
+func (e *Engine) Rules() []*Rule { return e.rules }
+
+// Observe records the value of metric reported by node at at. Metric rules
+// whose condition has held for their duration fire; firing rules resolve
+// once the value crosses their clear threshold.
+func (e *Engine) Observe(node, metric string, v float64, at time.Time) {
+	var out []Notification
+	name, role := e.node(node)
+	e.mu.Lock()
+	for _, r := range e.rules {
+		if r.Metric != metric || !r.appliesTo(node, name, role) {
+			continue
+		}
+		s := e.state(r, node)
+		s.value = v
+		if r.holds(v, s.firing) {
+			if s.pending.IsZero() {
+				s.pending = at
+			}
+			if !s.firing && at.Sub(s.pending) >= r.For {
+				s.firing = true
+				out = append(out, e.notification(r, node, name, at, false))
+			}
+			continue
+		}
+		s.pending = time.Time{}
+		if s.firing {
+			s.firing = false
+			if r.resolved != nil {
+				out = append(out, e.notification(r, node, name, at, true))
+			}
+		}
+	}
+	e.mu.Unlock()
+	e.send(out)
+}
+
+// HandleEvent evaluates the event rules against ev. Presence events also
+// update the online metric of the node.
+func (e *Engine) HandleEvent(ev events.Event) {
+	switch ev.Type {
+	case events.NodeOnline:
+		e.Observe(ev.NodeID, MetricOnline, 1, ev.Time)
+	case events.NodeOffline:
+		e.Observe(ev.NodeID, MetricOnline, 0, ev.Time)
+	}
+
+	var out []Notification
+	text := eventText(ev)
+	name, role := e.node(ev.NodeID)
+	e.mu.Lock()
+	for _, r := range e.rules {
+		if r.Event != ev.Type || !r.appliesTo(ev.NodeID, name, role) || !r.matchesText(text) {
+			continue
+		}
+		s := e.state(r, ev.NodeID)
+		if !s.last.IsZero() && ev.Time.Sub(s.last) < r.Debounce {
+			continue
+		}
+		s.last = ev.Time
+		n := Notification{Rule: r.Name, NodeID: ev.NodeID, Name: name, Event: ev.Type, EventText: text, Time: ev.Time.UTC()}
+		if n.Name == "" {
+			n.Name = n.NodeID
+		}
+		n.Text = render(r.message, n)
+		out = append(out, n)
+	}
+	e.mu.Unlock()
+	e.send(out)
+}
+
+// Tick fires the metric rules whose condition has held for their duration
+// without new samples, such as a node staying offline.
+func (e *Engine) Tick(now time.Time) {
+	var out []Notification
+	e.mu.Lock()
+	for k, s := range e.states {
+		r := e.byName[k.rule]
+		if r.Metric == "" || s.firing || s.pending.IsZero() || now.Sub(s.pending) < r.For {
+			continue
+		}
+		s.firing = true
+		name, _ := e.node(k.node)
+		out = append(out, e.notification(r, k.node, name, now, false))
+	}
+	e.mu.Unlock()
+	e.send(out)
+}
+
+// Run calls Tick every interval until ctx is cancelled.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.Tick(now)
+		}
+	}
+}
+
+// Firing returns the number of rule and node pairs currently firing.
+func (e *Engine) Firing() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for _, s := range e.states {
+		if s.firing {
+			n++
+		}
+	}
+	return n
+}
+
+// state returns the state of r for node. The caller must hold e.mu.
+func (e *Engine) state(r *Rule, node string) *state {
+	k := stateKey{r.Name, node}
+	s, ok := e.states[k]
+	if !ok {
+		s = &state{}
+		e.states[k] = s
+	}
+	return s
+}
+
+// notification builds the notification of metric rule r for node. The
+// caller must hold e.mu.
+func (e *Engine) notification(r *Rule, node, name string, at time.Time, resolved bool) Notification {
+	n := Notification{
+		Rule: r.Name, NodeID: node, Name: name, Time: at.UTC(), Resolved: resolved,
+		Metric: r.Metric, Value: e.states[stateKey{r.Name, node}].value,
+	}
+	if n.Name == "" {
+		n.Name = node
+	}
+	t := r.message
+	if resolved {
+		t = r.resolved
+	}
+	n.Text = render(t, n)
+	return n
+}
+
+func (e *Engine) node(id string) (name, role string) {
+	if e.opts.Node == nil || id == "" {
+		return "", ""
+	}
+	return e.opts.Node(id)
+}
+
+func (e *Engine) send(out []Notification) {
+	if e.opts.Notify == nil {
+		return
+	}
+	for _, n := range out {
+		for _, a := range e.byName[n.Rule].Notify {
+			e.opts.Notify(a, n)
+		}
+	}
+}
+
+// eventText returns the "text" field of the event data, if any.
+func eventText(ev events.Event) string {
+	var d struct {
+		Text string `json:"text"`
+	}
+	if len(ev.Data) > 0 {
+		_ = json.Unmarshal(ev.Data, &d)
+	}
+	return d.Text
+}
+
+// render executes t with n, falling back to the rule name on errors.
+func render(t *template.Template, n Notification) string {
+	var b strings.Builder
+	if err := t.Execute(&b, n); err != nil {
+		return n.Rule
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,108 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"meshspy/events"
+)
+
+func newTestEngine(t *testing.T, src string) (*Engine, *[]Notification) {
+	rules, err := Parse([]byte(src))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	var got []Notification
+	e := New(rules, Options{
+		Node:   func(id string) (string, string) { return "Node " + id, "CLIENT" },
+		Notify: func(a Action, n Notification) { got = append(got, n) },
+	})
+	return e, &got
+}
+
+func TestMetricRuleDebounceAndHysteresis(t *testing.T) {
+	e, got := newTestEngine(t, `
+rules:
+  - name: battery
+    metric: battery_level
+    op: "<"
+    value: 20
+    clear: 25
+    for: 10m
+    message: "{{.Name}} {{.Value}}%"
+    resolved_message: "{{.Name}} ok"
+    notify: [{mqtt: alerts}]
+`)
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.Observe("0xa", "battery_level", 15, now)
+	e.Observe("0xa", "battery_level", 14, now.Add(5*time.Minute))
+	if len(*got) != 0 {
+		t.Fatalf("fired before 10 minutes: %+v", *got)
+	}
+	e.Observe("0xa", "battery_level", 13, now.Add(10*time.Minute))
+	if len(*got) != 1 || (*got)[0].Text != "Node 0xa 13%" || (*got)[0].Resolved {
+		t.Fatalf("unexpected notifications %+v", *got)
+	}
+	// Between the trigger and the clear threshold the rule keeps firing.
+	e.Observe("0xa", "battery_level", 22, now.Add(15*time.Minute))
+	e.Observe("0xa", "battery_level", 13, now.Add(16*time.Minute))
+	if len(*got) != 1 || e.Firing() != 1 {
+		t.Fatalf("flapping around the threshold: %+v", *got)
+	}
+	e.Observe("0xa", "battery_level", 30, now.Add(20*time.Minute))
+	if len(*got) != 2 || !(*got)[1].Resolved || (*got)[1].Text != "Node 0xa ok" || e.Firing() != 0 {
+		t.Fatalf("unexpected notifications %+v", *got)
+	}
+}
+
+func TestOfflineRuleFiresOnTick(t *testing.T) {
+	e, got := newTestEngine(t, `
+rules:
+  - name: offline
+    metric: online
+    op: "=="
+    value: 0
+    for: 30m
+    notify: [{mesh: 0}]
+`)
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.HandleEvent(events.Event{Type: events.NodeOffline, NodeID: "0xa", Time: now})
+	e.Tick(now.Add(20 * time.Minute))
+	if len(*got) != 0 {
+		t.Fatalf("fired early: %+v", *got)
+	}
+	e.Tick(now.Add(31 * time.Minute))
+	e.Tick(now.Add(40 * time.Minute))
+	if len(*got) != 1 || (*got)[0].NodeID != "0xa" {
+		t.Fatalf("unexpected notifications %+v", *got)
+	}
+}
+
+func TestEventRuleDebounce(t *testing.T) {
+	e, got := newTestEngine(t, `
+rules:
+  - name: sos
+    event: text_message
+    contains: SOS
+    debounce: 5m
+    notify: [{webhook: ops}]
+`)
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	send := func(node, text string, at time.Time) {
+		ev := events.New(events.TextMessage, node, map[string]string{"text": text})
+		ev.Time = at
+		e.HandleEvent(ev)
+	}
+	send("0xa", "all good", now)
+	send("0xa", "sos! help", now.Add(time.Minute))
+	send("0xa", "SOS again", now.Add(2*time.Minute))
+	send("0xb", "SOS", now.Add(2*time.Minute))
+	send("0xa", "SOS later", now.Add(7*time.Minute))
+	if len(*got) != 3 {
+		t.Fatalf("unexpected notifications %+v", *got)
+	}
+	if n := (*got)[0]; n.EventText != "sos! help" || !strings.Contains(n.Text, "Node 0xa") {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+}
@@ -0,0 +1,99 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// senderQueue is the number of deliveries buffered by a Sender.
+const senderQueue = 64
+
+// Sender delivers notifications to the destinations of the actions.
+// Notifications queued with Queue are delivered in order by Run, so that a
+// slow destination does not hold up the caller.
+type Sender struct {
+	// MQTT publishes payload on topic.
+	MQTT func(topic string, payload []byte) error
+	// Mesh sends text on a channel, to node to when not empty.
+	Mesh func(to string, channel uint32, text string) error
+	// Webhook hands n to the webhook sink named sink, which delivers it
+	// with its signature, retries and dead letters.
+	Webhook func(sink string, n Notification) error
+	// Failed is called with the queued deliveries that failed or did not
+	// fit in the queue. It may be nil.
+	Failed func(Action, Notification, error)
+
+	once  sync.Once
+	queue chan delivery
+}
+
+type delivery struct {
+	action Action
+	n      Notification
+}
+
+func (s *Sender) init() {
+	s.once.Do(func() { s.queue = make(chan delivery, senderQueue) })
+}
+
+// Queue queues n for delivery as routed by a. It does not block: when the
+// queue is full the notification is dropped and reported to Failed.
+func (s *Sender) Queue(a Action, n Notification) {
+	s.init()
+	select {
+	case s.queue <- delivery{a, n}:
+	default:
+		s.failed(a, n, fmt.Errorf("queue full"))
+	}
+}
+
+// Run delivers the queued notifications until ctx is cancelled.
+func (s *Sender) Run(ctx context.Context) {
+	s.init()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-s.queue:
+			if err := s.Deliver(d.action, d.n); err != nil {
+				s.failed(d.action, d.n, err)
+			}
+		}
+	}
+}
+
+func (s *Sender) failed(a Action, n Notification, err error) {
+	if s.Failed != nil {
+		s.Failed(a, n, err)
+	}
+}
+
+// Deliver sends n as routed by a. MQTT destinations receive the
+// notification as JSON, webhook sinks the notification as the data of an
+// alert event and the mesh only its text.
+func (s *Sender) Deliver(a Action, n Notification) error {
+	switch {
+	case a.MQTT != "":
+		if s.MQTT == nil {
+			return fmt.Errorf("mqtt not available")
+		}
+		b, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		return s.MQTT(a.MQTT, b)
+	case a.Webhook != "":
+		if s.Webhook == nil {
+			return fmt.Errorf("webhooks not available")
+		}
+		return s.Webhook(a.Webhook, n)
+	case a.Mesh != nil:
+		if s.Mesh == nil {
+			return fmt.Errorf("mesh not available")
+		}
+		return s.Mesh(a.To, *a.Mesh, n.Text)
+	}
+	return fmt.Errorf("empty action")
+}
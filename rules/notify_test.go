@@ -0,0 +1,50 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSenderQueue(t *testing.T) {
+	release := make(chan struct{})
+	delivered := make(chan string, senderQueue+2)
+	var failed []string
+	s := &Sender{
+		MQTT: func(topic string, payload []byte) error {
+			<-release
+			delivered <- topic
+			return nil
+		},
+		Failed: func(a Action, n Notification, err error) { failed = append(failed, a.MQTT) },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	// A blocked destination does not block Queue: the first delivery is
+	// in progress, the next ones fill the queue and the last is dropped
+	s.Queue(Action{MQTT: "t0"}, Notification{})
+	deadline := time.Now().Add(time.Second)
+	for len(s.queue) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= senderQueue+1; i++ {
+		s.Queue(Action{MQTT: fmt.Sprintf("t%d", i)}, Notification{})
+	}
+	if len(failed) != 1 || failed[0] != fmt.Sprintf("t%d", senderQueue+1) {
+		t.Fatalf("unexpected failed deliveries %q", failed)
+	}
+	close(release)
+	for i := 0; i <= senderQueue; i++ {
+		select {
+		case got := <-delivered:
+			if got != fmt.Sprintf("t%d", i) {
+				t.Fatalf("delivery %d went to %s", i, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d not made", i)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package rules evaluates declarative alert rules, loaded from YAML, against
+// node metrics and the event stream, and routes the resulting notifications
+// to MQTT, webhooks or back to the mesh.
+//
+// A rule either watches a node metric:
+//
+//	rules:
+//	  - name: low-battery
+//	    metric: battery_level
+//	    op: "<"
+//	    value: 20
+//	    clear: 25      # hysteresis: resolved only once back to 25%
+//	    for: 10m       # debounce: the condition must hold for 10 minutes
+//	    notify:
+//	      - mqtt: meshspy/alerts
+//
+// or matches events:
+//
+//	rules:
+//	  - name: sos
+//	    event: text_message
+//	    contains: SOS
+//	    debounce: 5m   # at most one notification per node every 5 minutes
+//	    notify:
+//	      - mesh: 0    # channel index
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Metrics derived by the engine in addition to the reported telemetry.
+const (
+	// MetricOnline is 1 while the node is online and 0 once offline.
+	MetricOnline = "online"
+)
+
+// File is the layout of a rules file.
+type File struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule is a single alert rule.
+type Rule struct {
+	Name string `yaml:"name"`
+
+	// Metric rules fire when Metric compared with Value by Op holds for
+	// For. Once firing they resolve when the metric crosses Clear, which
+	// defaults to Value.
+	Metric string        `yaml:"metric"`
+	Op     string        `yaml:"op"`
+	Value  float64       `yaml:"value"`
+	Clear  *float64      `yaml:"clear"`
+	For    time.Duration `yaml:"for"`
+
+	// Event rules fire on every event of type Event whose text contains
+	// Contains (case insensitive) and matches Match, at most once per node
+	// every Debounce.
+	Event    string        `yaml:"event"`
+	Contains string        `yaml:"contains"`
+	Match    string        `yaml:"match"`
+	Debounce time.Duration `yaml:"debounce"`
+
+	// Nodes and Roles restrict the rule to nodes given by ID or name and
+	// to device roles.
+	Nodes []string `yaml:"nodes"`
+	Roles []string `yaml:"roles"`
+
+	// Message and ResolvedMessage are text/template strings rendered with
+	// the Notification. Without ResolvedMessage no notification is sent
+	// when a metric rule resolves.
+	Message         string   `yaml:"message"`
+	ResolvedMessage string   `yaml:"resolved_message"`
+	Notify          []Action `yaml:"notify"`
+
+	match    *regexp.Regexp
+	message  *template.Template
+	resolved *template.Template
+}
+
+// Action routes a notification. Exactly one of MQTT, Webhook and Mesh is
+// set; Webhook names a sink of webhooks.yaml, Mesh is the channel index and
+// To an optional destination node.
+type Action struct {
+	MQTT    string  `yaml:"mqtt"`
+	Webhook string  `yaml:"webhook"`
+	Mesh    *uint32 `yaml:"mesh"`
+	To      string  `yaml:"to"`
+}
+
+var ops = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// LoadFile reads and validates the rules in path.
+func LoadFile(path string) ([]*Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse decodes and validates YAML rules.
+func Parse(b []byte) ([]*Rule, error) {
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid rules: %v", err)
+	}
+	names := map[string]bool{}
+	for i, r := range f.Rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", i+1, r.Name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %d: duplicate name %q", i+1, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return f.Rules, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	switch {
+	case r.Metric != "" && r.Event != "":
+		return fmt.Errorf("metric and event are exclusive")
+	case r.Metric != "":
+		if ops[r.Op] == nil {
+			return fmt.Errorf("invalid op %q", r.Op)
+		}
+	case r.Event != "":
+		if r.Match != "" {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return fmt.Errorf("invalid match: %v", err)
+			}
+			r.match = re
+		}
+	default:
+		return fmt.Errorf("metric or event required")
+	}
+	if len(r.Notify) == 0 {
+		return fmt.Errorf("notify required")
+	}
+	for _, a := range r.Notify {
+		set := 0
+		for _, ok := range []bool{a.MQTT != "", a.Webhook != "", a.Mesh != nil} {
+			if ok {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("each notify entry needs exactly one of mqtt, webhook and mesh")
+		}
+	}
+	var err error
+	if r.message, err = parseTemplate(r.Name, r.Message, defaultMessage(r)); err != nil {
+		return err
+	}
+	if r.ResolvedMessage != "" {
+		if r.resolved, err = parseTemplate(r.Name+"-resolved", r.ResolvedMessage, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func defaultMessage(r *Rule) string {
+	if r.Metric != "" {
+		return `{{.Rule}}: {{.Name}} {{.Metric}} {{.Value}}`
+	}
+	return `{{.Rule}}: {{.Name}} {{.EventText}}`
+}
+
+func parseTemplate(name, text, def string) (*template.Template, error) {
+	if text == "" {
+		text = def
+	}
+	t, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	return t, nil
+}
+
+// holds reports whether v satisfies the rule. While the rule is active the
+// clear threshold is used instead of the trigger value, so that a metric
+// hovering around the threshold does not flap.
+func (r *Rule) holds(v float64, active bool) bool {
+	if active && r.Clear != nil {
+		return ops[r.Op](v, *r.Clear)
+	}
+	return ops[r.Op](v, r.Value)
+}
+
+// matchesText reports whether text satisfies Contains and Match.
+func (r *Rule) matchesText(text string) bool {
+	if r.Contains != "" && !strings.Contains(strings.ToLower(text), strings.ToLower(r.Contains)) {
+		return false
+	}
+	return r.match == nil || r.match.MatchString(text)
+}
+
+// appliesTo reports whether the node filters accept a node.
+func (r *Rule) appliesTo(id, name, role string) bool {
+	if len(r.Nodes) > 0 {
+		found := false
+		for _, n := range r.Nodes {
+			if strings.EqualFold(n, id) || (name != "" && strings.EqualFold(n, name)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Roles) > 0 {
+		for _, ro := range r.Roles {
+			if strings.EqualFold(ro, role) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
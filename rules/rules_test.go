@@ -0,0 +1,58 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	rules, err := Parse([]byte(`
+rules:
+  - name: battery
+    metric: battery_level
+    op: "<"
+    value: 20
+    clear: 25
+    for: 10m
+    roles: [ROUTER]
+    message: "{{.Name}} battery {{.Value}}%"
+    notify:
+      - mqtt: meshspy/alerts
+      - mesh: 0
+        to: Base
+  - name: sos
+    event: text_message
+    contains: sos
+    match: '\bSOS\b'
+    debounce: 5m
+    notify:
+      - webhook: ops
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(rules) != 2 || rules[0].For.Minutes() != 10 || *rules[0].Clear != 25 || *rules[0].Notify[1].Mesh != 0 {
+		t.Fatalf("unexpected rules %+v", rules[0])
+	}
+	if !rules[1].matchesText("help SOS now") || rules[1].matchesText("sosia") {
+		t.Fatal("unexpected text match")
+	}
+	if rules[0].appliesTo("0x1", "Base", "CLIENT") || !rules[0].appliesTo("0x1", "Base", "ROUTER") {
+		t.Fatal("unexpected role filter")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		`rules: [{name: a, metric: x, op: "~", notify: [{mqtt: t}]}]`:                                 "invalid op",
+		`rules: [{name: a, metric: x, op: "<"}]`:                                                      "notify required",
+		`rules: [{name: a, event: e, notify: [{mqtt: t, webhook: u}]}]`:                               "exactly one",
+		`rules: [{name: a, notify: [{mqtt: t}]}]`:                                                     "metric or event",
+		`rules: [{name: a, event: e, foo: 1, notify: [{mqtt: t}]}]`:                                   "field foo not found",
+		`rules: [{name: a, event: e, notify: [{mqtt: t}]}, {name: a, event: e, notify: [{mqtt: t}]}]`: "duplicate",
+	} {
+		if _, err := Parse([]byte(src)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: got %v, want %q", src, err, want)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package serial
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -22,8 +24,13 @@ type Manager struct {
 	port  seriallib.Port
 	proto string
 	mu    sync.Mutex
+	// closed is set by Close so that the read loop stops reopening the port.
+	closed bool
 }
 
+// errPortClosed is returned by reopen once the Manager has been closed.
+var errPortClosed = errors.New("serial port closed")
+
 // OpenManager opens the given serial port at the specified baud rate
 // and returns a Manager that can be used for reading and writing.
 func OpenManager(portName string, baud int, protoVersion string) (*Manager, error) {
@@ -39,6 +46,7 @@ func OpenManager(portName string, baud int, protoVersion string) (*Manager, erro
 func (m *Manager) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.closed = true
 	if m.port == nil {
 		return nil
 	}
@@ -47,6 +55,14 @@ func (m *Manager) Close() error {
 	return err
 }
 
+// Connected reports whether the port is open. It is false while the port
+// is being reopened and after Close.
+func (m *Manager) Connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.port != nil
+}
+
 // Send writes the given string to the serial port using the existing handle.
 func (m *Manager) Send(data string) error {
 	m.mu.Lock()
@@ -59,16 +75,25 @@ func (m *Manager) Send(data string) error {
 	return err
 }
 
+// BroadcastAddr is the destination address of packets sent to every node.
+const BroadcastAddr = 0xffffffff
+
 // SendTextMessage sends a broadcast text message over the mesh network
 // using the open serial port.
 func (m *Manager) SendTextMessage(text string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.port == nil {
-		return fmt.Errorf("serial port not open")
-	}
+	_, err := m.SendText(BroadcastAddr, 0, text)
+	return err
+}
+
+// SendText sends a text message to dest on the given channel index and
+// returns the packet ID. Direct messages request an acknowledgement so that
+// their delivery status can be tracked from the ROUTING_APP reply.
+func (m *Manager) SendText(dest, channel uint32, text string) (uint32, error) {
 	pkt := &latestpb.MeshPacket{
-		To: 0xffffffff,
+		To:      dest,
+		Channel: channel,
+		Id:      newPacketID(),
+		WantAck: dest != BroadcastAddr,
 		PayloadVariant: &latestpb.MeshPacket_Decoded{
 			Decoded: &latestpb.Data{
 				Portnum: latestpb.PortNum_TEXT_MESSAGE_APP,
@@ -76,8 +101,94 @@ func (m *Manager) SendTextMessage(text string) error {
 			},
 		},
 	}
-	tr := &latestpb.ToRadio{
+	log.Printf("\u2191 write text to %s: %q", m.name, text)
+	if err := m.SendPacket(pkt); err != nil {
+		return 0, err
+	}
+	return pkt.GetId(), nil
+}
+
+// SendWaypoint sends wp to dest on the given channel index as a
+// WAYPOINT_APP packet and returns the packet ID. Waypoints are updated by
+// sending them again with the same ID and deleted by setting Expire to a
+// time in the past. A zero waypoint ID is replaced by a random one.
+func (m *Manager) SendWaypoint(dest, channel uint32, wp *latestpb.Waypoint) (uint32, error) {
+	if wp.GetId() == 0 {
+		wp.Id = newPacketID()
+	}
+	payload, err := proto.Marshal(wp)
+	if err != nil {
+		return 0, err
+	}
+	pkt := &latestpb.MeshPacket{
+		To:      dest,
+		Channel: channel,
+		Id:      newPacketID(),
+		PayloadVariant: &latestpb.MeshPacket_Decoded{
+			Decoded: &latestpb.Data{
+				Portnum: latestpb.PortNum_WAYPOINT_APP,
+				Payload: payload,
+			},
+		},
+	}
+	log.Printf("\u2191 write waypoint %d to %s: %q", wp.GetId(), m.name, wp.GetName())
+	if err := m.SendPacket(pkt); err != nil {
+		return 0, err
+	}
+	return pkt.GetId(), nil
+}
+
+// SendTraceroute sends a TRACEROUTE_APP request to dest on the given
+// channel index and returns the packet ID. The destination answers with a
+// TRACEROUTE_APP packet whose Data.RequestId is that ID, carrying the route
+// discovered in both directions. A zero hopLimit keeps the radio default.
+func (m *Manager) SendTraceroute(dest, channel, hopLimit uint32) (uint32, error) {
+	payload, err := proto.Marshal(&latestpb.RouteDiscovery{})
+	if err != nil {
+		return 0, err
+	}
+	pkt := &latestpb.MeshPacket{
+		To:       dest,
+		Channel:  channel,
+		Id:       newPacketID(),
+		HopLimit: hopLimit,
+		PayloadVariant: &latestpb.MeshPacket_Decoded{
+			Decoded: &latestpb.Data{
+				Portnum:      latestpb.PortNum_TRACEROUTE_APP,
+				Payload:      payload,
+				WantResponse: true,
+			},
+		},
+	}
+	log.Printf("\u2191 write traceroute to %s: 0x%x", m.name, dest)
+	if err := m.SendPacket(pkt); err != nil {
+		return 0, err
+	}
+	return pkt.GetId(), nil
+}
+
+// SendPacket frames pkt in a ToRadio message and writes it to the serial port.
+func (m *Manager) SendPacket(pkt *latestpb.MeshPacket) error {
+	return m.write(&latestpb.ToRadio{
 		PayloadVariant: &latestpb.ToRadio_Packet{Packet: pkt},
+	})
+}
+
+// RequestConfig asks the radio to send its configuration, which includes
+// the node database and the channels, to the read loop.
+func (m *Manager) RequestConfig() error {
+	log.Printf("\u2191 write want_config to %s", m.name)
+	return m.write(&latestpb.ToRadio{
+		PayloadVariant: &latestpb.ToRadio_WantConfigId{WantConfigId: newPacketID()},
+	})
+}
+
+// write frames tr and writes it to the serial port.
+func (m *Manager) write(tr *latestpb.ToRadio) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.port == nil {
+		return fmt.Errorf("serial port not open")
 	}
 	payload, err := proto.Marshal(tr)
 	if err != nil {
@@ -95,23 +206,57 @@ func (m *Manager) SendTextMessage(text string) error {
 	frame[2] = byte(len(payload) >> 8)
 	frame[3] = byte(len(payload))
 	copy(frame[4:], payload)
-	log.Printf("\u2191 write text to %s: %q", m.name, text)
 	_, err = m.port.Write(frame)
 	return err
 }
 
+// newPacketID returns a random non-zero packet identifier.
+func newPacketID() uint32 {
+	for {
+		if id := rand.Uint32(); id != 0 {
+			return id
+		}
+	}
+}
+
 // ReadLoop starts reading from the serial port using the same logic as the
 // standalone ReadLoop function, but without reopening the port.
 func (m *Manager) ReadLoop(debug bool, protoVersion string, nm *nodemap.Map,
 	handleNodeInfo func(*latestpb.NodeInfo),
 	handleMyInfo func(*latestpb.MyNodeInfo),
+	handleChannel func(*latestpb.Channel),
 	handleTelemetry func(*latestpb.Telemetry),
 	handleWaypoint func(*latestpb.Waypoint),
 	handleAdmin func([]byte),
 	handleAlert func(string),
 	handleText func(string),
+	handlePacket func(*latestpb.MeshPacket),
 	publish func(string)) {
 
-	readLoop(m.port, m.name, m.baud, debug, protoVersion, nm,
-		handleNodeInfo, handleMyInfo, handleTelemetry, handleWaypoint, handleAdmin, handleAlert, handleText, publish)
+	m.mu.Lock()
+	port := m.port
+	m.mu.Unlock()
+	readLoop(port, m.reopen, m.name, m.baud, debug, protoVersion, nm,
+		handleNodeInfo, handleMyInfo, handleChannel, handleTelemetry, handleWaypoint, handleAdmin, handleAlert, handleText, handlePacket, publish)
+}
+
+// reopen closes the port and opens the device again, typically after it was
+// unplugged. Writes fail while the port is being reopened.
+func (m *Manager) reopen() (seriallib.Port, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errPortClosed
+	}
+	if m.port != nil {
+		m.port.Close()
+		m.port = nil
+	}
+	p, err := seriallib.Open(m.name, &seriallib.Mode{BaudRate: m.baud})
+	if err != nil {
+		return nil, err
+	}
+	p.SetReadTimeout(5 * time.Second)
+	m.port = p
+	return p, nil
 }
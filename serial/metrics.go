@@ -0,0 +1,41 @@
+package serial
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+var (
+	framesReceived = promauto.NewCounterVec(prometheus.CounterOpts{Name: "meshspy_frames_received_total",
+		Help: "FromRadio frames read from the serial port by payload variant and portnum."}, []string{"variant", "portnum"})
+	decodeFailures = promauto.NewCounter(prometheus.CounterOpts{Name: "meshspy_decode_failures_total",
+		Help: "Serial frames that could not be decoded as FromRadio messages."})
+	serialReconnects = promauto.NewCounter(prometheus.CounterOpts{Name: "meshspy_serial_reconnects_total",
+		Help: "Times the serial port was reopened after a read error."})
+)
+
+// countFrame records the FromRadio variant and, for packets, the portnum of
+// a frame payload. Encrypted packets are counted with portnum ENCRYPTED.
+func countFrame(payload []byte) {
+	var fr latestpb.FromRadio
+	if err := proto.Unmarshal(payload, &fr); err != nil {
+		decodeFailures.Inc()
+		return
+	}
+	variant := "none"
+	m := fr.ProtoReflect()
+	if fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("payload_variant")); fd != nil {
+		variant = string(fd.Name())
+	}
+	portnum := ""
+	if pkt := fr.GetPacket(); pkt != nil {
+		portnum = "ENCRYPTED"
+		if dec := pkt.GetDecoded(); dec != nil {
+			portnum = dec.GetPortnum().String()
+		}
+	}
+	framesReceived.WithLabelValues(variant, portnum).Inc()
+}
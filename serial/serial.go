@@ -20,16 +20,19 @@ var fallbackRe = regexp.MustCompile(`(?:from|fr|id) (0x[0-9a-fA-F]+)`)
 var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
 
 // ReadLoop opens the serial port and decodes incoming protobuf messages.
-// It invokes the provided callbacks for NodeInfo, Telemetry, waypoint, admin, alert and text messages.
+// It invokes the provided callbacks for NodeInfo, MyNodeInfo, Channel, Telemetry, waypoint, admin, alert and text messages.
+// handlePacket receives every MeshPacket together with its routing metadata.
 // It also publishes the identifiers of detected nodes using the publish function.
 func ReadLoop(portName string, baud int, debug bool, protoVersion string, nm *nodemap.Map,
 	handleNodeInfo func(*latestpb.NodeInfo),
 	handleMyInfo func(*latestpb.MyNodeInfo),
+	handleChannel func(*latestpb.Channel),
 	handleTelemetry func(*latestpb.Telemetry),
 	handleWaypoint func(*latestpb.Waypoint),
 	handleAdmin func([]byte),
 	handleAlert func(string),
 	handleText func(string),
+	handlePacket func(*latestpb.MeshPacket),
 	publish func(string)) {
 	var (
 		port serial.Port
@@ -48,20 +51,35 @@ func ReadLoop(portName string, baud int, debug bool, protoVersion string, nm *no
 	if err != nil {
 		log.Fatalf("Failed to open serial port %s after 5 attempts: %v", portName, err)
 	}
-	defer port.Close()
+	defer func() { port.Close() }()
 
-	readLoop(port, portName, baud, debug, protoVersion, nm,
-		handleNodeInfo, handleMyInfo, handleTelemetry, handleWaypoint, handleAdmin, handleAlert, handleText, publish)
+	reopen := func() (serial.Port, error) {
+		port.Close()
+		p, err := serial.Open(portName, &serial.Mode{BaudRate: baud})
+		if err != nil {
+			return nil, err
+		}
+		p.SetReadTimeout(5 * time.Second)
+		port = p
+		return p, nil
+	}
+	readLoop(port, reopen, portName, baud, debug, protoVersion, nm,
+		handleNodeInfo, handleMyInfo, handleChannel, handleTelemetry, handleWaypoint, handleAdmin, handleAlert, handleText, handlePacket, publish)
 }
 
-func readLoop(port serial.Port, portName string, baud int, debug bool, protoVersion string, nm *nodemap.Map,
+// readLoop decodes frames and log lines read from port. After a read error
+// the port is replaced with the one returned by reopen; readLoop returns when
+// reopen reports errPortClosed.
+func readLoop(port serial.Port, reopen func() (serial.Port, error), portName string, baud int, debug bool, protoVersion string, nm *nodemap.Map,
 	handleNodeInfo func(*latestpb.NodeInfo),
 	handleMyInfo func(*latestpb.MyNodeInfo),
+	handleChannel func(*latestpb.Channel),
 	handleTelemetry func(*latestpb.Telemetry),
 	handleWaypoint func(*latestpb.Waypoint),
 	handleAdmin func([]byte),
 	handleAlert func(string),
 	handleText func(string),
+	handlePacket func(*latestpb.MeshPacket),
 	publish func(string)) {
 	log.Printf("Listening on serial %s at %d baud", portName, baud)
 
@@ -162,6 +180,18 @@ func readLoop(port serial.Port, portName string, baud int, debug bool, protoVers
 			}
 			log.Printf("Serial read error: %v", err)
 			time.Sleep(time.Second)
+			p, err := reopen()
+			if err == errPortClosed {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to reopen serial port %s: %v", portName, err)
+				continue
+			}
+			port = p
+			buf = buf[:0]
+			serialReconnects.Inc()
+			log.Printf("Serial port %s reopened", portName)
 			continue
 		}
 		if n == 0 {
@@ -196,6 +226,7 @@ func readLoop(port serial.Port, portName string, baud int, debug bool, protoVers
 				break
 			}
 			payload := buf[headerLen : headerLen+length]
+			countFrame(payload)
 			if nm != nil {
 				if ni, err := decoder.DecodeNodeInfo(payload, protoVersion); err == nil {
 					nm.UpdateFromProto(ni)
@@ -212,6 +243,16 @@ func readLoop(port serial.Port, portName string, baud int, debug bool, protoVers
 					handleMyInfo(mi)
 				}
 			}
+			if ch, err := decoder.DecodeChannel(payload, protoVersion); err == nil {
+				if handleChannel != nil {
+					handleChannel(ch)
+				}
+			}
+			if pkt, err := decoder.DecodePacket(payload, protoVersion); err == nil {
+				if handlePacket != nil {
+					handlePacket(pkt)
+				}
+			}
 
 			if txt, err := decoder.DecodeText(payload, protoVersion); err == nil {
 				if handleText != nil {
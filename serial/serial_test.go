@@ -1,6 +1,13 @@
 package serial
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
 
 func TestParseNodeName(t *testing.T) {
 	tests := []struct {
@@ -23,3 +30,25 @@ func TestParseNodeName(t *testing.T) {
 		}
 	}
 }
+
+func TestCountFrame(t *testing.T) {
+	pkt := &latestpb.FromRadio{PayloadVariant: &latestpb.FromRadio_Packet{Packet: &latestpb.MeshPacket{
+		PayloadVariant: &latestpb.MeshPacket_Decoded{Decoded: &latestpb.Data{Portnum: latestpb.PortNum_TEXT_MESSAGE_APP}},
+	}}}
+	payload, err := proto.Marshal(pkt)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	text := framesReceived.WithLabelValues("packet", "TEXT_MESSAGE_APP")
+	before, failures := testutil.ToFloat64(text), testutil.ToFloat64(decodeFailures)
+
+	countFrame(payload)
+	countFrame([]byte{0xff, 0xff, 0xff})
+
+	if testutil.ToFloat64(text) != before+1 {
+		t.Fatalf("text frame not counted")
+	}
+	if testutil.ToFloat64(decodeFailures) != failures+1 {
+		t.Fatalf("decode failure not counted")
+	}
+}
@@ -0,0 +1,343 @@
+// Package state keeps a merged view of every node heard on the mesh and
+// publishes it as retained MQTT messages, so that subscribers connecting late
+// receive the full mesh picture without waiting for new packets.
+package state
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Publisher delivers a retained payload on the given topic.
+type Publisher func(topic string, payload []byte) error
+
+// Position is the last known location of a node.
+type Position struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  int     `json:"altitude"`
+	Time      int64   `json:"time,omitempty"`
+}
+
+// TelemetrySample holds the last telemetry of one kind reported by a node.
+type TelemetrySample struct {
+	Time    int64           `json:"time"`
+	Metrics json.RawMessage `json:"metrics"`
+}
+
+// NodeState is the merged state of a single node.
+type NodeState struct {
+	ID        string                     `json:"id"`
+	Num       uint32                     `json:"num"`
+	LongName  string                     `json:"long_name,omitempty"`
+	ShortName string                     `json:"short_name,omitempty"`
+	HwModel   string                     `json:"hw_model,omitempty"`
+	Role      string                     `json:"role,omitempty"`
+	PublicKey string                     `json:"public_key,omitempty"`
+	Position  *Position                  `json:"position,omitempty"`
+	Telemetry map[string]TelemetrySample `json:"telemetry,omitempty"`
+	LastHeard int64                      `json:"last_heard,omitempty"`
+	HopsAway  int                        `json:"hops_away"`
+	Snr       float64                    `json:"snr"`
+}
+
+// IndexEntry is a single node in the retained index of known nodes.
+type IndexEntry struct {
+	ID        string `json:"id"`
+	LongName  string `json:"long_name,omitempty"`
+	ShortName string `json:"short_name,omitempty"`
+}
+
+// Tracker merges information from NodeInfo messages and mesh packets into a
+// per-node state and publishes every change.
+type Tracker struct {
+	// pubMu serializes the flushes, so that the retained topics end with
+	// the latest state even when updates race; it is taken before mu.
+	pubMu sync.Mutex
+
+	mu        sync.Mutex
+	prefix    string
+	publish   Publisher
+	nodes     map[string]*NodeState
+	published map[string][]byte
+	index     []byte
+}
+
+// New returns a Tracker publishing under prefix. When publish is nil the
+// state is only kept in memory.
+func New(prefix string, publish Publisher) *Tracker {
+	return &Tracker{
+		prefix:    prefix,
+		publish:   publish,
+		nodes:     make(map[string]*NodeState),
+		published: make(map[string][]byte),
+	}
+}
+
+// StateTopic returns the topic where the state of node id is published.
+func (t *Tracker) StateTopic(id string) string {
+	return fmt.Sprintf("%s/nodes/%s/state", t.prefix, id)
+}
+
+// IndexTopic returns the topic where the index of known nodes is published.
+func (t *Tracker) IndexTopic() string {
+	return t.prefix + "/nodes/index"
+}
+
+// UpdateNodeInfo merges a NodeInfo message into the state of the node.
+func (t *Tracker) UpdateNodeInfo(ni *latestpb.NodeInfo) {
+	if ni == nil || ni.GetNum() == 0 {
+		return
+	}
+	t.mu.Lock()
+	n := t.node(ni.GetNum())
+	mergeUser(n, ni.GetUser())
+	if pos := ni.GetPosition(); pos != nil {
+		mergePosition(n, pos)
+	}
+	if dm := ni.GetDeviceMetrics(); dm != nil {
+		mergeTelemetry(n, "device_metrics", dm, int64(ni.GetLastHeard()))
+	}
+	if ni.GetLastHeard() != 0 && int64(ni.GetLastHeard()) > n.LastHeard {
+		n.LastHeard = int64(ni.GetLastHeard())
+	}
+	if ni.HopsAway != nil {
+		n.HopsAway = int(ni.GetHopsAway())
+	}
+	if ni.GetSnr() != 0 {
+		n.Snr = float64(ni.GetSnr())
+	}
+	t.mu.Unlock()
+	t.flush(n.ID)
+}
+
+// UpdatePacket merges the metadata and decoded payload of a mesh packet into
+// the state of its sender.
+func (t *Tracker) UpdatePacket(pkt *latestpb.MeshPacket) {
+	if pkt == nil || pkt.GetFrom() == 0 {
+		return
+	}
+	heard := int64(pkt.GetRxTime())
+	if heard == 0 {
+		heard = time.Now().Unix()
+	}
+	t.mu.Lock()
+	n := t.node(pkt.GetFrom())
+	if heard > n.LastHeard {
+		n.LastHeard = heard
+	}
+	if pkt.GetRxSnr() != 0 {
+		n.Snr = float64(pkt.GetRxSnr())
+	}
+	if pkt.GetHopStart() != 0 && pkt.GetHopStart() >= pkt.GetHopLimit() {
+		n.HopsAway = int(pkt.GetHopStart() - pkt.GetHopLimit())
+	}
+	if dec := pkt.GetDecoded(); dec != nil {
+		switch dec.GetPortnum() {
+		case latestpb.PortNum_POSITION_APP:
+			var pos latestpb.Position
+			if err := proto.Unmarshal(dec.GetPayload(), &pos); err == nil {
+				mergePosition(n, &pos)
+			}
+		case latestpb.PortNum_NODEINFO_APP:
+			var u latestpb.User
+			if err := proto.Unmarshal(dec.GetPayload(), &u); err == nil {
+				mergeUser(n, &u)
+			}
+		case latestpb.PortNum_TELEMETRY_APP:
+			var tm latestpb.Telemetry
+			if err := proto.Unmarshal(dec.GetPayload(), &tm); err == nil {
+				ts := int64(tm.GetTime())
+				if ts == 0 {
+					ts = heard
+				}
+				if kind, msg := telemetryVariant(&tm); msg != nil {
+					mergeTelemetry(n, kind, msg, ts)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+	t.flush(n.ID)
+}
+
+// Get returns a copy of the state of node id.
+func (t *Tracker) Get(id string) (NodeState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.nodes[id]
+	if !ok {
+		return NodeState{}, false
+	}
+	return copyState(n), true
+}
+
+// List returns a snapshot of all node states sorted by id.
+func (t *Tracker) List() []NodeState {
+	t.mu.Lock()
+	out := make([]NodeState, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		out = append(out, copyState(n))
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// node returns the state for num, creating it when needed. The caller must
+// hold t.mu.
+func (t *Tracker) node(num uint32) *NodeState {
+	id := fmt.Sprintf("0x%x", num)
+	n, ok := t.nodes[id]
+	if !ok {
+		n = &NodeState{ID: id, Num: num}
+		t.nodes[id] = n
+	}
+	return n
+}
+
+// flush publishes the state of node id and the index when they differ from
+// what was last published.
+func (t *Tracker) flush(id string) {
+	t.pubMu.Lock()
+	defer t.pubMu.Unlock()
+	t.mu.Lock()
+	n := t.nodes[id]
+	state, err := json.Marshal(n)
+	if err != nil {
+		t.mu.Unlock()
+		return
+	}
+	var pubState, pubIndex []byte
+	if !bytes.Equal(t.published[id], state) {
+		t.published[id] = state
+		pubState = state
+	}
+	entries := make([]IndexEntry, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		entries = append(entries, IndexEntry{ID: n.ID, LongName: n.LongName, ShortName: n.ShortName})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	if index, err := json.Marshal(entries); err == nil && !bytes.Equal(t.index, index) {
+		t.index = index
+		pubIndex = index
+	}
+	t.mu.Unlock()
+
+	if t.publish == nil {
+		return
+	}
+	if pubState != nil {
+		if err := t.publish(t.StateTopic(id), pubState); err != nil {
+			t.forget(id)
+		}
+	}
+	if pubIndex != nil {
+		if err := t.publish(t.IndexTopic(), pubIndex); err != nil {
+			t.mu.Lock()
+			t.index = nil
+			t.mu.Unlock()
+		}
+	}
+}
+
+// forget clears the last published state of id so the next update is
+// published again after a failure.
+func (t *Tracker) forget(id string) {
+	t.mu.Lock()
+	delete(t.published, id)
+	t.mu.Unlock()
+}
+
+func mergeUser(n *NodeState, u *latestpb.User) {
+	if u == nil {
+		return
+	}
+	if u.GetLongName() != "" {
+		n.LongName = u.GetLongName()
+	}
+	if u.GetShortName() != "" {
+		n.ShortName = u.GetShortName()
+	}
+	if u.HwModel != latestpb.HardwareModel_UNSET {
+		n.HwModel = u.GetHwModel().String()
+	}
+	n.Role = u.GetRole().String()
+	if len(u.GetPublicKey()) > 0 {
+		n.PublicKey = base64.StdEncoding.EncodeToString(u.GetPublicKey())
+	}
+}
+
+func mergePosition(n *NodeState, pos *latestpb.Position) {
+	if pos.GetLatitudeI() == 0 && pos.GetLongitudeI() == 0 {
+		return
+	}
+	n.Position = &Position{
+		Latitude:  float64(pos.GetLatitudeI()) / 1e7,
+		Longitude: float64(pos.GetLongitudeI()) / 1e7,
+		Altitude:  int(pos.GetAltitude()),
+		Time:      int64(pos.GetTime()),
+	}
+}
+
+func mergeTelemetry(n *NodeState, kind string, msg proto.Message, ts int64) {
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return
+	}
+	if n.Telemetry == nil {
+		n.Telemetry = make(map[string]TelemetrySample)
+	}
+	n.Telemetry[kind] = TelemetrySample{Time: ts, Metrics: buf.Bytes()}
+}
+
+// telemetryVariant returns the field name and message of the populated
+// telemetry variant.
+func telemetryVariant(tm *latestpb.Telemetry) (string, proto.Message) {
+	switch v := tm.GetVariant().(type) {
+	case *latestpb.Telemetry_DeviceMetrics:
+		return "device_metrics", v.DeviceMetrics
+	case *latestpb.Telemetry_EnvironmentMetrics:
+		return "environment_metrics", v.EnvironmentMetrics
+	case *latestpb.Telemetry_AirQualityMetrics:
+		return "air_quality_metrics", v.AirQualityMetrics
+	case *latestpb.Telemetry_PowerMetrics:
+		return "power_metrics", v.PowerMetrics
+	case *latestpb.Telemetry_LocalStats:
+		return "local_stats", v.LocalStats
+	case *latestpb.Telemetry_HealthMetrics:
+		return "health_metrics", v.HealthMetrics
+	case *latestpb.Telemetry_HostMetrics:
+		return "host_metrics", v.HostMetrics
+	}
+	return "", nil
+}
+
+func copyState(n *NodeState) NodeState {
+	c := *n
+	if n.Position != nil {
+		p := *n.Position
+		c.Position = &p
+	}
+	if n.Telemetry != nil {
+		c.Telemetry = make(map[string]TelemetrySample, len(n.Telemetry))
+		for k, v := range n.Telemetry {
+			c.Telemetry[k] = v
+		}
+	}
+	return c
+}
@@ -0,0 +1,144 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+type recorder struct {
+	msgs map[string][]byte
+	n    int
+}
+
+func (r *recorder) publish(topic string, payload []byte) error {
+	if r.msgs == nil {
+		r.msgs = make(map[string][]byte)
+	}
+	r.msgs[topic] = payload
+	r.n++
+	return nil
+}
+
+func packet(from uint32, port latestpb.PortNum, msg proto.Message) *latestpb.MeshPacket {
+	payload, _ := proto.Marshal(msg)
+	return &latestpb.MeshPacket{
+		From:     from,
+		RxTime:   1000,
+		RxSnr:    6.25,
+		HopStart: 3,
+		HopLimit: 1,
+		PayloadVariant: &latestpb.MeshPacket_Decoded{Decoded: &latestpb.Data{
+			Portnum: port,
+			Payload: payload,
+		}},
+	}
+}
+
+func TestTrackerMergesAndPublishesRetainedState(t *testing.T) {
+	rec := &recorder{}
+	tr := New("meshspy", rec.publish)
+
+	tr.UpdateNodeInfo(&latestpb.NodeInfo{
+		Num:  0xabc,
+		User: &latestpb.User{LongName: "Alice", ShortName: "A", HwModel: latestpb.HardwareModel_TBEAM},
+	})
+	tr.UpdatePacket(packet(0xabc, latestpb.PortNum_POSITION_APP, &latestpb.Position{
+		LatitudeI: proto.Int32(435000000), LongitudeI: proto.Int32(104000000),
+	}))
+	tr.UpdatePacket(packet(0xabc, latestpb.PortNum_TELEMETRY_APP, &latestpb.Telemetry{
+		Variant: &latestpb.Telemetry_EnvironmentMetrics{EnvironmentMetrics: &latestpb.EnvironmentMetrics{
+			Temperature: proto.Float32(21.5),
+		}},
+	}))
+
+	raw, ok := rec.msgs["meshspy/nodes/0xabc/state"]
+	if !ok {
+		t.Fatalf("state not published: %v", rec.msgs)
+	}
+	var st NodeState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if st.LongName != "Alice" || st.HwModel != "TBEAM" {
+		t.Fatalf("identity lost: %+v", st)
+	}
+	if st.Position == nil || st.Position.Latitude != 43.5 {
+		t.Fatalf("position not merged: %+v", st.Position)
+	}
+	if _, ok := st.Telemetry["environment_metrics"]; !ok {
+		t.Fatalf("telemetry not merged: %+v", st.Telemetry)
+	}
+	if st.HopsAway != 2 || st.Snr != 6.25 || st.LastHeard != 1000 {
+		t.Fatalf("link metadata not merged: %+v", st)
+	}
+
+	var index []IndexEntry
+	if err := json.Unmarshal(rec.msgs["meshspy/nodes/index"], &index); err != nil {
+		t.Fatalf("unmarshal index: %v", err)
+	}
+	if len(index) != 1 || index[0].ID != "0xabc" || index[0].LongName != "Alice" {
+		t.Fatalf("unexpected index %+v", index)
+	}
+}
+
+func TestTrackerSkipsUnchangedState(t *testing.T) {
+	rec := &recorder{}
+	tr := New("p", rec.publish)
+	ni := &latestpb.NodeInfo{Num: 1, User: &latestpb.User{LongName: "Bob"}}
+	tr.UpdateNodeInfo(ni)
+	n := rec.n
+	tr.UpdateNodeInfo(ni)
+	if rec.n != n {
+		t.Fatalf("unchanged state published again: %d -> %d", n, rec.n)
+	}
+	if _, ok := tr.Get("0x1"); !ok {
+		t.Fatalf("node not tracked")
+	}
+}
+
+func TestTrackerPublishesLatestStateLast(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+		last  []byte
+	)
+	tr := New("p", func(topic string, payload []byte) error {
+		if topic != "p/nodes/0x1/state" {
+			return nil
+		}
+		// A slow publish lets a later update overtake this one
+		mu.Lock()
+		calls++
+		slow := calls%2 == 1
+		mu.Unlock()
+		if slow {
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		last = payload
+		mu.Unlock()
+		return nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tr.UpdateNodeInfo(&latestpb.NodeInfo{Num: 1, User: &latestpb.User{LongName: fmt.Sprintf("node %d", i)}})
+		}(i)
+	}
+	wg.Wait()
+	var st NodeState
+	if err := json.Unmarshal(last, &st); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got, _ := tr.Get("0x1"); st.LongName != got.LongName {
+		t.Fatalf("retained state %q, tracker state %q", st.LongName, got.LongName)
+	}
+}
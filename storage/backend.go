@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	mqttpkg "meshspy/client"
+	"meshspy/events"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Backend is the persistent store of nodes, positions, telemetry, messages,
+// waypoints, events, radio channels, bulletin board posts, undelivered
+// webhooks, managed gateways and the user accounts with their audit trail.
+// NodeStore implements it on SQLite and PGStore on PostgreSQL; use Open to
+// pick one from a DSN.
+type Backend interface {
+	// Nodes
+	Upsert(info *mqttpkg.NodeInfo) error
+	Get(id string) (*mqttpkg.NodeInfo, error)
+	List() ([]*mqttpkg.NodeInfo, error)
+	History(nodeID string) ([]NodeChange, error)
+
+	// Positions
+	Positions(nodeID string, p Page) ([]NodePosition, error)
+	PositionRollups(nodeID, resolution string, since, until time.Time) ([]PositionRollup, error)
+
+	// Telemetry
+	AddNodeTelemetry(nodeID string, tel *latestpb.Telemetry) error
+	Telemetry(nodeID string, p Page) ([]TelemetryRecord, error)
+	TelemetryRollups(nodeID, resolution string, since, until time.Time) ([]TelemetryRollup, error)
+	AddNodeMetrics(nodeID string, at time.Time, values map[string]float64) error
+	Series(nodeID, metric, resolution string, since, until time.Time) ([]SeriesPoint, error)
+
+	// Messages
+	AddMessage(m *Message) (int64, error)
+	UpdateMessageStatus(packetID uint32, status, reason string) error
+	ApplyRouting(pkt *latestpb.MeshPacket) error
+	ChannelMessages(channel uint32, p Page) ([]Message, error)
+	Conversation(a, b string, p Page) ([]Message, error)
+	PeerMessages(peer string, p Page) ([]Message, error)
+	Conversations() ([]ConversationSummary, error)
+	Messages(p Page) ([]Message, error)
+	MessagesFrom(nodeID string, p Page) ([]Message, error)
+	SearchMessages(query string, p Page) ([]Message, error)
+
+	// Waypoints
+	SaveWaypoint(w *Waypoint) error
+	Waypoint(id uint32) (*Waypoint, error)
+	ActiveWaypoints(now time.Time) ([]Waypoint, error)
+	ExpiredWaypoints(now time.Time) ([]Waypoint, error)
+
+	// Events
+	AddEvent(e *events.Event) error
+	Events(f EventFilter, p Page) ([]events.Event, error)
+	Presence(since, now time.Time) ([]PresenceState, error)
+
+	// Channels of the local radio
+	SaveChannel(c *Channel) error
+	Channels() ([]Channel, error)
+
+	// Bulletin board posts
+	AddBoardPost(p *BoardPost) (int64, error)
+	BoardPosts(channel uint32, withHidden bool, p Page) ([]BoardPost, error)
+	SetBoardPostHidden(id int64, hidden bool) error
+	DeleteBoardPost(id int64) error
+
+	// Webhook dead letters
+	AddDeadLetter(d *DeadLetter) error
+	DeadLetters(sink string, p Page) ([]DeadLetter, error)
+	DeleteDeadLetter(id int64) error
+
+	// Gateways
+	SaveGateway(g *Gateway) error
+	Gateway(id string) (*Gateway, error)
+	GatewayByToken(tokenHash string) (*Gateway, error)
+	Gateways() ([]Gateway, error)
+	GatewayHeartbeat(id string, at time.Time, lastErr string) error
+	DeleteGateway(id string) error
+
+	// Users, sessions and API tokens
+	AddUser(u *User) error
+	UpdateUser(u *User) error
+	User(id int64) (*User, error)
+	UserByName(name string) (*User, error)
+	Users() ([]User, error)
+	DeleteUser(id int64) error
+	AddSession(tokenHash string, userID int64, expires time.Time) error
+	SessionUser(tokenHash string, now time.Time) (*User, error)
+	DeleteSession(tokenHash string) error
+	AddAPIToken(t *APIToken) error
+	APITokens(userID int64) ([]APIToken, error)
+	TokenUser(tokenHash string, now time.Time) (*User, error)
+	DeleteAPIToken(id int64) error
+
+	// Audit
+	AddAudit(e *AuditEntry) error
+	Audit(user string, p Page) ([]AuditEntry, error)
+
+	// Maintenance
+	Compact(now time.Time, r Retention) (CompactStats, error)
+	RunRetention(ctx context.Context, r Retention)
+	SchemaVersion() (int, error)
+	Close() error
+}
+
+var (
+	_ Backend = (*NodeStore)(nil)
+	_ Backend = (*PGStore)(nil)
+)
+
+// Open returns the backend selected by dsn. postgres:// and postgresql://
+// URLs open a PGStore; anything else is taken as the path of a SQLite
+// database, optionally prefixed with sqlite://.
+func Open(dsn string) (Backend, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return OpenPostgres(dsn)
+	}
+	return NewNodeStore(strings.TrimPrefix(dsn, "sqlite://"))
+}
+
+// sqlStore implements the queries shared by the SQL backends. Statements are
+// written with ? placeholders and rebound for the dialect of the database.
+type sqlStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *sqlStore) exec(query string, args ...any) (sql.Result, error) {
+	return s.db.Exec(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...any) (*sql.Rows, error) {
+	return s.db.Query(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...any) *sql.Row {
+	return s.db.QueryRow(s.d.rebind(query), args...)
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database.
+func (s *sqlStore) SchemaVersion() (int, error) {
+	return schemaVersion(s.db)
+}
+
+// Close closes the underlying database.
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// dialect captures the SQL differences between the supported databases.
+type dialect int
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
+
+// now is the current UTC time in the format of stored timestamps.
+func (d dialect) now() string {
+	if d == postgresDialect {
+		return `(now() AT TIME ZONE 'UTC')`
+	}
+	return `CURRENT_TIMESTAMP`
+}
+
+// rowID is the cursor column of tables without an explicit key.
+func (d dialect) rowID() string {
+	if d == postgresDialect {
+		return "id"
+	}
+	return "rowid"
+}
+
+// truncate returns an expression rounding the timestamp col down to the
+// start of its minute, hour or day.
+func (d dialect) truncate(resolution, col string) string {
+	if d == postgresDialect {
+		return `date_trunc('` + resolution + `', ` + col + `)`
+	}
+	switch resolution {
+	case ResolutionDay:
+		return `strftime('%Y-%m-%d 00:00:00', ` + col + `)`
+	case ResolutionMinute:
+		return `strftime('%Y-%m-%d %H:%M:00', ` + col + `)`
+	}
+	return `strftime('%Y-%m-%d %H:00:00', ` + col + `)`
+}
+
+// least and greatest return the scalar minimum and maximum of two values.
+func (d dialect) least(a, b string) string {
+	if d == postgresDialect {
+		return `LEAST(` + a + `, ` + b + `)`
+	}
+	return `MIN(` + a + `, ` + b + `)`
+}
+
+func (d dialect) greatest(a, b string) string {
+	if d == postgresDialect {
+		return `GREATEST(` + a + `, ` + b + `)`
+	}
+	return `MAX(` + a + `, ` + b + `)`
+}
+
+// rebind rewrites the ? placeholders of query into the numbered form used by
+// PostgreSQL. Question marks inside quoted literals are left alone.
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
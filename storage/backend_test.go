@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	mqttpkg "meshspy/client"
+	"meshspy/events"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// testBackend exercises the behaviour every Backend must share.
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+
+	if err := b.Upsert(&mqttpkg.NodeInfo{ID: "0xa", Num: 10, LongName: "Alpha", HwModel: "TBEAM",
+		Latitude: 43.7, Longitude: 10.4}); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	if err := b.Upsert(&mqttpkg.NodeInfo{ID: "0xa", LongName: "Alpha 2", BatteryLevel: 90}); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	n, err := b.Get("0xa")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if n == nil || n.LongName != "Alpha 2" || n.HwModel != "TBEAM" || n.BatteryLevel != 90 {
+		t.Fatalf("unexpected merged node %+v", n)
+	}
+	if n, err := b.Get("0xmissing"); err != nil || n != nil {
+		t.Fatalf("expected nil for unknown node, got %+v, %v", n, err)
+	}
+	hist, err := b.History("0xa")
+	if err != nil {
+		t.Fatalf("History returned error: %v", err)
+	}
+	if len(hist) != 1 || hist[0].OldValue != "Alpha" {
+		t.Fatalf("unexpected history %+v", hist)
+	}
+	pos, err := b.Positions("0xa", Page{})
+	if err != nil {
+		t.Fatalf("Positions returned error: %v", err)
+	}
+	if len(pos) != 1 || pos[0].Latitude != 43.7 {
+		t.Fatalf("unexpected positions %+v", pos)
+	}
+
+	tel := &latestpb.Telemetry{Time: 100, Variant: &latestpb.Telemetry_DeviceMetrics{
+		DeviceMetrics: &latestpb.DeviceMetrics{BatteryLevel: proto.Uint32(80)},
+	}}
+	if err := b.AddNodeTelemetry("0xa", tel); err != nil {
+		t.Fatalf("AddNodeTelemetry returned error: %v", err)
+	}
+	recs, err := b.Telemetry("0xa", Page{})
+	if err != nil {
+		t.Fatalf("Telemetry returned error: %v", err)
+	}
+	if len(recs) != 1 || recs[0].BatteryLevel != 80 {
+		t.Fatalf("unexpected telemetry %+v", recs)
+	}
+
+	for _, p := range []*latestpb.MeshPacket{
+		textPacket(1, 0xa, 0xffffffff, 0, "hello mesh"),
+		textPacket(1, 0xa, 0xffffffff, 0, "hello mesh"),
+		textPacket(2, 0xb, 0xa, 0, "private reply"),
+	} {
+		if _, err := b.AddMessage(MessageFromPacket(p)); err != nil {
+			t.Fatalf("AddMessage returned error: %v", err)
+		}
+	}
+	msgs, err := b.Messages(Page{})
+	if err != nil {
+		t.Fatalf("Messages returned error: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected duplicates to be dropped, got %+v", msgs)
+	}
+	found, err := b.SearchMessages("hel", Page{})
+	if err != nil {
+		t.Fatalf("SearchMessages returned error: %v", err)
+	}
+	if len(found) != 1 || found[0].Text != "hello mesh" {
+		t.Fatalf("unexpected search results %+v", found)
+	}
+
+	if _, err := b.Compact(time.Now().Add(48*time.Hour), Retention{
+		Positions: RetentionPolicy{Raw: time.Hour},
+		Telemetry: RetentionPolicy{Raw: time.Hour},
+	}); err != nil {
+		t.Fatalf("Compact returned error: %v", err)
+	}
+	rollups, err := b.TelemetryRollups("0xa", ResolutionHour, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("TelemetryRollups returned error: %v", err)
+	}
+	if len(rollups) != 1 || rollups[0].BatteryAvg != 80 {
+		t.Fatalf("unexpected rollups %+v", rollups)
+	}
+
+	e := events.New(events.NodeOnline, "0xa", map[string]string{"role": "ROUTER"})
+	if err := b.AddEvent(&e); err != nil || e.ID == 0 {
+		t.Fatalf("AddEvent returned %d, %v", e.ID, err)
+	}
+	evs, err := b.Events(EventFilter{Types: []string{events.NodeOnline}, NodeID: "0xa"}, Page{})
+	if err != nil {
+		t.Fatalf("Events returned error: %v", err)
+	}
+	if len(evs) != 1 || evs[0].ID != e.ID || string(evs[0].Data) != `{"role":"ROUTER"}` {
+		t.Fatalf("unexpected events %+v", evs)
+	}
+
+	d := DeadLetter{Sink: "chat", EventID: e.ID, EventType: e.Type, Payload: "{}", Error: "timeout", Attempts: 3}
+	if err := b.AddDeadLetter(&d); err != nil || d.ID == 0 {
+		t.Fatalf("AddDeadLetter returned %d, %v", d.ID, err)
+	}
+	if dl, err := b.DeadLetters("chat", Page{}); err != nil || len(dl) != 1 || dl[0].Attempts != 3 || dl[0].EventID != e.ID {
+		t.Fatalf("DeadLetters returned %+v, %v", dl, err)
+	}
+	if err := b.DeleteDeadLetter(d.ID); err != nil {
+		t.Fatalf("DeleteDeadLetter returned error: %v", err)
+	}
+	if dl, _ := b.DeadLetters("", Page{}); len(dl) != 0 {
+		t.Fatalf("dead letter not deleted: %+v", dl)
+	}
+
+	for _, c := range []Channel{
+		{Index: 1, Name: "old", Role: "SECONDARY"},
+		{Index: 0, Name: "", Role: "PRIMARY"},
+		{Index: 1, Name: "team", Role: "SECONDARY"},
+		{Index: 2, Role: "DISABLED"},
+	} {
+		if err := b.SaveChannel(&c); err != nil {
+			t.Fatalf("SaveChannel returned error: %v", err)
+		}
+	}
+	if chs, err := b.Channels(); err != nil || len(chs) != 2 || chs[0].Role != "PRIMARY" || chs[1].Name != "team" {
+		t.Fatalf("Channels returned %+v, %v", chs, err)
+	}
+
+	var posts []BoardPost
+	for _, bp := range []BoardPost{
+		{Channel: 1, From: "0xa", Text: "from the mesh"},
+		{Channel: 1, Author: "admin", Text: "from the web"},
+		{Channel: 2, From: "0xb", Text: "other board"},
+	} {
+		if _, err := b.AddBoardPost(&bp); err != nil || bp.ID == 0 {
+			t.Fatalf("AddBoardPost returned %d, %v", bp.ID, err)
+		}
+		posts = append(posts, bp)
+	}
+	if err := b.SetBoardPostHidden(posts[0].ID, true); err != nil {
+		t.Fatalf("SetBoardPostHidden returned error: %v", err)
+	}
+	if bps, err := b.BoardPosts(1, false, Page{}); err != nil || len(bps) != 1 || bps[0].Author != "admin" {
+		t.Fatalf("BoardPosts returned %+v, %v", bps, err)
+	}
+	if bps, err := b.BoardPosts(1, true, Page{}); err != nil || len(bps) != 2 || !bps[1].Hidden || bps[1].From != "0xa" {
+		t.Fatalf("BoardPosts with hidden returned %+v, %v", bps, err)
+	}
+	if err := b.DeleteBoardPost(posts[1].ID); err != nil {
+		t.Fatalf("DeleteBoardPost returned error: %v", err)
+	}
+	if bps, _ := b.BoardPosts(1, true, Page{}); len(bps) != 1 {
+		t.Fatalf("post not deleted: %+v", bps)
+	}
+
+	gw := Gateway{ID: "gw-1", Version: "1.0", Radio: "TBEAM", KeyHash: "k", LastSeen: time.Now()}
+	if err := b.SaveGateway(&gw); err != nil {
+		t.Fatalf("SaveGateway returned error: %v", err)
+	}
+	adopted := time.Now()
+	gw.Adopted, gw.AdoptedAt, gw.TokenHash = true, &adopted, "t"
+	gw.Settings = GatewaySettings{MQTTTopic: "site/a", Send: SendPermissions{Channels: []uint32{1}}}
+	if err := b.SaveGateway(&gw); err != nil {
+		t.Fatalf("SaveGateway returned error: %v", err)
+	}
+	if err := b.GatewayHeartbeat("gw-1", time.Now(), "serial down"); err != nil {
+		t.Fatalf("GatewayHeartbeat returned error: %v", err)
+	}
+	g, err := b.GatewayByToken("t")
+	if err != nil || g == nil || !g.Adopted || g.AdoptedAt == nil || g.LastError != "serial down" ||
+		g.Settings.MQTTTopic != "site/a" || !g.Settings.Send.Allows(1) || g.Settings.Send.Allows(0) {
+		t.Fatalf("GatewayByToken returned %+v, %v", g, err)
+	}
+	if g, err := b.Gateway("gw-missing"); err != nil || g != nil {
+		t.Fatalf("expected nil for unknown gateway, got %+v, %v", g, err)
+	}
+	if err := b.DeleteGateway("gw-1"); err != nil {
+		t.Fatalf("DeleteGateway returned error: %v", err)
+	}
+	if list, err := b.Gateways(); err != nil || len(list) != 0 {
+		t.Fatalf("Gateways returned %+v, %v", list, err)
+	}
+
+	u := User{Name: "anna", PasswordHash: "h", Role: "operator"}
+	if err := b.AddUser(&u); err != nil || u.ID == 0 {
+		t.Fatalf("AddUser returned %d, %v", u.ID, err)
+	}
+	if err := b.AddUser(&User{Name: "anna", PasswordHash: "h", Role: "viewer"}); err == nil {
+		t.Fatal("duplicate user name accepted")
+	}
+	u.Role = "admin"
+	if err := b.UpdateUser(&u); err != nil {
+		t.Fatalf("UpdateUser returned error: %v", err)
+	}
+	now := time.Now()
+	if err := b.AddSession("s1", u.ID, now.Add(time.Hour)); err != nil {
+		t.Fatalf("AddSession returned error: %v", err)
+	}
+	if got, err := b.SessionUser("s1", now); err != nil || got == nil || got.Role != "admin" {
+		t.Fatalf("SessionUser returned %+v, %v", got, err)
+	}
+	if got, err := b.SessionUser("s1", now.Add(2*time.Hour)); err != nil || got != nil {
+		t.Fatalf("expired session returned %+v, %v", got, err)
+	}
+	tok := APIToken{Name: "script", UserID: u.ID, TokenHash: "t1"}
+	if err := b.AddAPIToken(&tok); err != nil || tok.ID == 0 {
+		t.Fatalf("AddAPIToken returned %d, %v", tok.ID, err)
+	}
+	if got, err := b.TokenUser("t1", now); err != nil || got == nil || got.Name != "anna" {
+		t.Fatalf("TokenUser returned %+v, %v", got, err)
+	}
+	if list, err := b.APITokens(u.ID); err != nil || len(list) != 1 || list[0].User != "anna" || list[0].LastUsed == nil {
+		t.Fatalf("APITokens returned %+v, %v", list, err)
+	}
+	if err := b.AddAudit(&AuditEntry{User: "anna", Action: "send", Detail: "ciao"}); err != nil {
+		t.Fatalf("AddAudit returned error: %v", err)
+	}
+	if list, err := b.Audit("anna", Page{}); err != nil || len(list) != 1 || list[0].Detail != "ciao" {
+		t.Fatalf("Audit returned %+v, %v", list, err)
+	}
+	if err := b.DeleteUser(u.ID); err != nil {
+		t.Fatalf("DeleteUser returned error: %v", err)
+	}
+	if got, _ := b.SessionUser("s1", now); got != nil {
+		t.Fatalf("session survived its user: %+v", got)
+	}
+	if got, _ := b.TokenUser("t1", now); got != nil {
+		t.Fatalf("token survived its user: %+v", got)
+	}
+}
+
+func TestSQLiteBackend(t *testing.T) {
+	testBackend(t, openTestStore(t))
+}
+
+// TestPostgresBackend runs against the database named by
+// MESHSPY_TEST_POSTGRES_DSN, for example a throwaway container started with
+// docker run -e POSTGRES_PASSWORD=test -p 5432:5432 postgres. The tables are
+// created in a schema named after the test, which is dropped at the end.
+func TestPostgresBackend(t *testing.T) {
+	dsn := os.Getenv("MESHSPY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MESHSPY_TEST_POSTGRES_DSN not set")
+	}
+	plain, _, err := parsePostgresDSN(dsn)
+	if err != nil {
+		t.Fatalf("parsePostgresDSN returned error: %v", err)
+	}
+	admin, err := sql.Open("postgres", plain)
+	if err != nil {
+		t.Fatalf("sql.Open returned error: %v", err)
+	}
+	defer admin.Close()
+	schema := strings.ToLower(t.Name())
+	if _, err := admin.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE; CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	defer func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	}()
+
+	// lib/pq passes search_path to the server as a run-time parameter, so
+	// every connection of the pool starts in the test schema.
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("url.Parse returned error: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	b, err := Open(u.String())
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer b.Close()
+	testBackend(t, b)
+}
+
+func TestOpenSelectsBackend(t *testing.T) {
+	b, err := Open("sqlite://" + t.TempDir() + "/nodes.db")
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer b.Close()
+	if _, ok := b.(*NodeStore); !ok {
+		t.Fatalf("expected a SQLite store, got %T", b)
+	}
+}
+
+func TestParsePostgresDSN(t *testing.T) {
+	dsn, ts, err := parsePostgresDSN("postgres://u:p@db:5432/mesh?sslmode=disable&timescale=true")
+	if err != nil {
+		t.Fatalf("parsePostgresDSN returned error: %v", err)
+	}
+	if !ts || strings.Contains(dsn, "timescale") || !strings.Contains(dsn, "sslmode=disable") {
+		t.Fatalf("unexpected result %q, %v", dsn, ts)
+	}
+	if _, _, err := parsePostgresDSN("postgres://db/mesh?timescale=maybe"); err == nil {
+		t.Fatalf("expected error for invalid timescale flag")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	got := postgresDialect.rebind(`SELECT * FROM m WHERE a = ? AND b LIKE ? ESCAPE '\' AND c = '?'`)
+	want := `SELECT * FROM m WHERE a = $1 AND b LIKE $2 ESCAPE '\' AND c = '?'`
+	if got != want {
+		t.Fatalf("rebind = %q, want %q", got, want)
+	}
+	if q := sqliteDialect.rebind(`a = ?`); q != `a = ?` {
+		t.Fatalf("sqlite query rewritten: %q", q)
+	}
+	if q := tsQuery(`hello, "world"!`); q != `hello:* & world:*` {
+		t.Fatalf("tsQuery = %q", q)
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import "time"
+
+// BoardPost is a post of the bulletin board of a channel: a text received
+// on the channel, sent by the node From, or posted from the web by Author.
+// Hidden posts are only shown to moderators.
+type BoardPost struct {
+	ID        int64     `json:"id"`
+	Channel   uint32    `json:"channel"`
+	From      string    `json:"from,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Text      string    `json:"text"`
+	Hidden    bool      `json:"hidden"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddBoardPost stores p and returns its row ID. A zero CreatedAt is set to
+// the current time.
+func (s *sqlStore) AddBoardPost(p *BoardPost) (int64, error) {
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now()
+	}
+	err := s.queryRow(`INSERT INTO board_posts(channel, from_id, author, text, hidden, created_at)
+        VALUES(?, ?, ?, ?, ?, ?) RETURNING id`,
+		p.Channel, p.From, p.Author, p.Text, p.Hidden, sqlTime(p.CreatedAt)).Scan(&p.ID)
+	return p.ID, err
+}
+
+// BoardPosts returns the posts of the board of channel, newest first.
+// Hidden posts are left out unless withHidden is set.
+func (s *sqlStore) BoardPosts(channel uint32, withHidden bool, p Page) ([]BoardPost, error) {
+	where, args := `channel = ?`, []any{channel}
+	if !withHidden {
+		where += ` AND hidden = ?`
+		args = append(args, false)
+	}
+	clause, args := p.clause(where, args, "id", "created_at")
+	rows, err := s.query(`SELECT id, channel, from_id, author, text, hidden, created_at
+        FROM board_posts WHERE `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []BoardPost
+	for rows.Next() {
+		var bp BoardPost
+		if err := rows.Scan(&bp.ID, &bp.Channel, &bp.From, &bp.Author, &bp.Text,
+			&bp.Hidden, &bp.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, bp)
+	}
+	return out, rows.Err()
+}
+
+// SetBoardPostHidden hides or shows the post with the given ID.
+func (s *sqlStore) SetBoardPostHidden(id int64, hidden bool) error {
+	_, err := s.exec(`UPDATE board_posts SET hidden = ? WHERE id = ?`, hidden, id)
+	return err
+}
+
+// DeleteBoardPost removes the post with the given ID.
+func (s *sqlStore) DeleteBoardPost(id int64) error {
+	_, err := s.exec(`DELETE FROM board_posts WHERE id = ?`, id)
+	return err
+}
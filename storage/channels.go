@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"time"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Channel is a channel configured on the local radio.
+type Channel struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
+	// Role is PRIMARY, SECONDARY or DISABLED.
+	Role      string    `json:"role"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChannelFromProto converts a Channel sent by the radio. The secret key is
+// not kept.
+func ChannelFromProto(ch *latestpb.Channel) *Channel {
+	return &Channel{
+		Index: uint32(ch.GetIndex()),
+		Name:  ch.GetSettings().GetName(),
+		Role:  ch.GetRole().String(),
+	}
+}
+
+// SaveChannel inserts or replaces the channel with the index of c.
+func (s *sqlStore) SaveChannel(c *Channel) error {
+	c.UpdatedAt = time.Now().UTC()
+	_, err := s.exec(`INSERT INTO channels(idx, name, role, updated_at) VALUES(?, ?, ?, ?)
+        ON CONFLICT(idx) DO UPDATE SET name = excluded.name, role = excluded.role,
+        updated_at = excluded.updated_at`, c.Index, c.Name, c.Role, sqlTime(c.UpdatedAt))
+	return err
+}
+
+// Channels returns the enabled channels by index.
+func (s *sqlStore) Channels() ([]Channel, error) {
+	rows, err := s.query(`SELECT idx, name, role, updated_at FROM channels
+        WHERE role <> ? ORDER BY idx`, latestpb.Channel_DISABLED.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Channel
+	for rows.Next() {
+		var c Channel
+		if err := rows.Scan(&c.Index, &c.Name, &c.Role, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,58 @@
+package storage
+
+import "time"
+
+// DeadLetter is a webhook delivery abandoned after its retries, kept so it
+// can be inspected and replayed.
+type DeadLetter struct {
+	ID        int64     `json:"id"`
+	Sink      string    `json:"sink"`
+	EventID   int64     `json:"event_id"`
+	EventType string    `json:"event_type"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddDeadLetter stores d and sets its ID.
+func (s *sqlStore) AddDeadLetter(d *DeadLetter) error {
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	return s.queryRow(`INSERT INTO webhook_dead_letters(sink, event_id, event_type, payload, error, attempts, created_at)
+        VALUES(?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		d.Sink, d.EventID, d.EventType, d.Payload, d.Error, d.Attempts, sqlTime(d.CreatedAt)).Scan(&d.ID)
+}
+
+// DeadLetters returns the dead letters of sink, or of every sink when sink
+// is empty, newest first.
+func (s *sqlStore) DeadLetters(sink string, p Page) ([]DeadLetter, error) {
+	where, args := `1 = 1`, []any{}
+	if sink != "" {
+		where += ` AND sink = ?`
+		args = append(args, sink)
+	}
+	clause, args := p.clause(where, args, "id", "created_at")
+	rows, err := s.query(`SELECT id, sink, event_id, event_type, payload, error, attempts, created_at
+        FROM webhook_dead_letters WHERE `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DeadLetter
+	for rows.Next() {
+		var d DeadLetter
+		if err := rows.Scan(&d.ID, &d.Sink, &d.EventID, &d.EventType, &d.Payload, &d.Error, &d.Attempts, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// DeleteDeadLetter removes a dead letter, e.g. once replayed.
+func (s *sqlStore) DeleteDeadLetter(id int64) error {
+	_, err := s.exec(`DELETE FROM webhook_dead_letters WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"meshspy/events"
+)
+
+// EventFilter restricts the events returned by Events. Empty fields match
+// every event.
+type EventFilter struct {
+	Types   []string
+	NodeID  string
+	Gateway string
+	// After only matches the events with a greater ID, e.g. those missed
+	// by a client since the last one it received.
+	After int64
+}
+
+// Match reports whether e passes the filter.
+func (f EventFilter) Match(e events.Event) bool {
+	if f.NodeID != "" && e.NodeID != f.NodeID || f.Gateway != "" && e.Gateway != f.Gateway || e.ID <= f.After {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// AddEvent stores e and sets its ID.
+func (s *sqlStore) AddEvent(e *events.Event) error {
+	return s.queryRow(`INSERT INTO events(type, node_id, gateway, time, data) VALUES(?, ?, ?, ?, ?)
+        RETURNING id`, e.Type, e.NodeID, e.Gateway, sqlTime(e.Time), string(e.Data)).Scan(&e.ID)
+}
+
+// Events returns the stored events matching f within the page bounds,
+// newest first. Page.Since and Until bound the event time.
+func (s *sqlStore) Events(f EventFilter, p Page) ([]events.Event, error) {
+	where, args := `1 = 1`, []any{}
+	if f.NodeID != "" {
+		where += ` AND node_id = ?`
+		args = append(args, f.NodeID)
+	}
+	if f.Gateway != "" {
+		where += ` AND gateway = ?`
+		args = append(args, f.Gateway)
+	}
+	if f.After > 0 {
+		where += ` AND id > ?`
+		args = append(args, f.After)
+	}
+	if len(f.Types) > 0 {
+		where += ` AND type IN (` + placeholders(len(f.Types)) + `)`
+		for _, t := range f.Types {
+			args = append(args, t)
+		}
+	}
+	clause, args := p.clause(where, args, "id", "time")
+	rows, err := s.query(`SELECT id, type, node_id, gateway, time, data FROM events WHERE `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []events.Event
+	for rows.Next() {
+		var e events.Event
+		var data string
+		if err := rows.Scan(&e.ID, &e.Type, &e.NodeID, &e.Gateway, &e.Time, &data); err != nil {
+			return nil, err
+		}
+		if data != "" {
+			e.Data = []byte(data)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// PresenceState is the current presence of a node with its availability
+// over the queried window.
+type PresenceState struct {
+	NodeID string    `json:"node_id"`
+	Online bool      `json:"online"`
+	Since  time.Time `json:"since"`
+	// FirstSeen is the time of the first presence change read, before the
+	// window when the node was already known.
+	FirstSeen time.Time `json:"first_seen"`
+	// Uptime is the percentage of the window, or of the time since the
+	// node was first seen when later, the node was online.
+	Uptime float64 `json:"uptime"`
+}
+
+// Presence replays the node_online and node_offline events to return the
+// current state of every node and its uptime between since and now. Only the
+// last change of each node before since and the changes in [since, now] are
+// read.
+func (s *sqlStore) Presence(since, now time.Time) ([]PresenceState, error) {
+	rows, err := s.query(`SELECT id, node_id, type, time FROM events WHERE id IN (
+            SELECT MAX(id) FROM events WHERE type IN (?, ?) AND time < ? GROUP BY node_id)
+        UNION ALL
+        SELECT id, node_id, type, time FROM events WHERE type IN (?, ?) AND time >= ? AND time <= ?
+        ORDER BY node_id, id`,
+		events.NodeOnline, events.NodeOffline, sqlTime(since),
+		events.NodeOnline, events.NodeOffline, sqlTime(since), sqlTime(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type replay struct {
+		state  PresenceState
+		online time.Duration
+	}
+	nodes := map[string]*replay{}
+	// credit adds the part of [from, to) inside the window to the uptime.
+	credit := func(r *replay, from, to time.Time) {
+		if from.Before(since) {
+			from = since
+		}
+		if to.After(from) {
+			r.online += to.Sub(from)
+		}
+	}
+	for rows.Next() {
+		var seq int64
+		var id, typ string
+		var at time.Time
+		if err := rows.Scan(&seq, &id, &typ, &at); err != nil {
+			return nil, err
+		}
+		r, ok := nodes[id]
+		if !ok {
+			r = &replay{state: PresenceState{NodeID: id, FirstSeen: at}}
+			nodes[id] = r
+		}
+		online := typ == events.NodeOnline
+		if online == r.state.Online && ok {
+			continue
+		}
+		if r.state.Online {
+			credit(r, r.state.Since, at)
+		}
+		r.state.Online, r.state.Since = online, at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]PresenceState, 0, len(nodes))
+	for _, r := range nodes {
+		if r.state.Online {
+			credit(r, r.state.Since, now)
+		}
+		start := since
+		if r.state.FirstSeen.After(start) {
+			start = r.state.FirstSeen
+		}
+		if window := now.Sub(start); window > 0 {
+			r.state.Uptime = 100 * r.online.Seconds() / window.Seconds()
+			if r.state.Uptime > 100 {
+				r.state.Uptime = 100
+			}
+		} else if r.state.Online {
+			r.state.Uptime = 100
+		}
+		out = append(out, r.state)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	return out, nil
+}
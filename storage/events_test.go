@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"meshspy/events"
+)
+
+func TestPresenceUptime(t *testing.T) {
+	ns := openTestStore(t)
+	t0 := time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []events.Event{
+		{Type: events.NodeNew, NodeID: "0xa", Time: t0},
+		{Type: events.NodeOnline, NodeID: "0xa", Time: t0},
+		{Type: events.NodeOffline, NodeID: "0xa", Time: t0.Add(6 * time.Hour)},
+		{Type: events.NodeOnline, NodeID: "0xa", Time: t0.Add(9 * time.Hour)},
+		{Type: events.NodeOnline, NodeID: "0xb", Time: t0.Add(10 * time.Hour)},
+		{Type: events.NodeOffline, NodeID: "0xb", Time: t0.Add(11 * time.Hour)},
+	} {
+		if err := ns.AddEvent(&e); err != nil {
+			t.Fatalf("AddEvent returned error: %v", err)
+		}
+	}
+
+	now := t0.Add(12 * time.Hour)
+	states, err := ns.Presence(t0, now)
+	if err != nil {
+		t.Fatalf("Presence returned error: %v", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 nodes, got %+v", states)
+	}
+	a, b := states[0], states[1]
+	// 0xa was online 6h + 3h out of 12h.
+	if !a.Online || !a.Since.Equal(t0.Add(9*time.Hour)) || math.Abs(a.Uptime-75) > 0.01 {
+		t.Fatalf("unexpected state %+v", a)
+	}
+	// 0xb was first seen 2h ago and online for 1h.
+	if b.Online || math.Abs(b.Uptime-50) > 0.01 {
+		t.Fatalf("unexpected state %+v", b)
+	}
+
+	// A window starting later only counts the online time inside it.
+	states, _ = ns.Presence(t0.Add(8*time.Hour), now)
+	if math.Abs(states[0].Uptime-75) > 0.01 {
+		t.Fatalf("unexpected windowed uptime %+v", states[0])
+	}
+	// Inside the window 0xa starts online from its last change before it:
+	// online 3h + 3h out of 9h.
+	states, _ = ns.Presence(t0.Add(3*time.Hour), now)
+	if !states[0].FirstSeen.Equal(t0) || math.Abs(states[0].Uptime-100*6.0/9) > 0.01 {
+		t.Fatalf("unexpected windowed uptime %+v", states[0])
+	}
+	// Changes after now are not replayed.
+	states, _ = ns.Presence(t0, t0.Add(7*time.Hour))
+	if states[0].Online || len(states) != 1 {
+		t.Fatalf("unexpected states before the window end %+v", states)
+	}
+
+	evs, err := ns.Events(EventFilter{NodeID: "0xa"}, Page{Since: t0.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Events returned error: %v", err)
+	}
+	if len(evs) != 2 || evs[0].Type != events.NodeOnline || !evs[0].Time.Equal(t0.Add(9*time.Hour)) {
+		t.Fatalf("unexpected events %+v", evs)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	ns := openTestStore(t)
+	var ids []int64
+	for _, e := range []events.Event{
+		{Type: events.TextMessage, NodeID: "0xa", Gateway: "gw-1"},
+		{Type: events.Position, NodeID: "0xa", Gateway: "gw-2"},
+		{Type: events.GatewayOffline, Gateway: "gw-1"},
+		{Type: events.TextMessage, NodeID: "0xb", Gateway: "gw-1"},
+	} {
+		e.Time = time.Now()
+		if err := ns.AddEvent(&e); err != nil {
+			t.Fatalf("AddEvent returned error: %v", err)
+		}
+		ids = append(ids, e.ID)
+	}
+
+	f := EventFilter{Gateway: "gw-1", After: ids[0]}
+	evs, err := ns.Events(f, Page{})
+	if err != nil {
+		t.Fatalf("Events returned error: %v", err)
+	}
+	if len(evs) != 2 || evs[0].ID != ids[3] || evs[1].Type != events.GatewayOffline || evs[1].Gateway != "gw-1" {
+		t.Fatalf("unexpected events %+v", evs)
+	}
+	for _, e := range evs {
+		if !f.Match(e) {
+			t.Fatalf("stored event %+v does not match its filter", e)
+		}
+	}
+
+	f = EventFilter{Types: []string{events.TextMessage}, NodeID: "0xa"}
+	if !f.Match(events.Event{ID: 9, Type: events.TextMessage, NodeID: "0xa"}) ||
+		f.Match(events.Event{ID: 9, Type: events.Position, NodeID: "0xa"}) ||
+		f.Match(events.Event{ID: 9, Type: events.TextMessage, NodeID: "0xb"}) {
+		t.Fatalf("unexpected Match results for %+v", f)
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Gateway is a meshspy instance known to the management server. Gateways
+// announce themselves and stay pending until an operator adopts them, which
+// issues the credential they use from then on.
+type Gateway struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Radio      string `json:"radio,omitempty"`
+	Firmware   string `json:"firmware,omitempty"`
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Addr is the remote address of the last announcement.
+	Addr      string          `json:"addr,omitempty"`
+	Adopted   bool            `json:"adopted"`
+	AdoptedAt *time.Time      `json:"adopted_at,omitempty"`
+	LastSeen  time.Time       `json:"last_seen"`
+	LastError string          `json:"last_error,omitempty"`
+	Settings  GatewaySettings `json:"settings"`
+	CreatedAt time.Time       `json:"created_at"`
+	// KeyHash is the hash of the key sent with the announcements, which
+	// the gateway must present to collect its credential after adoption.
+	KeyHash string `json:"-"`
+	// TokenHash is the hash of the issued credential; empty until the
+	// gateway collects it.
+	TokenHash string `json:"-"`
+}
+
+// GatewaySettings is the configuration pushed to a gateway, which pulls it
+// on startup. Empty fields keep the local configuration.
+type GatewaySettings struct {
+	MQTTTopic    string `json:"mqtt_topic,omitempty"`
+	CommandTopic string `json:"command_topic,omitempty"`
+	StatePrefix  string `json:"state_prefix,omitempty"`
+	// Rules is the YAML of the alert rules, replacing the local rules
+	// file when set.
+	Rules string          `json:"rules,omitempty"`
+	Send  SendPermissions `json:"send"`
+}
+
+// SendPermissions restricts what a gateway may transmit on the mesh.
+type SendPermissions struct {
+	// ReadOnly gateways only listen.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Channels are the channel indexes allowed, all of them when empty.
+	Channels []uint32 `json:"channels,omitempty"`
+}
+
+// Allows reports whether sending on channel is permitted.
+func (p SendPermissions) Allows(channel uint32) bool {
+	if p.ReadOnly {
+		return false
+	}
+	if len(p.Channels) == 0 {
+		return true
+	}
+	for _, c := range p.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+const gatewayColumns = `id, name, version, radio, firmware, config_hash, addr, adopted, adopted_at,
+        last_seen, last_error, settings, created_at, key_hash, token_hash`
+
+// SaveGateway inserts or replaces g.
+func (s *sqlStore) SaveGateway(g *Gateway) error {
+	if g.CreatedAt.IsZero() {
+		g.CreatedAt = time.Now()
+	}
+	settings, err := json.Marshal(g.Settings)
+	if err != nil {
+		return err
+	}
+	var adoptedAt any
+	if g.AdoptedAt != nil {
+		adoptedAt = sqlTime(*g.AdoptedAt)
+	}
+	_, err = s.exec(`INSERT INTO gateways(`+gatewayColumns+`)
+        VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET name = excluded.name, version = excluded.version,
+            radio = excluded.radio, firmware = excluded.firmware, config_hash = excluded.config_hash,
+            addr = excluded.addr, adopted = excluded.adopted, adopted_at = excluded.adopted_at,
+            last_seen = excluded.last_seen, last_error = excluded.last_error, settings = excluded.settings,
+            key_hash = excluded.key_hash, token_hash = excluded.token_hash`,
+		g.ID, g.Name, g.Version, g.Radio, g.Firmware, g.ConfigHash, g.Addr, g.Adopted, adoptedAt,
+		sqlTime(g.LastSeen), g.LastError, string(settings), sqlTime(g.CreatedAt), g.KeyHash, g.TokenHash)
+	return err
+}
+
+// Gateway returns the gateway with the given ID, or nil if unknown.
+func (s *sqlStore) Gateway(id string) (*Gateway, error) {
+	return s.gateway(`id = ?`, id)
+}
+
+// GatewayByToken returns the gateway whose credential hashes to tokenHash,
+// or nil if none does.
+func (s *sqlStore) GatewayByToken(tokenHash string) (*Gateway, error) {
+	if tokenHash == "" {
+		return nil, nil
+	}
+	return s.gateway(`token_hash = ?`, tokenHash)
+}
+
+func (s *sqlStore) gateway(where string, arg any) (*Gateway, error) {
+	g, err := scanGateway(s.queryRow(`SELECT `+gatewayColumns+` FROM gateways WHERE `+where, arg))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
+
+// Gateways returns every gateway ordered by ID.
+func (s *sqlStore) Gateways() ([]Gateway, error) {
+	rows, err := s.query(`SELECT ` + gatewayColumns + ` FROM gateways ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Gateway
+	for rows.Next() {
+		g, err := scanGateway(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *g)
+	}
+	return out, rows.Err()
+}
+
+// GatewayHeartbeat records that gateway id was alive at the given time,
+// reporting lastErr, empty when healthy.
+func (s *sqlStore) GatewayHeartbeat(id string, at time.Time, lastErr string) error {
+	_, err := s.exec(`UPDATE gateways SET last_seen = ?, last_error = ? WHERE id = ?`, sqlTime(at), lastErr, id)
+	return err
+}
+
+// DeleteGateway forgets a gateway, revoking its credential.
+func (s *sqlStore) DeleteGateway(id string) error {
+	_, err := s.exec(`DELETE FROM gateways WHERE id = ?`, id)
+	return err
+}
+
+func scanGateway(row interface{ Scan(...any) error }) (*Gateway, error) {
+	var (
+		g         Gateway
+		adoptedAt sql.NullTime
+		settings  string
+	)
+	if err := row.Scan(&g.ID, &g.Name, &g.Version, &g.Radio, &g.Firmware, &g.ConfigHash, &g.Addr,
+		&g.Adopted, &adoptedAt, &g.LastSeen, &g.LastError, &settings, &g.CreatedAt, &g.KeyHash, &g.TokenHash); err != nil {
+		return nil, err
+	}
+	if adoptedAt.Valid {
+		g.AdoptedAt = &adoptedAt.Time
+	}
+	if settings != "" {
+		if err := json.Unmarshal([]byte(settings), &g.Settings); err != nil {
+			return nil, err
+		}
+	}
+	return &g, nil
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Message directions.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// Delivery states of a message.
+const (
+	StatusReceived  = "received"
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// BroadcastID is the destination of messages sent to a whole channel.
+const BroadcastID = "0xffffffff"
+
+// Message is a text message exchanged on the mesh.
+type Message struct {
+	ID        int64
+	PacketID  uint32
+	From      string
+	To        string
+	Channel   uint32
+	Direction string
+	Text      string
+	RxTime    int64
+	RxSnr     float64
+	RxRssi    int
+	HopsAway  int
+	ViaMqtt   bool
+	ReplyID   uint32
+	Emoji     bool
+	Status    string
+	Error     string
+	CreatedAt time.Time
+}
+
+const messageColumns = `id, packet_id, from_id, to_id, channel, direction, text,
+        rx_time, rx_snr, rx_rssi, hops_away, via_mqtt, reply_id, emoji, status,
+        error, created_at`
+
+// MessageFromPacket converts a received TEXT_MESSAGE_APP packet to a Message.
+// It returns nil for other packets.
+func MessageFromPacket(pkt *latestpb.MeshPacket) *Message {
+	dec := pkt.GetDecoded()
+	if dec == nil || dec.GetPortnum() != latestpb.PortNum_TEXT_MESSAGE_APP {
+		return nil
+	}
+	m := &Message{
+		PacketID:  pkt.GetId(),
+		From:      fmt.Sprintf("0x%x", pkt.GetFrom()),
+		To:        fmt.Sprintf("0x%x", pkt.GetTo()),
+		Channel:   pkt.GetChannel(),
+		Direction: DirectionIn,
+		Text:      string(dec.GetPayload()),
+		RxTime:    int64(pkt.GetRxTime()),
+		RxSnr:     float64(pkt.GetRxSnr()),
+		RxRssi:    int(pkt.GetRxRssi()),
+		ViaMqtt:   pkt.GetViaMqtt(),
+		ReplyID:   dec.GetReplyId(),
+		Emoji:     dec.GetEmoji() != 0,
+		Status:    StatusReceived,
+	}
+	if pkt.GetHopStart() != 0 && pkt.GetHopStart() >= pkt.GetHopLimit() {
+		m.HopsAway = int(pkt.GetHopStart() - pkt.GetHopLimit())
+	}
+	return m
+}
+
+// AddMessage stores m and returns its row ID. Packets received twice (for
+// example over the radio and via MQTT) are stored once; the ID of the
+// existing row is returned in that case.
+func (s *sqlStore) AddMessage(m *Message) (int64, error) {
+	if m.Status == "" {
+		m.Status = StatusReceived
+	}
+	if m.Direction == "" {
+		m.Direction = DirectionIn
+	}
+	err := s.queryRow(`INSERT INTO messages(packet_id, from_id, to_id,
+        channel, direction, text, rx_time, rx_snr, rx_rssi, hops_away, via_mqtt,
+        reply_id, emoji, status, error)
+        VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT DO NOTHING RETURNING id`,
+		m.PacketID, m.From, m.To, m.Channel, m.Direction, m.Text, m.RxTime,
+		m.RxSnr, m.RxRssi, m.HopsAway, m.ViaMqtt, m.ReplyID, m.Emoji, m.Status, m.Error).Scan(&m.ID)
+	if err == sql.ErrNoRows {
+		err = s.queryRow(`SELECT id FROM messages WHERE packet_id = ? AND from_id = ?`,
+			m.PacketID, m.From).Scan(&m.ID)
+	}
+	return m.ID, err
+}
+
+// UpdateMessageStatus sets the delivery status of the outgoing message with
+// the given packet ID. reason is stored for failed deliveries.
+func (s *sqlStore) UpdateMessageStatus(packetID uint32, status, reason string) error {
+	_, err := s.exec(`UPDATE messages SET status = ?, error = ?
+        WHERE packet_id = ? AND direction = ?`, status, reason, packetID, DirectionOut)
+	return err
+}
+
+// RoutingStatus returns the packet ID acknowledged by a ROUTING_APP packet
+// with the resulting delivery status and, for failures, the reason. The
+// packet ID is 0 for other packets.
+func RoutingStatus(pkt *latestpb.MeshPacket) (packetID uint32, status, reason string, err error) {
+	dec := pkt.GetDecoded()
+	if dec == nil || dec.GetPortnum() != latestpb.PortNum_ROUTING_APP || dec.GetRequestId() == 0 {
+		return 0, "", "", nil
+	}
+	var r latestpb.Routing
+	if err := proto.Unmarshal(dec.GetPayload(), &r); err != nil {
+		return 0, "", "", err
+	}
+	if r.GetErrorReason() == latestpb.Routing_NONE {
+		return dec.GetRequestId(), StatusDelivered, "", nil
+	}
+	return dec.GetRequestId(), StatusFailed, r.GetErrorReason().String(), nil
+}
+
+// ApplyRouting updates the delivery status of the message acknowledged by a
+// ROUTING_APP packet. Other packets are ignored.
+func (s *sqlStore) ApplyRouting(pkt *latestpb.MeshPacket) error {
+	id, status, reason, err := RoutingStatus(pkt)
+	if id == 0 {
+		return err
+	}
+	return s.UpdateMessageStatus(id, status, reason)
+}
+
+// ChannelMessages returns the broadcast messages of a channel, newest first.
+func (s *sqlStore) ChannelMessages(channel uint32, p Page) ([]Message, error) {
+	return s.queryMessages(`to_id = ? AND channel = ?`, []any{BroadcastID, channel}, p)
+}
+
+// Conversation returns the direct messages exchanged between nodes a and b,
+// newest first.
+func (s *sqlStore) Conversation(a, b string, p Page) ([]Message, error) {
+	return s.queryMessages(`((from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?))`,
+		[]any{a, b, b, a}, p)
+}
+
+// PeerMessages returns the direct messages exchanged between the local node
+// and peer, newest first.
+func (s *sqlStore) PeerMessages(peer string, p Page) ([]Message, error) {
+	return s.queryMessages(`((direction = ? AND to_id = ?) OR (direction = ? AND from_id = ? AND to_id <> ?))`,
+		[]any{DirectionOut, peer, DirectionIn, peer, BroadcastID}, p)
+}
+
+// ConversationSummary is a direct message conversation with a peer.
+type ConversationSummary struct {
+	Peer     string
+	Messages int
+	Last     Message
+}
+
+// Conversations returns the direct message conversations of the local
+// node, the most recently active first.
+func (s *sqlStore) Conversations() ([]ConversationSummary, error) {
+	rows, err := s.query(`SELECT c.peer, c.n, m.`+strings.ReplaceAll(messageColumns, ", ", ", m.")+`
+        FROM (SELECT CASE WHEN direction = ? THEN to_id ELSE from_id END AS peer,
+                COUNT(*) AS n, MAX(id) AS last
+              FROM messages WHERE to_id <> ? GROUP BY 1) c
+        JOIN messages m ON m.id = c.last ORDER BY m.id DESC`, DirectionOut, BroadcastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ConversationSummary
+	for rows.Next() {
+		var c ConversationSummary
+		m := &c.Last
+		if err := rows.Scan(&c.Peer, &c.Messages, &m.ID, &m.PacketID, &m.From, &m.To, &m.Channel,
+			&m.Direction, &m.Text, &m.RxTime, &m.RxSnr, &m.RxRssi, &m.HopsAway, &m.ViaMqtt,
+			&m.ReplyID, &m.Emoji, &m.Status, &m.Error, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// Messages returns all messages within the page bounds, newest first.
+func (s *sqlStore) Messages(p Page) ([]Message, error) {
+	return s.queryMessages(`1 = 1`, nil, p)
+}
+
+// MessagesFrom returns the messages sent by a node, newest first.
+func (s *sqlStore) MessagesFrom(nodeID string, p Page) ([]Message, error) {
+	return s.queryMessages(`from_id = ?`, []any{nodeID}, p)
+}
+
+// SearchMessages returns the messages matching query, newest first. Full
+// text search is used when SQLite was built with FTS5 (build tag
+// sqlite_fts5); otherwise a substring match is performed.
+func (s *NodeStore) SearchMessages(query string, p Page) ([]Message, error) {
+	if strings.TrimSpace(query) == "" {
+		return s.Messages(p)
+	}
+	if s.fts {
+		return s.queryMessages(`id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)`,
+			[]any{ftsQuery(query)}, p)
+	}
+	return s.queryMessages(`text LIKE ? ESCAPE '\'`, []any{"%" + escapeLike(query) + "%"}, p)
+}
+
+func (s *sqlStore) queryMessages(where string, args []any, p Page) ([]Message, error) {
+	clause, args := p.clause(where, args, "id", "created_at")
+	rows, err := s.query(`SELECT `+messageColumns+` FROM messages WHERE `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.PacketID, &m.From, &m.To, &m.Channel, &m.Direction,
+			&m.Text, &m.RxTime, &m.RxSnr, &m.RxRssi, &m.HopsAway, &m.ViaMqtt, &m.ReplyID,
+			&m.Emoji, &m.Status, &m.Error, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// setupMessageSearch keeps the FTS5 index of messages in sync with the
+// capabilities of the running binary. Binaries built without FTS5 drop the
+// triggers (inserts would fail otherwise) and fall back to LIKE searches; an
+// FTS5 build recreates them and rebuilds the index.
+func setupMessageSearch(db *sql.DB) (bool, error) {
+	var enabled bool
+	if err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&enabled); err != nil {
+		return false, err
+	}
+	if !enabled {
+		for _, t := range []string{"messages_fts_ai", "messages_fts_ad", "messages_fts_au"} {
+			if _, err := db.Exec(`DROP TRIGGER IF EXISTS ` + t); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	var triggers int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger'
+        AND name LIKE 'messages_fts_%'`).Scan(&triggers); err != nil {
+		return false, err
+	}
+	if triggers == 3 {
+		return true, nil
+	}
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(text, content='messages', content_rowid='id')`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_ai AFTER INSERT ON messages BEGIN
+            INSERT INTO messages_fts(rowid, text) VALUES (new.id, new.text);
+        END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_ad AFTER DELETE ON messages BEGIN
+            INSERT INTO messages_fts(messages_fts, rowid, text) VALUES('delete', old.id, old.text);
+        END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_au AFTER UPDATE OF text ON messages BEGIN
+            INSERT INTO messages_fts(messages_fts, rowid, text) VALUES('delete', old.id, old.text);
+            INSERT INTO messages_fts(rowid, text) VALUES (new.id, new.text);
+        END`,
+		`INSERT INTO messages_fts(messages_fts) VALUES('rebuild')`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ftsQuery turns free text into an FTS5 query matching all words as
+// prefixes, so user input never produces syntax errors.
+func ftsQuery(q string) string {
+	var terms []string
+	for _, w := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(w, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
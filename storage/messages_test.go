@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+func openTestStore(t *testing.T) *NodeStore {
+	t.Helper()
+	ns, err := NewNodeStore(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("NewNodeStore returned error: %v", err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	return ns
+}
+
+func textPacket(id, from, to, channel uint32, text string) *latestpb.MeshPacket {
+	return &latestpb.MeshPacket{
+		Id:       id,
+		From:     from,
+		To:       to,
+		Channel:  channel,
+		RxSnr:    4.5,
+		HopStart: 3,
+		HopLimit: 2,
+		PayloadVariant: &latestpb.MeshPacket_Decoded{Decoded: &latestpb.Data{
+			Portnum: latestpb.PortNum_TEXT_MESSAGE_APP,
+			Payload: []byte(text),
+		}},
+	}
+}
+
+func TestMessageArchiveQueries(t *testing.T) {
+	ns := openTestStore(t)
+
+	pkts := []*latestpb.MeshPacket{
+		textPacket(1, 0xa, 0xffffffff, 0, "hello everyone"),
+		textPacket(2, 0xb, 0xffffffff, 1, "on the other channel"),
+		textPacket(3, 0xa, 0xb, 0, "private hello"),
+		textPacket(4, 0xb, 0xa, 0, "private reply"),
+		textPacket(5, 0xc, 0xffffffff, 0, "SOS need help"),
+	}
+	for _, p := range pkts {
+		if _, err := ns.AddMessage(MessageFromPacket(p)); err != nil {
+			t.Fatalf("AddMessage returned error: %v", err)
+		}
+	}
+	// The same packet heard twice is stored once.
+	if _, err := ns.AddMessage(MessageFromPacket(pkts[0])); err != nil {
+		t.Fatalf("AddMessage duplicate returned error: %v", err)
+	}
+
+	ch0, err := ns.ChannelMessages(0, Page{})
+	if err != nil {
+		t.Fatalf("ChannelMessages returned error: %v", err)
+	}
+	if len(ch0) != 2 || ch0[0].Text != "SOS need help" || ch0[1].Text != "hello everyone" {
+		t.Fatalf("unexpected channel messages %+v", ch0)
+	}
+	if ch0[1].HopsAway != 1 || ch0[1].RxSnr != 4.5 {
+		t.Fatalf("rx metadata lost: %+v", ch0[1])
+	}
+
+	dm, err := ns.Conversation("0xb", "0xa", Page{})
+	if err != nil {
+		t.Fatalf("Conversation returned error: %v", err)
+	}
+	if len(dm) != 2 || dm[0].Text != "private reply" {
+		t.Fatalf("unexpected conversation %+v", dm)
+	}
+
+	first, err := ns.Messages(Page{Limit: 2})
+	if err != nil {
+		t.Fatalf("Messages returned error: %v", err)
+	}
+	next, err := ns.Messages(Page{Limit: 2, Before: first[len(first)-1].ID})
+	if err != nil {
+		t.Fatalf("Messages returned error: %v", err)
+	}
+	if len(first) != 2 || len(next) != 2 || next[0].ID >= first[1].ID {
+		t.Fatalf("bad pagination: %+v / %+v", first, next)
+	}
+
+	found, err := ns.SearchMessages("hello", Page{})
+	if err != nil {
+		t.Fatalf("SearchMessages returned error: %v", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 search results, got %+v", found)
+	}
+}
+
+func TestMessageDeliveryStatus(t *testing.T) {
+	ns := openTestStore(t)
+
+	out := &Message{PacketID: 77, From: "0xa", To: "0xb", Direction: DirectionOut,
+		Text: "ping", Status: StatusPending}
+	if _, err := ns.AddMessage(out); err != nil {
+		t.Fatalf("AddMessage returned error: %v", err)
+	}
+
+	payload, _ := proto.Marshal(&latestpb.Routing{
+		Variant: &latestpb.Routing_ErrorReason{ErrorReason: latestpb.Routing_NONE},
+	})
+	ack := &latestpb.MeshPacket{From: 0xb, To: 0xa, PayloadVariant: &latestpb.MeshPacket_Decoded{
+		Decoded: &latestpb.Data{Portnum: latestpb.PortNum_ROUTING_APP, RequestId: 77, Payload: payload},
+	}}
+	if err := ns.ApplyRouting(ack); err != nil {
+		t.Fatalf("ApplyRouting returned error: %v", err)
+	}
+	msgs, err := ns.Conversation("0xa", "0xb", Page{})
+	if err != nil {
+		t.Fatalf("Conversation returned error: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Status != StatusDelivered {
+		t.Fatalf("status not updated: %+v", msgs)
+	}
+}
+
+func TestConversations(t *testing.T) {
+	ns := openTestStore(t)
+
+	for _, m := range []*Message{
+		{PacketID: 1, From: "0xb", To: "0xa", Direction: DirectionIn, Text: "hi"},
+		{PacketID: 2, From: "0xa", To: "0xb", Direction: DirectionOut, Text: "hello", Status: StatusPending},
+		{PacketID: 3, From: "0xc", To: "0xa", Direction: DirectionIn, Text: "anyone?"},
+		{PacketID: 4, From: "0xb", To: BroadcastID, Direction: DirectionIn, Text: "to all"},
+	} {
+		if _, err := ns.AddMessage(m); err != nil {
+			t.Fatalf("AddMessage returned error: %v", err)
+		}
+	}
+
+	convs, err := ns.Conversations()
+	if err != nil {
+		t.Fatalf("Conversations returned error: %v", err)
+	}
+	if len(convs) != 2 || convs[0].Peer != "0xc" || convs[1].Peer != "0xb" ||
+		convs[1].Messages != 2 || convs[1].Last.Text != "hello" {
+		t.Fatalf("unexpected conversations %+v", convs)
+	}
+	msgs, err := ns.PeerMessages("0xb", Page{})
+	if err != nil {
+		t.Fatalf("PeerMessages returned error: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Text != "hello" || msgs[1].Text != "hi" {
+		t.Fatalf("unexpected peer messages %+v", msgs)
+	}
+}
+
+func TestRoutingStatus(t *testing.T) {
+	routing := func(reason latestpb.Routing_Error) *latestpb.MeshPacket {
+		payload, _ := proto.Marshal(&latestpb.Routing{
+			Variant: &latestpb.Routing_ErrorReason{ErrorReason: reason},
+		})
+		return &latestpb.MeshPacket{PayloadVariant: &latestpb.MeshPacket_Decoded{
+			Decoded: &latestpb.Data{Portnum: latestpb.PortNum_ROUTING_APP, RequestId: 9, Payload: payload},
+		}}
+	}
+
+	if id, status, _, err := RoutingStatus(routing(latestpb.Routing_NONE)); err != nil || id != 9 || status != StatusDelivered {
+		t.Fatalf("ack returned %d %q %v", id, status, err)
+	}
+	id, status, reason, err := RoutingStatus(routing(latestpb.Routing_NO_RESPONSE))
+	if err != nil || id != 9 || status != StatusFailed || reason != "NO_RESPONSE" {
+		t.Fatalf("nak returned %d %q %q %v", id, status, reason, err)
+	}
+	if id, _, _, err := RoutingStatus(textPacket(1, 0xa, 0xb, 0, "hi")); err != nil || id != 0 {
+		t.Fatalf("text packet returned %d %v", id, err)
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Metrics of a node stored besides the device metrics of the telemetry
+// table: the signal of its packets as heard by the local radio and its
+// environment sensors.
+const (
+	MetricSNR                = "snr"
+	MetricRSSI               = "rssi"
+	MetricTemperature        = "temperature"
+	MetricRelativeHumidity   = "relative_humidity"
+	MetricBarometricPressure = "barometric_pressure"
+	MetricGasResistance      = "gas_resistance"
+	MetricIAQ                = "iaq"
+	MetricLux                = "lux"
+)
+
+// Device metrics, served from the telemetry table and its rollups.
+const (
+	MetricBattery     = "battery"
+	MetricVoltage     = "voltage"
+	MetricChannelUtil = "channel_util"
+	MetricAirUtilTx   = "air_util_tx"
+)
+
+// ResolutionMinute buckets series over short ranges; rollups are never
+// kept at this resolution.
+const ResolutionMinute = "minute"
+
+// deviceMetric maps a device metric to its telemetry column and to the
+// rollup columns of its bounds; a bound the rollups do not keep falls back
+// to the average.
+type deviceMetric struct {
+	raw           string
+	avg, min, max string
+}
+
+var deviceMetrics = map[string]deviceMetric{
+	MetricBattery:     {"battery_level", "battery_avg", "battery_min", "battery_avg"},
+	MetricVoltage:     {"voltage", "voltage_avg", "voltage_min", "voltage_avg"},
+	MetricChannelUtil: {"channel_utilization", "channel_util_avg", "channel_util_avg", "channel_util_max"},
+	MetricAirUtilTx:   {"air_util_tx", "air_util_tx_avg", "air_util_tx_avg", "air_util_tx_max"},
+}
+
+var nodeMetrics = map[string]bool{
+	MetricSNR: true, MetricRSSI: true, MetricTemperature: true, MetricRelativeHumidity: true,
+	MetricBarometricPressure: true, MetricGasResistance: true, MetricIAQ: true, MetricLux: true,
+}
+
+// KnownMetric reports whether metric can be queried with Series.
+func KnownMetric(metric string) bool {
+	_, device := deviceMetrics[metric]
+	return device || nodeMetrics[metric]
+}
+
+// PacketMetrics returns the metrics carried by pkt: the SNR and RSSI it
+// was received with, unless relayed over MQTT, and the readings of
+// environment telemetry.
+func PacketMetrics(pkt *latestpb.MeshPacket) map[string]float64 {
+	out := make(map[string]float64)
+	if !pkt.GetViaMqtt() && pkt.GetRxRssi() != 0 {
+		out[MetricSNR] = float64(pkt.GetRxSnr())
+		out[MetricRSSI] = float64(pkt.GetRxRssi())
+	}
+	dec := pkt.GetDecoded()
+	if dec.GetPortnum() != latestpb.PortNum_TELEMETRY_APP {
+		return out
+	}
+	var tm latestpb.Telemetry
+	if err := proto.Unmarshal(dec.GetPayload(), &tm); err != nil {
+		return out
+	}
+	env := tm.GetEnvironmentMetrics()
+	if env == nil {
+		return out
+	}
+	for metric, v := range map[string]*float32{
+		MetricTemperature:        env.Temperature,
+		MetricRelativeHumidity:   env.RelativeHumidity,
+		MetricBarometricPressure: env.BarometricPressure,
+		MetricGasResistance:      env.GasResistance,
+		MetricLux:                env.Lux,
+	} {
+		if v != nil {
+			out[metric] = float64(*v)
+		}
+	}
+	if env.Iaq != nil {
+		out[MetricIAQ] = float64(*env.Iaq)
+	}
+	return out
+}
+
+// AddNodeMetrics stores the metrics of nodeID received at time at.
+func (s *sqlStore) AddNodeMetrics(nodeID string, at time.Time, values map[string]float64) error {
+	for metric, v := range values {
+		if _, err := s.exec(`INSERT INTO node_metrics(node_id, metric, value, received_at) VALUES(?, ?, ?, ?)`,
+			nodeID, metric, v, sqlTime(at)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SeriesPoint aggregates a metric over the bucket starting at Time.
+type SeriesPoint struct {
+	Time    time.Time `json:"time"`
+	Avg     float64   `json:"avg"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Samples int       `json:"samples"`
+}
+
+// Series returns metric of nodeID aggregated in buckets of the given
+// resolution within [since, until), oldest first. Raw samples and the
+// rollups left by the retention are combined, so a range reaching past the
+// raw retention still has data at the resolution the rollups keep.
+func (s *sqlStore) Series(nodeID, metric, resolution string, since, until time.Time) ([]SeriesPoint, error) {
+	switch resolution {
+	case ResolutionMinute, ResolutionHour, ResolutionDay:
+	default:
+		return nil, fmt.Errorf("invalid resolution %q", resolution)
+	}
+	var raw, rollup string
+	var args []any
+	if dm, ok := deviceMetrics[metric]; ok {
+		raw = `SELECT ` + s.d.truncate(resolution, "received_at") + `, AVG(` + dm.raw + `), MIN(` + dm.raw + `),
+                MAX(` + dm.raw + `), COUNT(*) FROM telemetry WHERE node_id = ?`
+		rollup = `SELECT ` + s.d.truncate(resolution, "bucket") + `, SUM(` + dm.avg + ` * samples) / SUM(samples),
+                MIN(` + dm.min + `), MAX(` + dm.max + `), SUM(samples) FROM telemetry_rollups WHERE node_id = ?`
+		args = []any{nodeID}
+	} else if nodeMetrics[metric] {
+		raw = `SELECT ` + s.d.truncate(resolution, "received_at") + `, AVG(value), MIN(value), MAX(value),
+                COUNT(*) FROM node_metrics WHERE node_id = ? AND metric = ?`
+		rollup = `SELECT ` + s.d.truncate(resolution, "bucket") + `, SUM(value_avg * samples) / SUM(samples),
+                MIN(value_min), MAX(value_max), SUM(samples) FROM node_metric_rollups
+                WHERE node_id = ? AND metric = ?`
+		args = []any{nodeID, metric}
+	} else {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+
+	buckets := make(map[time.Time]*SeriesPoint)
+	if err := s.scanSeries(raw, "received_at", args, since, until, buckets); err != nil {
+		return nil, err
+	}
+	// Minute buckets are finer than any rollup.
+	if resolution != ResolutionMinute {
+		if err := s.scanSeries(rollup, "bucket", args, since, until, buckets); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]SeriesPoint, 0, len(buckets))
+	for _, p := range buckets {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	if len(out) > maxPageSize {
+		out = out[len(out)-maxPageSize:]
+	}
+	return out, nil
+}
+
+// scanSeries runs the aggregate query q over the rows with col in
+// [since, until) and merges its buckets into buckets, averages weighted by
+// their samples.
+func (s *sqlStore) scanSeries(q, col string, args []any, since, until time.Time, buckets map[time.Time]*SeriesPoint) error {
+	if !since.IsZero() {
+		q += ` AND ` + col + ` >= ?`
+		args = append(args, sqlTime(since))
+	}
+	if !until.IsZero() {
+		q += ` AND ` + col + ` < ?`
+		args = append(args, sqlTime(until))
+	}
+	rows, err := s.query(q+` GROUP BY 1`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket string
+		var p SeriesPoint
+		if err := rows.Scan(&bucket, &p.Avg, &p.Min, &p.Max, &p.Samples); err != nil {
+			return err
+		}
+		if p.Time, err = parseBucket(bucket); err != nil {
+			return err
+		}
+		cur, ok := buckets[p.Time]
+		if !ok {
+			buckets[p.Time] = &p
+			continue
+		}
+		n := cur.Samples + p.Samples
+		cur.Avg = (cur.Avg*float64(cur.Samples) + p.Avg*float64(p.Samples)) / float64(n)
+		cur.Min = min(cur.Min, p.Min)
+		cur.Max = max(cur.Max, p.Max)
+		cur.Samples = n
+	}
+	return rows.Err()
+}
+
+// parseBucket parses a truncated timestamp, formatted by SQLite like
+// CURRENT_TIMESTAMP and by the PostgreSQL driver as RFC 3339.
+func parseBucket(v string) (time.Time, error) {
+	if strings.Contains(v, "T") {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t.UTC(), err
+	}
+	return time.Parse("2006-01-02 15:04:05", v)
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+func TestPacketMetrics(t *testing.T) {
+	temp, hum := float32(21.5), float32(40)
+	payload, _ := proto.Marshal(&latestpb.Telemetry{Variant: &latestpb.Telemetry_EnvironmentMetrics{
+		EnvironmentMetrics: &latestpb.EnvironmentMetrics{Temperature: &temp, RelativeHumidity: &hum},
+	}})
+	pkt := &latestpb.MeshPacket{RxSnr: 6.25, RxRssi: -90, PayloadVariant: &latestpb.MeshPacket_Decoded{
+		Decoded: &latestpb.Data{Portnum: latestpb.PortNum_TELEMETRY_APP, Payload: payload},
+	}}
+	m := PacketMetrics(pkt)
+	if len(m) != 4 || m[MetricSNR] != 6.25 || m[MetricRSSI] != -90 || m[MetricTemperature] != 21.5 || m[MetricRelativeHumidity] != 40 {
+		t.Fatalf("unexpected metrics %v", m)
+	}
+	pkt.ViaMqtt = true
+	if m := PacketMetrics(pkt); len(m) != 2 {
+		t.Fatalf("signal of a packet relayed over MQTT kept: %v", m)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	ns := openTestStore(t)
+	now := time.Date(2025, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, s := range []struct {
+		at  string
+		snr float64
+	}{
+		{"2025-03-01 08:10:00", 2}, {"2025-03-01 08:50:00", 4},
+		{"2025-03-10 12:05:00", 5}, {"2025-03-10 12:06:00", 7}, {"2025-03-10 12:20:00", 9},
+	} {
+		if err := ns.AddNodeMetrics("n", at(s.at), map[string]float64{MetricSNR: s.snr}); err != nil {
+			t.Fatalf("AddNodeMetrics returned error: %v", err)
+		}
+	}
+	if _, err := ns.db.Exec(`INSERT INTO telemetry(node_id, battery_level, voltage, channel_utilization, air_util_tx, uptime_seconds, time, received_at) VALUES('n', 80, 4.0, 10, 1, 0, 0, '2025-03-10 12:10:00')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	// The old samples are folded into an hourly rollup
+	st, err := ns.Compact(now, Retention{Telemetry: RetentionPolicy{Raw: 24 * time.Hour}})
+	if err != nil || st.MetricsDownsampled != 2 {
+		t.Fatalf("Compact returned %+v, %v", st, err)
+	}
+
+	hourly, err := ns.Series("n", MetricSNR, ResolutionHour, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Series returned error: %v", err)
+	}
+	if len(hourly) != 2 || !hourly[0].Time.Equal(at("2025-03-01 08:00:00")) || hourly[0].Avg != 3 ||
+		hourly[0].Samples != 2 || hourly[1].Avg != 7 || hourly[1].Min != 5 || hourly[1].Max != 9 {
+		t.Fatalf("unexpected hourly series %+v", hourly)
+	}
+	minutes, err := ns.Series("n", MetricSNR, ResolutionMinute, at("2025-03-10 12:00:00"), now)
+	if err != nil || len(minutes) != 3 || minutes[1].Avg != 7 {
+		t.Fatalf("unexpected minute series %+v, %v", minutes, err)
+	}
+	daily, err := ns.Series("n", MetricSNR, ResolutionDay, time.Time{}, time.Time{})
+	if err != nil || len(daily) != 2 || daily[0].Samples != 2 || daily[1].Samples != 3 {
+		t.Fatalf("unexpected daily series %+v, %v", daily, err)
+	}
+	battery, err := ns.Series("n", MetricBattery, ResolutionHour, time.Time{}, time.Time{})
+	if err != nil || len(battery) != 1 || battery[0].Avg != 80 {
+		t.Fatalf("unexpected battery series %+v, %v", battery, err)
+	}
+	if _, err := ns.Series("n", "bogus", ResolutionHour, time.Time{}, time.Time{}); err == nil {
+		t.Fatalf("unknown metric accepted")
+	}
+}
@@ -0,0 +1,531 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	mqttpkg "meshspy/client"
+)
+
+// migration is a single ordered schema change. Migrations are applied in a
+// transaction together with the schema_version row recording them, so a
+// failed step leaves the database at the previous version.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// execAll returns a migration step executing the given statements in order.
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// nodeMigrations describes the evolution of the nodes.db schema. New entries
+// must be appended with the next version number; released migrations must
+// never be edited.
+var nodeMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// The tables already exist on databases created before versioning
+		// was introduced, hence IF NOT EXISTS.
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS nodes (
+                id TEXT PRIMARY KEY,
+                info TEXT,
+                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+			`CREATE TABLE IF NOT EXISTS positions (
+                node_id TEXT,
+                latitude REAL,
+                longitude REAL,
+                altitude INTEGER,
+                time INTEGER,
+                received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+			`CREATE TABLE IF NOT EXISTS telemetry (
+                battery_level INTEGER,
+                voltage REAL,
+                channel_utilization REAL,
+                air_util_tx REAL,
+                uptime_seconds INTEGER,
+                time INTEGER,
+                received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+		),
+	},
+	{
+		version: 2,
+		name:    "typed node columns and history",
+		up:      migrateNodesToColumns,
+	},
+	{
+		version: 3,
+		name:    "message archive",
+		up: execAll(
+			`CREATE TABLE messages (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                packet_id INTEGER NOT NULL DEFAULT 0,
+                from_id TEXT NOT NULL,
+                to_id TEXT NOT NULL,
+                channel INTEGER NOT NULL DEFAULT 0,
+                direction TEXT NOT NULL,
+                text TEXT NOT NULL,
+                rx_time INTEGER NOT NULL DEFAULT 0,
+                rx_snr REAL NOT NULL DEFAULT 0,
+                rx_rssi INTEGER NOT NULL DEFAULT 0,
+                hops_away INTEGER NOT NULL DEFAULT 0,
+                via_mqtt INTEGER NOT NULL DEFAULT 0,
+                reply_id INTEGER NOT NULL DEFAULT 0,
+                emoji INTEGER NOT NULL DEFAULT 0,
+                status TEXT NOT NULL,
+                error TEXT NOT NULL DEFAULT '',
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+			`CREATE UNIQUE INDEX messages_packet_idx ON messages(packet_id, from_id) WHERE packet_id != 0`,
+			`CREATE INDEX messages_channel_idx ON messages(to_id, channel, id)`,
+			`CREATE INDEX messages_from_idx ON messages(from_id, id)`,
+			`CREATE INDEX messages_created_idx ON messages(created_at)`,
+		),
+	},
+	{
+		version: 4,
+		name:    "retention rollups",
+		up: execAll(
+			`ALTER TABLE telemetry ADD COLUMN node_id TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX positions_node_idx ON positions(node_id, received_at)`,
+			`CREATE INDEX positions_received_idx ON positions(received_at)`,
+			`CREATE INDEX telemetry_node_idx ON telemetry(node_id, received_at)`,
+			`CREATE INDEX telemetry_received_idx ON telemetry(received_at)`,
+			`CREATE TABLE position_rollups (
+                node_id TEXT NOT NULL,
+                resolution TEXT NOT NULL,
+                bucket TIMESTAMP NOT NULL,
+                latitude REAL NOT NULL,
+                longitude REAL NOT NULL,
+                altitude REAL NOT NULL,
+                samples INTEGER NOT NULL,
+                PRIMARY KEY (node_id, resolution, bucket)
+            )`,
+			`CREATE TABLE telemetry_rollups (
+                node_id TEXT NOT NULL,
+                resolution TEXT NOT NULL,
+                bucket TIMESTAMP NOT NULL,
+                battery_avg REAL NOT NULL,
+                battery_min REAL NOT NULL,
+                voltage_avg REAL NOT NULL,
+                voltage_min REAL NOT NULL,
+                channel_util_avg REAL NOT NULL,
+                channel_util_max REAL NOT NULL,
+                air_util_tx_avg REAL NOT NULL,
+                air_util_tx_max REAL NOT NULL,
+                samples INTEGER NOT NULL,
+                PRIMARY KEY (node_id, resolution, bucket)
+            )`,
+		),
+	},
+	{
+		version: 5,
+		name:    "waypoints",
+		up: execAll(
+			`CREATE TABLE waypoints (
+                id INTEGER PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                description TEXT NOT NULL DEFAULT '',
+                icon INTEGER NOT NULL DEFAULT 0,
+                latitude REAL NOT NULL DEFAULT 0,
+                longitude REAL NOT NULL DEFAULT 0,
+                expire INTEGER NOT NULL DEFAULT 0,
+                locked_to TEXT NOT NULL DEFAULT '',
+                created_by TEXT NOT NULL DEFAULT '',
+                updated_by TEXT NOT NULL DEFAULT '',
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+			`CREATE INDEX waypoints_expire_idx ON waypoints(expire)`,
+		),
+	},
+	{
+		version: 6,
+		name:    "events",
+		up: execAll(
+			`CREATE TABLE events (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                type TEXT NOT NULL,
+                node_id TEXT NOT NULL DEFAULT '',
+                time TIMESTAMP NOT NULL,
+                data TEXT NOT NULL DEFAULT ''
+            )`,
+			`CREATE INDEX events_node_idx ON events(node_id, id)`,
+			`CREATE INDEX events_type_idx ON events(type, id)`,
+		),
+	},
+	{
+		version: 7,
+		name:    "webhook dead letters",
+		up: execAll(
+			`CREATE TABLE webhook_dead_letters (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                sink TEXT NOT NULL,
+                event_id INTEGER NOT NULL DEFAULT 0,
+                event_type TEXT NOT NULL DEFAULT '',
+                payload TEXT NOT NULL DEFAULT '',
+                error TEXT NOT NULL DEFAULT '',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                created_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE INDEX webhook_dead_letters_sink_idx ON webhook_dead_letters(sink, id)`,
+		),
+	},
+	{
+		version: 8,
+		name:    "gateways",
+		up: execAll(
+			`CREATE TABLE gateways (
+                id TEXT PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                version TEXT NOT NULL DEFAULT '',
+                radio TEXT NOT NULL DEFAULT '',
+                firmware TEXT NOT NULL DEFAULT '',
+                config_hash TEXT NOT NULL DEFAULT '',
+                addr TEXT NOT NULL DEFAULT '',
+                adopted INTEGER NOT NULL DEFAULT 0,
+                adopted_at TIMESTAMP,
+                last_seen TIMESTAMP NOT NULL,
+                last_error TEXT NOT NULL DEFAULT '',
+                settings TEXT NOT NULL DEFAULT '',
+                created_at TIMESTAMP NOT NULL,
+                key_hash TEXT NOT NULL DEFAULT '',
+                token_hash TEXT NOT NULL DEFAULT ''
+            )`,
+			`CREATE INDEX gateways_token_idx ON gateways(token_hash)`,
+		),
+	},
+	{
+		version: 9,
+		name:    "users and audit",
+		up: execAll(
+			`CREATE TABLE users (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                name TEXT NOT NULL UNIQUE,
+                password_hash TEXT NOT NULL,
+                role TEXT NOT NULL,
+                created_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE TABLE sessions (
+                token_hash TEXT PRIMARY KEY,
+                user_id INTEGER NOT NULL,
+                expires_at TIMESTAMP NOT NULL,
+                created_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE TABLE api_tokens (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                name TEXT NOT NULL DEFAULT '',
+                user_id INTEGER NOT NULL,
+                token_hash TEXT NOT NULL UNIQUE,
+                created_at TIMESTAMP NOT NULL,
+                last_used TIMESTAMP
+            )`,
+			`CREATE TABLE audit (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                time TIMESTAMP NOT NULL,
+                user_name TEXT NOT NULL DEFAULT '',
+                action TEXT NOT NULL,
+                detail TEXT NOT NULL DEFAULT '',
+                remote TEXT NOT NULL DEFAULT ''
+            )`,
+			`CREATE INDEX audit_user_idx ON audit(user_name, id)`,
+		),
+	},
+	{
+		version: 10,
+		name:    "event gateway",
+		up: execAll(
+			`ALTER TABLE events ADD COLUMN gateway TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX events_gateway_idx ON events(gateway, id)`,
+		),
+	},
+	{
+		version: 11,
+		name:    "channels",
+		up: execAll(
+			`CREATE TABLE channels (
+                idx INTEGER PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                role TEXT NOT NULL,
+                updated_at TIMESTAMP NOT NULL
+            )`,
+		),
+	},
+	{
+		version: 12,
+		name:    "node metrics",
+		up: execAll(
+			`CREATE TABLE node_metrics (
+                node_id TEXT NOT NULL,
+                metric TEXT NOT NULL,
+                value REAL NOT NULL,
+                received_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE INDEX node_metrics_node_idx ON node_metrics(node_id, metric, received_at)`,
+			`CREATE TABLE node_metric_rollups (
+                node_id TEXT NOT NULL,
+                metric TEXT NOT NULL,
+                resolution TEXT NOT NULL,
+                bucket TIMESTAMP NOT NULL,
+                value_avg REAL NOT NULL,
+                value_min REAL NOT NULL,
+                value_max REAL NOT NULL,
+                samples INTEGER NOT NULL,
+                PRIMARY KEY (node_id, metric, resolution, bucket)
+            )`,
+		),
+	},
+	{
+		version: 13,
+		name:    "board posts",
+		up: execAll(
+			`CREATE TABLE board_posts (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                channel INTEGER NOT NULL,
+                from_id TEXT NOT NULL DEFAULT '',
+                author TEXT NOT NULL DEFAULT '',
+                text TEXT NOT NULL,
+                hidden INTEGER NOT NULL DEFAULT 0,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+			`CREATE INDEX board_posts_channel_idx ON board_posts(channel, id)`,
+		),
+	},
+	{
+		version: 14,
+		name:    "waypoints out of positions",
+		up:      moveWaypointPositions(sqliteDialect),
+	},
+}
+
+// moveWaypointPositions moves the waypoints stored as positions before the
+// waypoints table existed into it. They were recorded under the waypoint ID
+// formatted as a node ID, with neither altitude nor time; IDs of known nodes
+// are left alone. The latest coordinates of each waypoint are kept, unless
+// the waypoint has been stored since.
+func moveWaypointPositions(d dialect) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT DISTINCT node_id FROM positions
+                WHERE altitude = 0 AND time = 0 AND node_id NOT IN (SELECT id FROM nodes)`)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			num, err := strconv.ParseUint(strings.TrimPrefix(id, "0x"), 16, 32)
+			if err != nil || !strings.HasPrefix(id, "0x") {
+				continue
+			}
+			if _, err := tx.Exec(d.rebind(`INSERT INTO waypoints(id, latitude, longitude, created_at, updated_at)
+                SELECT ?, latitude, longitude, received_at, received_at FROM positions
+                WHERE node_id = ? AND altitude = 0 AND time = 0
+                ORDER BY received_at DESC LIMIT 1
+                ON CONFLICT(id) DO NOTHING`), num, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(d.rebind(`DELETE FROM positions WHERE node_id = ? AND altitude = 0 AND time = 0`), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrateNodesToColumns replaces the JSON blob nodes table with typed columns
+// and adds the node_history table.
+func migrateNodesToColumns(tx *sql.Tx) error {
+	if err := execAll(
+		`ALTER TABLE nodes RENAME TO nodes_legacy`,
+		`CREATE TABLE nodes (
+            id TEXT PRIMARY KEY,
+            num INTEGER NOT NULL DEFAULT 0,
+            long_name TEXT NOT NULL DEFAULT '',
+            short_name TEXT NOT NULL DEFAULT '',
+            mac_addr TEXT NOT NULL DEFAULT '',
+            hw_model TEXT NOT NULL DEFAULT '',
+            role TEXT NOT NULL DEFAULT '',
+            public_key TEXT NOT NULL DEFAULT '',
+            latitude REAL NOT NULL DEFAULT 0,
+            longitude REAL NOT NULL DEFAULT 0,
+            altitude INTEGER NOT NULL DEFAULT 0,
+            location_time INTEGER NOT NULL DEFAULT 0,
+            location_source TEXT NOT NULL DEFAULT '',
+            battery_level INTEGER NOT NULL DEFAULT 0,
+            voltage REAL NOT NULL DEFAULT 0,
+            channel_util REAL NOT NULL DEFAULT 0,
+            air_util_tx REAL NOT NULL DEFAULT 0,
+            uptime_seconds INTEGER NOT NULL DEFAULT 0,
+            firmware_version TEXT NOT NULL DEFAULT '',
+            device_state_ver INTEGER NOT NULL DEFAULT 0,
+            can_shutdown INTEGER NOT NULL DEFAULT 0,
+            has_wifi INTEGER NOT NULL DEFAULT 0,
+            has_bluetooth INTEGER NOT NULL DEFAULT 0,
+            has_ethernet INTEGER NOT NULL DEFAULT 0,
+            radio_role TEXT NOT NULL DEFAULT '',
+            position_flags INTEGER NOT NULL DEFAULT 0,
+            radio_hw_model TEXT NOT NULL DEFAULT '',
+            has_remote_hardware INTEGER NOT NULL DEFAULT 0,
+            snr REAL NOT NULL DEFAULT 0,
+            last_heard INTEGER NOT NULL DEFAULT 0,
+            channel INTEGER NOT NULL DEFAULT 0,
+            via_mqtt INTEGER NOT NULL DEFAULT 0,
+            hops_away INTEGER NOT NULL DEFAULT 0,
+            is_favorite INTEGER NOT NULL DEFAULT 0,
+            is_ignored INTEGER NOT NULL DEFAULT 0,
+            is_key_manually_verified INTEGER NOT NULL DEFAULT 0,
+            first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+		`CREATE INDEX nodes_role_idx ON nodes(role)`,
+		`CREATE INDEX nodes_last_heard_idx ON nodes(last_heard)`,
+		`CREATE TABLE node_history (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            node_id TEXT NOT NULL,
+            field TEXT NOT NULL,
+            old_value TEXT NOT NULL,
+            new_value TEXT NOT NULL,
+            changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+		`CREATE INDEX node_history_node_idx ON node_history(node_id, changed_at)`,
+	)(tx); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT info, updated_at FROM nodes_legacy`)
+	if err != nil {
+		return err
+	}
+	type legacyNode struct {
+		info    mqttpkg.NodeInfo
+		updated sql.NullString
+	}
+	var legacy []legacyNode
+	for rows.Next() {
+		var raw sql.NullString
+		var n legacyNode
+		if err := rows.Scan(&raw, &n.updated); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal([]byte(raw.String), &n.info); err != nil || n.info.ID == "" {
+			// Unreadable blobs carry no usable data; skip them.
+			continue
+		}
+		legacy = append(legacy, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, n := range legacy {
+		i := n.info
+		if _, err := tx.Exec(`INSERT INTO nodes(id, num, long_name, short_name, mac_addr,
+                hw_model, role, latitude, longitude, altitude, location_time,
+                location_source, battery_level, voltage, channel_util, air_util_tx,
+                uptime_seconds, firmware_version, device_state_ver, can_shutdown,
+                has_wifi, has_bluetooth, has_ethernet, radio_role, position_flags,
+                radio_hw_model, has_remote_hardware, snr, last_heard, channel,
+                via_mqtt, hops_away, is_favorite, is_ignored, is_key_manually_verified)
+                VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+                ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			i.ID, i.Num, i.LongName, i.ShortName, i.MacAddr, i.HwModel, i.Role,
+			i.Latitude, i.Longitude, i.Altitude, i.LocationTime, i.LocationSource,
+			i.BatteryLevel, i.Voltage, i.ChannelUtil, i.AirUtilTx, i.UptimeSeconds,
+			i.FirmwareVersion, i.DeviceStateVer, i.CanShutdown, i.HasWifi,
+			i.HasBluetooth, i.HasEthernet, i.RadioRole, i.PositionFlags,
+			i.RadioHwModel, i.HasRemoteHardware, i.Snr, i.LastHeard, i.Channel,
+			i.ViaMqtt, i.HopsAway, i.IsFavorite, i.IsIgnored, i.IsKeyManuallyVerified); err != nil {
+			return err
+		}
+		if n.updated.Valid {
+			if _, err := tx.Exec(`UPDATE nodes SET first_seen = ?, updated_at = ? WHERE id = ?`,
+				n.updated.String, n.updated.String, i.ID); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec(`DROP TABLE nodes_legacy`)
+	return err
+}
+
+// schemaVersion returns the highest applied migration version, or 0 for a
+// database that has never been migrated.
+func schemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT,
+        applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    )`); err != nil {
+		return 0, err
+	}
+	var v sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// migrate applies every migration newer than the current schema version.
+// Statements issued by migrate itself are written for d.
+func migrate(db *sql.DB, d dialect, migrations []migration) error {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			return fmt.Errorf("migration %d (%s) out of order", migrations[i].version, migrations[i].name)
+		}
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(d.rebind(`INSERT INTO schema_version(version, name) VALUES(?, ?)`), m.version, m.name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		current = m.version
+	}
+	return nil
+}
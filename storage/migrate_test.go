@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// legacySchema is the nodes.db layout created before schema versioning was
+// introduced.
+var legacySchema = []string{
+	`CREATE TABLE nodes (id TEXT PRIMARY KEY, info TEXT, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+	`CREATE TABLE positions (node_id TEXT, latitude REAL, longitude REAL, altitude INTEGER, time INTEGER, received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+	`CREATE TABLE telemetry (battery_level INTEGER, voltage REAL, channel_utilization REAL, air_util_tx REAL, uptime_seconds INTEGER, time INTEGER, received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+	`INSERT INTO nodes(id, info) VALUES('0x1', '{"ID":"0x1","Num":1,"LongName":"Legacy"}')`,
+	`INSERT INTO positions(node_id, latitude, longitude, altitude, time) VALUES('0x1', 43.7, 10.4, 5, 100)`,
+	// A waypoint stored as a position before the waypoints table existed
+	`INSERT INTO positions(node_id, latitude, longitude, altitude, time) VALUES('0xbeef', 43.8, 10.5, 0, 0)`,
+	`INSERT INTO telemetry(battery_level, voltage, channel_utilization, air_util_tx, uptime_seconds, time) VALUES(80, 3.9, 1.5, 0.5, 60, 100)`,
+}
+
+func writeFixture(t *testing.T, stmts []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nodes.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open fixture: %v", err)
+	}
+	defer db.Close()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("fixture %q: %v", stmt, err)
+		}
+	}
+	return path
+}
+
+func latestVersion() int {
+	return nodeMigrations[len(nodeMigrations)-1].version
+}
+
+func TestMigrateUpgradesLegacySchema(t *testing.T) {
+	path := writeFixture(t, legacySchema)
+
+	ns, err := NewNodeStore(path)
+	if err != nil {
+		t.Fatalf("NewNodeStore returned error: %v", err)
+	}
+	defer ns.Close()
+
+	v, err := ns.SchemaVersion()
+	if err != nil {
+		t.Fatalf("SchemaVersion returned error: %v", err)
+	}
+	if v != latestVersion() {
+		t.Fatalf("expected version %d, got %d", latestVersion(), v)
+	}
+	nodes, err := ns.List()
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].LongName != "Legacy" {
+		t.Fatalf("legacy nodes lost: %+v", nodes)
+	}
+	pos, err := ns.Positions("0x1", Page{})
+	if err != nil {
+		t.Fatalf("Positions returned error: %v", err)
+	}
+	if len(pos) != 1 {
+		t.Fatalf("legacy positions lost: %+v", pos)
+	}
+	wp, err := ns.Waypoint(0xbeef)
+	if err != nil || wp == nil || wp.Latitude != 43.8 || wp.Longitude != 10.5 {
+		t.Fatalf("legacy waypoint not moved: %+v, %v", wp, err)
+	}
+	if pos, _ := ns.Positions("0xbeef", Page{}); len(pos) != 0 {
+		t.Fatalf("legacy waypoint left in positions: %+v", pos)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.db")
+	for i := 0; i < 2; i++ {
+		ns, err := NewNodeStore(path)
+		if err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+		var n int
+		if err := ns.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&n); err != nil {
+			t.Fatalf("count versions: %v", err)
+		}
+		if n != len(nodeMigrations) {
+			t.Fatalf("expected %d applied migrations, got %d", len(nodeMigrations), n)
+		}
+		ns.Close()
+	}
+}
+
+func TestMigrateRollsBackFailedStep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	boom := errors.New("boom")
+	migs := []migration{
+		{version: 1, name: "create", up: execAll(`CREATE TABLE a (x INTEGER)`)},
+		{version: 2, name: "broken", up: func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`CREATE TABLE b (y INTEGER)`); err != nil {
+				return err
+			}
+			return boom
+		}},
+	}
+	if err := migrate(db, sqliteDialect, migs); !errors.Is(err, boom) {
+		t.Fatalf("expected boom error, got %v", err)
+	}
+	v, err := schemaVersion(db)
+	if err != nil {
+		t.Fatalf("schemaVersion: %v", err)
+	}
+	if v != 1 {
+		t.Fatalf("expected version 1 after failure, got %d", v)
+	}
+	var name string
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='b'`).Scan(&name)
+	if err != sql.ErrNoRows {
+		t.Fatalf("table from failed migration was kept: %v", err)
+	}
+}
+
+func TestMigrateRejectsOutOfOrder(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	migs := []migration{
+		{version: 2, name: "two", up: execAll()},
+		{version: 1, name: "one", up: execAll()},
+	}
+	if err := migrate(db, sqliteDialect, migs); err == nil {
+		t.Fatalf("expected error for out of order migrations")
+	}
+}
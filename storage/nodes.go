@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	mqttpkg "meshspy/client"
+)
+
+// nodeColumns lists the typed columns of the nodes table in the order used by
+// scanNode and nodeValues.
+const nodeColumns = `id, num, long_name, short_name, mac_addr, hw_model, role,
+        public_key, latitude, longitude, altitude, location_time, location_source,
+        battery_level, voltage, channel_util, air_util_tx, uptime_seconds,
+        firmware_version, device_state_ver, can_shutdown, has_wifi, has_bluetooth,
+        has_ethernet, radio_role, position_flags, radio_hw_model,
+        has_remote_hardware, snr, last_heard, channel, via_mqtt, hops_away,
+        is_favorite, is_ignored, is_key_manually_verified`
+
+// trackedFields are the identity fields whose changes are recorded in
+// node_history.
+var trackedFields = []struct {
+	name string
+	get  func(*mqttpkg.NodeInfo) string
+}{
+	{"long_name", func(n *mqttpkg.NodeInfo) string { return n.LongName }},
+	{"short_name", func(n *mqttpkg.NodeInfo) string { return n.ShortName }},
+	{"role", func(n *mqttpkg.NodeInfo) string { return n.Role }},
+	{"hw_model", func(n *mqttpkg.NodeInfo) string { return n.HwModel }},
+	{"firmware_version", func(n *mqttpkg.NodeInfo) string { return n.FirmwareVersion }},
+	{"public_key", func(n *mqttpkg.NodeInfo) string { return n.PublicKey }},
+}
+
+// NodeChange is a recorded change of an identity field of a node.
+type NodeChange struct {
+	NodeID    string
+	Field     string
+	OldValue  string
+	NewValue  string
+	ChangedAt time.Time
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanNode(r rowScanner) (*mqttpkg.NodeInfo, error) {
+	var n mqttpkg.NodeInfo
+	err := r.Scan(&n.ID, &n.Num, &n.LongName, &n.ShortName, &n.MacAddr, &n.HwModel,
+		&n.Role, &n.PublicKey, &n.Latitude, &n.Longitude, &n.Altitude,
+		&n.LocationTime, &n.LocationSource, &n.BatteryLevel, &n.Voltage,
+		&n.ChannelUtil, &n.AirUtilTx, &n.UptimeSeconds, &n.FirmwareVersion,
+		&n.DeviceStateVer, &n.CanShutdown, &n.HasWifi, &n.HasBluetooth,
+		&n.HasEthernet, &n.RadioRole, &n.PositionFlags, &n.RadioHwModel,
+		&n.HasRemoteHardware, &n.Snr, &n.LastHeard, &n.Channel, &n.ViaMqtt,
+		&n.HopsAway, &n.IsFavorite, &n.IsIgnored, &n.IsKeyManuallyVerified)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func nodeValues(n *mqttpkg.NodeInfo) []any {
+	return []any{n.ID, n.Num, n.LongName, n.ShortName, n.MacAddr, n.HwModel,
+		n.Role, n.PublicKey, n.Latitude, n.Longitude, n.Altitude,
+		n.LocationTime, n.LocationSource, n.BatteryLevel, n.Voltage,
+		n.ChannelUtil, n.AirUtilTx, n.UptimeSeconds, n.FirmwareVersion,
+		n.DeviceStateVer, n.CanShutdown, n.HasWifi, n.HasBluetooth,
+		n.HasEthernet, n.RadioRole, n.PositionFlags, n.RadioHwModel,
+		n.HasRemoteHardware, n.Snr, n.LastHeard, n.Channel, n.ViaMqtt,
+		n.HopsAway, n.IsFavorite, n.IsIgnored, n.IsKeyManuallyVerified}
+}
+
+// mergeNode returns old updated with the values known by upd. Partial
+// sources such as MyNodeInfo only fill a few fields, so zero values are
+// treated as unknown and never overwrite stored data. Boolean flags cannot
+// tell unknown from false, so the device capabilities are only taken from
+// updates describing the local radio (RadioHwModel set) and the remaining
+// flags from updates carrying a hardware model, as every complete NodeInfo
+// does.
+func mergeNode(old, upd *mqttpkg.NodeInfo) *mqttpkg.NodeInfo {
+	m := *old
+	setStr := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	setInt := func(dst *int, v int) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setFloat := func(dst *float64, v float64) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	if upd.Num != 0 {
+		m.Num = upd.Num
+	}
+	setStr(&m.LongName, upd.LongName)
+	setStr(&m.ShortName, upd.ShortName)
+	setStr(&m.MacAddr, upd.MacAddr)
+	setStr(&m.HwModel, upd.HwModel)
+	setStr(&m.Role, upd.Role)
+	setStr(&m.PublicKey, upd.PublicKey)
+	if upd.Latitude != 0 || upd.Longitude != 0 {
+		m.Latitude = upd.Latitude
+		m.Longitude = upd.Longitude
+		m.Altitude = upd.Altitude
+		m.LocationTime = upd.LocationTime
+		m.LocationSource = upd.LocationSource
+	}
+	setInt(&m.BatteryLevel, upd.BatteryLevel)
+	setFloat(&m.Voltage, upd.Voltage)
+	setFloat(&m.ChannelUtil, upd.ChannelUtil)
+	setFloat(&m.AirUtilTx, upd.AirUtilTx)
+	setInt(&m.UptimeSeconds, upd.UptimeSeconds)
+	setStr(&m.FirmwareVersion, upd.FirmwareVersion)
+	setInt(&m.DeviceStateVer, upd.DeviceStateVer)
+	setStr(&m.RadioRole, upd.RadioRole)
+	setInt(&m.PositionFlags, upd.PositionFlags)
+	setStr(&m.RadioHwModel, upd.RadioHwModel)
+	setFloat(&m.Snr, upd.Snr)
+	if upd.LastHeard > m.LastHeard {
+		m.LastHeard = upd.LastHeard
+	}
+	setInt(&m.Channel, upd.Channel)
+	setInt(&m.HopsAway, upd.HopsAway)
+	if upd.RadioHwModel != "" {
+		m.CanShutdown = upd.CanShutdown
+		m.HasWifi = upd.HasWifi
+		m.HasBluetooth = upd.HasBluetooth
+		m.HasEthernet = upd.HasEthernet
+		m.HasRemoteHardware = upd.HasRemoteHardware
+	}
+	if upd.HwModel != "" {
+		m.ViaMqtt = upd.ViaMqtt
+		m.IsFavorite = upd.IsFavorite
+		m.IsIgnored = upd.IsIgnored
+		m.IsKeyManuallyVerified = upd.IsKeyManuallyVerified
+	}
+	return &m
+}
+
+// Upsert inserts the given NodeInfo or merges it into the stored record,
+// keeping the values the update does not know. Changes of identity fields are
+// recorded in node_history.
+func (s *sqlStore) Upsert(info *mqttpkg.NodeInfo) error {
+	if info == nil || info.ID == "" {
+		return fmt.Errorf("node info without id")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sel := `SELECT ` + nodeColumns + ` FROM nodes WHERE id = ?`
+	if s.d == postgresDialect {
+		// Serialize concurrent updates of the same node from several gateways.
+		sel += ` FOR UPDATE`
+	}
+	old, err := scanNode(tx.QueryRow(s.d.rebind(sel), info.ID))
+	switch {
+	case err == sql.ErrNoRows:
+		old = nil
+	case err != nil:
+		return err
+	}
+
+	merged := info
+	if old != nil {
+		merged = mergeNode(old, info)
+		for _, f := range trackedFields {
+			before, after := f.get(old), f.get(merged)
+			if before == after {
+				continue
+			}
+			if _, err := tx.Exec(s.d.rebind(`INSERT INTO node_history(node_id, field, old_value, new_value)
+                VALUES(?, ?, ?, ?)`), info.ID, f.name, before, after); err != nil {
+				return err
+			}
+		}
+	}
+
+	vals := nodeValues(merged)
+	if _, err := tx.Exec(s.d.rebind(`INSERT INTO nodes(`+nodeColumns+`)
+        VALUES(`+placeholders(len(vals))+`)
+        ON CONFLICT(id) DO UPDATE SET `+nodeUpdates+`, updated_at = `+s.d.now()),
+		vals...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.addPosition(info)
+}
+
+// nodeUpdates assigns every column but id from the row rejected by an
+// upsert; first_seen is left untouched.
+var nodeUpdates = func() string {
+	var sets []string
+	for _, c := range strings.Split(nodeColumns, ",") {
+		if c = strings.TrimSpace(c); c != "id" {
+			sets = append(sets, c+" = excluded."+c)
+		}
+	}
+	return strings.Join(sets, ", ")
+}()
+
+// placeholders returns n comma separated ? placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Get returns the stored node with the given id, or nil when unknown.
+func (s *sqlStore) Get(id string) (*mqttpkg.NodeInfo, error) {
+	n, err := scanNode(s.queryRow(`SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return n, err
+}
+
+// List returns all NodeInfo records stored in the database.
+func (s *sqlStore) List() ([]*mqttpkg.NodeInfo, error) {
+	rows, err := s.query(`SELECT ` + nodeColumns + ` FROM nodes ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []*mqttpkg.NodeInfo
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// History returns the recorded identity changes of a node, oldest first.
+func (s *sqlStore) History(nodeID string) ([]NodeChange, error) {
+	rows, err := s.query(`SELECT node_id, field, old_value, new_value, changed_at
+        FROM node_history WHERE node_id = ? ORDER BY id`, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []NodeChange
+	for rows.Next() {
+		var c NodeChange
+		if err := rows.Scan(&c.NodeID, &c.Field, &c.OldValue, &c.NewValue, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
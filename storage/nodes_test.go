@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	mqttpkg "meshspy/client"
+)
+
+func TestUpsertKeepsKnownValues(t *testing.T) {
+	ns, err := NewNodeStore(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("NewNodeStore returned error: %v", err)
+	}
+	defer ns.Close()
+
+	full := &mqttpkg.NodeInfo{ID: "0x10", Num: 0x10, LongName: "Hilltop", ShortName: "HT",
+		HwModel: "RAK4631", Role: "ROUTER", BatteryLevel: 90, IsFavorite: true}
+	if err := ns.Upsert(full); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	// MyNodeInfo only knows the node number.
+	if err := ns.Upsert(&mqttpkg.NodeInfo{ID: "0x10", Num: 0x10}); err != nil {
+		t.Fatalf("Upsert partial returned error: %v", err)
+	}
+
+	got, err := ns.Get("0x10")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if got.LongName != "Hilltop" || got.Role != "ROUTER" || got.BatteryLevel != 90 || !got.IsFavorite {
+		t.Fatalf("partial update wiped known values: %+v", got)
+	}
+
+	var n int
+	if err := ns.db.QueryRow(`SELECT COUNT(*) FROM nodes WHERE role = 'ROUTER'`).Scan(&n); err != nil {
+		t.Fatalf("plain SQL query failed: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 router, got %d", n)
+	}
+}
+
+func TestUpsertRecordsHistory(t *testing.T) {
+	ns, err := NewNodeStore(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("NewNodeStore returned error: %v", err)
+	}
+	defer ns.Close()
+
+	if err := ns.Upsert(&mqttpkg.NodeInfo{ID: "0x20", LongName: "Old", Role: "CLIENT"}); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	if err := ns.Upsert(&mqttpkg.NodeInfo{ID: "0x20", LongName: "New", Role: "CLIENT"}); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	if err := ns.Upsert(&mqttpkg.NodeInfo{ID: "0x20", Role: "ROUTER", PublicKey: "a2V5"}); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+
+	hist, err := ns.History("0x20")
+	if err != nil {
+		t.Fatalf("History returned error: %v", err)
+	}
+	want := []NodeChange{
+		{Field: "long_name", OldValue: "Old", NewValue: "New"},
+		{Field: "role", OldValue: "CLIENT", NewValue: "ROUTER"},
+		{Field: "public_key", OldValue: "", NewValue: "a2V5"},
+	}
+	if len(hist) != len(want) {
+		t.Fatalf("expected %d changes, got %+v", len(want), hist)
+	}
+	for i, w := range want {
+		if hist[i].Field != w.Field || hist[i].OldValue != w.OldValue || hist[i].NewValue != w.NewValue {
+			t.Fatalf("change %d: got %+v want %+v", i, hist[i], w)
+		}
+	}
+}
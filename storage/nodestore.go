@@ -2,11 +2,8 @@ package storage
 
 import (
 	"database/sql"
-	"encoding/json"
-	"fmt"
 	"os"
 	"path/filepath"
-
 	"time"
 
 	mqttpkg "meshspy/client"
@@ -15,13 +12,15 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// NodeStore manages persistent storage of NodeInfo records.
+// NodeStore manages persistent storage of NodeInfo records in SQLite.
 type NodeStore struct {
-	db *sql.DB
+	sqlStore
+	fts bool
 }
 
 // NodePosition represents a recorded position for a node.
 type NodePosition struct {
+	ID         int64
 	NodeID     string
 	Latitude   float64
 	Longitude  float64
@@ -32,6 +31,8 @@ type NodePosition struct {
 
 // TelemetryRecord represents stored device metrics with timestamps.
 type TelemetryRecord struct {
+	ID                 int64
+	NodeID             string
 	BatteryLevel       uint32
 	Voltage            float64
 	ChannelUtilization float64
@@ -41,7 +42,8 @@ type TelemetryRecord struct {
 	ReceivedAt         time.Time
 }
 
-// NewNodeStore opens or creates a SQLite database at path and prepares the nodes table.
+// NewNodeStore opens or creates a SQLite database at path and brings its
+// schema up to date by running any pending migrations.
 func NewNodeStore(path string) (*NodeStore, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return nil, err
@@ -50,106 +52,45 @@ func NewNodeStore(path string) (*NodeStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS nodes (
-        id TEXT PRIMARY KEY,
-        info TEXT,
-        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )`); err != nil {
-		db.Close()
-		return nil, err
-	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS positions (
-        node_id TEXT,
-        latitude REAL,
-        longitude REAL,
-        altitude INTEGER,
-        time INTEGER,
-        received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )`); err != nil {
+	// SQLite allows a single writer; sharing one connection avoids
+	// "database is locked" errors between concurrent transactions.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db, sqliteDialect, nodeMigrations); err != nil {
 		db.Close()
 		return nil, err
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS telemetry (
-        battery_level INTEGER,
-        voltage REAL,
-        channel_utilization REAL,
-        air_util_tx REAL,
-        uptime_seconds INTEGER,
-        time INTEGER,
-        received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )`); err != nil {
-		db.Close()
-		return nil, err
-	}
-	return &NodeStore{db: db}, nil
-}
-
-// Close closes the underlying database.
-func (s *NodeStore) Close() error {
-	return s.db.Close()
-}
-
-// Upsert inserts or updates the given NodeInfo in the database.
-func (s *NodeStore) Upsert(info *mqttpkg.NodeInfo) error {
-	data, err := json.Marshal(info)
-	if err != nil {
-		return err
-	}
-	_, err = s.db.Exec(`INSERT INTO nodes(id, info, updated_at) VALUES(?, ?, CURRENT_TIMESTAMP)
-        ON CONFLICT(id) DO UPDATE SET info=excluded.info, updated_at=CURRENT_TIMESTAMP`,
-		info.ID, string(data))
-	if err != nil {
-		return err
-	}
-	return s.addPosition(info)
-}
-
-// List returns all NodeInfo records stored in the database.
-func (s *NodeStore) List() ([]*mqttpkg.NodeInfo, error) {
-	rows, err := s.db.Query(`SELECT info FROM nodes ORDER BY id`)
+	fts, err := setupMessageSearch(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	defer rows.Close()
-
-	var nodes []*mqttpkg.NodeInfo
-	for rows.Next() {
-		var raw string
-		if err := rows.Scan(&raw); err != nil {
-			return nil, err
-		}
-		var n mqttpkg.NodeInfo
-		if err := json.Unmarshal([]byte(raw), &n); err != nil {
-			return nil, err
-		}
-		nodes = append(nodes, &n)
-	}
-	return nodes, rows.Err()
+	return &NodeStore{sqlStore: sqlStore{db: db, d: sqliteDialect}, fts: fts}, nil
 }
 
 // addPosition stores the location from info if available.
-func (s *NodeStore) addPosition(info *mqttpkg.NodeInfo) error {
+func (s *sqlStore) addPosition(info *mqttpkg.NodeInfo) error {
 	if info == nil {
 		return nil
 	}
 	if info.Latitude == 0 && info.Longitude == 0 {
 		return nil
 	}
-	_, err := s.db.Exec(`INSERT INTO positions(node_id, latitude, longitude, altitude, time, received_at)
-                VALUES(?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+	_, err := s.exec(`INSERT INTO positions(node_id, latitude, longitude, altitude, time)
+                VALUES(?, ?, ?, ?, ?)`,
 		info.ID, info.Latitude, info.Longitude, info.Altitude, info.LocationTime)
 	return err
 }
 
-// Positions returns recorded positions. When nodeID is empty all positions are returned.
-func (s *NodeStore) Positions(nodeID string) ([]NodePosition, error) {
-	var rows *sql.Rows
-	var err error
-	if nodeID == "" {
-		rows, err = s.db.Query(`SELECT node_id, latitude, longitude, altitude, time, received_at FROM positions ORDER BY received_at`)
-	} else {
-		rows, err = s.db.Query(`SELECT node_id, latitude, longitude, altitude, time, received_at FROM positions WHERE node_id = ? ORDER BY received_at`, nodeID)
+// Positions returns recorded positions within the page bounds, newest
+// first. When nodeID is empty the positions of all nodes are returned.
+func (s *sqlStore) Positions(nodeID string, p Page) ([]NodePosition, error) {
+	where, args := `1 = 1`, []any{}
+	if nodeID != "" {
+		where, args = `node_id = ?`, []any{nodeID}
 	}
+	clause, args := p.clause(where, args, s.d.rowID(), "received_at")
+	rows, err := s.query(`SELECT `+s.d.rowID()+`, node_id, latitude, longitude, altitude, time, received_at
+                FROM positions WHERE `+clause, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +99,7 @@ func (s *NodeStore) Positions(nodeID string) ([]NodePosition, error) {
 	var positions []NodePosition
 	for rows.Next() {
 		var p NodePosition
-		if err := rows.Scan(&p.NodeID, &p.Latitude, &p.Longitude, &p.Altitude, &p.Time, &p.ReceivedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.NodeID, &p.Latitude, &p.Longitude, &p.Altitude, &p.Time, &p.ReceivedAt); err != nil {
 			return nil, err
 		}
 		positions = append(positions, p)
@@ -166,22 +107,14 @@ func (s *NodeStore) Positions(nodeID string) ([]NodePosition, error) {
 	return positions, rows.Err()
 }
 
-// AddWaypoint stores the coordinates from a Waypoint message in the positions table.
-func (s *NodeStore) AddWaypoint(wp *latestpb.Waypoint) error {
-	if wp == nil || wp.LatitudeI == nil || wp.LongitudeI == nil {
-		return nil
-	}
-	id := fmt.Sprintf("0x%x", wp.GetId())
-	lat := float64(wp.GetLatitudeI()) / 1e7
-	lon := float64(wp.GetLongitudeI()) / 1e7
-	_, err := s.db.Exec(`INSERT INTO positions(node_id, latitude, longitude, altitude, time, received_at)
-                VALUES(?, ?, ?, 0, 0, CURRENT_TIMESTAMP)`, id, lat, lon)
-	return err
+// AddTelemetry stores telemetry metrics in the database without a sender.
+// Only DeviceMetrics from the Telemetry message are saved when present.
+func (s *sqlStore) AddTelemetry(tel *latestpb.Telemetry) error {
+	return s.AddNodeTelemetry("", tel)
 }
 
-// AddTelemetry stores telemetry metrics in the database. Only DeviceMetrics
-// from the Telemetry message are saved when present.
-func (s *NodeStore) AddTelemetry(tel *latestpb.Telemetry) error {
+// AddNodeTelemetry stores the DeviceMetrics reported by nodeID.
+func (s *sqlStore) AddNodeTelemetry(nodeID string, tel *latestpb.Telemetry) error {
 	if tel == nil {
 		return nil
 	}
@@ -189,21 +122,26 @@ func (s *NodeStore) AddTelemetry(tel *latestpb.Telemetry) error {
 	if dm == nil {
 		return nil
 	}
-	_, err := s.db.Exec(`INSERT INTO telemetry(
-                battery_level, voltage, channel_utilization, air_util_tx,
-                uptime_seconds, time, received_at)
-                VALUES(?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
-		dm.GetBatteryLevel(), dm.GetVoltage(), dm.GetChannelUtilization(),
+	_, err := s.exec(`INSERT INTO telemetry(
+                node_id, battery_level, voltage, channel_utilization, air_util_tx,
+                uptime_seconds, time)
+                VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		nodeID, dm.GetBatteryLevel(), dm.GetVoltage(), dm.GetChannelUtilization(),
 		dm.GetAirUtilTx(), dm.GetUptimeSeconds(), tel.GetTime())
 	return err
 }
 
-// Telemetry returns stored telemetry records ordered by the time they were
-// received.
-func (s *NodeStore) Telemetry() ([]TelemetryRecord, error) {
-	rows, err := s.db.Query(`SELECT battery_level, voltage, channel_utilization,
+// Telemetry returns stored telemetry records within the page bounds, newest
+// first. When nodeID is empty the records of all nodes are returned.
+func (s *sqlStore) Telemetry(nodeID string, p Page) ([]TelemetryRecord, error) {
+	where, args := `1 = 1`, []any{}
+	if nodeID != "" {
+		where, args = `node_id = ?`, []any{nodeID}
+	}
+	clause, args := p.clause(where, args, s.d.rowID(), "received_at")
+	rows, err := s.query(`SELECT `+s.d.rowID()+`, node_id, battery_level, voltage, channel_utilization,
                 air_util_tx, uptime_seconds, time, received_at FROM telemetry
-                ORDER BY received_at`)
+                WHERE `+clause, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -212,7 +150,7 @@ func (s *NodeStore) Telemetry() ([]TelemetryRecord, error) {
 	var recs []TelemetryRecord
 	for rows.Next() {
 		var r TelemetryRecord
-		if err := rows.Scan(&r.BatteryLevel, &r.Voltage, &r.ChannelUtilization,
+		if err := rows.Scan(&r.ID, &r.NodeID, &r.BatteryLevel, &r.Voltage, &r.ChannelUtilization,
 			&r.AirUtilTx, &r.UptimeSeconds, &r.Time, &r.ReceivedAt); err != nil {
 			return nil, err
 		}
@@ -174,7 +174,7 @@ func TestNodeStoreAddTelemetry(t *testing.T) {
 		t.Fatalf("AddTelemetry returned error: %v", err)
 	}
 
-	recs, err := ns.Telemetry()
+	recs, err := ns.Telemetry("", Page{})
 	if err != nil {
 		t.Fatalf("Telemetry returned error: %v", err)
 	}
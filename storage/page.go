@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultPageSize is used when a Page does not specify a limit.
+	defaultPageSize = 50
+	// maxPageSize caps the number of rows returned by a single query.
+	maxPageSize = 5000
+)
+
+// Page selects a slice of a newest-first result set. Before is the row ID
+// returned last by the previous page (0 for the first page) and Since/Until
+// optionally bound the time the rows were stored.
+type Page struct {
+	Before int64
+	Limit  int
+	Since  time.Time
+	Until  time.Time
+}
+
+// clause appends the page bounds to where and returns the WHERE body with
+// ordering and limit, together with the query arguments. idCol is the row
+// identifier used as cursor and timeCol the storage timestamp.
+func (p Page) clause(where string, args []any, idCol, timeCol string) (string, []any) {
+	if p.Before > 0 {
+		where += ` AND ` + idCol + ` < ?`
+		args = append(args, p.Before)
+	}
+	if !p.Since.IsZero() {
+		where += ` AND ` + timeCol + ` >= ?`
+		args = append(args, sqlTime(p.Since))
+	}
+	if !p.Until.IsZero() {
+		where += ` AND ` + timeCol + ` < ?`
+		args = append(args, sqlTime(p.Until))
+	}
+	limit := p.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	args = append(args, limit)
+	return where + ` ORDER BY ` + idCol + ` DESC LIMIT ?`, args
+}
+
+// PageFromQuery builds a Page from the before, limit, since and until URL
+// query parameters. Times are accepted as RFC 3339 or Unix seconds.
+func PageFromQuery(q url.Values) (Page, error) {
+	var p Page
+	var err error
+	if v := q.Get("before"); v != "" {
+		if p.Before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return p, fmt.Errorf("invalid before: %v", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if p.Limit, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("invalid limit: %v", err)
+		}
+	}
+	if p.Since, err = parseQueryTime(q.Get("since")); err != nil {
+		return p, fmt.Errorf("invalid since: %v", err)
+	}
+	if p.Until, err = parseQueryTime(q.Get("until")); err != nil {
+		return p, fmt.Errorf("invalid until: %v", err)
+	}
+	return p, nil
+}
+
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// sqlTime formats t like SQLite's CURRENT_TIMESTAMP so that stored
+// timestamps compare correctly as text.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
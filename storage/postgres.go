@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	_ "github.com/lib/pq"
+)
+
+// PGStore stores the mesh data in PostgreSQL. It suits the management
+// server aggregating many gateways, where concurrent writers contend for a
+// single SQLite file.
+type PGStore struct {
+	sqlStore
+	timescale bool
+}
+
+// OpenPostgres connects to the PostgreSQL database at dsn and applies any
+// pending migrations. The timescale=true query parameter, removed before
+// connecting, turns positions and telemetry into TimescaleDB hypertables;
+// the extension must be installed on the server.
+func OpenPostgres(dsn string) (*PGStore, error) {
+	dsn, timescale, err := parsePostgresDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db, postgresDialect, pgMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if timescale {
+		if err := setupTimescale(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("timescale: %w", err)
+		}
+	}
+	return &PGStore{sqlStore: sqlStore{db: db, d: postgresDialect}, timescale: timescale}, nil
+}
+
+// parsePostgresDSN strips the timescale option from dsn, since the server
+// would reject it as an unknown run-time parameter.
+func parsePostgresDSN(dsn string) (string, bool, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", false, err
+	}
+	q := u.Query()
+	v := q.Get("timescale")
+	if v == "" {
+		return dsn, false, nil
+	}
+	timescale, err := strconv.ParseBool(v)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid timescale: %v", err)
+	}
+	q.Del("timescale")
+	u.RawQuery = q.Encode()
+	return u.String(), timescale, nil
+}
+
+// setupTimescale converts the time series tables into hypertables
+// partitioned on received_at. It is a no-op for tables already converted.
+func setupTimescale(db *sql.DB) error {
+	for _, stmt := range []string{
+		`CREATE EXTENSION IF NOT EXISTS timescaledb`,
+		`SELECT create_hypertable('positions', 'received_at', if_not_exists => TRUE, migrate_data => TRUE)`,
+		`SELECT create_hypertable('telemetry', 'received_at', if_not_exists => TRUE, migrate_data => TRUE)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchMessages returns the messages containing every word of query as a
+// prefix, newest first.
+func (s *PGStore) SearchMessages(query string, p Page) ([]Message, error) {
+	tsq := tsQuery(query)
+	if tsq == "" {
+		return s.Messages(p)
+	}
+	return s.queryMessages(`to_tsvector('simple', text) @@ to_tsquery('simple', ?)`, []any{tsq}, p)
+}
+
+// tsQuery turns free text into a tsquery matching all words as prefixes.
+// Punctuation is dropped so user input never produces syntax errors.
+func tsQuery(q string) string {
+	var terms []string
+	for _, w := range strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		terms = append(terms, strings.ToLower(w)+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// pgMigrations describes the evolution of the PostgreSQL schema. It starts
+// from the layout SQLite reached through nodeMigrations; new entries must be
+// appended with the next version number.
+var pgMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// positions and telemetry have no primary key: hypertables require
+		// the partitioning column in every unique index.
+		up: execAll(
+			`CREATE TABLE nodes (
+                id TEXT PRIMARY KEY,
+                num BIGINT NOT NULL DEFAULT 0,
+                long_name TEXT NOT NULL DEFAULT '',
+                short_name TEXT NOT NULL DEFAULT '',
+                mac_addr TEXT NOT NULL DEFAULT '',
+                hw_model TEXT NOT NULL DEFAULT '',
+                role TEXT NOT NULL DEFAULT '',
+                public_key TEXT NOT NULL DEFAULT '',
+                latitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+                longitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+                altitude INTEGER NOT NULL DEFAULT 0,
+                location_time BIGINT NOT NULL DEFAULT 0,
+                location_source TEXT NOT NULL DEFAULT '',
+                battery_level INTEGER NOT NULL DEFAULT 0,
+                voltage DOUBLE PRECISION NOT NULL DEFAULT 0,
+                channel_util DOUBLE PRECISION NOT NULL DEFAULT 0,
+                air_util_tx DOUBLE PRECISION NOT NULL DEFAULT 0,
+                uptime_seconds BIGINT NOT NULL DEFAULT 0,
+                firmware_version TEXT NOT NULL DEFAULT '',
+                device_state_ver INTEGER NOT NULL DEFAULT 0,
+                can_shutdown BOOLEAN NOT NULL DEFAULT FALSE,
+                has_wifi BOOLEAN NOT NULL DEFAULT FALSE,
+                has_bluetooth BOOLEAN NOT NULL DEFAULT FALSE,
+                has_ethernet BOOLEAN NOT NULL DEFAULT FALSE,
+                radio_role TEXT NOT NULL DEFAULT '',
+                position_flags INTEGER NOT NULL DEFAULT 0,
+                radio_hw_model TEXT NOT NULL DEFAULT '',
+                has_remote_hardware BOOLEAN NOT NULL DEFAULT FALSE,
+                snr DOUBLE PRECISION NOT NULL DEFAULT 0,
+                last_heard BIGINT NOT NULL DEFAULT 0,
+                channel INTEGER NOT NULL DEFAULT 0,
+                via_mqtt BOOLEAN NOT NULL DEFAULT FALSE,
+                hops_away INTEGER NOT NULL DEFAULT 0,
+                is_favorite BOOLEAN NOT NULL DEFAULT FALSE,
+                is_ignored BOOLEAN NOT NULL DEFAULT FALSE,
+                is_key_manually_verified BOOLEAN NOT NULL DEFAULT FALSE,
+                first_seen TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+                updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE INDEX nodes_role_idx ON nodes(role)`,
+			`CREATE INDEX nodes_last_heard_idx ON nodes(last_heard)`,
+			`CREATE TABLE node_history (
+                id BIGSERIAL PRIMARY KEY,
+                node_id TEXT NOT NULL,
+                field TEXT NOT NULL,
+                old_value TEXT NOT NULL,
+                new_value TEXT NOT NULL,
+                changed_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE INDEX node_history_node_idx ON node_history(node_id, changed_at)`,
+			`CREATE TABLE positions (
+                id BIGSERIAL,
+                node_id TEXT NOT NULL,
+                latitude DOUBLE PRECISION NOT NULL,
+                longitude DOUBLE PRECISION NOT NULL,
+                altitude INTEGER NOT NULL DEFAULT 0,
+                time BIGINT NOT NULL DEFAULT 0,
+                received_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE INDEX positions_id_idx ON positions(id)`,
+			`CREATE INDEX positions_node_idx ON positions(node_id, received_at)`,
+			`CREATE INDEX positions_received_idx ON positions(received_at)`,
+			`CREATE TABLE telemetry (
+                id BIGSERIAL,
+                node_id TEXT NOT NULL DEFAULT '',
+                battery_level INTEGER NOT NULL DEFAULT 0,
+                voltage DOUBLE PRECISION NOT NULL DEFAULT 0,
+                channel_utilization DOUBLE PRECISION NOT NULL DEFAULT 0,
+                air_util_tx DOUBLE PRECISION NOT NULL DEFAULT 0,
+                uptime_seconds BIGINT NOT NULL DEFAULT 0,
+                time BIGINT NOT NULL DEFAULT 0,
+                received_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE INDEX telemetry_id_idx ON telemetry(id)`,
+			`CREATE INDEX telemetry_node_idx ON telemetry(node_id, received_at)`,
+			`CREATE INDEX telemetry_received_idx ON telemetry(received_at)`,
+			`CREATE TABLE messages (
+                id BIGSERIAL PRIMARY KEY,
+                packet_id BIGINT NOT NULL DEFAULT 0,
+                from_id TEXT NOT NULL,
+                to_id TEXT NOT NULL,
+                channel BIGINT NOT NULL DEFAULT 0,
+                direction TEXT NOT NULL,
+                text TEXT NOT NULL,
+                rx_time BIGINT NOT NULL DEFAULT 0,
+                rx_snr DOUBLE PRECISION NOT NULL DEFAULT 0,
+                rx_rssi INTEGER NOT NULL DEFAULT 0,
+                hops_away INTEGER NOT NULL DEFAULT 0,
+                via_mqtt BOOLEAN NOT NULL DEFAULT FALSE,
+                reply_id BIGINT NOT NULL DEFAULT 0,
+                emoji BOOLEAN NOT NULL DEFAULT FALSE,
+                status TEXT NOT NULL,
+                error TEXT NOT NULL DEFAULT '',
+                created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE UNIQUE INDEX messages_packet_idx ON messages(packet_id, from_id) WHERE packet_id != 0`,
+			`CREATE INDEX messages_channel_idx ON messages(to_id, channel, id)`,
+			`CREATE INDEX messages_from_idx ON messages(from_id, id)`,
+			`CREATE INDEX messages_created_idx ON messages(created_at)`,
+			`CREATE INDEX messages_text_idx ON messages USING GIN (to_tsvector('simple', text))`,
+			`CREATE TABLE position_rollups (
+                node_id TEXT NOT NULL,
+                resolution TEXT NOT NULL,
+                bucket TIMESTAMP NOT NULL,
+                latitude DOUBLE PRECISION NOT NULL,
+                longitude DOUBLE PRECISION NOT NULL,
+                altitude DOUBLE PRECISION NOT NULL,
+                samples INTEGER NOT NULL,
+                PRIMARY KEY (node_id, resolution, bucket)
+            )`,
+			`CREATE TABLE telemetry_rollups (
+                node_id TEXT NOT NULL,
+                resolution TEXT NOT NULL,
+                bucket TIMESTAMP NOT NULL,
+                battery_avg DOUBLE PRECISION NOT NULL,
+                battery_min DOUBLE PRECISION NOT NULL,
+                voltage_avg DOUBLE PRECISION NOT NULL,
+                voltage_min DOUBLE PRECISION NOT NULL,
+                channel_util_avg DOUBLE PRECISION NOT NULL,
+                channel_util_max DOUBLE PRECISION NOT NULL,
+                air_util_tx_avg DOUBLE PRECISION NOT NULL,
+                air_util_tx_max DOUBLE PRECISION NOT NULL,
+                samples INTEGER NOT NULL,
+                PRIMARY KEY (node_id, resolution, bucket)
+            )`,
+		),
+	}, {
+		version: 2,
+		name:    "waypoints",
+		up: execAll(
+			`CREATE TABLE waypoints (
+                id BIGINT PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                description TEXT NOT NULL DEFAULT '',
+                icon BIGINT NOT NULL DEFAULT 0,
+                latitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+                longitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+                expire BIGINT NOT NULL DEFAULT 0,
+                locked_to TEXT NOT NULL DEFAULT '',
+                created_by TEXT NOT NULL DEFAULT '',
+                updated_by TEXT NOT NULL DEFAULT '',
+                created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+                updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE INDEX waypoints_expire_idx ON waypoints(expire)`,
+		),
+	}, {
+		version: 3,
+		name:    "events",
+		up: execAll(
+			`CREATE TABLE events (
+                id BIGSERIAL PRIMARY KEY,
+                type TEXT NOT NULL,
+                node_id TEXT NOT NULL DEFAULT '',
+                time TIMESTAMP NOT NULL,
+                data TEXT NOT NULL DEFAULT ''
+            )`,
+			`CREATE INDEX events_node_idx ON events(node_id, id)`,
+			`CREATE INDEX events_type_idx ON events(type, id)`,
+		),
+	}, {
+		version: 4,
+		name:    "webhook dead letters",
+		up: execAll(
+			`CREATE TABLE webhook_dead_letters (
+                id BIGSERIAL PRIMARY KEY,
+                sink TEXT NOT NULL,
+                event_id BIGINT NOT NULL DEFAULT 0,
+                event_type TEXT NOT NULL DEFAULT '',
+                payload TEXT NOT NULL DEFAULT '',
+                error TEXT NOT NULL DEFAULT '',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                created_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE INDEX webhook_dead_letters_sink_idx ON webhook_dead_letters(sink, id)`,
+		),
+	}, {
+		version: 5,
+		name:    "gateways",
+		up: execAll(
+			`CREATE TABLE gateways (
+                id TEXT PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                version TEXT NOT NULL DEFAULT '',
+                radio TEXT NOT NULL DEFAULT '',
+                firmware TEXT NOT NULL DEFAULT '',
+                config_hash TEXT NOT NULL DEFAULT '',
+                addr TEXT NOT NULL DEFAULT '',
+                adopted BOOLEAN NOT NULL DEFAULT FALSE,
+                adopted_at TIMESTAMP,
+                last_seen TIMESTAMP NOT NULL,
+                last_error TEXT NOT NULL DEFAULT '',
+                settings TEXT NOT NULL DEFAULT '',
+                created_at TIMESTAMP NOT NULL,
+                key_hash TEXT NOT NULL DEFAULT '',
+                token_hash TEXT NOT NULL DEFAULT ''
+            )`,
+			`CREATE INDEX gateways_token_idx ON gateways(token_hash)`,
+		),
+	}, {
+		version: 6,
+		name:    "users and audit",
+		up: execAll(
+			`CREATE TABLE users (
+                id BIGSERIAL PRIMARY KEY,
+                name TEXT NOT NULL UNIQUE,
+                password_hash TEXT NOT NULL,
+                role TEXT NOT NULL,
+                created_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE TABLE sessions (
+                token_hash TEXT PRIMARY KEY,
+                user_id BIGINT NOT NULL,
+                expires_at TIMESTAMP NOT NULL,
+                created_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE TABLE api_tokens (
+                id BIGSERIAL PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                user_id BIGINT NOT NULL,
+                token_hash TEXT NOT NULL UNIQUE,
+                created_at TIMESTAMP NOT NULL,
+                last_used TIMESTAMP
+            )`,
+			`CREATE TABLE audit (
+                id BIGSERIAL PRIMARY KEY,
+                time TIMESTAMP NOT NULL,
+                user_name TEXT NOT NULL DEFAULT '',
+                action TEXT NOT NULL,
+                detail TEXT NOT NULL DEFAULT '',
+                remote TEXT NOT NULL DEFAULT ''
+            )`,
+			`CREATE INDEX audit_user_idx ON audit(user_name, id)`,
+		),
+	}, {
+		version: 7,
+		name:    "event gateway",
+		up: execAll(
+			`ALTER TABLE events ADD COLUMN gateway TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX events_gateway_idx ON events(gateway, id)`,
+		),
+	}, {
+		version: 8,
+		name:    "channels",
+		up: execAll(
+			`CREATE TABLE channels (
+                idx BIGINT PRIMARY KEY,
+                name TEXT NOT NULL DEFAULT '',
+                role TEXT NOT NULL,
+                updated_at TIMESTAMP NOT NULL
+            )`,
+		),
+	}, {
+		version: 9,
+		name:    "node metrics",
+		up: execAll(
+			`CREATE TABLE node_metrics (
+                node_id TEXT NOT NULL,
+                metric TEXT NOT NULL,
+                value DOUBLE PRECISION NOT NULL,
+                received_at TIMESTAMP NOT NULL
+            )`,
+			`CREATE INDEX node_metrics_node_idx ON node_metrics(node_id, metric, received_at)`,
+			`CREATE TABLE node_metric_rollups (
+                node_id TEXT NOT NULL,
+                metric TEXT NOT NULL,
+                resolution TEXT NOT NULL,
+                bucket TIMESTAMP NOT NULL,
+                value_avg DOUBLE PRECISION NOT NULL,
+                value_min DOUBLE PRECISION NOT NULL,
+                value_max DOUBLE PRECISION NOT NULL,
+                samples INTEGER NOT NULL,
+                PRIMARY KEY (node_id, metric, resolution, bucket)
+            )`,
+		),
+	}, {
+		version: 10,
+		name:    "board posts",
+		up: execAll(
+			`CREATE TABLE board_posts (
+                id BIGSERIAL PRIMARY KEY,
+                channel BIGINT NOT NULL,
+                from_id TEXT NOT NULL DEFAULT '',
+                author TEXT NOT NULL DEFAULT '',
+                text TEXT NOT NULL,
+                hidden BOOLEAN NOT NULL DEFAULT FALSE,
+                created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+            )`,
+			`CREATE INDEX board_posts_channel_idx ON board_posts(channel, id)`,
+		),
+	}, {
+		version: 11,
+		name:    "waypoints out of positions",
+		up:      moveWaypointPositions(postgresDialect),
+	},
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// Rollup resolutions.
+const (
+	ResolutionHour = "hour"
+	ResolutionDay  = "day"
+)
+
+// RetentionPolicy describes how long the data of a time series table is
+// kept at each resolution. Raw rows older than Raw are downsampled into
+// hourly aggregates, hourly aggregates older than Hourly into daily ones and
+// daily aggregates older than Daily are deleted. A zero duration disables the
+// corresponding step.
+type RetentionPolicy struct {
+	Raw    time.Duration
+	Hourly time.Duration
+	Daily  time.Duration
+}
+
+// Retention configures the background compaction of nodes.db.
+type Retention struct {
+	Positions RetentionPolicy
+	Telemetry RetentionPolicy
+	// Events, DeadLetters and Audit are how long events, webhook dead
+	// letters and audit rows are kept; zero keeps them forever.
+	Events      time.Duration
+	DeadLetters time.Duration
+	Audit       time.Duration
+	// Interval between compaction runs.
+	Interval time.Duration
+	// VacuumEvery is the minimum time between VACUUM runs; zero disables it.
+	VacuumEvery time.Duration
+}
+
+// DefaultRetention keeps a month of raw positions and a week of raw
+// telemetry, half a year and three months of hourly aggregates respectively,
+// and daily aggregates forever. Events and dead letters are kept for a month,
+// audit rows for a year.
+var DefaultRetention = Retention{
+	Positions:   RetentionPolicy{Raw: 30 * 24 * time.Hour, Hourly: 180 * 24 * time.Hour},
+	Telemetry:   RetentionPolicy{Raw: 7 * 24 * time.Hour, Hourly: 90 * 24 * time.Hour},
+	Events:      30 * 24 * time.Hour,
+	DeadLetters: 30 * 24 * time.Hour,
+	Audit:       365 * 24 * time.Hour,
+	Interval:    time.Hour,
+	VacuumEvery: 7 * 24 * time.Hour,
+}
+
+// CompactStats reports the rows removed by a compaction run.
+type CompactStats struct {
+	PositionsDownsampled int64
+	TelemetryDownsampled int64
+	MetricsDownsampled   int64
+	RollupsMerged        int64
+	RollupsExpired       int64
+	EventsExpired        int64
+	DeadLettersExpired   int64
+	AuditExpired         int64
+}
+
+// rollupTable describes how a raw table is aggregated into its rollup table.
+type rollupTable struct {
+	raw    string
+	rollup string
+	// keys identifying a series in both tables, node_id when empty.
+	keys string
+	// columns of the rollup table after the keys, resolution and bucket,
+	// excluding samples.
+	columns []rollupColumn
+}
+
+// rollupColumn is an aggregate of the raw column src. agg is AVG, MIN or
+// MAX; averages of coarser buckets are weighted by the samples they cover.
+type rollupColumn struct {
+	name string
+	src  string
+	agg  string
+}
+
+var positionRollup = rollupTable{
+	raw:    "positions",
+	rollup: "position_rollups",
+	columns: []rollupColumn{
+		{"latitude", "latitude", "AVG"},
+		{"longitude", "longitude", "AVG"},
+		{"altitude", "altitude", "AVG"},
+	},
+}
+
+var telemetryRollup = rollupTable{
+	raw:    "telemetry",
+	rollup: "telemetry_rollups",
+	columns: []rollupColumn{
+		{"battery_avg", "battery_level", "AVG"},
+		{"battery_min", "battery_level", "MIN"},
+		{"voltage_avg", "voltage", "AVG"},
+		{"voltage_min", "voltage", "MIN"},
+		{"channel_util_avg", "channel_utilization", "AVG"},
+		{"channel_util_max", "channel_utilization", "MAX"},
+		{"air_util_tx_avg", "air_util_tx", "AVG"},
+		{"air_util_tx_max", "air_util_tx", "MAX"},
+	},
+}
+
+var metricRollup = rollupTable{
+	raw:    "node_metrics",
+	rollup: "node_metric_rollups",
+	keys:   "node_id, metric",
+	columns: []rollupColumn{
+		{"value_avg", "value", "AVG"},
+		{"value_min", "value", "MIN"},
+		{"value_max", "value", "MAX"},
+	},
+}
+
+// key returns the columns identifying a series.
+func (t rollupTable) key() string {
+	if t.keys == "" {
+		return "node_id"
+	}
+	return t.keys
+}
+
+// columnList returns the names of the aggregated columns.
+func (t rollupTable) columnList() string {
+	var out []string
+	for _, c := range t.columns {
+		out = append(out, c.name)
+	}
+	return strings.Join(out, ", ")
+}
+
+// aggregates computes the columns from raw rows.
+func (t rollupTable) aggregates() string {
+	var out []string
+	for _, c := range t.columns {
+		out = append(out, c.agg+"("+c.src+")")
+	}
+	return strings.Join(out, ", ")
+}
+
+// merge computes the columns from finer rollups.
+func (t rollupTable) merge() string {
+	var out []string
+	for _, c := range t.columns {
+		if c.agg == "AVG" {
+			out = append(out, "SUM("+c.name+" * samples) / SUM(samples)")
+		} else {
+			out = append(out, c.agg+"("+c.name+")")
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// upsert combines an existing bucket with the excluded row, samples
+// included.
+func (t rollupTable) upsert(d dialect) string {
+	var out []string
+	for _, c := range t.columns {
+		cur, ex := t.rollup+"."+c.name, "excluded."+c.name
+		switch c.agg {
+		case "AVG":
+			out = append(out, c.name+" = ("+cur+" * "+t.rollup+".samples + "+ex+
+				" * excluded.samples) / ("+t.rollup+".samples + excluded.samples)")
+		case "MIN":
+			out = append(out, c.name+" = "+d.least(cur, ex))
+		case "MAX":
+			out = append(out, c.name+" = "+d.greatest(cur, ex))
+		}
+	}
+	out = append(out, "samples = "+t.rollup+".samples + excluded.samples")
+	return strings.Join(out, ", ")
+}
+
+// Compact applies the retention policies as of now: raw rows are folded into
+// hourly aggregates, hourly aggregates into daily ones and expired rows are
+// deleted. Events, dead letters and audit rows older than their retention
+// are deleted too. Each table is processed in its own transaction.
+func (s *sqlStore) Compact(now time.Time, r Retention) (CompactStats, error) {
+	var st CompactStats
+	for _, job := range []struct {
+		table  rollupTable
+		policy RetentionPolicy
+		raw    *int64
+	}{
+		{positionRollup, r.Positions, &st.PositionsDownsampled},
+		{telemetryRollup, r.Telemetry, &st.TelemetryDownsampled},
+		{metricRollup, r.Telemetry, &st.MetricsDownsampled},
+	} {
+		raw, merged, expired, err := s.compactTable(now.UTC(), job.table, job.policy)
+		if err != nil {
+			return st, err
+		}
+		*job.raw += raw
+		st.RollupsMerged += merged
+		st.RollupsExpired += expired
+	}
+	for _, job := range []struct {
+		table, column string
+		age           time.Duration
+		expired       *int64
+	}{
+		{"events", "time", r.Events, &st.EventsExpired},
+		{"webhook_dead_letters", "created_at", r.DeadLetters, &st.DeadLettersExpired},
+		{"audit", "time", r.Audit, &st.AuditExpired},
+	} {
+		if job.age <= 0 {
+			continue
+		}
+		res, err := s.exec(`DELETE FROM `+job.table+` WHERE `+job.column+` < ?`, sqlTime(now.Add(-job.age)))
+		if err != nil {
+			return st, err
+		}
+		if *job.expired, err = res.RowsAffected(); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+func (s *sqlStore) compactTable(now time.Time, t rollupTable, p RetentionPolicy) (raw, merged, expired int64, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if p.Raw > 0 {
+		// Cut on an hour boundary so that only complete buckets are folded.
+		cutoff := sqlTime(now.Add(-p.Raw).Truncate(time.Hour))
+		bucket := s.d.truncate(ResolutionHour, "received_at")
+		if _, err = tx.Exec(s.d.rebind(`INSERT INTO `+t.rollup+`(`+t.key()+`, resolution, bucket, `+t.columnList()+`, samples)
+                SELECT `+t.key()+`, CAST(? AS TEXT), `+bucket+`, `+t.aggregates()+`, COUNT(*)
+                FROM `+t.raw+` WHERE received_at < ?
+                GROUP BY `+t.key()+`, `+bucket+`
+                ON CONFLICT(`+t.key()+`, resolution, bucket) DO UPDATE SET `+t.upsert(s.d)),
+			ResolutionHour, cutoff); err != nil {
+			return
+		}
+		if raw, err = s.execCount(tx, `DELETE FROM `+t.raw+` WHERE received_at < ?`, cutoff); err != nil {
+			return
+		}
+	}
+	if p.Hourly > 0 {
+		cutoff := sqlTime(startOfDay(now.Add(-p.Hourly)))
+		bucket := s.d.truncate(ResolutionDay, "bucket")
+		if _, err = tx.Exec(s.d.rebind(`INSERT INTO `+t.rollup+`(`+t.key()+`, resolution, bucket, `+t.columnList()+`, samples)
+                SELECT `+t.key()+`, CAST(? AS TEXT), `+bucket+`, `+t.merge()+`, SUM(samples)
+                FROM `+t.rollup+` WHERE resolution = ? AND bucket < ?
+                GROUP BY `+t.key()+`, `+bucket+`
+                ON CONFLICT(`+t.key()+`, resolution, bucket) DO UPDATE SET `+t.upsert(s.d)),
+			ResolutionDay, ResolutionHour, cutoff); err != nil {
+			return
+		}
+		if merged, err = s.execCount(tx, `DELETE FROM `+t.rollup+` WHERE resolution = ? AND bucket < ?`,
+			ResolutionHour, cutoff); err != nil {
+			return
+		}
+	}
+	if p.Daily > 0 {
+		cutoff := sqlTime(startOfDay(now.Add(-p.Daily)))
+		if expired, err = s.execCount(tx, `DELETE FROM `+t.rollup+` WHERE resolution = ? AND bucket < ?`,
+			ResolutionDay, cutoff); err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// Vacuum rebuilds the database file, returning the space freed by deleted
+// rows to the file system.
+func (s *sqlStore) Vacuum() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+// RunRetention compacts the database every r.Interval and vacuums it every
+// r.VacuumEvery until ctx is cancelled.
+func (s *sqlStore) RunRetention(ctx context.Context, r Retention) {
+	if r.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	lastVacuum := time.Now()
+	for {
+		st, err := s.Compact(time.Now(), r)
+		if err != nil {
+			log.Printf("⚠️ compattazione db nodi: %v", err)
+		} else if st.PositionsDownsampled+st.TelemetryDownsampled+st.MetricsDownsampled+st.RollupsMerged+st.RollupsExpired > 0 {
+			log.Printf("🧹 compattazione db nodi: %d posizioni, %d telemetrie, %d metriche aggregate, %d aggregati orari uniti, %d scaduti",
+				st.PositionsDownsampled, st.TelemetryDownsampled, st.MetricsDownsampled, st.RollupsMerged, st.RollupsExpired)
+		}
+		if err == nil && st.EventsExpired+st.DeadLettersExpired+st.AuditExpired > 0 {
+			log.Printf("🧹 scaduti %d eventi, %d dead letter webhook, %d voci di audit",
+				st.EventsExpired, st.DeadLettersExpired, st.AuditExpired)
+		}
+		if r.VacuumEvery > 0 && time.Since(lastVacuum) >= r.VacuumEvery {
+			if err := s.Vacuum(); err != nil {
+				log.Printf("⚠️ vacuum db nodi: %v", err)
+			}
+			lastVacuum = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Rollup is an aggregated sample of a time series.
+type Rollup struct {
+	NodeID     string
+	Resolution string
+	Bucket     time.Time
+	Samples    int
+}
+
+// PositionRollup is the average position of a node over a bucket.
+type PositionRollup struct {
+	Rollup
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// TelemetryRollup aggregates the device metrics of a node over a bucket.
+type TelemetryRollup struct {
+	Rollup
+	BatteryAvg     float64
+	BatteryMin     float64
+	VoltageAvg     float64
+	VoltageMin     float64
+	ChannelUtilAvg float64
+	ChannelUtilMax float64
+	AirUtilTxAvg   float64
+	AirUtilTxMax   float64
+}
+
+// PositionRollups returns the aggregated positions of nodeID at the given
+// resolution with buckets in [since, until), oldest first.
+func (s *sqlStore) PositionRollups(nodeID, resolution string, since, until time.Time) ([]PositionRollup, error) {
+	where, args := rollupRange(nodeID, resolution, since, until)
+	rows, err := s.query(`SELECT node_id, resolution, bucket, samples, latitude, longitude, altitude
+                FROM position_rollups WHERE `+where+` ORDER BY bucket LIMIT ?`, append(args, maxPageSize)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PositionRollup
+	for rows.Next() {
+		var r PositionRollup
+		if err := rows.Scan(&r.NodeID, &r.Resolution, &r.Bucket, &r.Samples,
+			&r.Latitude, &r.Longitude, &r.Altitude); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// TelemetryRollups returns the aggregated telemetry of nodeID at the given
+// resolution with buckets in [since, until), oldest first.
+func (s *sqlStore) TelemetryRollups(nodeID, resolution string, since, until time.Time) ([]TelemetryRollup, error) {
+	where, args := rollupRange(nodeID, resolution, since, until)
+	rows, err := s.query(`SELECT node_id, resolution, bucket, samples, battery_avg, battery_min,
+                voltage_avg, voltage_min, channel_util_avg, channel_util_max, air_util_tx_avg,
+                air_util_tx_max FROM telemetry_rollups WHERE `+where+` ORDER BY bucket LIMIT ?`,
+		append(args, maxPageSize)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TelemetryRollup
+	for rows.Next() {
+		var r TelemetryRollup
+		if err := rows.Scan(&r.NodeID, &r.Resolution, &r.Bucket, &r.Samples, &r.BatteryAvg,
+			&r.BatteryMin, &r.VoltageAvg, &r.VoltageMin, &r.ChannelUtilAvg, &r.ChannelUtilMax,
+			&r.AirUtilTxAvg, &r.AirUtilTxMax); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func rollupRange(nodeID, resolution string, since, until time.Time) (string, []any) {
+	where, args := `node_id = ? AND resolution = ?`, []any{nodeID, resolution}
+	if !since.IsZero() {
+		where += ` AND bucket >= ?`
+		args = append(args, sqlTime(since))
+	}
+	if !until.IsZero() {
+		where += ` AND bucket < ?`
+		args = append(args, sqlTime(until))
+	}
+	return where, args
+}
+
+func (s *sqlStore) execCount(tx *sql.Tx, query string, args ...any) (int64, error) {
+	res, err := tx.Exec(s.d.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"meshspy/events"
+)
+
+func TestCompactDownsamplesAndExpires(t *testing.T) {
+	ns := openTestStore(t)
+	now := time.Date(2025, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	insert := func(q string, args ...any) {
+		t.Helper()
+		if _, err := ns.db.Exec(q, args...); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	// Two old positions in the same hour, one recent.
+	insert(`INSERT INTO positions(node_id, latitude, longitude, altitude, time, received_at) VALUES('n', 10, 20, 100, 0, '2025-03-01 08:10:00')`)
+	insert(`INSERT INTO positions(node_id, latitude, longitude, altitude, time, received_at) VALUES('n', 12, 22, 200, 0, '2025-03-01 08:50:00')`)
+	insert(`INSERT INTO positions(node_id, latitude, longitude, altitude, time, received_at) VALUES('n', 50, 50, 0, 0, '2025-03-10 12:00:00')`)
+	insert(`INSERT INTO telemetry(node_id, battery_level, voltage, channel_utilization, air_util_tx, uptime_seconds, time, received_at) VALUES('n', 80, 4.0, 10, 1, 0, 0, '2025-03-01 08:10:00')`)
+	insert(`INSERT INTO telemetry(node_id, battery_level, voltage, channel_utilization, air_util_tx, uptime_seconds, time, received_at) VALUES('n', 60, 3.6, 30, 3, 0, 0, '2025-03-01 08:20:00')`)
+
+	r := Retention{
+		Positions: RetentionPolicy{Raw: 24 * time.Hour},
+		Telemetry: RetentionPolicy{Raw: 24 * time.Hour},
+	}
+	st, err := ns.Compact(now, r)
+	if err != nil {
+		t.Fatalf("Compact returned error: %v", err)
+	}
+	if st.PositionsDownsampled != 2 || st.TelemetryDownsampled != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	pos, err := ns.Positions("n", Page{})
+	if err != nil {
+		t.Fatalf("Positions returned error: %v", err)
+	}
+	if len(pos) != 1 || pos[0].Latitude != 50 {
+		t.Fatalf("recent position not kept: %+v", pos)
+	}
+	hourly, err := ns.PositionRollups("n", ResolutionHour, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("PositionRollups returned error: %v", err)
+	}
+	if len(hourly) != 1 || hourly[0].Latitude != 11 || hourly[0].Samples != 2 {
+		t.Fatalf("unexpected hourly rollups %+v", hourly)
+	}
+	tel, err := ns.TelemetryRollups("n", ResolutionHour, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("TelemetryRollups returned error: %v", err)
+	}
+	if len(tel) != 1 || tel[0].BatteryAvg != 70 || tel[0].BatteryMin != 60 || tel[0].ChannelUtilMax != 30 {
+		t.Fatalf("unexpected telemetry rollups %+v", tel)
+	}
+
+	// Fold hourly into daily and check the weighted average survives.
+	insert(`INSERT INTO position_rollups(node_id, resolution, bucket, latitude, longitude, altitude, samples) VALUES('n', 'hour', '2025-03-01 09:00:00', 14, 24, 0, 2)`)
+	r.Positions.Hourly = 48 * time.Hour
+	if _, err := ns.Compact(now, r); err != nil {
+		t.Fatalf("Compact returned error: %v", err)
+	}
+	daily, err := ns.PositionRollups("n", ResolutionDay, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("PositionRollups returned error: %v", err)
+	}
+	if len(daily) != 1 || daily[0].Latitude != 12.5 || daily[0].Samples != 4 {
+		t.Fatalf("unexpected daily rollups %+v", daily)
+	}
+	if hourly, _ := ns.PositionRollups("n", ResolutionHour, time.Time{}, time.Time{}); len(hourly) != 0 {
+		t.Fatalf("hourly rollups not trimmed: %+v", hourly)
+	}
+
+	r.Positions.Daily = 24 * time.Hour
+	st, err = ns.Compact(now, r)
+	if err != nil {
+		t.Fatalf("Compact returned error: %v", err)
+	}
+	if st.RollupsExpired != 1 {
+		t.Fatalf("daily rollup not expired: %+v", st)
+	}
+	if err := ns.Vacuum(); err != nil {
+		t.Fatalf("Vacuum returned error: %v", err)
+	}
+}
+
+func TestCompactExpiresEventsDeadLettersAndAudit(t *testing.T) {
+	ns := openTestStore(t)
+	now := time.Date(2025, 3, 10, 12, 30, 0, 0, time.UTC)
+	for _, at := range []time.Time{now.Add(-48 * time.Hour), now.Add(-time.Hour)} {
+		if err := ns.AddEvent(&events.Event{Type: events.NodeOnline, NodeID: "n", Time: at}); err != nil {
+			t.Fatalf("AddEvent returned error: %v", err)
+		}
+		if err := ns.AddDeadLetter(&DeadLetter{Sink: "s", CreatedAt: at}); err != nil {
+			t.Fatalf("AddDeadLetter returned error: %v", err)
+		}
+		if err := ns.AddAudit(&AuditEntry{Time: at, User: "admin", Action: "login"}); err != nil {
+			t.Fatalf("AddAudit returned error: %v", err)
+		}
+	}
+
+	st, err := ns.Compact(now, Retention{Events: 24 * time.Hour, DeadLetters: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Compact returned error: %v", err)
+	}
+	if st.EventsExpired != 1 || st.DeadLettersExpired != 1 || st.AuditExpired != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	evs, err := ns.Events(EventFilter{}, Page{})
+	if err != nil {
+		t.Fatalf("Events returned error: %v", err)
+	}
+	if len(evs) != 1 || !evs[0].Time.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("recent event not kept: %+v", evs)
+	}
+	if dl, _ := ns.DeadLetters("s", Page{}); len(dl) != 1 {
+		t.Fatalf("unexpected dead letters %+v", dl)
+	}
+	// A zero retention keeps the audit trail.
+	if audit, _ := ns.Audit("", Page{}); len(audit) != 2 {
+		t.Fatalf("audit rows expired: %+v", audit)
+	}
+}
+
+func TestPositionsPagination(t *testing.T) {
+	ns := openTestStore(t)
+	for i := 1; i <= 5; i++ {
+		if _, err := ns.db.Exec(`INSERT INTO positions(node_id, latitude, longitude, altitude, time, received_at)
+            VALUES('n', ?, 1, 0, 0, ?)`, i, sqlTime(time.Date(2025, 1, i, 0, 0, 0, 0, time.UTC))); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	page, err := ns.Positions("n", Page{Limit: 2})
+	if err != nil {
+		t.Fatalf("Positions returned error: %v", err)
+	}
+	if len(page) != 2 || page[0].Latitude != 5 {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	page, err = ns.Positions("n", Page{Before: page[1].ID, Since: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatalf("Positions returned error: %v", err)
+	}
+	if len(page) != 2 || page[0].Latitude != 3 || page[1].Latitude != 2 {
+		t.Fatalf("unexpected bounded page %+v", page)
+	}
+}
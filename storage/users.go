@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// User is an account of the web interface and the management server.
+// Role is one of the roles of package auth.
+type User struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// APIToken is a bearer token acting on behalf of a user, e.g. for a
+// script.
+type APIToken struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	UserID    int64      `json:"user_id"`
+	User      string     `json:"user"`
+	TokenHash string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// AuditEntry records an action taken by a user, e.g. a message sent.
+type AuditEntry struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+}
+
+const userColumns = `id, name, password_hash, role, created_at`
+
+// AddUser stores u and sets its ID. Names are unique.
+func (s *sqlStore) AddUser(u *User) error {
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	return s.queryRow(`INSERT INTO users(name, password_hash, role, created_at) VALUES(?, ?, ?, ?) RETURNING id`,
+		u.Name, u.PasswordHash, u.Role, sqlTime(u.CreatedAt)).Scan(&u.ID)
+}
+
+// UpdateUser saves the name, password and role of u.
+func (s *sqlStore) UpdateUser(u *User) error {
+	_, err := s.exec(`UPDATE users SET name = ?, password_hash = ?, role = ? WHERE id = ?`,
+		u.Name, u.PasswordHash, u.Role, u.ID)
+	return err
+}
+
+// User returns the user with the given ID, or nil if unknown.
+func (s *sqlStore) User(id int64) (*User, error) {
+	return s.user(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+}
+
+// UserByName returns the user with the given name, or nil if unknown.
+func (s *sqlStore) UserByName(name string) (*User, error) {
+	return s.user(`SELECT `+userColumns+` FROM users WHERE name = ?`, name)
+}
+
+func (s *sqlStore) user(query string, args ...any) (*User, error) {
+	var u User
+	err := s.queryRow(query, args...).Scan(&u.ID, &u.Name, &u.PasswordHash, &u.Role, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Users returns every user ordered by name.
+func (s *sqlStore) Users() ([]User, error) {
+	rows, err := s.query(`SELECT ` + userColumns + ` FROM users ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.PasswordHash, &u.Role, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// DeleteUser removes a user with its sessions and API tokens.
+func (s *sqlStore) DeleteUser(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM api_tokens WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(s.d.rebind(q), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddSession stores a login session of user until expires, dropping the
+// sessions already expired.
+func (s *sqlStore) AddSession(tokenHash string, userID int64, expires time.Time) error {
+	if _, err := s.exec(`DELETE FROM sessions WHERE expires_at <= ?`, sqlTime(time.Now())); err != nil {
+		return err
+	}
+	_, err := s.exec(`INSERT INTO sessions(token_hash, user_id, expires_at, created_at) VALUES(?, ?, ?, ?)`,
+		tokenHash, userID, sqlTime(expires), sqlTime(time.Now()))
+	return err
+}
+
+// SessionUser returns the user of the session whose token hashes to
+// tokenHash, or nil when there is none or it expired before now.
+func (s *sqlStore) SessionUser(tokenHash string, now time.Time) (*User, error) {
+	return s.user(`SELECT u.id, u.name, u.password_hash, u.role, u.created_at
+        FROM sessions s JOIN users u ON u.id = s.user_id
+        WHERE s.token_hash = ? AND s.expires_at > ?`, tokenHash, sqlTime(now))
+}
+
+// DeleteSession ends a session, e.g. at logout.
+func (s *sqlStore) DeleteSession(tokenHash string) error {
+	_, err := s.exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+// AddAPIToken stores t and sets its ID.
+func (s *sqlStore) AddAPIToken(t *APIToken) error {
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	return s.queryRow(`INSERT INTO api_tokens(name, user_id, token_hash, created_at) VALUES(?, ?, ?, ?) RETURNING id`,
+		t.Name, t.UserID, t.TokenHash, sqlTime(t.CreatedAt)).Scan(&t.ID)
+}
+
+// APITokens returns the API tokens of a user, or of every user when userID
+// is zero.
+func (s *sqlStore) APITokens(userID int64) ([]APIToken, error) {
+	where, args := `1 = 1`, []any{}
+	if userID != 0 {
+		where, args = `t.user_id = ?`, append(args, userID)
+	}
+	rows, err := s.query(`SELECT t.id, t.name, t.user_id, u.name, t.created_at, t.last_used
+        FROM api_tokens t JOIN users u ON u.id = t.user_id WHERE `+where+` ORDER BY t.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []APIToken
+	for rows.Next() {
+		var (
+			t    APIToken
+			used sql.NullTime
+		)
+		if err := rows.Scan(&t.ID, &t.Name, &t.UserID, &t.User, &t.CreatedAt, &used); err != nil {
+			return nil, err
+		}
+		if used.Valid {
+			t.LastUsed = &used.Time
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// TokenUser returns the user owning the API token that hashes to
+// tokenHash, or nil if none does, and records its use at now.
+func (s *sqlStore) TokenUser(tokenHash string, now time.Time) (*User, error) {
+	u, err := s.user(`SELECT u.id, u.name, u.password_hash, u.role, u.created_at
+        FROM api_tokens t JOIN users u ON u.id = t.user_id WHERE t.token_hash = ?`, tokenHash)
+	if err != nil || u == nil {
+		return u, err
+	}
+	_, err = s.exec(`UPDATE api_tokens SET last_used = ? WHERE token_hash = ?`, sqlTime(now), tokenHash)
+	return u, err
+}
+
+// DeleteAPIToken revokes an API token.
+func (s *sqlStore) DeleteAPIToken(id int64) error {
+	_, err := s.exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	return err
+}
+
+// AddAudit stores e and sets its ID.
+func (s *sqlStore) AddAudit(e *AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return s.queryRow(`INSERT INTO audit(time, user_name, action, detail, remote) VALUES(?, ?, ?, ?, ?) RETURNING id`,
+		sqlTime(e.Time), e.User, e.Action, e.Detail, e.Remote).Scan(&e.ID)
+}
+
+// Audit returns the audit trail of user, or of every user when empty,
+// newest first.
+func (s *sqlStore) Audit(user string, p Page) ([]AuditEntry, error) {
+	where, args := `1 = 1`, []any{}
+	if user != "" {
+		where += ` AND user_name = ?`
+		args = append(args, user)
+	}
+	clause, args := p.clause(where, args, "id", "time")
+	rows, err := s.query(`SELECT id, time, user_name, action, detail, remote FROM audit WHERE `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.User, &e.Action, &e.Detail, &e.Remote); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+// Waypoint is a point of interest shared on the mesh. Waypoints are updated
+// by resending them with the same ID; an Expire time in the past deletes
+// them, while zero means they never expire.
+type Waypoint struct {
+	ID          uint32
+	Name        string
+	Description string
+	// Icon is the Unicode code point of the emoji shown on maps.
+	Icon      uint32
+	Latitude  float64
+	Longitude float64
+	Expire    int64
+	// LockedTo is the node allowed to change the waypoint, if any.
+	LockedTo  string
+	CreatedBy string
+	UpdatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+const waypointColumns = `id, name, description, icon, latitude, longitude, expire,
+        locked_to, created_by, updated_by, created_at, updated_at`
+
+// Active reports whether w has not expired at now.
+func (w *Waypoint) Active(now time.Time) bool {
+	return w.Expire == 0 || w.Expire > now.Unix()
+}
+
+// WaypointFromProto converts wp sent by node from.
+func WaypointFromProto(from uint32, wp *latestpb.Waypoint) *Waypoint {
+	w := &Waypoint{
+		ID:          wp.GetId(),
+		Name:        wp.GetName(),
+		Description: wp.GetDescription(),
+		Icon:        wp.GetIcon(),
+		Latitude:    float64(wp.GetLatitudeI()) / 1e7,
+		Longitude:   float64(wp.GetLongitudeI()) / 1e7,
+		Expire:      int64(wp.GetExpire()),
+		CreatedBy:   fmt.Sprintf("0x%x", from),
+	}
+	if wp.GetLockedTo() != 0 {
+		w.LockedTo = fmt.Sprintf("0x%x", wp.GetLockedTo())
+	}
+	return w
+}
+
+// Proto converts w back to the Waypoint message sent on the mesh.
+func (w *Waypoint) Proto() *latestpb.Waypoint {
+	wp := &latestpb.Waypoint{
+		Id:          w.ID,
+		Name:        w.Name,
+		Description: w.Description,
+		Icon:        w.Icon,
+		LatitudeI:   proto.Int32(int32(math.Round(w.Latitude * 1e7))),
+		LongitudeI:  proto.Int32(int32(math.Round(w.Longitude * 1e7))),
+		Expire:      uint32(w.Expire),
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(w.LockedTo, "0x"), 16, 32); err == nil {
+		wp.LockedTo = uint32(n)
+	}
+	return wp
+}
+
+// WaypointFromPacket decodes a WAYPOINT_APP packet. It returns nil for other
+// packets.
+func WaypointFromPacket(pkt *latestpb.MeshPacket) *Waypoint {
+	dec := pkt.GetDecoded()
+	if dec == nil || dec.GetPortnum() != latestpb.PortNum_WAYPOINT_APP {
+		return nil
+	}
+	var wp latestpb.Waypoint
+	if err := proto.Unmarshal(dec.GetPayload(), &wp); err != nil {
+		return nil
+	}
+	return WaypointFromProto(pkt.GetFrom(), &wp)
+}
+
+// SaveWaypoint inserts w or updates the stored waypoint with the same ID.
+// CreatedBy is the sender: it is kept as creator of new waypoints and
+// recorded as UpdatedBy otherwise. Waypoints locked to a node ignore updates
+// from other senders.
+func (s *sqlStore) SaveWaypoint(w *Waypoint) error {
+	if w == nil || w.ID == 0 {
+		return fmt.Errorf("waypoint without id")
+	}
+	_, err := s.exec(`INSERT INTO waypoints(id, name, description, icon, latitude, longitude,
+        expire, locked_to, created_by, updated_by)
+        VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET name = excluded.name, description = excluded.description,
+        icon = excluded.icon, latitude = excluded.latitude, longitude = excluded.longitude,
+        expire = excluded.expire, locked_to = excluded.locked_to,
+        updated_by = excluded.created_by, updated_at = `+s.d.now()+`
+        WHERE waypoints.locked_to = '' OR waypoints.locked_to = excluded.created_by`,
+		w.ID, w.Name, w.Description, w.Icon, w.Latitude, w.Longitude, w.Expire,
+		w.LockedTo, w.CreatedBy, w.CreatedBy)
+	return err
+}
+
+// Waypoint returns the stored waypoint with the given ID, or nil when
+// unknown.
+func (s *sqlStore) Waypoint(id uint32) (*Waypoint, error) {
+	var w Waypoint
+	err := scanWaypoint(s.queryRow(`SELECT `+waypointColumns+` FROM waypoints WHERE id = ?`, id), &w)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// ActiveWaypoints returns the waypoints not expired at now, most recently
+// updated first.
+func (s *sqlStore) ActiveWaypoints(now time.Time) ([]Waypoint, error) {
+	return s.queryWaypoints(`expire = 0 OR expire > ?`, now.Unix())
+}
+
+// ExpiredWaypoints returns the waypoints expired or deleted before now, most
+// recently updated first.
+func (s *sqlStore) ExpiredWaypoints(now time.Time) ([]Waypoint, error) {
+	return s.queryWaypoints(`expire != 0 AND expire <= ?`, now.Unix())
+}
+
+func (s *sqlStore) queryWaypoints(where string, args ...any) ([]Waypoint, error) {
+	rows, err := s.query(`SELECT `+waypointColumns+` FROM waypoints WHERE `+where+`
+        ORDER BY updated_at DESC, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Waypoint
+	for rows.Next() {
+		var w Waypoint
+		if err := scanWaypoint(rows, &w); err != nil {
+			return nil, err
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+func scanWaypoint(r rowScanner, w *Waypoint) error {
+	return r.Scan(&w.ID, &w.Name, &w.Description, &w.Icon, &w.Latitude, &w.Longitude,
+		&w.Expire, &w.LockedTo, &w.CreatedBy, &w.UpdatedBy, &w.CreatedAt, &w.UpdatedAt)
+}
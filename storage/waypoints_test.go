@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	latestpb "meshspy/proto/latest/meshtastic"
+)
+
+func waypointPacket(from uint32, wp *latestpb.Waypoint) *latestpb.MeshPacket {
+	payload, _ := proto.Marshal(wp)
+	return &latestpb.MeshPacket{From: from, To: 0xffffffff, PayloadVariant: &latestpb.MeshPacket_Decoded{
+		Decoded: &latestpb.Data{Portnum: latestpb.PortNum_WAYPOINT_APP, Payload: payload},
+	}}
+}
+
+func TestWaypointLifecycle(t *testing.T) {
+	ns := openTestStore(t)
+	now := time.Now()
+
+	w := WaypointFromPacket(waypointPacket(0xa, &latestpb.Waypoint{
+		Id: 7, Name: "Camp", Description: "base", Icon: 0x26FA,
+		LatitudeI: proto.Int32(437000000), LongitudeI: proto.Int32(104000000),
+	}))
+	if w == nil || w.CreatedBy != "0xa" || w.Latitude != 43.7 {
+		t.Fatalf("unexpected waypoint %+v", w)
+	}
+	if err := ns.SaveWaypoint(w); err != nil {
+		t.Fatalf("SaveWaypoint returned error: %v", err)
+	}
+
+	// An update from another node keeps the creator.
+	upd := WaypointFromPacket(waypointPacket(0xb, &latestpb.Waypoint{
+		Id: 7, Name: "Camp 2", LatitudeI: proto.Int32(437100000), LongitudeI: proto.Int32(104000000),
+	}))
+	if err := ns.SaveWaypoint(upd); err != nil {
+		t.Fatalf("SaveWaypoint returned error: %v", err)
+	}
+	got, err := ns.Waypoint(7)
+	if err != nil {
+		t.Fatalf("Waypoint returned error: %v", err)
+	}
+	if got.Name != "Camp 2" || got.CreatedBy != "0xa" || got.UpdatedBy != "0xb" {
+		t.Fatalf("unexpected updated waypoint %+v", got)
+	}
+
+	active, err := ns.ActiveWaypoints(now)
+	if err != nil {
+		t.Fatalf("ActiveWaypoints returned error: %v", err)
+	}
+	if len(active) != 1 {
+		t.Fatalf("expected 1 active waypoint, got %+v", active)
+	}
+
+	// Resending with an expiry in the past deletes the waypoint.
+	del := WaypointFromPacket(waypointPacket(0xa, &latestpb.Waypoint{Id: 7, Name: "Camp 2", Expire: 1}))
+	if err := ns.SaveWaypoint(del); err != nil {
+		t.Fatalf("SaveWaypoint returned error: %v", err)
+	}
+	if active, _ := ns.ActiveWaypoints(now); len(active) != 0 {
+		t.Fatalf("deleted waypoint still active: %+v", active)
+	}
+	expired, err := ns.ExpiredWaypoints(now)
+	if err != nil {
+		t.Fatalf("ExpiredWaypoints returned error: %v", err)
+	}
+	if len(expired) != 1 || expired[0].Active(now) {
+		t.Fatalf("unexpected expired waypoints %+v", expired)
+	}
+	if missing, err := ns.Waypoint(8); err != nil || missing != nil {
+		t.Fatalf("expected nil for unknown waypoint, got %+v, %v", missing, err)
+	}
+}
+
+func TestWaypointLockedTo(t *testing.T) {
+	ns := openTestStore(t)
+	if err := ns.SaveWaypoint(&Waypoint{ID: 9, Name: "Mine", LockedTo: "0xa", CreatedBy: "0xa"}); err != nil {
+		t.Fatalf("SaveWaypoint returned error: %v", err)
+	}
+	if err := ns.SaveWaypoint(&Waypoint{ID: 9, Name: "Stolen", CreatedBy: "0xb"}); err != nil {
+		t.Fatalf("SaveWaypoint returned error: %v", err)
+	}
+	got, _ := ns.Waypoint(9)
+	if got.Name != "Mine" {
+		t.Fatalf("locked waypoint changed by another node: %+v", got)
+	}
+	if err := ns.SaveWaypoint(&Waypoint{ID: 9, Name: "Renamed", LockedTo: "0xa", CreatedBy: "0xa"}); err != nil {
+		t.Fatalf("SaveWaypoint returned error: %v", err)
+	}
+	if got, _ := ns.Waypoint(9); got.Name != "Renamed" {
+		t.Fatalf("owner update ignored: %+v", got)
+	}
+}
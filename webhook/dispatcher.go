@@ -0,0 +1,231 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"meshspy/events"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var deliveries = promauto.NewCounterVec(prometheus.CounterOpts{Name: "meshspy_webhook_deliveries_total",
+	Help: "Webhook delivery attempts by sink and result (ok, retry, dead_letter)."}, []string{"sink", "result"})
+
+// DeadLetter is a delivery abandoned after its retries.
+type DeadLetter struct {
+	Sink     string
+	Event    events.Event
+	Payload  []byte
+	Attempts int
+	Err      error
+}
+
+// Options configures a Dispatcher.
+type Options struct {
+	// Resolve returns the name of a node for the body templates. It may be
+	// nil.
+	Resolve func(id string) string
+	// DeadLetter stores deliveries abandoned after the retries, or left in
+	// the queue at shutdown. They are logged when nil.
+	DeadLetter func(DeadLetter)
+	// Queue is the number of events buffered per sink, 256 by default.
+	// Events not fitting are dead-lettered.
+	Queue int
+	// Client sends the requests; http.DefaultClient when nil. Timeouts
+	// are applied per sink.
+	Client *http.Client
+}
+
+// Dispatcher routes events to the sinks accepting them. Each sink is served
+// by its own goroutine, so a slow endpoint does not delay the others.
+type Dispatcher struct {
+	opts    Options
+	workers []*worker
+	// ctx is cancelled to abandon the deliveries; done is closed when Run
+	// returns.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type worker struct {
+	sink *Sink
+	ch   chan events.Event
+}
+
+// NewDispatcher returns a dispatcher for sinks, which must be initialized.
+func NewDispatcher(sinks []*Sink, opts Options) *Dispatcher {
+	if opts.Queue <= 0 {
+		opts.Queue = 256
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	d := &Dispatcher{opts: opts, done: make(chan struct{})}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, s := range sinks {
+		d.workers = append(d.workers, &worker{sink: s, ch: make(chan events.Event, opts.Queue)})
+	}
+	return d
+}
+
+// Handle queues e for every sink accepting its type. It does not block.
+func (d *Dispatcher) Handle(e events.Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, w := range d.workers {
+		if w.sink.Accepts(e.Type) {
+			d.queue(w, e)
+		}
+	}
+}
+
+// Send queues e for the sink named sink, whatever the event types it
+// accepts. It does not block; an event not fitting in the queue is
+// dead-lettered.
+func (d *Dispatcher) Send(sink string, e events.Event) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, w := range d.workers {
+		if w.sink.Name == sink {
+			d.queue(w, e)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown webhook sink %q", sink)
+}
+
+// queue adds e to the queue of w, dead-lettering it when the queue is full
+// or the dispatcher closed. The caller must hold d.mu for reading.
+func (d *Dispatcher) queue(w *worker, e events.Event) {
+	if d.closed {
+		d.deadLetter(w.sink, e, nil, 0, fmt.Errorf("dispatcher closed"))
+		return
+	}
+	select {
+	case w.ch <- e:
+	default:
+		d.deadLetter(w.sink, e, nil, 0, fmt.Errorf("queue full"))
+	}
+}
+
+// Run delivers the queued events until ctx is cancelled or the dispatcher
+// is closed. Events still queued or being retried when ctx is cancelled are
+// dead-lettered. Run must be called once.
+func (d *Dispatcher) Run(ctx context.Context) {
+	defer close(d.done)
+	stop := context.AfterFunc(ctx, d.cancel)
+	defer stop()
+	ctx = d.ctx
+	var wg sync.WaitGroup
+	for _, w := range d.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			d.work(ctx, w)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// Close stops accepting events, later ones being dead-lettered, and waits
+// until Run, which must have been started, delivered the queued events.
+// Those still queued or being retried when ctx is done are dead-lettered.
+func (d *Dispatcher) Close(ctx context.Context) {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, w := range d.workers {
+			close(w.ch)
+		}
+	}
+	d.mu.Unlock()
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		d.cancel()
+		<-d.done
+	}
+	// Events queued after Run was cancelled
+	for _, w := range d.workers {
+		for e := range w.ch {
+			d.deadLetter(w.sink, e, nil, 0, fmt.Errorf("dispatcher closed"))
+		}
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context, w *worker) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e, ok := <-w.ch:
+					if !ok {
+						return
+					}
+					d.deadLetter(w.sink, e, nil, 0, ctx.Err())
+				default:
+					return
+				}
+			}
+		case e, ok := <-w.ch:
+			if !ok {
+				return
+			}
+			d.deliver(ctx, w.sink, e)
+		}
+	}
+}
+
+// deliver sends e to s, retrying with exponential backoff.
+func (d *Dispatcher) deliver(ctx context.Context, s *Sink, e events.Event) {
+	name := ""
+	if d.opts.Resolve != nil && e.NodeID != "" {
+		name = d.opts.Resolve(e.NodeID)
+	}
+	body, err := s.Render(e, name)
+	if err != nil {
+		d.deadLetter(s, e, nil, 0, fmt.Errorf("render body: %v", err))
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.send(ctx, d.opts.Client, e, body)
+		if err == nil {
+			deliveries.WithLabelValues(s.Name, "ok").Inc()
+			return
+		}
+		if !retryable(err) || attempt > s.MaxRetries || ctx.Err() != nil {
+			d.deadLetter(s, e, body, attempt, err)
+			return
+		}
+		deliveries.WithLabelValues(s.Name, "retry").Inc()
+		t := time.NewTimer(s.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			d.deadLetter(s, e, body, attempt, ctx.Err())
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (d *Dispatcher) deadLetter(s *Sink, e events.Event, body []byte, attempts int, err error) {
+	deliveries.WithLabelValues(s.Name, "dead_letter").Inc()
+	dl := DeadLetter{Sink: s.Name, Event: e, Payload: body, Attempts: attempts, Err: err}
+	if d.opts.DeadLetter != nil {
+		d.opts.DeadLetter(dl)
+		return
+	}
+	log.Printf("webhook %s: event %d abandoned after %d attempts: %v", s.Name, e.ID, attempts, err)
+}
@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"meshspy/events"
+)
+
+func TestDispatcherRetriesAndDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	var sig, typ string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[r.URL.Path]++
+		switch r.URL.Path {
+		case "/flaky":
+			// Fails twice before accepting the event.
+			if calls[r.URL.Path] < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get(SignatureHeader) == Sign("key", body) {
+				sig = "ok"
+			}
+			typ = r.Header.Get(EventHeader)
+		case "/rejects":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	var sinks []*Sink
+	for _, s := range []*Sink{
+		{Name: "flaky", URL: srv.URL + "/flaky", Secret: "key", Backoff: time.Millisecond},
+		{Name: "rejects", URL: srv.URL + "/rejects", Backoff: time.Millisecond},
+		{Name: "down", URL: srv.URL + "/down", Events: []string{events.NodeOffline}},
+	} {
+		if err := s.Init(); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		sinks = append(sinks, s)
+	}
+	dead := make(chan DeadLetter, 10)
+	d := NewDispatcher(sinks, Options{DeadLetter: func(dl DeadLetter) { dead <- dl }})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { d.Run(ctx); close(done) }()
+
+	d.Handle(events.Event{ID: 7, Type: events.Alert, NodeID: "0xa", Time: time.Now()})
+	select {
+	case dl := <-dead:
+		if dl.Sink != "rejects" || dl.Attempts != 1 || dl.Event.ID != 7 || string(dl.Payload) == "" {
+			t.Fatalf("unexpected dead letter %+v", dl)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter for rejected delivery")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := calls["/flaky"]
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flaky sink called %d times", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sig != "ok" || typ != events.Alert {
+		t.Fatalf("unexpected signature %q or event header %q", sig, typ)
+	}
+	if calls["/down"] != 0 {
+		t.Fatal("event delivered to a sink not accepting its type")
+	}
+	select {
+	case dl := <-dead:
+		t.Fatalf("unexpected dead letter %+v", dl)
+	default:
+	}
+}
+
+func TestDispatcherSend(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.URL.Path + " " + r.Header.Get(EventHeader)
+	}))
+	defer srv.Close()
+
+	s := &Sink{Name: "ops", URL: srv.URL + "/ops", Events: []string{events.NodeOffline}}
+	if err := s.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	d := NewDispatcher([]*Sink{s}, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	if err := d.Send("other", events.Event{Type: events.Alert}); err == nil {
+		t.Fatal("Send to an unknown sink returned no error")
+	}
+	// A named sink receives the event even if it does not select its type
+	if err := d.Send("ops", events.Event{Type: events.Alert}); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	select {
+	case r := <-got:
+		if r != "/ops "+events.Alert {
+			t.Fatalf("unexpected request %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+
+func TestDispatcherClose(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	delivered := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		mu.Lock()
+		delivered++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	newDispatcher := func(path string, dead chan DeadLetter) *Dispatcher {
+		s := &Sink{Name: path, URL: srv.URL + "/" + path, Backoff: time.Millisecond}
+		if err := s.Init(); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		d := NewDispatcher([]*Sink{s}, Options{DeadLetter: func(dl DeadLetter) { dead <- dl }})
+		go d.Run(context.Background())
+		for i := 1; i <= 3; i++ {
+			d.Handle(events.Event{ID: int64(i), Type: events.Alert})
+		}
+		return d
+	}
+
+	// The queue is delivered before Close returns
+	dead := make(chan DeadLetter, 10)
+	newDispatcher("fast", dead).Close(context.Background())
+	mu.Lock()
+	n := delivered
+	mu.Unlock()
+	if n != 3 || len(dead) != 0 {
+		t.Fatalf("Close returned after %d deliveries and %d dead letters", n, len(dead))
+	}
+
+	// What cannot be delivered in time is dead-lettered, and so are the
+	// events arriving after Close
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d := newDispatcher("slow", dead)
+	d.Close(ctx)
+	d.Handle(events.Event{ID: 4, Type: events.Alert})
+	if len(dead) != 4 {
+		t.Fatalf("expected 4 dead letters, got %d", len(dead))
+	}
+}
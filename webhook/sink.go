@@ -0,0 +1,260 @@
+// Package webhook delivers events to HTTP endpoints such as chat or ticketing
+// tools. Each sink selects the event types it receives and renders the
+// request body from a Go template; deliveries are signed with HMAC-SHA256
+// and retried with exponential backoff before being dead-lettered.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"meshspy/events"
+)
+
+// Headers set on every delivery.
+const (
+	SignatureHeader = "X-Meshspy-Signature"
+	EventHeader     = "X-Meshspy-Event"
+	DeliveryHeader  = "X-Meshspy-Delivery"
+)
+
+// Defaults applied to sinks leaving the fields empty.
+const (
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxRetries = 5
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+)
+
+// File is the layout of a webhooks file.
+type File struct {
+	Webhooks []*Sink `yaml:"webhooks"`
+}
+
+// Sink is a webhook endpoint. URL, header values and Secret may reference
+// environment variables as ${NAME}.
+type Sink struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Events lists the event types delivered; empty means all.
+	Events  []string          `yaml:"events"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is a text/template rendered with a Payload. Without it the
+	// event is sent as JSON.
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"content_type"`
+	// Secret signs the body with HMAC-SHA256, sent as sha256=<hex> in the
+	// X-Meshspy-Signature header.
+	Secret string `yaml:"secret"`
+
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxRetries is the number of retries after the first attempt; a
+	// negative value disables them.
+	MaxRetries int           `yaml:"max_retries"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	body  *template.Template
+	types map[string]bool
+}
+
+// Payload is the data available to body templates.
+type Payload struct {
+	ID     int64
+	Type   string
+	NodeID string
+	// Name is the name of the node when known, its ID otherwise.
+	Name string
+	Time time.Time
+	// Data is the decoded event data, e.g. .Data.text for messages.
+	Data  map[string]any
+	Event events.Event
+}
+
+var funcs = template.FuncMap{
+	// json encodes a value, e.g. a string to embed in a JSON body.
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// LoadFile reads and validates the sinks in path.
+func LoadFile(path string) ([]*Sink, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse decodes and validates YAML sinks.
+func Parse(b []byte) ([]*Sink, error) {
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid webhooks: %v", err)
+	}
+	names := map[string]bool{}
+	for i, s := range f.Webhooks {
+		if err := s.Init(); err != nil {
+			return nil, fmt.Errorf("webhook %d (%s): %v", i+1, s.Name, err)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("webhook %d: duplicate name %q", i+1, s.Name)
+		}
+		names[s.Name] = true
+	}
+	return f.Webhooks, nil
+}
+
+// Init validates s, expands environment variables and applies the defaults.
+// It must be called on sinks not obtained from Parse.
+func (s *Sink) Init() error {
+	if s.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	s.URL = os.ExpandEnv(s.URL)
+	if s.URL == "" {
+		return fmt.Errorf("url required")
+	}
+	s.Secret = os.ExpandEnv(s.Secret)
+	for k, v := range s.Headers {
+		s.Headers[k] = os.ExpandEnv(v)
+	}
+	if s.Method == "" {
+		s.Method = http.MethodPost
+	}
+	if s.ContentType == "" {
+		s.ContentType = "application/json"
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+	if s.MaxRetries == 0 {
+		s.MaxRetries = DefaultMaxRetries
+	}
+	if s.Backoff <= 0 {
+		s.Backoff = DefaultBackoff
+	}
+	if s.MaxBackoff <= 0 {
+		s.MaxBackoff = DefaultMaxBackoff
+	}
+	if s.Body != "" {
+		t, err := template.New(s.Name).Funcs(funcs).Option("missingkey=zero").Parse(s.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body: %v", err)
+		}
+		s.body = t
+	}
+	s.types = make(map[string]bool, len(s.Events))
+	for _, t := range s.Events {
+		s.types[t] = true
+	}
+	return nil
+}
+
+// Accepts reports whether events of type typ are delivered to s.
+func (s *Sink) Accepts(typ string) bool {
+	return len(s.types) == 0 || s.types[typ]
+}
+
+// Render returns the request body for e; name is the name of its node.
+func (s *Sink) Render(e events.Event, name string) ([]byte, error) {
+	if s.body == nil {
+		return json.Marshal(e)
+	}
+	p := Payload{ID: e.ID, Type: e.Type, NodeID: e.NodeID, Name: name, Time: e.Time, Event: e}
+	if p.Name == "" {
+		p.Name = e.NodeID
+	}
+	if len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, &p.Data); err != nil {
+			return nil, fmt.Errorf("decode event data: %v", err)
+		}
+	}
+	var b bytes.Buffer
+	if err := s.body.Execute(&b, p); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Sign returns the signature of body for the X-Meshspy-Signature header.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// StatusError is returned for deliveries answered with a non-2xx status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string { return "unexpected status " + e.Status }
+
+// retryable reports whether a failed delivery may succeed later: network
+// errors, timeouts, 429 and server errors are retried, other statuses not.
+func retryable(err error) bool {
+	se, ok := err.(*StatusError)
+	if !ok {
+		return true
+	}
+	return se.Code == http.StatusRequestTimeout || se.Code == http.StatusTooManyRequests || se.Code >= 500
+}
+
+// send makes a single delivery attempt of body for e.
+func (s *Sink) send(ctx context.Context, client *http.Client, e events.Event, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, s.Method, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", s.ContentType)
+	req.Header.Set(EventHeader, e.Type)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(e.ID, 10))
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// backoff returns the delay before retry n (1-based).
+func (s *Sink) backoff(n int) time.Duration {
+	d := s.Backoff
+	for i := 1; i < n && d < s.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	return d
+}
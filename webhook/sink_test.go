@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"meshspy/events"
+)
+
+func TestParseAndRender(t *testing.T) {
+	t.Setenv("CHAT_TOKEN", "s3cret")
+	sinks, err := Parse([]byte(`
+webhooks:
+  - name: chat
+    url: https://chat.example.com/hooks/${CHAT_TOKEN}
+    events: [text_message, alert]
+    headers:
+      Authorization: Bearer ${CHAT_TOKEN}
+    body: '{"text": {{json (printf "%s: %s" .Name .Data.text)}}}'
+    backoff: 2s
+    max_backoff: 10s
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	s := sinks[0]
+	if s.URL != "https://chat.example.com/hooks/s3cret" || s.Headers["Authorization"] != "Bearer s3cret" {
+		t.Fatalf("environment not expanded: %+v", s)
+	}
+	if s.Method != "POST" || s.Timeout != DefaultTimeout || s.MaxRetries != DefaultMaxRetries {
+		t.Fatalf("defaults not applied: %+v", s)
+	}
+	if !s.Accepts(events.Alert) || s.Accepts(events.NodeOnline) {
+		t.Fatal("unexpected event filter")
+	}
+
+	e := events.New(events.TextMessage, "0xa", map[string]string{"text": `say "hi"`})
+	b, err := s.Render(e, "Base")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if string(b) != `{"text": "Base: say \"hi\""}` {
+		t.Fatalf("unexpected body %s", b)
+	}
+
+	var got []time.Duration
+	for n := 1; n <= 4; n++ {
+		got = append(got, s.backoff(n))
+	}
+	if got[0] != 2*time.Second || got[2] != 8*time.Second || got[3] != 10*time.Second {
+		t.Fatalf("unexpected backoff %v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		`webhooks: [{url: http://x}]`:                                    "name required",
+		`webhooks: [{name: a}]`:                                          "url required",
+		`webhooks: [{name: a, url: http://x, body: "{{"}]`:               "invalid body",
+		`webhooks: [{name: a, url: http://x}, {name: a, url: http://y}]`: "duplicate",
+	} {
+		if _, err := Parse([]byte(src)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: got %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{}' | openssl dgst -sha256 -hmac key
+	if got := Sign("key", []byte("{}")); got != "sha256=a777724d943eb48dc69bca8a4a6d57a04db3f9ec7e1de4e581e860265bdf3032" {
+		t.Fatalf("unexpected signature %s", got)
+	}
+}
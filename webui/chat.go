@@ -0,0 +1,157 @@
+package webui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"meshspy/auth"
+	"meshspy/nodemap"
+	"meshspy/storage"
+)
+
+// maxChatText is the largest text payload, in bytes, fitting in a mesh
+// packet.
+const maxChatText = 200
+
+// chat serves the channels, the direct message conversations and the
+// message history of the gateway, and sends messages through its command
+// topic. Delivery updates reach the browser as message_sent and
+// message_status events on the websocket.
+type chat struct {
+	store   storage.Backend
+	publish func(cmd string) error
+	audit   func(r *http.Request, action, detail string)
+}
+
+// mount registers the chat endpoints: reading requires the viewer role,
+// sending the operator role.
+func (c *chat) mount(mux *http.ServeMux, a *auth.Authenticator) {
+	mux.Handle("/chat/channels", a.Require(auth.Viewer, http.HandlerFunc(c.channels)))
+	mux.Handle("/chat/conversations", a.Require(auth.Viewer, http.HandlerFunc(c.conversations)))
+	mux.Handle("/chat/messages", a.Require(auth.Viewer, http.HandlerFunc(c.messages)))
+	mux.Handle("/chat/send", a.Require(auth.Operator, http.HandlerFunc(c.send)))
+}
+
+// channels lists the channels of the radio. Before the radio has sent its
+// configuration only the primary channel is known.
+func (c *chat) channels(w http.ResponseWriter, r *http.Request) {
+	list, err := c.store.Channels()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(list) == 0 {
+		list = []storage.Channel{{Index: 0, Role: "PRIMARY"}}
+	}
+	writeJSON(w, list)
+}
+
+func (c *chat) conversations(w http.ResponseWriter, r *http.Request) {
+	list, err := c.store.Conversations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// messages returns the history of a channel (?channel=1) or of a direct
+// conversation (?peer=0x1a2b), newest first, paged with before and limit.
+func (c *chat) messages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, err := storage.PageFromQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var list []storage.Message
+	switch {
+	case q.Get("peer") != "":
+		num, ok := nodemap.ParseID(q.Get("peer"))
+		if !ok {
+			http.Error(w, "invalid peer", http.StatusBadRequest)
+			return
+		}
+		list, err = c.store.PeerMessages(nodemap.FormatID(num), page)
+	default:
+		var channel uint64
+		if v := q.Get("channel"); v != "" {
+			if channel, err = strconv.ParseUint(v, 10, 8); err != nil {
+				http.Error(w, "invalid channel", http.StatusBadRequest)
+				return
+			}
+		}
+		list, err = c.store.ChannelMessages(uint32(channel), page)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		list = []storage.Message{}
+	}
+	writeJSON(w, list)
+}
+
+// sendRequest is the body of /chat/send: a text for a channel or, when To
+// is set, for a single node.
+type sendRequest struct {
+	Channel uint32 `json:"channel"`
+	To      string `json:"to"`
+	Text    string `json:"text"`
+}
+
+// command returns the gateway command sending the message.
+func (s sendRequest) command() (string, error) {
+	text := strings.TrimSpace(s.Text)
+	switch {
+	case text == "":
+		return "", fmt.Errorf("text required")
+	case len(text) > maxChatText:
+		return "", fmt.Errorf("text longer than %d bytes", maxChatText)
+	case s.Channel > 7:
+		return "", fmt.Errorf("invalid channel %d", s.Channel)
+	}
+	if s.To != "" {
+		num, ok := nodemap.ParseID(s.To)
+		if !ok {
+			return "", fmt.Errorf("invalid destination %q", s.To)
+		}
+		return "dm:" + nodemap.FormatID(num) + ":" + text, nil
+	}
+	if s.Channel == 0 {
+		return "send:" + text, nil
+	}
+	return fmt.Sprintf("chan:%d:%s", s.Channel, text), nil
+}
+
+func (c *chat) send(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req sendRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	cmd, err := req.command()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := c.publish(cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	c.audit(r, "send", cmd)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
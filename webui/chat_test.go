@@ -0,0 +1,99 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"meshspy/storage"
+)
+
+func TestSendCommand(t *testing.T) {
+	for _, tc := range []struct {
+		req  sendRequest
+		want string
+	}{
+		{sendRequest{Text: "ciao"}, "send:ciao"},
+		{sendRequest{Channel: 2, Text: " ciao "}, "chan:2:ciao"},
+		{sendRequest{To: "!00001a2b", Text: "a: b"}, "dm:0x1a2b:a: b"},
+		{sendRequest{Text: "  "}, ""},
+		{sendRequest{Channel: 8, Text: "x"}, ""},
+		{sendRequest{To: "nobody", Text: "x"}, ""},
+		{sendRequest{Text: strings.Repeat("x", maxChatText+1)}, ""},
+	} {
+		got, err := tc.req.command()
+		if tc.want == "" && err == nil {
+			t.Errorf("%+v: expected an error, got %q", tc.req, got)
+		}
+		if tc.want != "" && (err != nil || got != tc.want) {
+			t.Errorf("%+v: got %q, %v, want %q", tc.req, got, err, tc.want)
+		}
+	}
+}
+
+func TestChatHandlers(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer store.Close()
+	for _, m := range []storage.Message{
+		{PacketID: 1, From: "0xa", To: storage.BroadcastID, Channel: 1, Direction: storage.DirectionIn, Text: "on one"},
+		{PacketID: 2, From: "0xa", To: "0x1", Direction: storage.DirectionIn, Text: "hi"},
+		{PacketID: 3, From: "0x1", To: "0xa", Direction: storage.DirectionOut, Text: "hello", Status: storage.StatusPending},
+	} {
+		if _, err := store.AddMessage(&m); err != nil {
+			t.Fatalf("AddMessage returned error: %v", err)
+		}
+	}
+	var sent []string
+	c := &chat{
+		store:   store,
+		publish: func(cmd string) error { sent = append(sent, cmd); return nil },
+		audit:   func(*http.Request, string, string) {},
+	}
+
+	get := func(h http.HandlerFunc, url string, v any) int {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+				t.Fatalf("%s: %v", url, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var channels []storage.Channel
+	if code := get(c.channels, "/chat/channels", &channels); code != http.StatusOK || len(channels) != 1 || channels[0].Role != "PRIMARY" {
+		t.Fatalf("channels returned %d %+v", code, channels)
+	}
+	var msgs []storage.Message
+	if code := get(c.messages, "/chat/messages?channel=1", &msgs); code != http.StatusOK || len(msgs) != 1 || msgs[0].Text != "on one" {
+		t.Fatalf("channel messages returned %d %+v", code, msgs)
+	}
+	if code := get(c.messages, "/chat/messages?peer=!0000000a&limit=1", &msgs); code != http.StatusOK || len(msgs) != 1 || msgs[0].Text != "hello" {
+		t.Fatalf("peer messages returned %d %+v", code, msgs)
+	}
+	if code := get(c.messages, "/chat/messages?peer=nobody", &msgs); code != http.StatusBadRequest {
+		t.Fatalf("invalid peer returned %d", code)
+	}
+	var convs []storage.ConversationSummary
+	if code := get(c.conversations, "/chat/conversations", &convs); code != http.StatusOK || len(convs) != 1 || convs[0].Peer != "0xa" || convs[0].Messages != 2 {
+		t.Fatalf("conversations returned %d %+v", code, convs)
+	}
+
+	rec := httptest.NewRecorder()
+	c.send(rec, httptest.NewRequest(http.MethodPost, "/chat/send", strings.NewReader(`{"to":"0xa","text":"ok"}`)))
+	if rec.Code != http.StatusAccepted || len(sent) != 1 || sent[0] != "dm:0xa:ok" {
+		t.Fatalf("send returned %d, published %q", rec.Code, sent)
+	}
+	rec = httptest.NewRecorder()
+	c.send(rec, httptest.NewRequest(http.MethodPost, "/chat/send", strings.NewReader(`{"text":""}`)))
+	if rec.Code != http.StatusBadRequest || len(sent) != 1 {
+		t.Fatalf("empty text returned %d, published %q", rec.Code, sent)
+	}
+}
@@ -0,0 +1,204 @@
+package webui
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sendBuffer is the number of messages queued for a websocket client;
+	// a client falling further behind is evicted.
+	sendBuffer = 64
+	// writeWait bounds the time to write a message to a client.
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed to read the next pong from a client,
+	// pinged every pingPeriod.
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// maxMessage is the largest message accepted from a client.
+	maxMessage = 64 << 10
+)
+
+// hub shares a single feed, an MQTT subscription or the event bus of
+// meshspy, among the websocket clients. Each client has its own buffered
+// writer, so a slow browser neither blocks the feed nor the other clients.
+type hub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[*wsClient]struct{})}
+}
+
+// broadcast queues payload for the clients whose filters match topic,
+// evicting those whose queue is full.
+func (h *hub) broadcast(topic string, payload []byte) {
+	var slow []*wsClient
+	h.mu.Lock()
+	for c := range h.clients {
+		if c.wants(topic) && !c.queue(payload) {
+			slow = append(slow, c)
+		}
+	}
+	h.mu.Unlock()
+	for _, c := range slow {
+		log.Printf("🐢 websocket client %s too slow, disconnected", c.conn.RemoteAddr())
+		c.close()
+	}
+}
+
+// register adds a client on conn receiving the messages whose topic
+// matches one of filters, or every message without filters, and starts
+// its writer.
+func (h *hub) register(conn *websocket.Conn, filters []string) *wsClient {
+	c := &wsClient{
+		hub:     h,
+		conn:    conn,
+		filters: filters,
+		send:    make(chan []byte, sendBuffer),
+		done:    make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	go c.writePump()
+	return c
+}
+
+// len returns the number of connected clients.
+func (h *hub) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// wsClient is a websocket connection of the hub. Only its writer writes to
+// the connection.
+type wsClient struct {
+	hub     *hub
+	conn    *websocket.Conn
+	filters []string
+	send    chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *wsClient) wants(topic string) bool {
+	if len(c.filters) == 0 {
+		return true
+	}
+	for _, f := range c.filters {
+		if topicMatch(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue hands msg to the writer, reporting false when the queue is full.
+func (c *wsClient) queue(msg []byte) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// close removes the client from the hub and closes the connection.
+func (c *wsClient) close() {
+	c.once.Do(func() {
+		c.hub.mu.Lock()
+		delete(c.hub.clients, c)
+		c.hub.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// writePump writes the queued messages and the keepalive pings until the
+// client is closed or a write fails.
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	defer c.close()
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Printf("websocket write error: %v", err)
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump passes the messages of the client to handle until the
+// connection fails or the client stops answering the pings.
+func (c *wsClient) readPump(handle func([]byte)) {
+	defer c.close()
+	c.conn.SetReadLimit(maxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket read error: %v", err)
+			}
+			return
+		}
+		handle(msg)
+	}
+}
+
+// validFilter reports whether f is a valid MQTT topic filter.
+func validFilter(f string) bool {
+	if f == "" {
+		return false
+	}
+	levels := strings.Split(f, "/")
+	for i, l := range levels {
+		switch {
+		case l == "#" && i != len(levels)-1:
+			return false
+		case l != "#" && l != "+" && strings.ContainsAny(l, "#+"):
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatch reports whether topic matches the MQTT filter, where + matches
+// a single level and a trailing # any number of levels.
+func topicMatch(filter, topic string) bool {
+	fl, tl := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) || f != "+" && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
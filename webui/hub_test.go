@@ -0,0 +1,131 @@
+package webui
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTopicMatch(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"meshspy/nodo/connesso", "meshspy/nodo/connesso", true},
+		{"meshspy/+/connesso", "meshspy/nodo/connesso", true},
+		{"meshspy/+", "meshspy/nodo/connesso", false},
+		{"meshspy/#", "meshspy/nodo/connesso", true},
+		{"meshspy/#", "meshspy", true},
+		{"#", "anything/at/all", true},
+		{"meshspy/nodo", "meshspy/nodo/connesso", false},
+		{"meshspy/nodo/connesso/x", "meshspy/nodo/connesso", false},
+	} {
+		if got := topicMatch(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+	for f, want := range map[string]bool{"a/+/b": true, "a/#": true, "a/#/b": false, "a/b+": false, "": false} {
+		if got := validFilter(f); got != want {
+			t.Errorf("validFilter(%q) = %v, want %v", f, got, want)
+		}
+	}
+}
+
+// newHubServer serves the clients of h, registered with the topic
+// parameters of their request.
+func newHubServer(t *testing.T, h *hub) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := h.register(conn, r.URL.Query()["topic"])
+		c.readPump(func(msg []byte) { c.queue(append([]byte("echo: "), msg...)) })
+	}))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitClients(t *testing.T, h *hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, got %d", n, h.len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func read(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(msg)
+}
+
+func TestHubFanOut(t *testing.T) {
+	h := newHub()
+	url := newHubServer(t, h)
+	all := dial(t, url)
+	alerts := dial(t, url+"?topic=mesh/alerts/%23")
+	leaving := dial(t, url)
+	waitClients(t, h, 3)
+
+	// A client leaving does not stop the feed of the others
+	leaving.Close()
+	waitClients(t, h, 2)
+
+	h.broadcast("mesh/text", []byte("ciao"))
+	h.broadcast("mesh/alerts/0x1", []byte("sos"))
+	if got := read(t, all); got != "ciao" {
+		t.Fatalf("unexpected message %q", got)
+	}
+	if got := read(t, all); got != "sos" {
+		t.Fatalf("unexpected message %q", got)
+	}
+	if got := read(t, alerts); got != "sos" {
+		t.Fatalf("filtered client received %q", got)
+	}
+
+	// Replies to the client go through the same writer
+	if err := alerts.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := read(t, alerts); got != "echo: hello" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	h := newHub()
+	url := newHubServer(t, h)
+	dial(t, url) // never reads
+	waitClients(t, h, 1)
+
+	payload := bytes.Repeat([]byte("x"), 64<<10)
+	for i := 0; i < 4*sendBuffer && h.len() > 0; i++ {
+		h.broadcast("mesh/text", payload)
+		time.Sleep(time.Millisecond)
+	}
+	waitClients(t, h, 0)
+}
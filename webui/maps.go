@@ -0,0 +1,70 @@
+package webui
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"meshspy/auth"
+	"meshspy/config"
+	"meshspy/storage"
+)
+
+// defaultLeafletURL serves Leaflet when neither MAP_LEAFLET_URL nor a local
+// copy in MAP_LEAFLET_DIR is available.
+const defaultLeafletURL = "https://unpkg.com/leaflet@1.9.4/dist"
+
+// localTiles is the tile template used for MAP_TILE_DIR.
+const localTiles = "/tiles/{z}/{x}/{y}.png"
+
+// mapConfig tells the map page where to load Leaflet and the tiles from.
+type mapConfig struct {
+	TileURL     string `json:"tile_url"`
+	Attribution string `json:"attribution"`
+	LeafletURL  string `json:"leaflet_url"`
+}
+
+// newMapConfig resolves the map sources of cfg: the local tile directory
+// wins over the tile URL, and Leaflet is served from MapLeafletDir when it
+// exists so that the map works without internet.
+func newMapConfig(cfg config.Config) mapConfig {
+	m := mapConfig{TileURL: cfg.MapTileURL, Attribution: cfg.MapAttribution, LeafletURL: cfg.MapLeafletURL}
+	if cfg.MapTileDir != "" {
+		m.TileURL = localTiles
+	}
+	if m.LeafletURL == "" {
+		if st, err := os.Stat(cfg.MapLeafletDir); cfg.MapLeafletDir != "" && err == nil && st.IsDir() {
+			m.LeafletURL = "/leaflet"
+		} else {
+			m.LeafletURL = defaultLeafletURL
+		}
+	}
+	return m
+}
+
+// mountMap registers the map page with its configuration, the active
+// waypoints and the local tiles and Leaflet copy when configured.
+func mountMap(mux *http.ServeMux, a *auth.Authenticator, store storage.Backend, cfg config.Config) {
+	mc := newMapConfig(cfg)
+	mux.Handle("/map", a.Page(servePage("map.html")))
+	mux.Handle("/map/config", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mc)
+	})))
+	mux.Handle("/waypoints", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, err := store.ActiveWaypoints(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			list = []storage.Waypoint{}
+		}
+		writeJSON(w, list)
+	})))
+	if cfg.MapTileDir != "" {
+		mux.Handle("/tiles/", a.Require(auth.Viewer, http.StripPrefix("/tiles/", http.FileServer(http.Dir(cfg.MapTileDir)))))
+	}
+	if mc.LeafletURL == "/leaflet" {
+		mux.Handle("/leaflet/", http.StripPrefix("/leaflet/", http.FileServer(http.Dir(cfg.MapLeafletDir))))
+	}
+}
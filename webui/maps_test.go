@@ -0,0 +1,29 @@
+package webui
+
+import (
+	"path/filepath"
+	"testing"
+
+	"meshspy/config"
+)
+
+func TestNewMapConfig(t *testing.T) {
+	cfg := config.Config{MapTileURL: "https://tiles.example/{z}/{x}/{y}.png", MapAttribution: "example",
+		MapLeafletDir: filepath.Join(t.TempDir(), "missing")}
+
+	m := newMapConfig(cfg)
+	if m.TileURL != cfg.MapTileURL || m.Attribution != "example" || m.LeafletURL != defaultLeafletURL {
+		t.Fatalf("unexpected config %+v", m)
+	}
+
+	// A local tile directory and Leaflet copy make the map work offline
+	cfg.MapTileDir, cfg.MapLeafletDir = t.TempDir(), t.TempDir()
+	if m = newMapConfig(cfg); m.TileURL != localTiles || m.LeafletURL != "/leaflet" {
+		t.Fatalf("unexpected offline config %+v", m)
+	}
+
+	cfg.MapLeafletURL = "https://cdn.example/leaflet"
+	if m = newMapConfig(cfg); m.LeafletURL != cfg.MapLeafletURL {
+		t.Fatalf("MAP_LEAFLET_URL ignored: %+v", m)
+	}
+}
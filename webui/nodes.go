@@ -0,0 +1,170 @@
+package webui
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"meshspy/auth"
+	mqttpkg "meshspy/client"
+	"meshspy/nodemap"
+	"meshspy/storage"
+)
+
+// maxSeriesMetrics caps the metrics of a single series request.
+const maxSeriesMetrics = 16
+
+// nodeDetail is a node with the fingerprint of its public key.
+type nodeDetail struct {
+	*mqttpkg.NodeInfo
+	KeyFingerprint string `json:"KeyFingerprint,omitempty"`
+}
+
+// keyFingerprint returns the first 8 bytes of the SHA-256 of a base64
+// public key, the short form users compare between devices.
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		raw = []byte(key)
+	}
+	sum := sha256.Sum256(raw)
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%02x", sum[i])
+	}
+	return strings.Join(parts, ":")
+}
+
+// seriesQuery is a parsed /nodes/series request.
+type seriesQuery struct {
+	node       string
+	metrics    []string
+	resolution string
+	since      time.Time
+	until      time.Time
+}
+
+// parseSeriesQuery reads the node id, the comma separated metrics and the
+// range of a series request: either range=24h back from now or since and
+// until as Unix seconds or RFC 3339. The resolution defaults to one giving
+// a few hundred points over the range.
+func parseSeriesQuery(q url.Values, now time.Time) (seriesQuery, error) {
+	var sq seriesQuery
+	num, ok := nodemap.ParseID(q.Get("id"))
+	if !ok {
+		return sq, fmt.Errorf("invalid node id")
+	}
+	sq.node = nodemap.FormatID(num)
+	for _, m := range strings.Split(q.Get("metrics"), ",") {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		if !storage.KnownMetric(m) {
+			return sq, fmt.Errorf("unknown metric %q", m)
+		}
+		sq.metrics = append(sq.metrics, m)
+	}
+	switch {
+	case len(sq.metrics) == 0:
+		return sq, fmt.Errorf("metrics required")
+	case len(sq.metrics) > maxSeriesMetrics:
+		return sq, fmt.Errorf("at most %d metrics", maxSeriesMetrics)
+	}
+
+	page, err := storage.PageFromQuery(url.Values{"since": {q.Get("since")}, "until": {q.Get("until")}})
+	if err != nil {
+		return sq, err
+	}
+	sq.since, sq.until = page.Since, page.Until
+	if sq.until.IsZero() {
+		sq.until = now
+	}
+	if v := q.Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return sq, fmt.Errorf("invalid range")
+		}
+		sq.since = sq.until.Add(-d)
+	}
+	if sq.since.IsZero() {
+		sq.since = sq.until.Add(-24 * time.Hour)
+	}
+	if !sq.since.Before(sq.until) {
+		return sq, fmt.Errorf("empty time range")
+	}
+
+	switch sq.resolution = q.Get("resolution"); sq.resolution {
+	case "", "auto":
+		span := sq.until.Sub(sq.since)
+		switch {
+		case span <= 6*time.Hour:
+			sq.resolution = storage.ResolutionMinute
+		case span <= 14*24*time.Hour:
+			sq.resolution = storage.ResolutionHour
+		default:
+			sq.resolution = storage.ResolutionDay
+		}
+	case storage.ResolutionMinute, storage.ResolutionHour, storage.ResolutionDay:
+	default:
+		return sq, fmt.Errorf("invalid resolution")
+	}
+	return sq, nil
+}
+
+// seriesResponse holds the aggregated series of a node, by metric.
+type seriesResponse struct {
+	Node       string                           `json:"node"`
+	Resolution string                           `json:"resolution"`
+	Since      time.Time                        `json:"since"`
+	Until      time.Time                        `json:"until"`
+	Series     map[string][]storage.SeriesPoint `json:"series"`
+}
+
+// mountNodes registers the node detail page with its data: the node
+// itself and its metrics aggregated over time, e.g.
+// /nodes/series?id=0x1a2b&metrics=battery,snr&range=168h
+func mountNodes(mux *http.ServeMux, a *auth.Authenticator, store storage.Backend) {
+	mux.Handle("/node", a.Page(servePage("node.html")))
+	mux.Handle("/nodes/info", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		num, ok := nodemap.ParseID(r.URL.Query().Get("id"))
+		if !ok {
+			http.Error(w, "invalid node id", http.StatusBadRequest)
+			return
+		}
+		n, err := store.Get(nodemap.FormatID(num))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == nil {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, nodeDetail{NodeInfo: n, KeyFingerprint: keyFingerprint(n.PublicKey)})
+	})))
+	mux.Handle("/nodes/series", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sq, err := parseSeriesQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := seriesResponse{Node: sq.node, Resolution: sq.resolution, Since: sq.since, Until: sq.until,
+			Series: make(map[string][]storage.SeriesPoint)}
+		for _, m := range sq.metrics {
+			points, err := store.Series(sq.node, m, sq.resolution, sq.since, sq.until)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Series[m] = points
+		}
+		writeJSON(w, resp)
+	})))
+}
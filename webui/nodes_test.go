@@ -0,0 +1,62 @@
+package webui
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"meshspy/storage"
+)
+
+func TestParseSeriesQuery(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	parse := func(q string) (seriesQuery, error) {
+		t.Helper()
+		v, err := url.ParseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseSeriesQuery(v, now)
+	}
+
+	sq, err := parse("id=!00001a2b&metrics=battery,+snr")
+	if err != nil {
+		t.Fatalf("parseSeriesQuery returned error: %v", err)
+	}
+	if sq.node != "0x1a2b" || len(sq.metrics) != 2 || sq.metrics[1] != "snr" ||
+		!sq.until.Equal(now) || !sq.since.Equal(now.Add(-24*time.Hour)) || sq.resolution != storage.ResolutionHour {
+		t.Fatalf("unexpected query %+v", sq)
+	}
+	if sq, err = parse("id=0x1&metrics=rssi&range=1h"); err != nil || sq.resolution != storage.ResolutionMinute {
+		t.Fatalf("short range returned %+v, %v", sq, err)
+	}
+	if sq, err = parse("id=0x1&metrics=rssi&range=720h"); err != nil || sq.resolution != storage.ResolutionDay {
+		t.Fatalf("long range returned %+v, %v", sq, err)
+	}
+	if sq, err = parse("id=0x1&metrics=rssi&since=1741000000&until=1741003600&resolution=hour"); err != nil ||
+		sq.since.Unix() != 1741000000 || sq.resolution != storage.ResolutionHour {
+		t.Fatalf("explicit range returned %+v, %v", sq, err)
+	}
+	for _, q := range []string{
+		"metrics=battery",
+		"id=0x1",
+		"id=0x1&metrics=bogus",
+		"id=0x1&metrics=battery&range=-1h",
+		"id=0x1&metrics=battery&resolution=week",
+		"id=0x1&metrics=battery&since=1741003600&until=1741000000",
+	} {
+		if _, err := parse(q); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	if got := keyFingerprint(""); got != "" {
+		t.Fatalf("empty key fingerprint %q", got)
+	}
+	// SHA-256 of "key"
+	if got := keyFingerprint("a2V5"); got != "2c:70:e1:2b:7a:06:46:f9" {
+		t.Fatalf("unexpected fingerprint %q", got)
+	}
+}
@@ -0,0 +1,233 @@
+// Package webui serves the web interface of meshspy: the dashboard with the
+// node list and the chat, the map and the node pages. The pages are
+// embedded in the binary. The interface runs in the standalone webapp, fed
+// over MQTT, or inside meshspy, fed by its event bus.
+package webui
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"meshspy/auth"
+	"meshspy/config"
+	"meshspy/export"
+	"meshspy/nodemap"
+	"meshspy/storage"
+)
+
+//go:embed assets
+var assets embed.FS
+
+var upgrader = websocket.Upgrader{}
+
+// Options configures a Server.
+type Options struct {
+	Store storage.Backend
+	Auth  *auth.Authenticator
+	// Config provides the map settings.
+	Config config.Config
+	// Send runs a gateway command, e.g. "dm:0x1a2b:ciao" or "send:ciao",
+	// typed in the page or sent from the chat.
+	Send func(cmd string) error
+	// EventsTopic is the topic filter of the gateway events added to the
+	// feed of /ws?events=1, e.g. "meshspy/events/#".
+	EventsTopic string
+}
+
+// Server is the HTTP handler of the web interface. The messages for the
+// websocket clients must be fed to Publish.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+	hub  *hub
+}
+
+// New returns a Server with opts.
+func New(opts Options) *Server {
+	s := &Server{opts: opts, mux: http.NewServeMux(), hub: newHub()}
+	a, store := opts.Auth, opts.Store
+	a.Mount(s.mux)
+
+	s.mux.Handle("/login", servePage("login.html"))
+	s.mux.Handle("/", a.Page(servePage("index.html")))
+
+	s.mux.Handle("/nodes", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nodes, err := store.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, nodes)
+	})))
+
+	s.mux.Handle("/positions", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nodeID := r.URL.Query().Get("node")
+		page, err := storage.PageFromQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pos, err := store.Positions(nodeID, page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, pos)
+	})))
+
+	// Name to ID resolution, e.g. /resolve?q=Monte%20Serra or /resolve?q=!00001a2b
+	s.mux.Handle("/resolve", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nm := nodemap.New()
+		if err := nm.Load(store); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, ok := nm.Lookup(r.URL.Query().Get("q"))
+		if !ok {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, n)
+	})))
+
+	// Current presence of every node with its uptime over the window,
+	// e.g. /presence?window=168h
+	s.mux.Handle("/presence", a.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window := 24 * time.Hour
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid window", http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		now := time.Now()
+		states, err := store.Presence(now.Add(-window), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, states)
+	})))
+
+	// Webhook deliveries abandoned after their retries, e.g. /deadletters?sink=chat
+	s.mux.Handle("/deadletters", a.Require(auth.Admin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, err := storage.PageFromQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		list, err := store.DeadLetters(r.URL.Query().Get("sink"), page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+	})))
+
+	// Tracks as GPX, KML or GeoJSON, e.g. /export?format=kml&node=0x1
+	s.mux.Handle("/export", a.Require(auth.Viewer, export.Handler(store)))
+
+	// Node detail page with the aggregated history of its metrics
+	mountNodes(s.mux, a, store)
+
+	// Map page with its tile source, possibly a local directory
+	mountMap(s.mux, a, store, opts.Config)
+
+	// Chat history from the database; messages are sent as gateway
+	// commands
+	chats := &chat{store: store, publish: opts.Send, audit: a.Audit}
+	chats.mount(s.mux, a)
+
+	// Clients may narrow the feed with topic filters, e.g.
+	// /ws?topic=meshspy/+/text&topic=meshspy/alerts/#, and add the
+	// gateway events with ?events=1
+	s.mux.Handle("/ws", a.Require(auth.Viewer, http.HandlerFunc(s.websocket)))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Publish hands payload, received on topic, to the websocket clients
+// following it. Clients connecting and leaving do not affect each other.
+func (s *Server) Publish(topic string, payload []byte) {
+	s.hub.broadcast(topic, payload)
+}
+
+func (s *Server) websocket(w http.ResponseWriter, r *http.Request) {
+	filters := r.URL.Query()["topic"]
+	for _, f := range filters {
+		if !validFilter(f) {
+			http.Error(w, "invalid topic filter "+f, http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.Query().Get("events") != "" && s.opts.EventsTopic != "" {
+		filters = append(filters, s.opts.EventsTopic)
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("upgrade error: %v", err)
+		return
+	}
+	c := s.hub.register(conn, filters)
+	log.Printf("🔌 websocket client %s connected (%d clients)", r.RemoteAddr, s.hub.len())
+
+	// Channel used to queue the commands coming from the websocket. The
+	// small buffer (10) prevents slow sends from blocking the websocket
+	// reader.
+	sendCh := make(chan []byte, 10)
+	defer func() {
+		close(sendCh) // stop sender goroutine
+		log.Printf("🔌 websocket client %s disconnected", r.RemoteAddr)
+	}()
+
+	// Goroutine responsible for sending the commands received from the
+	// websocket. It exits when sendCh is closed.
+	go func() {
+		for msg := range sendCh {
+			if err := s.opts.Send(string(msg)); err != nil {
+				log.Printf("send error: %v", err)
+			} else {
+				log.Printf("⬆️ command sent: %s", msg)
+			}
+		}
+	}()
+
+	canSend := auth.FromContext(r.Context()).Role.Allows(auth.Operator)
+	c.readPump(func(message []byte) {
+		log.Printf("➡️  from web client: %s", message)
+		if !canSend {
+			c.queue([]byte("error: sending requires the operator role"))
+			return
+		}
+		s.opts.Auth.Audit(r, "send", string(message))
+		// Queue the message for sending. If the buffer is full the
+		// message is dropped to avoid blocking the websocket reader.
+		select {
+		case sendCh <- message:
+		default:
+			log.Printf("send queue full, dropping message")
+		}
+		c.queue(append([]byte("echo: "), message...))
+	})
+}
+
+// servePage serves the named page from the embedded assets.
+func servePage(name string) http.Handler {
+	pages, err := fs.Sub(assets, "assets")
+	if err != nil {
+		panic(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, pages, name)
+	})
+}
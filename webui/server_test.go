@@ -0,0 +1,98 @@
+package webui
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"meshspy/auth"
+	"meshspy/storage"
+)
+
+func TestServer(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer store.Close()
+	a := auth.New(store, auth.Options{SessionTTL: time.Hour})
+	if _, err := a.Bootstrap("admin", "secret-pass"); err != nil {
+		t.Fatalf("Bootstrap returned error: %v", err)
+	}
+	sent := make(chan string, 1)
+	s := New(Options{
+		Store:       store,
+		Auth:        a,
+		Send:        func(cmd string) error { sent <- cmd; return nil },
+		EventsTopic: "meshspy/events/#",
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// The login page is served from the embedded assets
+	resp, err := http.Get(ts.URL + "/login")
+	if err != nil {
+		t.Fatalf("GET /login returned error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<form") {
+		t.Fatalf("GET /login returned %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/login", "application/json", strings.NewReader(`{"name":"admin","password":"secret-pass"}`))
+	if err != nil {
+		t.Fatalf("login returned error: %v", err)
+	}
+	resp.Body.Close()
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == auth.CookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("login returned %d without a session", resp.StatusCode)
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?topic=meshspy&events=1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Cookie": {cookie.String()}})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitClients(t, s.hub, 1)
+
+	// Raw packets and events reach the client, other topics do not
+	s.Publish("meshspy/state/0x1", []byte("state"))
+	s.Publish("meshspy", []byte("packet"))
+	s.Publish("meshspy/events/text_message", []byte("event"))
+	if got := read(t, conn); got != "packet" {
+		t.Fatalf("unexpected message %q", got)
+	}
+	if got := read(t, conn); got != "event" {
+		t.Fatalf("unexpected message %q", got)
+	}
+
+	// Messages typed in the page become gateway commands
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("send:ciao")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := read(t, conn); got != "echo: send:ciao" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	select {
+	case cmd := <-sent:
+		if cmd != "send:ciao" {
+			t.Fatalf("sent %q", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("command not sent")
+	}
+}